@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lines an agent prints on stdout for its coordinator start with one of
+// these prefixes followed by a JSON agentReport.
+const (
+	AGENT_PROGRESS_PREFIX = "MIGXATTRS-PROGRESS "
+	AGENT_RESULT_PREFIX   = "MIGXATTRS-RESULT "
+
+	agentReportInterval = 10 * time.Second
+)
+
+// agentReport is the progress or final result of one agent.
+type agentReport struct {
+	Host         string            `json:"host"`
+	Lines        int               `json:"lines"`
+	Migrated     int               `json:"migrated"`
+	Bytes        int64             `json:"bytes"`
+	Errors       int               `json:"errors"`
+	VerifyFailed int               `json:"verify_failed,omitempty"`
+	ErrorCodes   map[errorCode]int `json:"error_codes,omitempty"`
+	ElapsedSec   float64           `json:"elapsed_sec"`
+	ExitStatus   int               `json:"exit_status"`
+}
+
+func newAgentReport(stats *runStats, elapsed time.Duration) *agentReport {
+	host, _ := os.Hostname()
+	return &agentReport{
+		Host:         host,
+		Lines:        stats.lineCount,
+		Migrated:     stats.migrated,
+		Bytes:        stats.bytesTotal,
+		Errors:       stats.errors,
+		VerifyFailed: stats.verifyFailed,
+		ErrorCodes:   stats.errorCodes,
+		ElapsedSec:   elapsed.Seconds(),
+		ExitStatus:   exitStatus(stats),
+	}
+}
+
+func emitAgentLine(prefix string, report *agentReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	fmt.Printf("\n%s%s\n", prefix, data)
+}
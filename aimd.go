@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptInterval is how often the adaptive controller reconsiders the
+	// worker count.
+	adaptInterval = 10 * time.Second
+	// adaptMinSamples is how many completions a window needs to be judged.
+	adaptMinSamples = 5
+	// latencySpikeFactor is how far above the best latency seen a window
+	// may go before the workers are halved.
+	latencySpikeFactor = 2.0
+	// baselineDrift lets the best latency rise slowly so the controller
+	// follows lasting changes of the cluster instead of a lucky window.
+	baselineDrift = 1.01
+)
+
+// latencyWindow sums the latencies observed since the last adjustment.
+type latencyWindow struct {
+	stats    int
+	statTime time.Duration
+	copies   int
+	copyTime time.Duration // per MiB, small files counted as one MiB
+}
+
+func (w latencyWindow) stat() time.Duration { return w.statTime / time.Duration(max(1, w.stats)) }
+func (w latencyWindow) copy() time.Duration { return w.copyTime / time.Duration(max(1, w.copies)) }
+
+// adaptiveWorkers is an AIMD controller of the worker count
+// (--adaptive-workers): while stat and copy latencies stay near the best
+// seen and every worker is busy it adds a worker per interval, and it halves
+// the workers as soon as either latency spikes, as a loaded MDS or OSD makes
+// them do.
+type adaptiveWorkers struct {
+	pool     *workerPool
+	maxLimit int
+
+	mu                   sync.Mutex
+	limit, low, high     int
+	window               latencyWindow
+	bestStat, bestCopy   time.Duration
+	increases, decreases int
+}
+
+func newAdaptiveWorkers(pool *workerPool, start, maxLimit int) *adaptiveWorkers {
+	start = min(max(1, start), maxLimit)
+	pool.resize(start)
+	return &adaptiveWorkers{pool: pool, maxLimit: maxLimit, limit: start, low: start, high: start}
+}
+
+// observeStat records the latency of a file's metadata lookup.
+func (a *adaptiveWorkers) observeStat(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.window.stats++
+	a.window.statTime += d
+	a.mu.Unlock()
+}
+
+// observeCopy records how long the migration of a file of size bytes took.
+func (a *adaptiveWorkers) observeCopy(d time.Duration, size int64) {
+	if a == nil {
+		return
+	}
+	mib := max(1, float64(size)/(1<<20))
+	a.mu.Lock()
+	a.window.copies++
+	a.window.copyTime += time.Duration(float64(d) / mib)
+	a.mu.Unlock()
+}
+
+// reset restarts the controller from limit, as set by a reload of --config.
+func (a *adaptiveWorkers) reset(limit int) {
+	a.mu.Lock()
+	a.limit = min(max(1, limit), a.maxLimit)
+	a.window = latencyWindow{}
+	a.pool.resize(a.limit)
+	a.mu.Unlock()
+}
+
+// adjust closes the current window and applies its verdict to the pool.
+func (a *adaptiveWorkers) adjust() {
+	active, waiting := a.pool.depth()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w := a.window
+	if w.stats+w.copies < adaptMinSamples {
+		return
+	}
+	a.window = latencyWindow{}
+
+	spiked := w.stats > 0 && a.bestStat > 0 && float64(w.stat()) > latencySpikeFactor*float64(a.bestStat) ||
+		w.copies > 0 && a.bestCopy > 0 && float64(w.copy()) > latencySpikeFactor*float64(a.bestCopy)
+	if w.stats > 0 {
+		a.bestStat = bestLatency(a.bestStat, w.stat())
+	}
+	if w.copies > 0 {
+		a.bestCopy = bestLatency(a.bestCopy, w.copy())
+	}
+
+	limit := a.limit
+	switch {
+	case spiked && a.limit > 1:
+		limit = max(1, a.limit/2)
+		a.decreases++
+	case !spiked && a.limit < a.maxLimit && (waiting > 0 || active >= a.limit):
+		limit = a.limit + 1
+		a.increases++
+	default:
+		return
+	}
+	logf(LOG_DEBUG, "Adaptive workers: %d -> %d (stat %v, copy %v/MiB)\n", a.limit, limit, w.stat().Round(time.Microsecond), w.copy().Round(time.Microsecond))
+	a.limit = limit
+	a.low, a.high = min(a.low, limit), max(a.high, limit)
+	a.pool.resize(limit)
+}
+
+// bestLatency lowers best to d, or lets it drift up towards d.
+func bestLatency(best, d time.Duration) time.Duration {
+	if best == 0 {
+		return d
+	}
+	return min(d, time.Duration(float64(best)*baselineDrift))
+}
+
+// run adjusts the workers every adaptInterval until the returned function
+// is called.
+func (a *adaptiveWorkers) run() (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(adaptInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				a.adjust()
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// String summarizes what the controller did.
+func (a *adaptiveWorkers) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return fmt.Sprintf("%d at the end, between %d and %d (%d increases, %d decreases)", a.limit, a.low, a.high, a.increases, a.decreases)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const alertCheckInterval = 30 * time.Second
+
+// alertConfig holds the operator-defined alert conditions and sinks.
+type alertConfig struct {
+	errorRate        float64 // percent of processed files; 0 disables
+	errorRateMinimum int     // files processed before the error rate is judged
+	minThroughput    float64 // MB/s; 0 disables
+	throughputWindow time.Duration
+	minFree          int64 // bytes free on the filesystem; 0 disables
+	webhooks         []string
+	emails           []string
+	onFinish         bool // also send the outcome of the run
+	summaryMail      summaryMailConfig
+}
+
+func (c *alertConfig) enabled() bool {
+	return c.errorRate > 0 || c.minThroughput > 0 || c.minFree > 0
+}
+
+type alert struct {
+	Name    string     `json:"alert"`
+	Message string     `json:"message"`
+	Time    time.Time  `json:"time"`
+	Host    string     `json:"host"`
+	Root    string     `json:"root"`
+	Summary *runTotals `json:"summary,omitempty"` // end of run alerts only
+}
+
+// alertSink delivers an alert to one destination.
+type alertSink interface {
+	Send(a *alert) error
+}
+
+type logSink struct{}
+
+func (logSink) Send(a *alert) error {
+	fmt.Fprintf(os.Stderr, "ALERT [%s] %s\n", a.Name, a.Message)
+	return nil
+}
+
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Send(a *alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// emailSink hands the alert to the local sendmail binary.
+type emailSink struct {
+	to string
+}
+
+func (s emailSink) Send(a *alert) error {
+	cmd := exec.Command("sendmail", "-t")
+	cmd.Stdin = strings.NewReader(s.message(a))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// message is the mail for a, headers first. sendmail -t takes the recipients
+// from the To header, so nothing in a may add a header of its own.
+func (s emailSink) message(a *alert) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "To: %s\nSubject: [migxattrs] %s on %s\n\n", headerValue(s.to), headerValue(a.Name), headerValue(a.Host))
+	fmt.Fprintf(&msg, "%s\n\nRoot: %s\nTime: %s\n", a.Message, a.Root, a.Time.Format(time.RFC3339))
+	return msg.String()
+}
+
+// alertMonitor evaluates the alert conditions against the running totals.
+// Each condition fires once when it becomes true and re-arms after it clears.
+type alertMonitor struct {
+	cfg      *alertConfig
+	cephRoot string
+	sinks    []alertSink
+	active   map[string]bool
+
+	lastCheck time.Time
+	lastBytes int64
+	lowSince  time.Time
+}
+
+func newAlertMonitor(cfg *alertConfig, cephRoot string) *alertMonitor {
+	mon := &alertMonitor{cfg: cfg, cephRoot: cephRoot, sinks: []alertSink{logSink{}}, active: make(map[string]bool), lastCheck: time.Now()}
+	for _, url := range cfg.webhooks {
+		mon.sinks = append(mon.sinks, webhookSink{url: url})
+	}
+	for _, to := range cfg.emails {
+		mon.sinks = append(mon.sinks, emailSink{to: to})
+	}
+	return mon
+}
+
+// check re-evaluates the conditions at most once per alertCheckInterval.
+func (mon *alertMonitor) check(stats *runStats) {
+	now := time.Now()
+	elapsed := now.Sub(mon.lastCheck)
+	if elapsed < alertCheckInterval {
+		return
+	}
+
+	if mon.cfg.errorRate > 0 {
+		processed := stats.migrated + stats.errors
+		rate := errorRate(stats.errors, stats.migrated)
+		mon.update("error-rate", processed >= mon.cfg.errorRateMinimum && rate > mon.cfg.errorRate,
+			fmt.Sprintf("error rate %.2f%% exceeds %.2f%% (%d errors in %d files)", rate, mon.cfg.errorRate, stats.errors, processed))
+	}
+
+	if mon.cfg.minThroughput > 0 {
+		rate := mb(stats.bytesTotal-mon.lastBytes) / elapsed.Seconds()
+		if rate >= mon.cfg.minThroughput {
+			mon.lowSince = time.Time{}
+		} else if mon.lowSince.IsZero() {
+			mon.lowSince = mon.lastCheck
+		}
+		low := !mon.lowSince.IsZero() && now.Sub(mon.lowSince) >= mon.cfg.throughputWindow
+		mon.update("low-throughput", low,
+			fmt.Sprintf("throughput %.2f MB/s below %.2f MB/s for %v", rate, mon.cfg.minThroughput, now.Sub(mon.lowSince).Round(time.Second)))
+	}
+
+	if mon.cfg.minFree > 0 {
+		if free, err := freeSpace(mon.cephRoot); err == nil {
+			mon.update("low-free-space", free < mon.cfg.minFree,
+				fmt.Sprintf("free space %.2f GB below %.2f GB", float64(free)/(1<<30), float64(mon.cfg.minFree)/(1<<30)))
+		}
+	}
+
+	mon.lastCheck = now
+	mon.lastBytes = stats.bytesTotal
+}
+
+func (mon *alertMonitor) update(name string, firing bool, message string) {
+	if !firing {
+		mon.active[name] = false
+		return
+	}
+	if mon.active[name] {
+		return
+	}
+	mon.active[name] = true
+	mon.send(name, message)
+}
+
+// send delivers an alert to every sink.
+func (mon *alertMonitor) send(name, message string) {
+	mon.deliver(name, message, nil)
+}
+
+func (mon *alertMonitor) deliver(name, message string, summary *runTotals) {
+	host, _ := os.Hostname()
+	a := &alert{Name: name, Message: message, Time: time.Now(), Host: host, Root: displayPath(mon.cephRoot), Summary: summary}
+	for _, sink := range mon.sinks {
+		if err := sink.Send(a); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending %s alert: %v\n", name, err)
+		}
+	}
+}
+
+// runTotals adds up the passes of a run for its end of run alert.
+type runTotals struct {
+	Passes       int               `json:"passes"`
+	Migrated     int               `json:"migrated"`
+	Bytes        int64             `json:"bytes"`
+	Errors       int               `json:"errors"`
+	VerifyFailed int               `json:"verify_failed,omitempty"`
+	ErrorCodes   map[errorCode]int `json:"error_codes,omitempty"`
+	ElapsedSec   float64           `json:"elapsed_sec"`
+	ExitStatus   int               `json:"exit_status"`
+}
+
+// runNotifier sends the outcome of a run to the alert webhooks and emails
+// with --alert-on-finish, and mails its summary with --summary-email, so
+// whoever takes over a multi-day drain hears when it is done or has stopped
+// without watching it.
+type runNotifier struct {
+	mon      *alertMonitor // nil without --alert-on-finish
+	mail     *summaryMailConfig
+	cephRoot string
+	started  time.Time
+
+	mu     sync.Mutex
+	totals runTotals
+	failed map[string]bool // in any pass
+}
+
+// newRunNotifier returns nil unless the outcome is to be sent somewhere.
+func newRunNotifier(cfg *alertConfig, cephRoot string) *runNotifier {
+	n := &runNotifier{cephRoot: cephRoot, started: time.Now(), totals: runTotals{ErrorCodes: make(map[errorCode]int)},
+		failed: make(map[string]bool)}
+	if cfg.onFinish && len(cfg.webhooks)+len(cfg.emails) > 0 {
+		n.mon = newAlertMonitor(cfg, cephRoot)
+		// The summary is on the terminal already.
+		n.mon.sinks = slices.DeleteFunc(n.mon.sinks, func(s alertSink) bool {
+			_, ok := s.(logSink)
+			return ok
+		})
+	}
+	if cfg.summaryMail.enabled() {
+		n.mail = &cfg.summaryMail
+	}
+	if n.mon == nil && n.mail == nil {
+		return nil
+	}
+	return n
+}
+
+// pass counts a finished pass; the mounts of --mounts may finish at once.
+func (n *runNotifier) pass(stats *runStats) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := &n.totals
+	t.Passes++
+	t.Migrated += stats.migrated
+	t.Bytes += stats.bytesTotal
+	t.Errors += stats.errors
+	t.VerifyFailed += stats.verifyFailed
+	for code, count := range stats.errorCodes {
+		t.ErrorCodes[code] += count
+	}
+	for path := range stats.failed {
+		n.failed[path] = true
+	}
+}
+
+// finish sends the outcome of the run, which exits with status.
+func (n *runNotifier) finish(status int) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	t := n.totals
+	failed := make([]string, 0, len(n.failed))
+	for path := range n.failed {
+		failed = append(failed, displayPath(path))
+	}
+	n.mu.Unlock()
+	sort.Strings(failed)
+	elapsed := time.Since(n.started)
+	t.ElapsedSec, t.ExitStatus = elapsed.Seconds(), status
+
+	name := "run-completed"
+	switch status {
+	case EXIT_OK:
+	case EXIT_INCOMPLETE:
+		name = "run-incomplete"
+	case EXIT_FATAL:
+		name = "run-aborted"
+	default:
+		name = "run-completed-with-errors"
+	}
+	message := fmt.Sprintf("%d files (%.2f MB) migrated in %d passes over %v, %d errors, exit status %d",
+		t.Migrated, mb(t.Bytes), t.Passes, elapsed.Round(time.Second), t.Errors, status)
+	if n.mon != nil {
+		n.mon.deliver(name, message, &t)
+	}
+	if n.mail != nil {
+		if err := sendSummaryMail(n.mail, n.cephRoot, name, &t, failed); err != nil {
+			fmt.Fprintf(os.Stderr, "Error mailing the summary: %v\n", err)
+		} else {
+			logf(LOG_INFO, "Summary mailed to %s\n", strings.Join(n.mail.to, ", "))
+		}
+	}
+}
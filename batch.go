@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BATCH_JOURNAL records, under CEPH_ROOT_DIR, the temp files of every
+// directory batch in flight so an interrupted run can clean them up.
+const BATCH_JOURNAL = "migxattrs.batches"
+
+type batchItem struct {
+	absPath      string
+	pool         string // before the migration
+	tmpPath      string
+	info         os.FileInfo
+	sum          []byte
+	finalAttempt bool
+	copyTime     time.Duration
+}
+
+// dirBatch collects consecutive scan entries of one directory. A batch is
+// copied completely, every copy verified, and only then renamed into place,
+// so a failure leaves the directory either untouched or fully migrated.
+type dirBatch struct {
+	dir     string
+	items   []batchItem
+	max     int
+	journal *os.File
+}
+
+// openDirBatch cleans up after batches an earlier run left unfinished and
+// starts a new journal.
+func openDirBatch(journalPath string, max int) (*dirBatch, error) {
+	if err := recoverBatches(journalPath); err != nil {
+		return nil, err
+	}
+	journal, err := os.Create(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	return &dirBatch{max: max, journal: journal}, nil
+}
+
+// recoverBatches removes the temp files of batches that never reached the
+// rename phase. Batches interrupted while renaming are reported, since some
+// of their files are already in place.
+func recoverBatches(journalPath string) error {
+	file, err := os.Open(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var dir string
+	var temps []string
+	renaming := false
+	finish := func() {
+		if dir == "" {
+			return
+		}
+		if renaming {
+			logf(LOG_WARN, "Warning: batch for %s was interrupted while renaming and is partially migrated\n", displayPath(dir))
+		} else {
+			for _, tmp := range temps {
+				os.Remove(tmp)
+			}
+			fmt.Fprintf(os.Stderr, "Cleaned up %d temp files of an interrupted batch for %s\n", len(temps), displayPath(dir))
+		}
+		dir, temps, renaming = "", nil, false
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kind, arg, _ := strings.Cut(scanner.Text(), "\t")
+		switch kind {
+		case "begin":
+			finish()
+			dir = arg
+		case "temp":
+			temps = append(temps, arg)
+		case "rename":
+			renaming = true
+		case "end":
+			dir, temps, renaming = "", nil, false
+		}
+	}
+	finish()
+	return scanner.Err()
+}
+
+func (b *dirBatch) log(kind, arg string) {
+	fmt.Fprintf(b.journal, "%s\t%s\n", kind, arg)
+}
+
+func (b *dirBatch) close() error {
+	return b.journal.Close()
+}
+
+// batchFile adds a file to the current batch, flushing the batch first when
+// the file belongs to another directory or the batch is full.
+func (m *migrator) batchFile(absPath, pool string, info os.FileInfo, finalAttempt bool) {
+	b := m.batch
+	dir := filepath.Dir(absPath)
+	if dir != b.dir || len(b.items) >= b.max {
+		m.flushBatch()
+		b.dir = dir
+	}
+	tmpPath := attemptTempPath(tempPath(m.opts.tempName, absPath, info))
+	b.items = append(b.items, batchItem{absPath: absPath, pool: pool, tmpPath: tmpPath, info: info, finalAttempt: finalAttempt})
+}
+
+// flushBatch copies, verifies and renames the pending batch, if any.
+func (m *migrator) flushBatch() {
+	b, opts := m.batch, m.opts
+	if b == nil {
+		return
+	}
+	items := b.items
+	b.items = nil
+	if len(items) == 0 {
+		return
+	}
+
+	b.log("begin", b.dir)
+	for _, it := range items {
+		b.log("temp", it.tmpPath)
+	}
+	b.journal.Sync()
+
+	failed, err := -1, error(nil)
+	for i := range items {
+		it := &items[i]
+		h := newChecksum()
+		jsonLog.logFile("file_start", "", it.absPath, it.info.Size(), 0, "", nil)
+		start := time.Now()
+		err = withFileTimeout(m.ctx, opts.fileTimeout, it.tmpPath, func(ctx context.Context) error {
+			return watchedCopy(ctx, it.absPath, it.tmpPath, func(ctx context.Context) error {
+				return copyToTemp(ctx, it.absPath, it.tmpPath, it.info, opts.dstPool, h)
+			})
+		})
+		if err != nil {
+			failed = i
+			break
+		}
+		it.sum = h.Sum(nil)
+		it.copyTime = time.Since(start)
+	}
+	if failed < 0 {
+		for i, it := range items {
+			if err = verifyMigratedFile(it.tmpPath, opts.dstPool, it.sum); err != nil {
+				failed = i
+				break
+			}
+			m.count(&m.stats.verified)
+		}
+	}
+
+	if failed >= 0 {
+		for _, it := range items {
+			os.Remove(it.tmpPath)
+		}
+		b.log("end", "abort")
+		m.migrateFailed(items[failed].absPath, err, items[failed].finalAttempt)
+		for i, it := range items {
+			if i == failed {
+				continue
+			}
+			if it.finalAttempt {
+				m.fail(it.absPath, "Batch aborted for", codeErrorf(E_BATCH, "%s failed", displayPath(items[failed].absPath)), false)
+			} else {
+				m.requeue(it.absPath)
+			}
+		}
+		return
+	}
+
+	b.log("rename", b.dir)
+	b.journal.Sync()
+	for _, it := range items {
+		if err := commitTemp(it.absPath, it.tmpPath, it.info, opts.placement); err != nil {
+			m.fail(it.absPath, "Error migrating", err, true)
+			continue
+		}
+		m.recordMigrated(it.absPath, it.tmpPath, it.info, it.sum)
+		jsonLog.logFile("file_done", "", it.absPath, it.info.Size(), it.copyTime, "", nil)
+		m.fileRows.record(it.absPath, it.info.Size(), it.pool, opts.dstPool, "migrated", it.copyTime, nil)
+	}
+	b.log("end", "commit")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// BTIME_XATTR holds the birth time a file had before its first migration.
+// Rewriting a file creates a new inode and birth time cannot be set, so
+// tools that depend on it read the original from here instead.
+const BTIME_XATTR = "user.migxattrs.btime"
+
+// recordBtime is set by --btime-report: copies then carry BTIME_XATTR.
+var recordBtime bool
+
+// copyBirthTime stores the original birth time of path in BTIME_XATTR on
+// tmpPath. A value left by an earlier migration is carried over unchanged.
+// Filesystems that do not report birth times are skipped.
+func copyBirthTime(path, tmpPath string, info os.FileInfo) error {
+	mdsOps(2)
+	value, err := getXattrValue(path, BTIME_XATTR)
+	if xattrMissing(err) {
+		btime, ok := fileBirthTime(path, info)
+		if !ok {
+			return nil
+		}
+		value, err = []byte(btime.UTC().Format(time.RFC3339Nano)), nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", BTIME_XATTR, err)
+	}
+	if err := sysSetxattr(tmpPath, BTIME_XATTR, value); err != nil {
+		return fmt.Errorf("failed to set %s: %w", BTIME_XATTR, err)
+	}
+	return nil
+}
+
+// btimeReport lists the migrated files whose birth time changed, with the
+// original one, so auditing tools can compensate.
+type btimeReport struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// openBtimeReport creates path, or appends to it when appending is set (a
+// resumed run).
+func openBtimeReport(path string, appending bool) (*btimeReport, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &btimeReport{file: file, w: bufio.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		fmt.Fprintln(r.w, "# original_btime\tnew_btime\tpath")
+	}
+	return r, nil
+}
+
+// record compares the birth time of the migrated file at path with the
+// original kept in its BTIME_XATTR.
+func (r *btimeReport) record(path string) error {
+	value, err := getXattrValue(path, BTIME_XATTR)
+	if xattrMissing(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	original, err := time.Parse(time.RFC3339Nano, string(value))
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", BTIME_XATTR, value, err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	current, ok := fileBirthTime(path, info)
+	if !ok || current.Equal(original) {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = fmt.Fprintf(r.w, "%s\t%s\t%s\n", original.Format(time.RFC3339Nano), current.UTC().Format(time.RFC3339Nano), path)
+	return err
+}
+
+func (r *btimeReport) close() error {
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
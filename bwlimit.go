@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidth caps the data the migration writes per second (--bwlimit). It
+// is nil when there is no cap.
+var bandwidth *rateLimiter
+
+// rateLimiter is a token bucket refilled at rate tokens per second: bytes
+// for --bwlimit, files for --files-per-sec. It holds at most one second
+// worth of tokens, so an idle spell is not followed by a burst. Callers that
+// overdraw it sleep off their debt, which spreads the available rate over
+// every worker.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take accounts n tokens, sleeping until the bucket has covered them. A nil
+// limiter does not limit.
+func (l *rateLimiter) take(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	l.last = now
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// setBandwidth replaces the cap; 0 removes it. Copies must not be running.
+func setBandwidth(rate int64) {
+	if rate <= 0 {
+		bandwidth = nil
+	} else {
+		bandwidth = newRateLimiter(float64(rate))
+	}
+}
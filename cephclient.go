@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CEPH_DEBUGFS    = "/sys/kernel/debug/ceph"
+	CEPH_ASOK_GLOB  = "/var/run/ceph/*client*.asok"
+	clientSampleTTL = 5 * time.Second
+)
+
+// clientSample is a point-in-time view of the local CephFS client. Fields
+// the source cannot provide are left at -1.
+type clientSample struct {
+	source      string
+	caps        int64
+	mdsInflight int
+	osdInflight int
+	dirtyBytes  int64
+	readLat     time.Duration
+	writeLat    time.Duration
+	metaLat     time.Duration
+}
+
+func (s *clientSample) String() string {
+	var parts []string
+	if s.caps >= 0 {
+		parts = append(parts, fmt.Sprintf("caps=%d", s.caps))
+	}
+	if s.mdsInflight >= 0 {
+		parts = append(parts, fmt.Sprintf("mds_inflight=%d", s.mdsInflight))
+	}
+	if s.osdInflight >= 0 {
+		parts = append(parts, fmt.Sprintf("osd_inflight=%d", s.osdInflight))
+	}
+	if s.dirtyBytes >= 0 {
+		parts = append(parts, fmt.Sprintf("dirty=%.1fMB", mb(s.dirtyBytes)))
+	}
+	for _, l := range []struct {
+		name string
+		d    time.Duration
+	}{{"read_lat", s.readLat}, {"write_lat", s.writeLat}, {"meta_lat", s.metaLat}} {
+		if l.d >= 0 {
+			parts = append(parts, fmt.Sprintf("%s=%v", l.name, l.d.Round(time.Microsecond)))
+		}
+	}
+	return s.source + ": " + strings.Join(parts, " ")
+}
+
+func newClientSample(source string) *clientSample {
+	return &clientSample{source: source, caps: -1, mdsInflight: -1, osdInflight: -1, dirtyBytes: -1, readLat: -1, writeLat: -1, metaLat: -1}
+}
+
+// clientMonitor samples the kernel client through debugfs or ceph-fuse
+// through its admin socket, and throttles dispatch while the client reports
+// more dirty data or higher latency than allowed.
+type clientMonitor struct {
+	debugfsDir string
+	asokPath   string
+	maxDirty   int64
+	maxLatency time.Duration
+
+	last     *clientSample
+	lastTime time.Time
+}
+
+// newClientMonitor locates a client to sample. asok overrides discovery.
+func newClientMonitor(asok string, maxDirty int64, maxLatency time.Duration) (*clientMonitor, error) {
+	mon := &clientMonitor{asokPath: asok, maxDirty: maxDirty, maxLatency: maxLatency}
+	if mon.asokPath != "" {
+		return mon, nil
+	}
+
+	if dirs, _ := filepath.Glob(filepath.Join(CEPH_DEBUGFS, "*")); len(dirs) > 0 {
+		mon.debugfsDir = dirs[0]
+		return mon, nil
+	}
+	if socks, _ := filepath.Glob(CEPH_ASOK_GLOB); len(socks) > 0 {
+		mon.asokPath = socks[0]
+		return mon, nil
+	}
+	return nil, fmt.Errorf("no kernel client in %s and no admin socket matching %s", CEPH_DEBUGFS, CEPH_ASOK_GLOB)
+}
+
+// sample returns the latest client statistics, re-reading them at most once
+// per clientSampleTTL.
+func (mon *clientMonitor) sample() *clientSample {
+	if mon.last != nil && time.Since(mon.lastTime) < clientSampleTTL {
+		return mon.last
+	}
+
+	var s *clientSample
+	var err error
+	if mon.debugfsDir != "" {
+		s, err = sampleKernelClient(mon.debugfsDir)
+	} else {
+		s, err = sampleFuseClient(mon.asokPath)
+	}
+	if err != nil {
+		logf(LOG_DEBUG, "Error sampling Ceph client: %v\n", err)
+		s = newClientSample("unavailable")
+	}
+
+	mon.last, mon.lastTime = s, time.Now()
+	return s
+}
+
+func (mon *clientMonitor) overloaded(s *clientSample) string {
+	if mon.maxDirty > 0 && s.dirtyBytes > mon.maxDirty {
+		return fmt.Sprintf("dirty data %.1f MB above %.1f MB", mb(s.dirtyBytes), mb(mon.maxDirty))
+	}
+	if mon.maxLatency > 0 {
+		for _, lat := range []time.Duration{s.writeLat, s.metaLat} {
+			if lat > mon.maxLatency {
+				return fmt.Sprintf("client latency %v above %v", lat.Round(time.Millisecond), mon.maxLatency)
+			}
+		}
+	}
+	return ""
+}
+
+// throttle blocks while the client is overloaded, backing off up to a
+// minute between checks, and returns how long it blocked.
+func (mon *clientMonitor) throttle() (paused time.Duration) {
+	backoff := time.Second
+	for {
+		reason := mon.overloaded(mon.sample())
+		if reason == "" {
+			return paused
+		}
+		logf(LOG_DEBUG, "Throttling for %v: %s\n", backoff, reason)
+		time.Sleep(backoff)
+		paused += backoff
+		mon.last = nil
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// sampleKernelClient reads the kernel client's debugfs files. Dirty data is
+// taken from /proc/meminfo since the kernel client does not track it
+// separately.
+func sampleKernelClient(dir string) (*clientSample, error) {
+	s := newClientSample("kernel " + filepath.Base(dir))
+
+	caps, err := os.ReadFile(filepath.Join(dir, "caps"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(caps), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "used" {
+			s.caps, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "mdsc")); err == nil {
+		s.mdsInflight = countNonEmptyLines(string(data))
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "osdc")); err == nil {
+		// "REQUESTS <n> homeless <m>" heads the in-flight request list.
+		fields := strings.Fields(string(data))
+		if len(fields) >= 2 && fields[0] == "REQUESTS" {
+			s.osdInflight, _ = strconv.Atoi(fields[1])
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "metrics", "latency")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			us, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch fields[0] {
+			case "read":
+				s.readLat = time.Duration(us) * time.Microsecond
+			case "write":
+				s.writeLat = time.Duration(us) * time.Microsecond
+			case "metadata":
+				s.metaLat = time.Duration(us) * time.Microsecond
+			}
+		}
+	}
+
+	if dirty, err := meminfoDirty(); err == nil {
+		s.dirtyBytes = dirty
+	}
+	return s, nil
+}
+
+func countNonEmptyLines(data string) int {
+	n := 0
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// meminfoDirty returns Dirty + Writeback from /proc/meminfo in bytes.
+func meminfoDirty() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var total int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && (fields[0] == "Dirty:" || fields[0] == "Writeback:") {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			total += kb * 1024
+		}
+	}
+	return total, scanner.Err()
+}
+
+// sampleFuseClient queries a ceph-fuse admin socket with "perf dump".
+func sampleFuseClient(asok string) (*clientSample, error) {
+	data, err := adminSocketCommand(asok, "perf dump")
+	if err != nil {
+		return nil, err
+	}
+
+	var perf map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &perf); err != nil {
+		return nil, fmt.Errorf("invalid perf dump: %w", err)
+	}
+
+	s := newClientSample("ceph-fuse " + filepath.Base(asok))
+	if client, ok := perf["client"]; ok {
+		s.metaLat = perfAvgTime(client["reply"])
+		s.writeLat = perfAvgTime(client["wrlat"])
+		s.readLat = perfAvgTime(client["rdlat"])
+	}
+	if objecter, ok := perf["objecter"]; ok {
+		var active int
+		if json.Unmarshal(objecter["op_active"], &active) == nil {
+			s.osdInflight = active
+		}
+	}
+	if cache, ok := perf["objectcacher-libcephfs"]; ok {
+		var dirty int64
+		if json.Unmarshal(cache["data_dirty"], &dirty) == nil {
+			s.dirtyBytes = dirty
+		}
+	}
+	return s, nil
+}
+
+func perfAvgTime(raw json.RawMessage) time.Duration {
+	var v struct {
+		AvgTime float64 `json:"avgtime"`
+	}
+	if raw == nil || json.Unmarshal(raw, &v) != nil {
+		return -1
+	}
+	return time.Duration(v.AvgTime * float64(time.Second))
+}
+
+// adminSocketCommand speaks the Ceph admin socket protocol: a NUL-terminated
+// JSON command, answered by a big-endian uint32 length and the payload.
+func adminSocketCommand(asok, prefix string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", asok, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	cmd, _ := json.Marshal(map[string]string{"prefix": prefix, "format": "json"})
+	if _, err := conn.Write(append(cmd, 0)); err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const CGROUP_ROOT = "/sys/fs/cgroup"
+
+type cgroupConfig struct {
+	path      string // cgroup to join, relative to the cgroup v2 root; empty to stay put
+	cpuMax    float64
+	memoryMax int64
+	ioMax     []string
+}
+
+// requested reports whether the operator asked for any cgroup changes.
+func (c cgroupConfig) requested() bool {
+	return c.path != "" || c.cpuMax > 0 || c.memoryMax > 0 || len(c.ioMax) > 0
+}
+
+// setupCgroup optionally moves the process into a cgroup v2 group, writes the
+// requested limits into it, and then adapts the Go runtime to whatever CPU and
+// memory limits apply to the group the process ends up in. Failures to write
+// limits are reported but not fatal: unprivileged runs can still honor limits
+// set by the administrator.
+func setupCgroup(cfg cgroupConfig) error {
+	cgPath, err := currentCgroup()
+	if err != nil {
+		return fmt.Errorf("failed to detect cgroup: %w", err)
+	}
+
+	if cfg.path != "" {
+		cgPath = filepath.Join(CGROUP_ROOT, cfg.path)
+		if err := os.MkdirAll(cgPath, 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup %s: %w", cgPath, err)
+		}
+		if err := writeCgroupFile(filepath.Join(cgPath, "cgroup.procs"), strconv.Itoa(os.Getpid())); err != nil {
+			return fmt.Errorf("failed to join cgroup %s: %w", cgPath, err)
+		}
+		logf(LOG_INFO, "Joined cgroup %s\n", cgPath)
+	} else {
+		logf(LOG_DEBUG, "Running in cgroup %s\n", cgPath)
+	}
+
+	if cfg.cpuMax > 0 {
+		period := 100000
+		value := fmt.Sprintf("%d %d", int(cfg.cpuMax*float64(period)), period)
+		writeCgroupLimit(cgPath, "cpu.max", value)
+	}
+	if cfg.memoryMax > 0 {
+		writeCgroupLimit(cgPath, "memory.max", strconv.FormatInt(cfg.memoryMax, 10))
+	}
+	for _, limit := range cfg.ioMax {
+		writeCgroupLimit(cgPath, "io.max", limit)
+	}
+
+	applyCgroupLimits(cgPath)
+	return nil
+}
+
+func writeCgroupLimit(cgPath, name, value string) {
+	if err := writeCgroupFile(filepath.Join(cgPath, name), value); err != nil {
+		logf(LOG_WARN, "Warning: could not set %s to %q: %v\n", name, value, err)
+		return
+	}
+	logf(LOG_INFO, "Set %s = %s\n", name, value)
+}
+
+// writeCgroupFile writes to an existing cgroup interface file; it never
+// creates files, so a missing controller surfaces as an error.
+func writeCgroupFile(path, value string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(value)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// applyCgroupLimits sizes GOMAXPROCS to the CPU quota and sets a soft memory
+// limit just below memory.max so the GC works harder before the OOM killer
+// gets involved.
+func applyCgroupLimits(cgPath string) {
+	if data, err := os.ReadFile(filepath.Join(cgPath, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, qerr := strconv.ParseFloat(fields[0], 64)
+			period, perr := strconv.ParseFloat(fields[1], 64)
+			if qerr == nil && perr == nil && period > 0 {
+				procs := max(1, int(math.Ceil(quota/period)))
+				if procs < runtime.GOMAXPROCS(0) {
+					runtime.GOMAXPROCS(procs)
+					logf(LOG_DEBUG, "GOMAXPROCS limited to %d by cgroup cpu.max\n", procs)
+				}
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(cgPath, "memory.max")); err == nil {
+		value := strings.TrimSpace(string(data))
+		if value != "max" {
+			if limit, err := strconv.ParseInt(value, 10, 64); err == nil {
+				debug.SetMemoryLimit(limit / 10 * 9)
+				logf(LOG_DEBUG, "Go memory limit set to %.2f MB by cgroup memory.max\n", float64(limit/10*9)/(1024*1024))
+			}
+		}
+	}
+}
+
+// currentCgroup returns the cgroup v2 directory of this process.
+func currentCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(CGROUP_ROOT, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("%s is not a cgroup v2 hierarchy", CGROUP_ROOT)
+	}
+
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rel, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return filepath.Join(CGROUP_ROOT, rel), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy found")
+}
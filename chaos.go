@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CHAOS_POINTS are the operations where --chaos can inject failures.
+var CHAOS_POINTS = []string{"copy", "setxattr", "rename"}
+
+type chaosConfig struct {
+	rates   map[string]float64
+	latency time.Duration
+}
+
+// chaos is set by the hidden --chaos flag to exercise retry, cleanup and
+// resume paths. It is nil in normal runs.
+var chaos *chaosConfig
+
+// parseChaos parses "copy=0.01,setxattr=0.01,rename=0.01,latency=50ms".
+// "all=P" sets every injection point at once.
+func parseChaos(spec string) (*chaosConfig, error) {
+	cfg := &chaosConfig{rates: make(map[string]float64)}
+	for _, part := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", part)
+		}
+
+		if key == "latency" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			cfg.latency = d
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid probability %q for %s", value, key)
+		}
+		switch {
+		case key == "all":
+			for _, point := range CHAOS_POINTS {
+				cfg.rates[point] = rate
+			}
+		case isChaosPoint(key):
+			cfg.rates[key] = rate
+		default:
+			return nil, fmt.Errorf("unknown chaos point %q (want %s, all or latency)", key, strings.Join(CHAOS_POINTS, ", "))
+		}
+	}
+	return cfg, nil
+}
+
+func isChaosPoint(name string) bool {
+	for _, point := range CHAOS_POINTS {
+		if point == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosPoint is called after an operation succeeds; with --chaos it may sleep
+// for a random fraction of the configured latency and then report an
+// injected EIO instead.
+func chaosPoint(point string) error {
+	if chaos == nil {
+		return nil
+	}
+	if chaos.latency > 0 {
+		time.Sleep(rand.N(chaos.latency))
+	}
+	if rand.Float64() < chaos.rates[point] {
+		return fmt.Errorf("chaos: injected %s failure: %w", point, syscall.EIO)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpoint records how far through the scan file a run got, so a later
+// invocation with --resume can skip the lines already handled.
+type checkpoint struct {
+	ScanFile string    `json:"scan_file"`
+	Line     int       `json:"line"`
+	Pending  []string  `json:"pending,omitempty"`
+	SavedAt  time.Time `json:"saved_at"`
+}
+
+// loadCheckpoint reads the checkpoint at path of a run over scanPath. The
+// line number of a checkpoint saved for another scan file would skip an
+// unrelated part of this one, so that is refused.
+func loadCheckpoint(path, scanPath string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	if !sameScanFile(cp.ScanFile, scanPath) {
+		return nil, fmt.Errorf("checkpoint %s was saved for scan file %q, not %q", path, cp.ScanFile, scanPath)
+	}
+	return &cp, nil
+}
+
+// sameScanFile reports whether two spellings of a scan file path name the
+// same file.
+func sameScanFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// saveCheckpoint writes the checkpoint atomically via a temp file and rename.
+func saveCheckpoint(path string, cp *checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
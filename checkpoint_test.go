@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, CHECKPOINT_FILE)
+	scanPath := filepath.Join(dir, SCAN_FILE)
+	want := &checkpoint{
+		ScanFile: scanPath,
+		Line:     1234,
+		Pending:  []string{"/mnt/cephfs/a", "/mnt/cephfs/dir/b c"},
+		SavedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := saveCheckpoint(path, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file of the checkpoint left behind: %v", err)
+	}
+	got, err := loadCheckpoint(path, scanPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadCheckpoint = %+v, want %+v", got, want)
+	}
+
+	// Saving again replaces the checkpoint.
+	want.Line, want.Pending = 5678, nil
+	if err := saveCheckpoint(path, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loadCheckpoint(path, scanPath); err != nil || got.Line != 5678 || len(got.Pending) != 0 {
+		t.Errorf("loadCheckpoint after a second save = %+v, %v", got, err)
+	}
+}
+
+func TestLoadCheckpointScanFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, CHECKPOINT_FILE)
+	scanPath := filepath.Join(dir, "scans", "a.tab")
+	if err := saveCheckpoint(path, &checkpoint{ScanFile: scanPath, Line: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other spellings of the same file are the same scan file.
+	t.Chdir(dir)
+	for _, same := range []string{scanPath, "scans/a.tab", "./scans//a.tab", filepath.Join(dir, "scans", "..", "scans", "a.tab")} {
+		if _, err := loadCheckpoint(path, same); err != nil {
+			t.Errorf("loadCheckpoint(%q) = %v, want the checkpoint", same, err)
+		}
+	}
+	for _, other := range []string{filepath.Join(dir, "scans", "b.tab"), "a.tab", ""} {
+		if cp, err := loadCheckpoint(path, other); err == nil {
+			t.Errorf("loadCheckpoint(%q) = %+v, want a scan file mismatch", other, cp)
+		}
+	}
+
+	// A checkpoint that does not name its scan file cannot be trusted.
+	if err := os.WriteFile(path, []byte(`{"line": 10}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := loadCheckpoint(path, scanPath); err == nil {
+		t.Errorf("loadCheckpoint without a scan file = %+v, want an error", cp)
+	}
+}
+
+func TestLoadCheckpointErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, CHECKPOINT_FILE)
+	if _, err := loadCheckpoint(path, "scan"); !os.IsNotExist(err) {
+		t.Errorf("loadCheckpoint of a missing file = %v, want a not-exist error", err)
+	}
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(path, "scan"); err == nil || !strings.Contains(err.Error(), "invalid checkpoint") {
+		t.Errorf("loadCheckpoint of a corrupt file = %v, want invalid checkpoint", err)
+	}
+}
+
+func TestFinishCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, CHECKPOINT_FILE)
+	scanPath := filepath.Join(dir, SCAN_FILE)
+	opts := &options{}
+
+	stats := &runStats{deadlineHit: true, stoppedAt: 42, requeued: []string{"/x"}}
+	if err := finishCheckpoint(path, scanPath, stats, opts); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := loadCheckpoint(path, scanPath)
+	if err != nil || cp.Line != 42 || len(cp.Pending) != 1 {
+		t.Fatalf("checkpoint after the deadline = %+v, %v", cp, err)
+	}
+
+	// A completed resumed run removes it.
+	opts.resume = cp
+	if err := finishCheckpoint(path, scanPath, &runStats{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of a completed run still there: %v", err)
+	}
+
+	// Failing to save it is reported, not fatal to the process.
+	blocked := filepath.Join(dir, "missing", CHECKPOINT_FILE)
+	if err := finishCheckpoint(blocked, scanPath, stats, &options{}); err == nil {
+		t.Error("finishCheckpoint into a missing directory succeeded")
+	}
+}
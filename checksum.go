@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// CHECKSUMS are the algorithms selectable with --checksum. sha256 is also
+// what the audit log records; xxhash (XXH64) is much cheaper and still
+// catches short writes and bit flips, and blake3 is a cryptographic hash
+// faster than sha256.
+var CHECKSUMS = map[string]func() hash.Hash{
+	"xxhash": func() hash.Hash { return xxhash.New() },
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// newChecksum creates the hash used for every checksum of a run, the
+// algorithm checksumName.
+var (
+	newChecksum  = sha256.New
+	checksumName = "sha256"
+)
+
+// verifyCopies is set by --checksum: every temp file is re-read and compared
+// with the source checksum before it is renamed into place.
+var verifyCopies bool
+
+func parseChecksum(name string) (func() hash.Hash, error) {
+	if fn, ok := CHECKSUMS[name]; ok {
+		return fn, nil
+	}
+	names := make([]string, 0, len(CHECKSUMS))
+	for n := range CHECKSUMS {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown checksum %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// checkCopy re-reads tmpPath and compares it with sum, the checksum of the
+// source data taken while copying.
+func checkCopy(tmpPath string, sum []byte) error {
+	mdsOps(1)
+	got, err := fileChecksum(tmpPath)
+	if err != nil {
+		return codeErrorf(E_CHECKSUM, "failed to re-read copy: %w", err)
+	}
+	if !bytes.Equal(got, sum) {
+		return codeErrorf(E_CHECKSUM, "copy differs from source: source %x, copy %x", sum, got)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pattern is the input of the BLAKE3 test vectors: bytes 0..250 repeated.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestChecksumVectors(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		n         int
+		want      string
+	}{
+		// xxhsum -H64
+		{"xxhash", 0, "ef46db3751d8e999"},
+		{"xxhash", 1, "e934a84adb052768"},
+		{"xxhash", 31, "c346d2b59b4d8ee1"},
+		{"xxhash", 32, "cbf59c5116ff32b4"},
+		{"xxhash", 1000, "f306f04aa88b54d3"},
+		// The official BLAKE3 test vectors.
+		{"blake3", 0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{"blake3", 1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{"blake3", 1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{"blake3", 1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{"blake3", 3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{"blake3", 8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+	}
+	for _, tt := range tests {
+		fn, err := parseChecksum(tt.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := pattern(tt.n)
+		h := fn()
+		h.Write(data)
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("%s of %d bytes = %s, want %s", tt.algorithm, tt.n, got, tt.want)
+		}
+
+		// The copy engines write in pieces of any size.
+		h.Reset()
+		for i := 0; i < len(data); i += 7 {
+			h.Write(data[i:min(i+7, len(data))])
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("%s of %d bytes written in pieces = %s, want %s", tt.algorithm, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for _, name := range []string{"xxhash", "sha256", "blake3"} {
+		if _, err := parseChecksum(name); err != nil {
+			t.Errorf("parseChecksum(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "md5", "crc32c", "SHA256"} {
+		if _, err := parseChecksum(name); err == nil {
+			t.Errorf("parseChecksum(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+// useChecksum selects algorithm for the duration of the test.
+func useChecksum(t *testing.T, algorithm string) {
+	t.Helper()
+	fn, err := parseChecksum(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevFn, prevName := newChecksum, checksumName
+	newChecksum, checksumName = fn, algorithm
+	t.Cleanup(func() { newChecksum, checksumName = prevFn, prevName })
+}
+
+func TestCheckCopyDetectsCorruption(t *testing.T) {
+	data := pattern(5000)
+	corruptions := []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"bit flip", func(b []byte) []byte { b[2345] ^= 0x10; return b }},
+		{"short write", func(b []byte) []byte { return b[:4096] }},
+		{"zeroed block", func(b []byte) []byte { clear(b[1024:2048]); return b }},
+		{"extra bytes", func(b []byte) []byte { return append(b, 0) }},
+	}
+	for algorithm := range CHECKSUMS {
+		t.Run(algorithm, func(t *testing.T) {
+			useChecksum(t, algorithm)
+			h := newChecksum()
+			h.Write(data)
+			sum := h.Sum(nil)
+
+			copyPath := filepath.Join(t.TempDir(), "copy")
+			if err := os.WriteFile(copyPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkCopy(copyPath, sum); err != nil {
+				t.Errorf("intact copy: %v", err)
+			}
+			for _, c := range corruptions {
+				if err := os.WriteFile(copyPath, c.mangle(append([]byte(nil), data...)), 0644); err != nil {
+					t.Fatal(err)
+				}
+				err := checkCopy(copyPath, sum)
+				if code := errorCodeOf(err); code != E_CHECKSUM {
+					t.Errorf("%s: checkCopy = %v, want %s", c.name, err, E_CHECKSUM)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateFileRejectsBadCopy(t *testing.T) {
+	dir := t.TempDir()
+	useTestXattrKey(t, dir)
+	useChecksum(t, "blake3")
+	prev := verifyCopies
+	verifyCopies = true
+	t.Cleanup(func() { verifyCopies = prev })
+
+	path := filepath.Join(dir, "file")
+	info := writeFile(t, path, "source data")
+	if err := sysSetxattr(path, xattrKey, []byte("src")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A source checksum the copy cannot match, as if the data was damaged
+	// on its way to the temp file.
+	h := newChecksum()
+	h.Write([]byte("damaged in flight: "))
+	err := migrateFile(context.Background(), path, path+".mig", info, "dst", PLACE_RENAME, h)
+	if code := errorCodeOf(err); code != E_CHECKSUM {
+		t.Fatalf("migrateFile = %v, want %s", err, E_CHECKSUM)
+	}
+	if pool, err := getXattr(path); err != nil || string(pool) != "src" {
+		t.Errorf("pool of the original = %q, %v, want it not replaced", pool, err)
+	}
+	checkContent(t, path, "source data")
+	if _, err := os.Lstat(path + ".mig"); !os.IsNotExist(err) {
+		t.Errorf("rejected copy left behind: %v", err)
+	}
+
+	// The same copy with the true source checksum goes through.
+	if err := migrateFile(context.Background(), path, path+".mig", info, "dst", PLACE_RENAME, newChecksum()); err != nil {
+		t.Fatal(err)
+	}
+	if pool, err := getXattr(path); err != nil || string(pool) != "dst" {
+		t.Errorf("pool = %q, %v, want dst", pool, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var checksumDBHeader = []string{"path", "size", "mtime", "algorithm", "checksum"}
+
+// checksumDB appends the size, mtime and checksum of every migrated file to
+// a CSV file, so "migxattrs audit --checksum-db" can re-verify samples long
+// after the run. Later rows for a path supersede earlier ones.
+type checksumDB struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+}
+
+func openChecksumDB(path string) (*checksumDB, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db := &checksumDB{file: file, w: csv.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		db.w.Write(checksumDBHeader)
+	}
+	return db, nil
+}
+
+func (db *checksumDB) record(path string, info os.FileInfo, sum []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.w.Write([]string{path, strconv.FormatInt(info.Size(), 10), info.ModTime().UTC().Format(time.RFC3339Nano),
+		checksumName, hex.EncodeToString(sum)})
+}
+
+func (db *checksumDB) close() error {
+	db.w.Flush()
+	if err := db.w.Error(); err != nil {
+		db.file.Close()
+		return err
+	}
+	return db.file.Close()
+}
+
+type checksumRow struct {
+	path      string
+	size      int64
+	mtime     time.Time
+	algorithm string
+	sum       []byte
+}
+
+// sampleChecksumDB reads the latest row of every path in the database at
+// path and returns n of them picked at random, or all of them if n is 0.
+func sampleChecksumDB(path string, n int) ([]checksumRow, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = len(checksumDBHeader)
+	latest := make(map[string]checksumRow)
+	for line := 1; ; line++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if line == 1 && fields[0] == checksumDBHeader[0] {
+			continue
+		}
+		row := checksumRow{path: fields[0], algorithm: fields[3]}
+		if row.size, err = strconv.ParseInt(fields[1], 10, 64); err == nil {
+			row.mtime, err = time.Parse(time.RFC3339Nano, fields[2])
+		}
+		if err == nil {
+			row.sum, err = hex.DecodeString(fields[4])
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		latest[row.path] = row
+	}
+
+	rows := make([]checksumRow, 0, len(latest))
+	for _, row := range latest {
+		rows = append(rows, row)
+	}
+	rand.Shuffle(len(rows), func(i, j int) { rows[i], rows[j] = rows[j], rows[i] })
+	if n > 0 && n < len(rows) {
+		rows = rows[:n]
+	}
+	return rows, len(latest), nil
+}
+
+// auditChecksums re-verifies a random sample of the checksum database and
+// returns the exit status. Files changed since their migration (a different
+// size or mtime) are reported separately, as they are expected to differ.
+func auditChecksums(dbPath string, sample int) int {
+	rows, total, err := sampleChecksumDB(dbPath, sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading checksum database: %v\n", err)
+		return 1
+	}
+
+	var passed, modified, missing, failed int
+	for _, row := range rows {
+		newHash, err := parseChecksum(row.algorithm)
+		if err != nil {
+			fmt.Printf("FAILED   %s: %v\n", displayPath(row.path), err)
+			failed++
+			continue
+		}
+		info, err := os.Stat(row.path)
+		if os.IsNotExist(err) {
+			missing++
+			continue
+		} else if err != nil {
+			fmt.Printf("FAILED   %s: %s\n", displayPath(row.path), displayErr(row.path, err))
+			failed++
+			continue
+		}
+		if info.Size() != row.size || !info.ModTime().Equal(row.mtime) {
+			modified++
+			continue
+		}
+
+		file, err := os.Open(row.path)
+		if err == nil {
+			h := newHash()
+			_, err = io.Copy(h, file)
+			file.Close()
+			if err == nil && !bytes.Equal(h.Sum(nil), row.sum) {
+				err = fmt.Errorf("%s mismatch: recorded %x, now %x", row.algorithm, row.sum, h.Sum(nil))
+			}
+		}
+		if err != nil {
+			fmt.Printf("FAILED   %s: %s\n", displayPath(row.path), displayErr(row.path, err))
+			failed++
+			continue
+		}
+		passed++
+	}
+
+	fmt.Printf("Sampled %d of %d files\n", len(rows), total)
+	fmt.Printf("Intact:           %d\nCorrupted:        %d\nModified since:   %d\nRemoved since:    %d\n", passed, failed, modified, missing)
+	if failed > 0 {
+		return EXIT_VERIFY_FAILED
+	}
+	return EXIT_OK
+}
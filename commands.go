@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+// command is a "migxattrs NAME" subcommand. run gets the arguments after
+// the name and returns the exit status.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// COMMANDS lists the subcommands in the order "migxattrs help" shows them.
+// Running migxattrs without a subcommand is the same as "migxattrs migrate".
+var COMMANDS = []command{
+	{"scan", "Walk a tree and write the scan file", runScanCommand},
+	{"migrate", "Rewrite every file still in the source pool (the default)", runMigrateCommand},
+	{"fix-dirs", "Rewrite only the default layouts of directories in the source pool", runFixDirsCommand},
+	{"verify", "Check that the files of a scan file have left the source pool", runVerifyCommand},
+	{"remigrate", "Re-run the files of a previous run selected from one of its manifests", runRemigrateCommand},
+	{"cleanup", "Remove temp files left behind by interrupted runs", runCleanupCommand},
+	{"rollback", "Swap the originals of --swap migrations back in", func(args []string) int { return runSwapCommand("rollback", args) }},
+	{"swap-cleanup", "Remove originals kept by --swap", func(args []string) int { return runSwapCommand("swap-cleanup", args) }},
+	{"audit", "Check the hash chain of an audit log", runAuditCommand},
+	{"history", "Show the run history", runHistoryCommand},
+	{"compare", "Compare two runs from the history", runCompareCommand},
+	{"synth", "Build a synthetic tree for testing", runSynthCommand},
+	{"remote", "Coordinate migration agents on several hosts", runRemoteCommand},
+	{"coordinate", "Hand out the scan file in batches to --coordinator workers", runCoordinateCommand},
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range COMMANDS {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printCommands() {
+	fmt.Println("Usage: migxattrs [COMMAND] [flags] ARGS")
+	fmt.Println("\nCommands:")
+	for _, cmd := range COMMANDS {
+		fmt.Printf("  %-14s%s\n", cmd.name, cmd.summary)
+	}
+	fmt.Println("\nRun \"migxattrs COMMAND --help\" for the flags of a command.")
+}
+
+// xattrFlags are the flags naming the attribute, and optionally its source
+// and destination values, shared by the commands that read layouts.
+type xattrFlags struct {
+	key     *string
+	match   *string
+	set     *string
+	emulate *bool
+}
+
+func addXattrFlags(fs *pflag.FlagSet, pools bool) *xattrFlags {
+	f := &xattrFlags{
+		key:     fs.String("xattr-key", XATTR_KEY, "Extended attribute to rewrite (e.g. ceph.dir.layout.pool or a user.* attribute)"),
+		emulate: fs.Bool("emulate", false, "Store ceph.* keys as user.ceph.* so a migration can be rehearsed on a staging copy of the tree on any filesystem"),
+	}
+	if pools {
+		f.match = fs.String("match-value", SRC_POOL, "Rewrite files whose --xattr-key has this value (the source pool)")
+		f.set = fs.String("set-value", DST_POOL, "Value to give --xattr-key on the rewritten files (the destination pool)")
+	} else {
+		src, dst := SRC_POOL, DST_POOL
+		f.match, f.set = &src, &dst
+	}
+	return f
+}
+
+// apply validates the flags and sets xattrKey and dirLayoutKey.
+func (f *xattrFlags) apply() error {
+	if *f.key == "" || *f.match == "" || *f.set == "" {
+		return fmt.Errorf("--xattr-key, --match-value and --set-value must not be empty")
+	}
+	if *f.match == *f.set {
+		return fmt.Errorf("--match-value and --set-value are both %s", *f.match)
+	}
+	xattrKey, dirLayoutKey = *f.key, DIR_LAYOUT_XATTR
+	if *f.emulate {
+		xattrKey, dirLayoutKey = emulatedKey(xattrKey), emulatedKey(dirLayoutKey)
+	}
+	return nil
+}
+
+// runScanCommand implements "migxattrs scan", which writes the scan file a
+// later migrate, verify or residual report works from.
+func runScanCommand(args []string) int {
+	fs := pflag.NewFlagSet("scan", pflag.ExitOnError)
+	scanFile := fs.String("scan-file", "", "Write the scan to this file instead of CEPH_ROOT_DIR/"+SCAN_FILE)
+	xattr := addXattrFlags(fs, false)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs scan [--scan-file FILE] [--xattr-key KEY] [--emulate] CEPH_ROOT_DIR\n")
+		return 1
+	}
+	if err := xattr.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	cephRoot := fs.Arg(0)
+	scanPath := filepath.Join(cephRoot, SCAN_FILE)
+	if *scanFile != "" {
+		scanPath = *scanFile
+	}
+
+	if _, err := buildScanFile(cephRoot, scanPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error scanning %s: %v\n", displayPath(cephRoot), err)
+		return 1
+	}
+	fmt.Printf("Scan file: %s\n", scanPath)
+	return 0
+}
+
+// runVerifyCommand implements "migxattrs verify", which re-reads the live
+// xattr of every file a run was to migrate: the source-pool entries of the
+// scan file, or the files listed in a run's state database or audit log.
+// With --checksum the content is also compared with the audit log.
+func runVerifyCommand(args []string) int {
+	fs := pflag.NewFlagSet("verify", pflag.ExitOnError)
+	scanFile := fs.String("scan-file", "", "Scan file to use instead of CEPH_ROOT_DIR/"+SCAN_FILE)
+	manifest := fs.String("manifest", "", "Verify the files recorded as migrated in this --state-db or --audit-log file instead of the scan file")
+	checksum := fs.Bool("checksum", false, "Also compare each file's SHA-256 with the one in the --manifest audit log")
+	workers := fs.Int("workers", 4, "Number of files verified concurrently")
+	failedFile := fs.String("failed-file", "", "Write every file that failed verification to this file")
+	xattr := addXattrFlags(fs, true)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 && (*manifest == "" || fs.NArg() != 0) {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs verify [--scan-file FILE] [--failed-file FILE] [--match-value POOL] [--set-value POOL] CEPH_ROOT_DIR\n")
+		fmt.Fprintf(os.Stderr, "       migxattrs verify --manifest FILE [--checksum] [--failed-file FILE]\n")
+		return 1
+	}
+	if *checksum && *manifest == "" {
+		fmt.Fprintf(os.Stderr, "--checksum needs the checksums of a --manifest audit log\n")
+		return 1
+	}
+	if err := xattr.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var entries []manifestEntry
+	if *manifest != "" {
+		var err error
+		if entries, err = loadManifestEntries(*manifest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading manifest: %v\n", err)
+			return 1
+		}
+	} else {
+		cephRoot := fs.Arg(0)
+		scanPath := filepath.Join(cephRoot, SCAN_FILE)
+		if *scanFile != "" {
+			scanPath = *scanFile
+		}
+		// Only the entries the scan lists in the source pool were to be migrated.
+		srcPaths, err := loadScanPool(scanPath, *xattr.match)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading scan file: %v\n", err)
+			return 1
+		}
+		for _, rel := range srcPaths {
+			entries = append(entries, manifestEntry{path: filepath.Join(cephRoot, rel)})
+		}
+	}
+
+	var out *os.File
+	if *failedFile != "" {
+		var err error
+		if out, err = os.Create(*failedFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating failed-file: %v\n", err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	var mu sync.Mutex
+	var passed, remaining, vanished, mismatched, unchecked, other int
+	pool := newWorkerPool(*workers)
+	for _, e := range entries {
+		pool.submit(func() {
+			status := ""
+			value, err := getXattr(e.path)
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				status = "unreadable: " + displayErr(e.path, err)
+			case string(value) == *xattr.match:
+				status = "still in " + *xattr.match
+			case string(value) != *xattr.set:
+				status = "in " + string(value)
+			case *checksum && e.sum != nil:
+				if err := verifyMigratedFile(e.path, *xattr.set, e.sum); err != nil {
+					status = displayErr(e.path, err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case os.IsNotExist(err):
+				vanished++
+			case status == "":
+				passed++
+				if *checksum && e.sum == nil {
+					unchecked++
+				}
+			case strings.HasPrefix(status, "still in "):
+				remaining++
+			case strings.HasPrefix(status, "checksum mismatch"):
+				mismatched++
+			default:
+				other++
+			}
+			if status != "" && out != nil {
+				fmt.Fprintf(out, "%s\t%s\n", e.path, status)
+			}
+		})
+	}
+	pool.wait()
+
+	fmt.Printf("Files checked:    %d\n", len(entries))
+	fmt.Printf("Passed:           %d\nStill in source:  %d\nVanished:         %d\nOther:            %d\n", passed, remaining, vanished, other)
+	if *checksum {
+		fmt.Printf("Content differs:  %d\n", mismatched)
+		if unchecked > 0 {
+			fmt.Printf("No checksum:      %d (pool checked only)\n", unchecked)
+		}
+	}
+	if remaining > 0 || mismatched > 0 || other > 0 {
+		fmt.Println("Verification FAILED")
+		if out != nil {
+			fmt.Printf("Failures listed in %s\n", *failedFile)
+		}
+		return EXIT_VERIFY_FAILED
+	}
+	fmt.Println("Verification PASSED")
+	return EXIT_OK
+}
+
+// loadScanPool returns the paths the scan file lists in pool, in order.
+func loadScanPool(scanPath, pool string) ([]string, error) {
+	data, err := os.ReadFile(scanPath)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == pool {
+			paths = append(paths, filepath.Clean(fields[1]))
+		}
+	}
+	return paths, nil
+}
+
+// runCleanupCommand implements "migxattrs cleanup". It looks up the temp
+// name of every file under the root, and the names of the retries after a
+// timeout (see attemptTempPath), and removes the temp files that exist,
+// already carry the destination layout and still hold the TEMP_MARKER_XATTR
+// createTemp gave them for that file; a name match alone is never enough.
+// Originals kept by --swap are left to swap-cleanup. Temp files whose
+// original is gone are not found. It holds the lock of the root, so it
+// never runs alongside a migration of the same tree.
+func runCleanupCommand(args []string) int {
+	flags := pflag.NewFlagSet("cleanup", pflag.ExitOnError)
+	tempName := flags.String("temp-name", "visible", "Temp file naming used by the runs: visible, hidden, staging or a template")
+	dryRun := flags.Bool("dry-run", false, "List the temp files without removing them")
+	xattr := addXattrFlags(flags, true)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs cleanup [--temp-name SPEC] [--dry-run] CEPH_ROOT_DIR\n")
+		return 1
+	}
+	if err := xattr.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	template, err := parseTempName(*tempName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --temp-name value: %v\n", err)
+		return 1
+	}
+	cephRoot := flags.Arg(0)
+	lock, err := lockRun(cephRoot, shardSpec{}, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locking %s: %v\n", displayPath(cephRoot), err)
+		return 1
+	}
+	defer lock.release()
+
+	retries := make(retryTemps)
+	removed, failed := 0, 0
+	err = filepath.WalkDir(cephRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		tmpPath := tempPath(template, path, info)
+		if tmpPath == path {
+			return nil
+		}
+		for _, tmpPath := range append([]string{tmpPath}, retries.of(tmpPath)...) {
+			if !ownedTemp(tmpPath, info) {
+				continue
+			}
+			if value, err := getXattr(tmpPath); err != nil || string(value) != *xattr.set {
+				continue
+			}
+
+			if *dryRun {
+				fmt.Println(displayPath(tmpPath))
+				removed++
+				continue
+			}
+			if err := os.Remove(tmpPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove %s: %s\n", displayPath(tmpPath), displayErr(tmpPath, err))
+				failed++
+				continue
+			}
+			if dir := filepath.Dir(tmpPath); dir != filepath.Dir(path) {
+				os.Remove(dir)
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error walking %s: %v\n", displayPath(cephRoot), err)
+		return 1
+	}
+
+	if *dryRun {
+		fmt.Printf("Found %d temp files\n", removed)
+	} else {
+		fmt.Printf("Removed %d temp files\n", removed)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// retryTemps indexes, by directory, the temp names of retries after a
+// timeout: TMP.N for the temp name TMP (see attemptTempPath). Each
+// directory is listed once, when a temp name in it is first looked up.
+type retryTemps map[string]map[string][]string
+
+// of returns the retry temp names of tmpPath that exist.
+func (r retryTemps) of(tmpPath string) []string {
+	dir, base := filepath.Split(tmpPath)
+	names, ok := r[dir]
+	if !ok {
+		names = make(map[string][]string)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			i := strings.LastIndexByte(e.Name(), '.')
+			if i <= 0 {
+				continue
+			}
+			if _, err := strconv.ParseUint(e.Name()[i+1:], 10, 64); err == nil {
+				names[e.Name()[:i]] = append(names[e.Name()[:i]], filepath.Join(dir, e.Name()))
+			}
+		}
+		r[dir] = names
+	}
+	return names[base]
+}
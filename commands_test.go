@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestCleanupCommand(t *testing.T) {
+	dir := t.TempDir()
+	useTestXattrKey(t, dir)
+	args := func(extra ...string) []string {
+		return append(extra, "--xattr-key", xattrKey, "--set-value", "dst", dir)
+	}
+
+	left := filepath.Join(dir, "left")
+	leftInfo := writeFile(t, left, "source")
+	if err := createTemp(left, left+".mig", leftInfo, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	// The temp of a retry after a timeout.
+	if err := createTemp(left, left+".mig.3", leftInfo, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	// Files that merely carry a temp name are someone else's.
+	named := filepath.Join(dir, "named")
+	writeFile(t, named, "source")
+	writeFile(t, named+".mig", "user data")
+	if err := sysSetxattr(named+".mig", xattrKey, []byte("dst")); err != nil {
+		t.Fatal(err)
+	}
+	// A temp of another file moved next to this one.
+	moved := filepath.Join(dir, "moved")
+	writeFile(t, moved, "source")
+	if err := createTemp(left, moved+".mig.new", leftInfo, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(moved+".mig.new", moved+".mig"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Never alongside a migration of the tree.
+	lock, err := lockRun(dir, shardSpec{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := runCleanupCommand(args()); code == 0 {
+		t.Error("cleanup ran while the root was locked")
+	}
+	lock.release()
+
+	if code := runCleanupCommand(args("--dry-run")); code != 0 {
+		t.Fatalf("cleanup --dry-run exit code %d", code)
+	}
+	if _, err := os.Lstat(left + ".mig"); err != nil {
+		t.Errorf("--dry-run removed a temp: %v", err)
+	}
+
+	if code := runCleanupCommand(args()); code != 0 {
+		t.Fatalf("cleanup exit code %d", code)
+	}
+	for _, tmpPath := range []string{left + ".mig", left + ".mig.3"} {
+		if _, err := os.Lstat(tmpPath); !os.IsNotExist(err) {
+			t.Errorf("leftover temp %s not removed: %v", tmpPath, err)
+		}
+	}
+	checkContent(t, named+".mig", "user data")
+	if _, err := os.Lstat(moved + ".mig"); err != nil {
+		t.Errorf("temp of another file removed: %v", err)
+	}
+	checkContent(t, left, "source")
+	checkContent(t, named, "source")
+}
+
+func TestXattrFlagsEmulate(t *testing.T) {
+	prevKey, prevDir := xattrKey, dirLayoutKey
+	t.Cleanup(func() { xattrKey, dirLayoutKey = prevKey, prevDir })
+
+	for _, emulate := range []bool{false, true} {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		f := addXattrFlags(fs, true)
+		*f.emulate = emulate
+		if err := f.apply(); err != nil {
+			t.Fatal(err)
+		}
+		wantKey, wantDir := XATTR_KEY, DIR_LAYOUT_XATTR
+		if emulate {
+			wantKey, wantDir = EMULATE_PREFIX+XATTR_KEY, EMULATE_PREFIX+DIR_LAYOUT_XATTR
+		}
+		if xattrKey != wantKey || dirLayoutKey != wantDir {
+			t.Errorf("emulate %v: keys %s and %s, want %s and %s", emulate, xattrKey, dirLayoutKey, wantKey, wantDir)
+		}
+	}
+}
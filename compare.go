@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// regressionThreshold is the relative change in throughput or error rate that
+// is flagged as a regression.
+const regressionThreshold = 0.10
+
+// runCompareCommand implements "migxattrs compare RUN_A RUN_B".
+func runCompareCommand(args []string) int {
+	fs := pflag.NewFlagSet("compare", pflag.ExitOnError)
+	historyFile := fs.String("history-file", defaultHistoryPath(), "Run history file")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs compare [--history-file FILE] RUN_A RUN_B\n")
+		return 1
+	}
+
+	records, err := loadHistory(*historyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history: %v\n", err)
+		return 1
+	}
+	a, err := findRun(records, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	b, err := findRun(records, fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("A: %s  %s  %s\nB: %s  %s  %s\n\n", a.ID, a.Started.Format(time.RFC3339), a.Outcome, b.ID, b.Started.Format(time.RFC3339), b.Outcome)
+
+	regressions := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tA\tB\tCHANGE\t")
+	// better is +1 when higher values are better, -1 when lower values are
+	// better and 0 for metrics that only give context.
+	row := func(name string, va, vb float64, format string, better int) {
+		change, flag := relativeChange(va, vb), ""
+		if better != 0 && isRegression(va, vb, better > 0) {
+			flag = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(tw, "%s\t"+format+"\t"+format+"\t%s\t%s\n", name, va, vb, change, flag)
+	}
+	row("Files migrated", float64(a.Migrated), float64(b.Migrated), "%.0f", 0)
+	row("MB migrated", mb(a.Bytes), mb(b.Bytes), "%.2f", 0)
+	row("Duration (s)", a.duration().Seconds(), b.duration().Seconds(), "%.0f", 0)
+	row("Throughput (MB/s)", perSecond(mb(a.Bytes), a.duration()), perSecond(mb(b.Bytes), b.duration()), "%.2f", 1)
+	row("Files/s", perSecond(float64(a.Migrated), a.duration()), perSecond(float64(b.Migrated), b.duration()), "%.1f", 1)
+	row("Error rate (%)", errorRate(a.Errors, a.Migrated), errorRate(b.Errors, b.Migrated), "%.2f", -1)
+	row("Verify failures", float64(a.VerifyFailed), float64(b.VerifyFailed), "%.0f", -1)
+	tw.Flush()
+
+	dirs := make(map[string]bool)
+	for name := range a.Dirs {
+		dirs[name] = true
+	}
+	for name := range b.Dirs {
+		dirs[name] = true
+	}
+	if len(dirs) > 0 {
+		names := make([]string, 0, len(dirs))
+		for name := range dirs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		fmt.Println("\nPer-directory progress:")
+		tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DIRECTORY\tMIGRATED A\tMIGRATED B\tERRORS A\tERRORS B\t")
+		for _, name := range names {
+			da, db := a.Dirs[name], b.Dirs[name]
+			if da == nil {
+				da = &dirCounts{}
+			}
+			if db == nil {
+				db = &dirCounts{}
+			}
+			flag := ""
+			if db.Errors > da.Errors {
+				flag = "MORE ERRORS"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", name, da.Migrated, db.Migrated, da.Errors, db.Errors, flag)
+		}
+		tw.Flush()
+	}
+
+	if regressions > 0 {
+		fmt.Printf("\n%d regressions from A to B\n", regressions)
+		return 2
+	}
+	return 0
+}
+
+func mb(bytes int64) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
+
+func perSecond(v float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return v / d.Seconds()
+}
+
+func errorRate(errors, migrated int) float64 {
+	if errors+migrated == 0 {
+		return 0
+	}
+	return float64(errors) / float64(errors+migrated) * 100
+}
+
+func relativeChange(a, b float64) string {
+	if a == 0 {
+		if b == 0 {
+			return "0%"
+		}
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", (b-a)/a*100)
+}
+
+func isRegression(a, b float64, higherIsBetter bool) bool {
+	if higherIsBetter {
+		return a > 0 && b < a*(1-regressionThreshold)
+	}
+	if a == 0 {
+		return b > 0
+	}
+	return b > a*(1+regressionThreshold)
+}
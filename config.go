@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// CONFIG_EXCLUSIVE are groups of flags that cannot be combined. A flag of a
+// group given on the command line overrides the others of the group that
+// the config file sets, so that the file holds defaults the command line
+// can always override.
+var CONFIG_EXCLUSIVE = [][]string{
+	{"verbose", "quiet", "log-level"},
+	{"copy-engine", "direct-io", "copy-cmd"},
+}
+
+// applyConfigFile sets every flag named in the YAML or TOML file at path that
+// was not given on the command line, so command-line flags override the
+// file. Keys are flag names; nested mappings and tables are joined with
+// "-", so
+//
+//	alert:
+//	  error-rate: 5
+//
+// and
+//
+//	[alert]
+//	error-rate = 5
+//
+// both set --alert-error-rate. Lists set repeatable flags once per element.
+func applyConfigFile(fs *pflag.FlagSet, path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fromFile := make(map[string]bool)
+	for _, name := range names {
+		flag := fs.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if flag.Changed {
+			continue
+		}
+		for _, value := range settings[name] {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+		fromFile[name] = true
+	}
+
+	for _, group := range CONFIG_EXCLUSIVE {
+		onCommandLine := slices.ContainsFunc(group, func(name string) bool {
+			flag := fs.Lookup(name)
+			return flag != nil && flag.Changed && !fromFile[name]
+		})
+		if !onCommandLine {
+			continue
+		}
+		for _, name := range group {
+			if flag := fs.Lookup(name); flag != nil && fromFile[name] {
+				flag.Value.Set(flag.DefValue)
+				flag.Changed = false
+			}
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the YAML or TOML file at path, chosen by its
+// extension, into the values to pass to each flag it names.
+func readConfigFile(path string) (map[string][]string, error) {
+	var unmarshal func([]byte, any) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return nil, fmt.Errorf("%s: unknown config format (use .yaml, .yml or .toml)", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err := unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string][]string)
+	if err := flattenConfig("", values, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// flattenConfig turns nested mappings into flag names and every value into the
+// strings to pass to the flag.
+func flattenConfig(prefix string, values map[string]any, settings map[string][]string) error {
+	for key, value := range values {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, v, settings); err != nil {
+				return err
+			}
+		case []any:
+			for _, elem := range v {
+				s, err := configScalar(name, elem)
+				if err != nil {
+					return err
+				}
+				settings[name] = append(settings[name], s)
+			}
+		default:
+			s, err := configScalar(name, v)
+			if err != nil {
+				return err
+			}
+			settings[name] = []string{s}
+		}
+	}
+	return nil
+}
+
+func configScalar(name string, value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("%s: unsupported value %v", name, value)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// configFlags is a flag set with one flag of every kind main registers.
+type configFlags struct {
+	fs       *pflag.FlagSet
+	str      *string
+	boolean  *bool
+	integer  *int
+	float    *float64
+	duration *time.Duration
+	array    *[]string
+	slice    *[]string
+	nested   *int
+}
+
+func newConfigFlags() *configFlags {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.String("config", "", "")
+	return &configFlags{
+		fs:       fs,
+		str:      fs.String("src-pool", "", ""),
+		boolean:  fs.Bool("dry-run", false, ""),
+		integer:  fs.Int("workers", 4, ""),
+		float:    fs.Float64("max-throughput", 0, ""),
+		duration: fs.Duration("file-timeout", 0, ""),
+		array:    fs.StringArray("exclude", nil, ""),
+		slice:    fs.StringSlice("only", nil, ""),
+		nested:   fs.Int("alert-error-rate", 0, ""),
+	}
+}
+
+func writeConfig(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		check func(*configFlags) bool
+	}{
+		{"string", "src-pool: cephfs_data\n", func(f *configFlags) bool { return *f.str == "cephfs_data" }},
+		{"quoted string", "src-pool: \"with # hash\"\n", func(f *configFlags) bool { return *f.str == "with # hash" }},
+		{"bool", "dry-run: true\n", func(f *configFlags) bool { return *f.boolean }},
+		{"int", "workers: 16\n", func(f *configFlags) bool { return *f.integer == 16 }},
+		{"float", "max-throughput: 2.5\n", func(f *configFlags) bool { return *f.float == 2.5 }},
+		{"float from int", "max-throughput: 3\n", func(f *configFlags) bool { return *f.float == 3 }},
+		{"duration", "file-timeout: 90s\n", func(f *configFlags) bool { return *f.duration == 90*time.Second }},
+		{"string array", "exclude: ['*.tmp', 'scratch/**']\n", func(f *configFlags) bool {
+			return slices.Equal(*f.array, []string{"*.tmp", "scratch/**"})
+		}},
+		{"string slice", "only:\n  - a\n  - b\n", func(f *configFlags) bool {
+			return slices.Equal(*f.slice, []string{"a", "b"})
+		}},
+		{"nested", "alert:\n  error-rate: 5\n", func(f *configFlags) bool { return *f.nested == 5 }},
+		{"empty", "", func(f *configFlags) bool { return *f.integer == 4 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFlags()
+			if err := applyConfigFile(f.fs, writeConfig(t, "migxattrs.yaml", tt.body)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(f) {
+				t.Errorf("config %q did not set its flag", tt.body)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		body string
+	}{
+		{"unknown setting", "c.yaml", "no-such-flag: 1\n"},
+		{"config itself", "c.yaml", "config: other.yaml\n"},
+		{"bad int", "c.yaml", "workers: many\n"},
+		{"bad float", "c.yaml", "max-throughput: fast\n"},
+		{"bad bool", "c.yaml", "dry-run: sometimes\n"},
+		{"bad duration", "c.yaml", "file-timeout: 90\n"},
+		{"nested list", "c.yaml", "exclude: [[a]]\n"},
+		{"malformed yaml", "c.yml", "workers: [1\n"},
+		{"malformed toml", "c.toml", "workers = [1\n"},
+		{"toml datetime", "c.toml", "src-pool = 2024-01-01T00:00:00Z\n"},
+		{"no extension", "config", "workers: 16\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFlags()
+			if err := applyConfigFile(f.fs, writeConfig(t, tt.file, tt.body)); err == nil {
+				t.Errorf("applyConfigFile(%s: %q) succeeded, want an error", tt.file, tt.body)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileCommandLineWins(t *testing.T) {
+	f := newConfigFlags()
+	if err := f.fs.Parse([]string{"--workers=2", "--exclude=cli"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, "c.yaml", "workers: 16\nexclude: [file]\nsrc-pool: data\n")
+	if err := applyConfigFile(f.fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *f.integer != 2 || !slices.Equal(*f.array, []string{"cli"}) {
+		t.Errorf("config overrode the command line: workers=%d exclude=%v", *f.integer, *f.array)
+	}
+	if *f.str != "data" {
+		t.Errorf("src-pool = %q, want the config's value", *f.str)
+	}
+}
+
+func TestApplyConfigFileTOML(t *testing.T) {
+	body := `src-pool = "cephfs_data"
+dry-run = true
+workers = 16
+max-throughput = 2.5
+file-timeout = "90s"
+exclude = ["*.tmp", "scratch/**"]
+
+[alert]
+error-rate = 5
+`
+	f := newConfigFlags()
+	if err := applyConfigFile(f.fs, writeConfig(t, "migxattrs.toml", body)); err != nil {
+		t.Fatal(err)
+	}
+	if *f.str != "cephfs_data" || !*f.boolean || *f.integer != 16 || *f.float != 2.5 || *f.duration != 90*time.Second ||
+		!slices.Equal(*f.array, []string{"*.tmp", "scratch/**"}) || *f.nested != 5 {
+		t.Errorf("TOML config not applied: src-pool=%q dry-run=%v workers=%d max-throughput=%v file-timeout=%v exclude=%v alert-error-rate=%d",
+			*f.str, *f.boolean, *f.integer, *f.float, *f.duration, *f.array, *f.nested)
+	}
+}
+
+func TestApplyConfigFileExclusiveFlags(t *testing.T) {
+	newFlags := func() *pflag.FlagSet {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.Bool("verbose", false, "")
+		fs.Bool("quiet", false, "")
+		fs.String("log-level", "info", "")
+		fs.String("copy-engine", "read-write", "")
+		fs.Bool("direct-io", false, "")
+		fs.String("copy-cmd", "", "")
+		return fs
+	}
+	path := writeConfig(t, "c.yaml", "log-level: warn\ncopy-engine: splice\n")
+
+	// Flags of the same group on the command line override the file.
+	fs := newFlags()
+	if err := fs.Parse([]string{"--quiet", "--direct-io"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"log-level", "copy-engine"} {
+		if flag := fs.Lookup(name); flag.Changed || flag.Value.String() != flag.DefValue {
+			t.Errorf("--%s = %s (changed %v), want the config's value dropped", name, flag.Value, flag.Changed)
+		}
+	}
+
+	// Without them the file's settings stand.
+	fs = newFlags()
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if level, engine := fs.Lookup("log-level"), fs.Lookup("copy-engine"); level.Value.String() != "warn" || engine.Value.String() != "splice" {
+		t.Errorf("--log-level %s and --copy-engine %s, want the config's warn and splice", level.Value, engine.Value)
+	}
+}
+
+func TestApplyReloadConfig(t *testing.T) {
+	path := writeConfig(t, "migxattrs.yaml", "workers: 8\nfile-timeout: 30s\nverbose: true\nsrc-pool: other\nbwlimit: 10M\n")
+	opts := &options{configPath: path, workers: 4, logLevel: LOG_INFO, commandLine: map[string]bool{"bwlimit": true}}
+	if err := applyReloadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.workers != 8 || opts.fileTimeout != 30*time.Second || opts.logLevel != LOG_DEBUG {
+		t.Errorf("workers %d, file-timeout %v, log level %s; want 8, 30s, debug", opts.workers, opts.fileTimeout, opts.logLevel)
+	}
+	if opts.srcPool != "" {
+		t.Errorf("src-pool reloaded as %q", opts.srcPool)
+	}
+	if opts.bwlimit != 0 {
+		t.Errorf("bwlimit given on the command line reloaded as %d", opts.bwlimit)
+	}
+
+	// Dropping verbose from the file goes back to the default level.
+	if err := os.WriteFile(path, []byte("workers: 8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyReloadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.logLevel != LOG_INFO {
+		t.Errorf("log level %s after dropping verbose, want info", opts.logLevel)
+	}
+
+	for _, body := range []string{"workers: 0\n", "verbose: true\nquiet: true\n", "log-level: loud\n"} {
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyReloadConfig(opts); err == nil {
+			t.Errorf("%q: no error", body)
+		}
+		if opts.workers != 8 || opts.logLevel != LOG_INFO {
+			t.Errorf("%q: settings changed by a rejected reload", body)
+		}
+	}
+}
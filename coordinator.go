@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// leaseRetryWait is how long a worker waits to ask again while every
+	// batch is leased but not all are done, since one may still expire.
+	leaseRetryWait = 5 * time.Second
+	// coordinatorLinger keeps the coordinator answering after the last
+	// batch so that waiting workers learn there is nothing left.
+	coordinatorLinger = 2 * leaseRetryWait
+)
+
+// COORDINATOR_TOKEN_ENV holds the secret the coordinator and its workers
+// share, kept off the command line where every user of the host could read
+// it. A coordinator listening beyond the loopback interface requires it.
+const COORDINATOR_TOKEN_ENV = "MIGXATTRS_COORDINATOR_TOKEN"
+
+// The coordinator and its workers talk net/rpc (gob over TCP) from the
+// standard library, so the protocol needs no code generation and adds no
+// dependency. Every call carries the shared token; the traffic itself is not
+// encrypted, so run it on the storage network only.
+
+var errBadToken = errors.New("wrong coordinator token (see $" + COORDINATOR_TOKEN_ENV + ")")
+
+// errLeaseLost stops a worker's pass over a batch once its lease has expired
+// and the batch was handed to another worker, which now migrates its files.
+var errLeaseLost = withCode(E_TIMEOUT, errors.New("lease expired and was handed to another worker"))
+
+// LeaseArgs asks the coordinator for a batch.
+type LeaseArgs struct {
+	Token  string
+	Worker string
+}
+
+// Lease is a batch of scan file lines for one worker. Without lines the
+// worker asks again after Wait, unless Done. Grant tells this handout of the
+// batch from any other; the worker renews it every Renew until it reports.
+type Lease struct {
+	ID    int
+	Grant uint64
+	Lines []string
+	Renew time.Duration
+	Wait  time.Duration
+	Done  bool
+}
+
+// RenewArgs extends a lease while its worker is still busy with the batch.
+type RenewArgs struct {
+	Token   string
+	Worker  string
+	LeaseID int
+	Grant   uint64
+}
+
+// BatchResult is what a worker reports for a lease: the statistics of the
+// pass over it, the outcome of every file it migrated or failed, with paths
+// relative to the root, and which lines of the batch it finished and which
+// it left, for instance when its run deadline was reached.
+type BatchResult struct {
+	Token     string
+	Worker    string
+	LeaseID   int
+	Grant     uint64
+	Report    agentReport
+	Files     []fileEvent
+	Completed []string
+	Remaining []string
+}
+
+// leasedBatch is a batch of the scan file and who holds it.
+type leasedBatch struct {
+	id      int
+	lines   []string
+	worker  string
+	grant   uint64
+	expires time.Time // zero while pending
+}
+
+// Coordinator owns the scan file and hands it out in batches ("migxattrs
+// coordinate"). A batch whose worker neither renews nor reports it within
+// the lease timeout is handed out again; only the worker holding the
+// current grant of a batch may renew or report it, and the lines its report
+// leaves are handed out again as a new batch.
+type Coordinator struct {
+	token        string
+	leaseTimeout time.Duration
+
+	mu          sync.Mutex
+	pending     []*leasedBatch
+	leased      map[int]*leasedBatch
+	nextID      int
+	grants      uint64
+	lines       int
+	doneLines   int
+	reassigned  int
+	requeued    int
+	workers     map[string]*agentReport
+	failures    []fileEvent
+	finished    chan struct{}
+	finishedSet bool
+}
+
+func newCoordinator(batches []*leasedBatch, lines int, leaseTimeout time.Duration, token string) *Coordinator {
+	return &Coordinator{token: token, leaseTimeout: leaseTimeout, pending: batches, leased: make(map[int]*leasedBatch),
+		nextID: len(batches), lines: lines, workers: make(map[string]*agentReport), finished: make(chan struct{})}
+}
+
+func (c *Coordinator) authorized(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// Lease hands out the next pending batch, or an expired one.
+func (c *Coordinator) Lease(args LeaseArgs, lease *Lease) error {
+	if !c.authorized(args.Token) {
+		return errBadToken
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, b := range c.leased {
+		if now.After(b.expires) {
+			fmt.Fprintf(os.Stderr, "\nLease %d of %s expired, handing it out again\n", id, b.worker)
+			delete(c.leased, id)
+			b.expires = time.Time{}
+			c.pending = append(c.pending, b)
+			c.reassigned++
+		}
+	}
+	switch {
+	case len(c.pending) > 0:
+		b := c.pending[0]
+		c.pending = c.pending[1:]
+		c.grants++
+		b.worker, b.grant, b.expires = args.Worker, c.grants, now.Add(c.leaseTimeout)
+		c.leased[b.id] = b
+		*lease = Lease{ID: b.id, Grant: b.grant, Lines: b.lines, Renew: c.leaseTimeout / 3}
+	case len(c.leased) > 0:
+		*lease = Lease{Wait: leaseRetryWait}
+	default:
+		*lease = Lease{Done: true}
+	}
+	return nil
+}
+
+// Renew extends the lease of a batch by the lease timeout. It reports
+// false once the batch was handed to another worker or is done.
+func (c *Coordinator) Renew(args RenewArgs, ok *bool) error {
+	if !c.authorized(args.Token) {
+		return errBadToken
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.leased[args.LeaseID]
+	*ok = b != nil && b.grant == args.Grant
+	if *ok {
+		b.expires = time.Now().Add(c.leaseTimeout)
+	}
+	return nil
+}
+
+// Report records the result of a batch. A report from a worker whose lease
+// was handed out again since is not accepted: the new holder reports the
+// batch.
+func (c *Coordinator) Report(result BatchResult, ack *bool) error {
+	if !c.authorized(result.Token) {
+		return errBadToken
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.leased[result.LeaseID]
+	i := -1
+	if b == nil {
+		// An expired lease reported before it was handed out again.
+		if i = sliceIndex(c.pending, result.LeaseID); i >= 0 {
+			b = c.pending[i]
+		}
+	}
+	*ack = b != nil && b.grant == result.Grant
+	if !*ack {
+		return nil
+	}
+	if !partitions(b.lines, result.Completed, result.Remaining) {
+		return fmt.Errorf("report of lease %d does not account for its %d lines", b.id, len(b.lines))
+	}
+	if i >= 0 {
+		c.pending = append(c.pending[:i], c.pending[i+1:]...)
+	} else {
+		delete(c.leased, b.id)
+	}
+	c.doneLines += len(result.Completed)
+	if len(result.Remaining) > 0 {
+		c.pending = append(c.pending, &leasedBatch{id: c.nextID, lines: result.Remaining})
+		c.nextID++
+		c.requeued += len(result.Remaining)
+	}
+
+	w := c.workers[result.Worker]
+	if w == nil {
+		w = &agentReport{Host: result.Worker, ErrorCodes: make(map[errorCode]int)}
+		c.workers[result.Worker] = w
+	}
+	r := result.Report
+	w.Lines += r.Lines
+	w.Migrated += r.Migrated
+	w.Bytes += r.Bytes
+	w.Errors += r.Errors
+	w.VerifyFailed += r.VerifyFailed
+	w.ElapsedSec += r.ElapsedSec
+	w.ExitStatus = max(w.ExitStatus, r.ExitStatus)
+	for code, n := range r.ErrorCodes {
+		w.ErrorCodes[code] += n
+	}
+	for _, ev := range result.Files {
+		if ev.Event != "migrated" {
+			c.failures = append(c.failures, ev)
+		}
+	}
+
+	if len(c.pending) == 0 && len(c.leased) == 0 && !c.finishedSet {
+		c.finishedSet = true
+		close(c.finished)
+	}
+	return nil
+}
+
+// partitions reports whether completed and remaining together hold exactly
+// the lines of a batch.
+func partitions(lines, completed, remaining []string) bool {
+	if len(completed)+len(remaining) != len(lines) {
+		return false
+	}
+	count := make(map[string]int, len(lines))
+	for _, line := range lines {
+		count[line]++
+	}
+	for _, part := range [][]string{completed, remaining} {
+		for _, line := range part {
+			if count[line] == 0 {
+				return false
+			}
+			count[line]--
+		}
+	}
+	return true
+}
+
+func sliceIndex(batches []*leasedBatch, id int) int {
+	for i, b := range batches {
+		if b.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadBatches splits the lines of scanPath the workers are to process into
+// batches of size lines.
+func loadBatches(scanPath, pool string, all bool, size int) ([]*leasedBatch, int, error) {
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	var batches []*leasedBatch
+	var current []string
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != pool && !all {
+			continue
+		}
+		current = append(current, scanner.Text())
+		lines++
+		if len(current) == size {
+			batches = append(batches, &leasedBatch{id: len(batches), lines: current})
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		batches = append(batches, &leasedBatch{id: len(batches), lines: current})
+	}
+	return batches, lines, scanner.Err()
+}
+
+// runCoordinateCommand implements "migxattrs coordinate": it serves the
+// scan file in batches to workers started on any number of client hosts
+// with "migxattrs --coordinator ADDR [flags] CEPH_ROOT_DIR", and once every
+// batch is done prints the combined summary and writes the failure list.
+func runCoordinateCommand(args []string) int {
+	fs := pflag.NewFlagSet("coordinate", pflag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:7431", "Address to serve the workers on; any address beyond loopback requires $"+COORDINATOR_TOKEN_ENV)
+	batchSize := fs.Int("batch", 1000, "Scan entries per batch")
+	leaseTimeout := fs.Duration("lease-timeout", 5*time.Minute, "Hand a batch out again when its worker has neither renewed nor reported it within this long; workers renew every third of it")
+	scanFile := fs.String("scan-file", "", "Scan file to use instead of CEPH_ROOT_DIR/"+SCAN_FILE)
+	failedFile := fs.String("failed-file", "", "Write every failed path with its error code and message to this file (default: under CEPH_ROOT_DIR/"+REMOTE_DIR+")")
+	redrain := fs.Bool("redrain", false, "Hand out every scan entry, for workers running with --redrain")
+	srcPool := fs.String("match-value", SRC_POOL, "Hand out the scan entries in this pool (the source pool)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs coordinate [--listen ADDR] [--batch N] CEPH_ROOT_DIR\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *batchSize < 1 {
+		fs.Usage()
+		return EXIT_FATAL
+	}
+	cephRoot := fs.Arg(0)
+	scanPath := filepath.Join(cephRoot, SCAN_FILE)
+	if *scanFile != "" {
+		scanPath = *scanFile
+	}
+
+	batches, lines, err := loadBatches(scanPath, *srcPool, *redrain, *batchSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading scan file: %v\n", err)
+		return EXIT_FATAL
+	}
+	if lines == 0 {
+		fmt.Println("No files found in source pool. Nothing to hand out.")
+		return EXIT_OK
+	}
+	token := os.Getenv(COORDINATOR_TOKEN_ENV)
+	c := newCoordinator(batches, lines, *leaseTimeout, token)
+
+	server := rpc.NewServer()
+	if err := server.Register(c); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return EXIT_FATAL
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening on %s: %v\n", *listen, err)
+		return EXIT_FATAL
+	}
+	defer ln.Close()
+	if tcp, ok := ln.Addr().(*net.TCPAddr); token == "" && (!ok || !tcp.IP.IsLoopback()) {
+		fmt.Fprintf(os.Stderr, "Listening on %s, beyond loopback, requires a shared token in $%s\n", ln.Addr(), COORDINATOR_TOKEN_ENV)
+		return EXIT_FATAL
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	fmt.Printf("Serving %d entries in %d batches on %s\n", lines, len(batches), ln.Addr())
+	fmt.Printf("Start workers with: migxattrs --coordinator HOST%s --yes [flags] CEPH_ROOT_DIR\n", portOf(ln.Addr()))
+	if token != "" {
+		fmt.Printf("Workers need the same $%s\n", COORDINATOR_TOKEN_ENV)
+	}
+
+	startTime := time.Now()
+	ticker := time.NewTicker(agentReportInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-c.finished:
+			running = false
+		case <-ticker.C:
+			c.printProgress(time.Since(startTime))
+		}
+	}
+	elapsed := time.Since(startTime)
+	time.Sleep(coordinatorLinger)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.workers))
+	for name := range c.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	agents := make([]*remoteAgent, len(names))
+	for i, name := range names {
+		agents[i] = &remoteAgent{host: name, result: c.workers[name]}
+	}
+	status := printRemoteReport(agents, elapsed)
+	if c.reassigned > 0 {
+		fmt.Printf("Batches handed out again after their lease expired: %d\n", c.reassigned)
+	}
+	if c.requeued > 0 {
+		fmt.Printf("Entries workers left and were handed out again: %d\n", c.requeued)
+	}
+	if len(c.failures) > 0 {
+		path := *failedFile
+		if path == "" {
+			path = filepath.Join(cephRoot, REMOTE_DIR, "coordinator-"+startTime.Format("20060102-150405")+"-failed.tab")
+		}
+		if err := writeCoordinatorFailures(path, cephRoot, c.failures); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing failure list: %v\n", err)
+			status = max(status, EXIT_FATAL)
+		} else {
+			fmt.Printf("%d failed files listed in %s\n", len(c.failures), path)
+		}
+	}
+	return status
+}
+
+func (c *Coordinator) printProgress(elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var migrated, errors int
+	var bytes int64
+	for _, w := range c.workers {
+		migrated += w.Migrated
+		errors += w.Errors
+		bytes += w.Bytes
+	}
+	fmt.Printf("\rProgress: %d of %d entries done, %d batches out, %d migrated, %d errors, %.2f MB/s, %d workers",
+		c.doneLines, c.lines, len(c.leased), migrated, errors, perSecond(mb(bytes), elapsed), len(c.workers))
+}
+
+// writeCoordinatorFailures writes PATH<TAB>CODE<TAB>ERROR<TAB>HOST lines.
+func writeCoordinatorFailures(path, cephRoot string, failures []fileEvent) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, ev := range failures {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", filepath.Join(cephRoot, ev.Path), ev.Code, ev.Error, ev.Host)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func portOf(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return fmt.Sprintf(":%d", tcp.Port)
+	}
+	return ""
+}
+
+// runWorker migrates the batches leased from the coordinator at addr until
+// it has none left (--coordinator). Each batch is one pass of runMigration
+// over a scan file holding just its lines, with the lease renewed meanwhile.
+func runWorker(cephRoot, addr string, opts *options) int {
+	// The coordinator keeps track of what is done: a batch left unfinished
+	// goes back to it, not to a checkpoint of this worker.
+	opts.checkpointInterval = 0
+	token := os.Getenv(COORDINATOR_TOKEN_ENV)
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to coordinator: %v\n", err)
+		return EXIT_FATAL
+	}
+	defer client.Close()
+	host, _ := os.Hostname()
+	worker := fmt.Sprintf("%s/%d", host, os.Getpid())
+	dir, err := os.MkdirTemp("", "migxattrs-worker-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return EXIT_FATAL
+	}
+	defer os.RemoveAll(dir)
+	batchPath := filepath.Join(dir, SCAN_FILE)
+
+	var mu sync.Mutex
+	var files []fileEvent
+	opts.fileResults = func(ev *fileEvent) {
+		e := *ev
+		if rel, err := filepath.Rel(cephRoot, e.Path); err == nil {
+			e.Path = rel
+		}
+		e.Host = host
+		mu.Lock()
+		files = append(files, e)
+		mu.Unlock()
+	}
+
+	status, batches := EXIT_OK, 0
+	for {
+		var lease Lease
+		if err := client.Call("Coordinator.Lease", LeaseArgs{Token: token, Worker: worker}, &lease); err != nil {
+			fmt.Fprintf(os.Stderr, "Error leasing a batch: %v\n", err)
+			return EXIT_FATAL
+		}
+		if lease.Done {
+			break
+		}
+		if len(lease.Lines) == 0 {
+			time.Sleep(lease.Wait)
+			continue
+		}
+		if err := os.WriteFile(batchPath, []byte(strings.Join(lease.Lines, "\n")+"\n"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing batch: %v\n", err)
+			return EXIT_FATAL
+		}
+		logf(LOG_INFO, "Batch %d: %d entries\n", lease.ID, len(lease.Lines))
+		opts.expectedFiles = len(lease.Lines)
+		start := time.Now()
+		ctx, lost := context.WithCancelCause(context.Background())
+		stopRenewing := make(chan struct{})
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			renewLease(client, RenewArgs{Token: token, Worker: worker, LeaseID: lease.ID, Grant: lease.Grant}, lease.Renew, stopRenewing, lost)
+		}()
+		stats, err := runMigration(ctx, cephRoot, batchPath, opts, nil)
+		close(stopRenewing)
+		<-renewed
+		lost(nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening scan file: %v\n", err)
+			return EXIT_FATAL
+		}
+		printSummary(stats, opts, time.Since(start))
+
+		mu.Lock()
+		result := BatchResult{Token: token, Worker: worker, LeaseID: lease.ID, Grant: lease.Grant,
+			Report: *newAgentReport(stats, time.Since(start)), Files: files}
+		files = nil
+		mu.Unlock()
+		if errors.Is(context.Cause(ctx), errLeaseLost) {
+			// The batch is another worker's now, and so is its report.
+			logf(LOG_WARN, "Warning: stopped batch %d, whose lease expired and was handed to another worker\n", lease.ID)
+			continue
+		}
+		result.Completed, result.Remaining = splitBatch(cephRoot, lease.Lines, stats)
+		var accepted bool
+		if err := client.Call("Coordinator.Report", result, &accepted); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reporting batch %d: %v\n", lease.ID, err)
+			return EXIT_FATAL
+		}
+		if !accepted {
+			fmt.Fprintf(os.Stderr, "Batch %d was handed to another worker after its lease expired; that worker reports it\n", lease.ID)
+		}
+		batches++
+		status = max(status, exitStatus(stats))
+		if stats.deadlineHit {
+			// The report handed the lines this run did not get to back
+			// to the coordinator, which gives them to another worker.
+			return EXIT_INCOMPLETE
+		}
+	}
+	logf(LOG_INFO, "\nNo batches left; this worker processed %d\n", batches)
+	return status
+}
+
+// renewLease renews a lease every interval until stop is closed. Once the
+// coordinator has handed the batch to another worker it calls lost with
+// errLeaseLost, which stops the pass over the batch, and gives up.
+func renewLease(client *rpc.Client, args RenewArgs, interval time.Duration, stop <-chan struct{}, lost context.CancelCauseFunc) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var ok bool
+		if err := client.Call("Coordinator.Renew", args, &ok); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError renewing lease %d: %v\n", args.LeaseID, err)
+			continue
+		}
+		if !ok {
+			lost(errLeaseLost)
+			return
+		}
+	}
+}
+
+// splitBatch divides the lines of a batch into those the pass over it
+// finished and those it left: every line after the one its run deadline
+// stopped it at, and the files it requeued but did not get to retry.
+func splitBatch(cephRoot string, lines []string, stats *runStats) (completed, remaining []string) {
+	if !stats.deadlineHit {
+		return lines, nil
+	}
+	stop := min(stats.stoppedAt, len(lines))
+	requeued := make(map[string]bool, len(stats.requeued))
+	for _, absPath := range stats.requeued {
+		requeued[absPath] = true
+	}
+	for _, line := range lines[:stop] {
+		if fields := strings.Fields(line); len(fields) >= 2 && requeued[filepath.Join(cephRoot, fields[1])] {
+			remaining = append(remaining, line)
+		} else {
+			completed = append(completed, line)
+		}
+	}
+	return completed, append(remaining, lines[stop:]...)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testCoordinator(leaseTimeout time.Duration, batches ...[]string) *Coordinator {
+	var leased []*leasedBatch
+	lines := 0
+	for i, b := range batches {
+		leased = append(leased, &leasedBatch{id: i, lines: b})
+		lines += len(b)
+	}
+	return newCoordinator(leased, lines, leaseTimeout, "secret")
+}
+
+func lease(t *testing.T, c *Coordinator, worker string) Lease {
+	t.Helper()
+	var l Lease
+	if err := c.Lease(LeaseArgs{Token: "secret", Worker: worker}, &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func report(t *testing.T, c *Coordinator, worker string, l Lease, completed, remaining []string) bool {
+	t.Helper()
+	var ack bool
+	result := BatchResult{Token: "secret", Worker: worker, LeaseID: l.ID, Grant: l.Grant, Completed: completed, Remaining: remaining}
+	if err := c.Report(result, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack
+}
+
+// expire makes the lease of batch id run out.
+func expire(c *Coordinator, id int) {
+	c.mu.Lock()
+	c.leased[id].expires = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+}
+
+func finished(c *Coordinator) bool {
+	select {
+	case <-c.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCoordinatorLeaseAndReport(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta"}, []string{"src\tb"})
+	a, b := lease(t, c, "w1"), lease(t, c, "w2")
+	if a.ID == b.ID || a.Grant == b.Grant || len(a.Lines) != 1 || len(b.Lines) != 1 {
+		t.Fatalf("leases %+v and %+v, want two distinct batches", a, b)
+	}
+	if a.Renew <= 0 || a.Renew >= time.Hour {
+		t.Errorf("renew interval %v, want a fraction of the lease timeout", a.Renew)
+	}
+	if l := lease(t, c, "w3"); len(l.Lines) != 0 || l.Done || l.Wait == 0 {
+		t.Errorf("lease while all batches are out = %+v, want a wait", l)
+	}
+	if !report(t, c, "w1", a, a.Lines, nil) || !report(t, c, "w2", b, b.Lines, nil) {
+		t.Fatal("report of a held lease not accepted")
+	}
+	if !finished(c) {
+		t.Error("coordinator not finished with every batch reported")
+	}
+	if l := lease(t, c, "w3"); !l.Done {
+		t.Errorf("lease after the last batch = %+v, want done", l)
+	}
+	if c.doneLines != 2 {
+		t.Errorf("done lines = %d, want 2", c.doneLines)
+	}
+}
+
+func TestCoordinatorExpiredLease(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta", "src\tb"})
+	stale := lease(t, c, "w1")
+	expire(c, stale.ID)
+
+	current := lease(t, c, "w2")
+	if current.ID != stale.ID || current.Grant == stale.Grant {
+		t.Fatalf("lease after expiry = %+v, want batch %d under a new grant", current, stale.ID)
+	}
+	if c.reassigned != 1 {
+		t.Errorf("reassigned = %d, want 1", c.reassigned)
+	}
+
+	// The worker that lost the batch may neither keep nor report it.
+	var ok bool
+	if err := c.Renew(RenewArgs{Token: "secret", Worker: "w1", LeaseID: stale.ID, Grant: stale.Grant}, &ok); err != nil || ok {
+		t.Errorf("renewal by the stale holder = %v, %v, want it refused", ok, err)
+	}
+	if report(t, c, "w1", stale, stale.Lines, nil) {
+		t.Error("report by the stale holder accepted")
+	}
+	if finished(c) || c.doneLines != 0 {
+		t.Fatal("stale report counted")
+	}
+	if !report(t, c, "w2", current, current.Lines, nil) {
+		t.Error("report by the current holder not accepted")
+	}
+	if report(t, c, "w2", current, current.Lines, nil) {
+		t.Error("second report of the batch accepted")
+	}
+	if !finished(c) || c.doneLines != 2 {
+		t.Errorf("finished %v with %d lines done, want the batch done once", finished(c), c.doneLines)
+	}
+}
+
+func TestCoordinatorExpiredLeaseReportedInTime(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta"}, []string{"src\tb"})
+	l := lease(t, c, "w1")
+	expire(c, l.ID)
+	// w2 gets the other batch; the expired one waits for the next lease.
+	if other := lease(t, c, "w2"); other.ID == l.ID {
+		t.Fatalf("lease %+v, want the batch still pending", other)
+	}
+	if !report(t, c, "w1", l, l.Lines, nil) {
+		t.Error("report of an expired lease not yet handed out again not accepted")
+	}
+	c.mu.Lock()
+	pending := len(c.pending)
+	c.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("reported batch still pending")
+	}
+}
+
+func TestCoordinatorRenew(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta"})
+	l := lease(t, c, "w1")
+	expire(c, l.ID)
+	var ok bool
+	if err := c.Renew(RenewArgs{Token: "secret", Worker: "w1", LeaseID: l.ID, Grant: l.Grant}, &ok); err != nil || !ok {
+		t.Fatalf("renewal = %v, %v", ok, err)
+	}
+	// Renewed in time, the batch is not handed out again.
+	if other := lease(t, c, "w2"); len(other.Lines) != 0 {
+		t.Errorf("renewed batch handed out again: %+v", other)
+	}
+	if !report(t, c, "w1", l, l.Lines, nil) {
+		t.Error("report after renewal not accepted")
+	}
+}
+
+func TestCoordinatorRequeuesRemaining(t *testing.T) {
+	batch := []string{"src\ta", "src\tb", "src\tc", "src\td"}
+	c := testCoordinator(time.Hour, batch)
+	l := lease(t, c, "w1")
+	if !report(t, c, "w1", l, []string{"src\ta", "src\tc"}, []string{"src\tb", "src\td"}) {
+		t.Fatal("report not accepted")
+	}
+	if finished(c) {
+		t.Fatal("finished with lines left")
+	}
+	rest := lease(t, c, "w2")
+	if rest.ID == l.ID || !slices.Equal(rest.Lines, []string{"src\tb", "src\td"}) {
+		t.Fatalf("lease after a partial report = %+v, want the remaining lines as a new batch", rest)
+	}
+	if !report(t, c, "w2", rest, rest.Lines, nil) || !finished(c) {
+		t.Error("remaining lines not finished by their report")
+	}
+	if c.doneLines != len(batch) || c.requeued != 2 {
+		t.Errorf("done %d, requeued %d, want %d and 2", c.doneLines, c.requeued, len(batch))
+	}
+}
+
+func TestCoordinatorRejectsBadReports(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta", "src\tb"})
+	l := lease(t, c, "w1")
+	var ack bool
+	for _, tt := range []struct {
+		name                 string
+		completed, remaining []string
+	}{
+		{"missing line", []string{"src\ta"}, nil},
+		{"unknown line", []string{"src\ta"}, []string{"src\tz"}},
+		{"line twice", []string{"src\ta", "src\ta"}, nil},
+	} {
+		result := BatchResult{Token: "secret", Worker: "w1", LeaseID: l.ID, Grant: l.Grant, Completed: tt.completed, Remaining: tt.remaining}
+		if err := c.Report(result, &ack); err == nil {
+			t.Errorf("%s: report accepted", tt.name)
+		}
+	}
+	if finished(c) || c.doneLines != 0 {
+		t.Error("rejected report counted")
+	}
+
+	if err := c.Lease(LeaseArgs{Token: "wrong", Worker: "w2"}, &Lease{}); err == nil {
+		t.Error("lease with a wrong token succeeded")
+	}
+	if err := c.Renew(RenewArgs{Worker: "w1", LeaseID: l.ID, Grant: l.Grant}, &ack); err == nil {
+		t.Error("renewal without the token succeeded")
+	}
+	result := BatchResult{Worker: "w1", LeaseID: l.ID, Grant: l.Grant, Completed: l.Lines}
+	if err := c.Report(result, &ack); err == nil {
+		t.Error("report without the token succeeded")
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	root := "/mnt/cephfs"
+	lines := []string{"src\ta", "src\tb", "src\tc", "src\td", "src\te"}
+	if completed, remaining := splitBatch(root, lines, &runStats{}); !slices.Equal(completed, lines) || remaining != nil {
+		t.Errorf("full pass: completed %q, remaining %q", completed, remaining)
+	}
+
+	stats := &runStats{deadlineHit: true, stoppedAt: 3, requeued: []string{filepath.Join(root, "b")}}
+	completed, remaining := splitBatch(root, lines, stats)
+	if !slices.Equal(completed, []string{"src\ta", "src\tc"}) || !slices.Equal(remaining, []string{"src\tb", "src\td", "src\te"}) {
+		t.Errorf("stopped pass: completed %q, remaining %q", completed, remaining)
+	}
+	if !partitions(lines, completed, remaining) {
+		t.Error("split does not account for every line")
+	}
+}
+
+func TestRenewLeaseLost(t *testing.T) {
+	c := testCoordinator(time.Hour, []string{"src\ta"})
+	server := rpc.NewServer()
+	if err := server.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	l := lease(t, c, "w1")
+	expire(c, l.ID)
+	if other := lease(t, c, "w2"); other.ID != l.ID {
+		t.Fatalf("expired batch not handed out again: %+v", other)
+	}
+
+	ctx, lost := context.WithCancelCause(context.Background())
+	defer lost(nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		renewLease(client, RenewArgs{Token: "secret", Worker: "w1", LeaseID: l.ID, Grant: l.Grant}, time.Millisecond, make(chan struct{}), lost)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewLease kept renewing a lease handed to another worker")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, errLeaseLost) {
+		t.Errorf("pass stopped with %v, want %v", cause, errLeaseLost)
+	}
+}
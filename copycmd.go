@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyCommandWaitDelay bounds how long a cancelled copy command may hold on
+// to its output after it was killed, e.g. through a child it left behind.
+const copyCommandWaitDelay = 5 * time.Second
+
+// commandEngine hands the data copy of every file to an external command
+// (--copy-cmd), run with "sh -c" and given the source and the temp file as
+// $1 and $2, and as MIGXATTRS_SRC and MIGXATTRS_DST with MIGXATTRS_SIZE.
+// The temp file already has the destination layout; everything else about
+// the migration stays with migxattrs.
+type commandEngine struct {
+	command string
+}
+
+func (e commandEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.command, "sh", src.Name(), dst.Name())
+	cmd.Env = append(os.Environ(),
+		"MIGXATTRS_SRC="+src.Name(),
+		"MIGXATTRS_DST="+dst.Name(),
+		"MIGXATTRS_SIZE="+strconv.FormatInt(info.Size(), 10),
+	)
+	cmd.WaitDelay = copyCommandWaitDelay
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if msg := lastLine(output.String()); msg != "" {
+			return fmt.Errorf("copy command: %w: %s", err, msg)
+		}
+		return fmt.Errorf("copy command: %w", err)
+	}
+
+	// A command that replaced the temp file, as rsync does without
+	// --inplace, dropped its layout; one that exits 0 without copying
+	// everything must not get the file renamed over its source.
+	copied, err := os.Stat(dst.Name())
+	if err != nil {
+		return err
+	}
+	if opened, err := dst.Stat(); err != nil {
+		return err
+	} else if !os.SameFile(opened, copied) {
+		return fmt.Errorf("copy command replaced the temp file instead of writing into it, losing its layout")
+	}
+	if info, err = src.Stat(); err != nil {
+		return err
+	}
+	if copied.Size() != info.Size() {
+		return fmt.Errorf("copy command left %d bytes in the temp file, the source has %d", copied.Size(), info.Size())
+	}
+	accountWrite(dst, int(copied.Size()))
+
+	// The checksum has to come from the source, not from what the command
+	// wrote, for the verification to check the command's work.
+	if h != nil {
+		if _, err := io.Copy(h, &ctxReader{ctx: ctx, r: src}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of output.
+func lastLine(output string) string {
+	output = strings.TrimSpace(output)
+	if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	return strings.TrimSpace(output)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// copyStreams is the number of concurrent ranges of the multi-stream
+	// engine; files smaller than copyStreamMinSize are copied as one range.
+	copyStreams       = 4
+	copyStreamMinSize = 64 << 20
+)
+
+// copyEngine moves the data of src into the empty file dst. Engines must
+// stop with ctx.Err() once ctx is done and report every write with
+// accountWrite. If h is non-nil the source data must be fed to it in order;
+// engines that keep the data in the kernel hand such copies to the buffered
+// engine instead.
+type copyEngine interface {
+	copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error
+}
+
+// COPY_ENGINES are the engines selectable with --copy-engine. A new
+// transport only needs to implement copyEngine and be listed here, or be
+// added from an init function when it is platform specific.
+var COPY_ENGINES = map[string]copyEngine{
+	"buffered":     bufferedEngine{},
+	"multi-stream": multiStreamEngine{streams: copyStreams},
+}
+
+// defaultCopyEngine is the --copy-engine default. Platforms with a
+// kernel-side engine replace it, and engine, from an init function.
+var defaultCopyEngine = "buffered"
+
+// copyBufferSize is the buffer of the copies made through user space
+// (--buffer-size). Large buffers suit EC pools with wide stripes.
+var copyBufferSize = 4 << 20
+
+// copyBuffers recycles the copy buffers across files.
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// engine copies the data of every migrated file.
+var engine copyEngine = bufferedEngine{}
+
+func parseCopyEngine(name string) (copyEngine, error) {
+	if e, ok := COPY_ENGINES[name]; ok {
+		return e, nil
+	}
+	names := make([]string, 0, len(COPY_ENGINES))
+	for n := range COPY_ENGINES {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown copy engine %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// accountWrite feeds n bytes written to f into the page cache limiter and
+// the bandwidth cap.
+func accountWrite(f *os.File, n int) {
+	if pageCache != nil && n > 0 {
+		pageCache.wrote(f, n)
+	}
+	bandwidth.take(n)
+}
+
+// bufferedEngine copies through a user-space buffer with io.Copy.
+type bufferedEngine struct{}
+
+func (bufferedEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	var r io.Reader = src
+	if ctx.Done() != nil {
+		r = &ctxReader{ctx: ctx, r: src}
+	}
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hiding ReadFrom and WriteTo keeps io.CopyBuffer on buf instead of
+	// the 32 KiB buffer of their generic fallbacks.
+	_, err := io.CopyBuffer(struct{ io.Writer }{cappedWriter(dst)}, struct{ io.Reader }{r}, *buf)
+	return err
+}
+
+// multiStreamEngine copies large files as several ranges in parallel, which
+// keeps more OSDs busy for a single file than one sequential stream.
+type multiStreamEngine struct {
+	streams int
+}
+
+func (e multiStreamEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if h != nil || e.streams < 2 || size < copyStreamMinSize {
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+
+	part := (size + int64(e.streams) - 1) / int64(e.streams)
+	errs := make([]error, e.streams)
+	var wg sync.WaitGroup
+	for i := 0; i < e.streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = copyRange(ctx, dst, src, int64(i)*part, min(int64(i+1)*part, size), nil)
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	// Pick up anything appended since the size was taken.
+	return copyRange(ctx, dst, src, size, -1, nil)
+}
+
+// copyRange copies the bytes [off, end) of src to the same offsets of dst,
+// or up to the end of src if end is negative. If h is non-nil the data is
+// fed to it.
+func copyRange(ctx context.Context, dst, src *os.File, off, end int64, h hash.Hash) error {
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+	for end < 0 || off < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		want := int64(len(buf))
+		if end >= 0 {
+			want = min(want, end-off)
+		}
+		n, err := src.ReadAt(buf[:want], off)
+		if n > 0 {
+			if _, werr := dst.WriteAt(buf[:n], off); werr != nil {
+				return werr
+			}
+			accountWrite(dst, n)
+			if h != nil {
+				h.Write(buf[:n])
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyChunkSize is how much a kernel-side engine moves per call, and so how
+// often it checks the context and the page cache cap.
+const copyChunkSize = 8 << 20
+
+// directAlign is the alignment O_DIRECT needs of offsets and lengths. The
+// buffer itself is page aligned.
+const directAlign = 4096
+
+func init() {
+	COPY_ENGINES["copy_file_range"] = copyFileRangeEngine{}
+	COPY_ENGINES["sendfile"] = sendfileEngine{}
+	COPY_ENGINES["splice"] = spliceEngine{}
+	COPY_ENGINES["direct"] = directEngine{}
+	// Keeping the data in the kernel saves a copy through user space and
+	// most of the syscalls of every file.
+	defaultCopyEngine = "copy_file_range"
+	engine = copyFileRangeEngine{}
+}
+
+// copyUnsupported reports whether err from the first call of a kernel-side
+// copy means the files do not support it, so that nothing was copied and a
+// more generic engine can take over.
+func copyUnsupported(err error) bool {
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+// copyFileRangeEngine copies with copy_file_range(2), which CephFS can turn
+// into object copies on the OSDs. Filesystems that do not support it fall
+// back to sendfile, then to the buffered engine.
+type copyFileRangeEngine struct{}
+
+func (copyFileRangeEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	if h != nil {
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+	for first := true; ; first = false {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, copyChunkSize, 0)
+		// Some filesystems report an immediate end of file instead of an
+		// error; sendfile then finds out whether the file is really empty.
+		if first && (copyUnsupported(err) || err == nil && n == 0) {
+			return sendfileEngine{}.copyData(ctx, dst, src, h)
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		accountWrite(dst, n)
+	}
+}
+
+// sendfileEngine copies with sendfile(2), which keeps the data in the
+// kernel like copy_file_range but does not need the filesystem's support.
+type sendfileEngine struct{}
+
+func (sendfileEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	if h != nil {
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+	for first := true; ; first = false {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := unix.Sendfile(int(dst.Fd()), int(src.Fd()), nil, copyChunkSize)
+		if first && copyUnsupported(err) {
+			return bufferedEngine{}.copyData(ctx, dst, src, h)
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		accountWrite(dst, n)
+	}
+}
+
+// spliceEngine moves the data through a pipe with splice(2), avoiding the
+// copy into user space.
+type spliceEngine struct{}
+
+func (spliceEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	if h != nil {
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return err
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	// A larger pipe means fewer calls; the default size is kept if refused.
+	unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, 1<<20)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := unix.Splice(int(src.Fd()), nil, p[1], nil, 1<<20, unix.SPLICE_F_MOVE)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		for n > 0 {
+			m, err := unix.Splice(p[0], nil, int(dst.Fd()), nil, int(n), unix.SPLICE_F_MOVE)
+			if err != nil {
+				return err
+			}
+			n -= m
+			accountWrite(dst, int(m))
+		}
+	}
+}
+
+// directEngine reads and writes with O_DIRECT, so the migration traffic
+// bypasses the client's page cache entirely and leaves it to the workloads
+// sharing the host. Nothing is cached, so writes only count towards the
+// bandwidth cap. Filesystems refusing O_DIRECT fall back to the buffered
+// engine.
+type directEngine struct{}
+
+func (directEngine) copyData(ctx context.Context, dst, src *os.File, h hash.Hash) error {
+	if err := setDirect(src, true); err != nil {
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+	if err := setDirect(dst, true); err != nil {
+		setDirect(src, false)
+		return bufferedEngine{}.copyData(ctx, dst, src, h)
+	}
+	size := (copyBufferSize + directAlign - 1) &^ (directAlign - 1)
+	buf, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(buf)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if h != nil {
+				h.Write(buf[:n])
+			}
+			aligned := n &^ (directAlign - 1)
+			if _, err := dst.Write(buf[:aligned]); err != nil {
+				return err
+			}
+			bandwidth.take(n)
+			// Only the last block of the file can be partial; it is
+			// written through the page cache.
+			if aligned < n {
+				if err := setDirect(dst, false); err != nil {
+					return err
+				}
+				if _, err := dst.Write(buf[aligned:n]); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// setDirect turns O_DIRECT on or off for f.
+func setDirect(f *os.File, on bool) error {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if on {
+		flags |= unix.O_DIRECT
+	} else {
+		flags &^= unix.O_DIRECT
+	}
+	_, err = unix.FcntlInt(f.Fd(), unix.F_SETFL, flags)
+	return err
+}
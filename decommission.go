@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapScheduleTimeout bounds each "ceph fs snap-schedule status" query.
+const snapScheduleTimeout = 10 * time.Second
+
+// retentionUnits are the periods of a snap-schedule retention spec. Months
+// and years are taken at their longest so expiry dates are upper bounds.
+var retentionUnits = map[string]time.Duration{
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"m": 31 * 24 * time.Hour,
+	"M": 31 * 24 * time.Hour,
+	"y": 366 * 24 * time.Hour,
+}
+
+// decommissionItem is one line of the readiness checklist.
+type decommissionItem struct {
+	label string
+	count int
+	paths []string // examples, at most residualExamples
+	notes map[string]string
+}
+
+// reportDecommission writes the readiness of the source pool for removal,
+// from the residual sweep of a finished drain, to reportPath and stdout:
+// the files and directory layouts still naming the pool, the snapshots that
+// may pin its objects with their expiry where a snap-schedule retention
+// gives one, and the failed and skipped leftovers. It is meant to be
+// attached as is to the change removing the pool.
+func reportDecommission(reportPath, cephRoot string, opts *options, stats *runStats, r *residualReport) error {
+	files := 0
+	var breakdown []string
+	for _, category := range []string{RESIDUAL_FAILED, RESIDUAL_HARDLINKED, RESIDUAL_SWAPPED, RESIDUAL_SKIPPED, RESIDUAL_NEW} {
+		if n := r.counts[category]; n > 0 {
+			files += n
+			breakdown = append(breakdown, fmt.Sprintf("%d %s", n, category))
+		}
+	}
+	leftovers := &decommissionItem{label: "Failed or skipped files left:", count: r.counts[RESIDUAL_FAILED] + r.counts[RESIDUAL_SKIPPED]}
+	for _, category := range []string{RESIDUAL_FAILED, RESIDUAL_SKIPPED} {
+		for _, path := range r.examples[category] {
+			if len(leftovers.paths) < residualExamples {
+				leftovers.paths = append(leftovers.paths, path)
+			}
+		}
+	}
+	snapshots := &decommissionItem{label: "Snapshots that may pin it:", count: r.counts[RESIDUAL_SNAPSHOT], paths: r.examples[RESIDUAL_SNAPSHOT]}
+	snapshots.notes = describeSnapshots(snapshots.paths)
+
+	items := []*decommissionItem{
+		{label: "Files reporting the pool:", count: files},
+		{label: "Directories defaulting to it:", count: r.counts[RESIDUAL_DIRECTORY], paths: r.examples[RESIDUAL_DIRECTORY]},
+		snapshots,
+		leftovers,
+		{label: "Unreadable entries:", count: r.unreadable},
+	}
+
+	out, err := os.Create(reportPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(io.MultiWriter(out, os.Stdout))
+	host, _ := os.Hostname()
+	fmt.Fprintf(w, "\nDecommission readiness of pool %s\n", opts.srcPool)
+	fmt.Fprintf(w, "Root:         %s\n", cephRoot)
+	if opts.shard.enabled() {
+		fmt.Fprintf(w, "Shard:        %s (the files of other shards are not included)\n", opts.shard)
+	}
+	fmt.Fprintf(w, "Generated:    %s on %s\n", time.Now().Format(time.RFC3339), host)
+	fmt.Fprintf(w, "Last pass:    %d migrated, %d errors\n\n", stats.migrated, stats.errors)
+	open := 0
+	for i, item := range items {
+		mark := "x"
+		if item.count > 0 {
+			mark = " "
+			open++
+		}
+		fmt.Fprintf(w, "[%s] %-30s %d", mark, item.label, item.count)
+		if i == 0 && len(breakdown) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(breakdown, ", "))
+		}
+		fmt.Fprintln(w)
+		for _, path := range item.paths {
+			if note := item.notes[path]; note != "" {
+				fmt.Fprintf(w, "      %s: %s\n", path, note)
+			} else {
+				fmt.Fprintf(w, "      %s\n", path)
+			}
+		}
+		if more := item.count - len(item.paths); more > 0 && len(item.paths) > 0 {
+			fmt.Fprintf(w, "      ... and %d more%s\n", more, residualListHint(opts))
+		}
+	}
+	if open == 0 {
+		fmt.Fprintf(w, "\nREADY: nothing below %s refers to %s any longer.\n", cephRoot, opts.srcPool)
+	} else {
+		fmt.Fprintf(w, "\nNOT READY: %d of %d items to clear before %s can be removed.\n", open, len(items), opts.srcPool)
+	}
+	if err = w.Flush(); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	return err
+}
+
+// residualListHint points to the full lists when --residual-report is set.
+func residualListHint(opts *options) string {
+	if opts.residual == "" {
+		return ""
+	}
+	return " in " + opts.residual
+}
+
+// describeSnapshots returns when each snapshot was taken and, for those of a
+// snap-schedule, when its retention removes it at the latest.
+func describeSnapshots(paths []string) map[string]string {
+	notes := make(map[string]string, len(paths))
+	mounts, _ := cephMounts()
+	retention := make(map[string]map[string]int) // per snapshotted directory
+	for _, path := range paths {
+		dir := filepath.Dir(filepath.Dir(path)) // DIR/.snap/NAME
+		name := filepath.Base(path)
+		taken, scheduled := scheduledSnapshotTime(name)
+		if !scheduled {
+			if info, err := os.Stat(path); err == nil {
+				taken = info.ModTime()
+			}
+		}
+		note := "taken " + taken.Format("2006-01-02 15:04 MST")
+		if taken.IsZero() {
+			note = "time unknown"
+		}
+		if !scheduled {
+			notes[path] = note + ", no schedule: remove by hand"
+			continue
+		}
+		spec, ok := retention[dir]
+		if !ok {
+			spec = snapRetention(dir, mounts)
+			retention[dir] = spec
+		}
+		if expires, ok := retentionExpiry(taken, spec); ok {
+			notes[path] = fmt.Sprintf("%s, expires by %s (retention %s)", note, expires.Format("2006-01-02 15:04 MST"), formatRetention(spec))
+		} else if len(spec) > 0 {
+			notes[path] = fmt.Sprintf("%s, kept by count (retention %s)", note, formatRetention(spec))
+		} else {
+			notes[path] = note + ", expiry unknown"
+		}
+	}
+	return notes
+}
+
+// scheduledSnapshotTime parses the time from the name snap-schedule gives
+// its snapshots, e.g. scheduled-2024-05-01-12_00_00_UTC.
+func scheduledSnapshotTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, "scheduled-")
+	if !ok {
+		return time.Time{}, false
+	}
+	loc := time.Local
+	if s, ok := strings.CutSuffix(stamp, "_UTC"); ok {
+		stamp, loc = s, time.UTC
+	}
+	t, err := time.ParseInLocation("2006-01-02-15_04_05", stamp, loc)
+	return t, err == nil
+}
+
+// snapRetention asks the snap-schedule module for the retention of dir, a
+// local path mapped onto the filesystem through the CephFS mounts. It
+// returns nil when it cannot tell.
+func snapRetention(dir string, mounts []cephMount) map[string]int {
+	fsPath, fsName, ok := filesystemPath(dir, mounts)
+	if !ok {
+		return nil
+	}
+	args := []string{"fs", "snap-schedule", "status", fsPath, "--format=json"}
+	if fsName != "" {
+		args = append(args, "--fs", fsName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapScheduleTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ceph", args...).Output()
+	if err != nil {
+		return nil
+	}
+	var schedules []struct {
+		Retention map[string]int `json:"retention"`
+	}
+	if err := json.Unmarshal(out, &schedules); err != nil {
+		return nil
+	}
+	spec := make(map[string]int)
+	for _, s := range schedules {
+		for unit, count := range s.Retention {
+			spec[unit] = max(spec[unit], count)
+		}
+	}
+	return spec
+}
+
+// filesystemPath maps a local path onto the path inside the filesystem of
+// the CephFS mount holding it.
+func filesystemPath(path string, mounts []cephMount) (fsPath, fsName string, ok bool) {
+	best := -1
+	for i, mnt := range mounts {
+		rel, err := filepath.Rel(mnt.mountPoint, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if best < 0 || len(mnt.mountPoint) > len(mounts[best].mountPoint) {
+			best, fsPath = i, filepath.Join(mnt.fsPath, rel)
+		}
+	}
+	if best < 0 {
+		return "", "", false
+	}
+	return fsPath, mounts[best].fsName, true
+}
+
+// retentionExpiry is the latest time a snapshot taken at taken survives a
+// retention spec: each period keeps that many snapshots one period apart.
+// Specs that only keep a count ("n") give no date.
+func retentionExpiry(taken time.Time, spec map[string]int) (time.Time, bool) {
+	var keep time.Duration
+	for unit, count := range spec {
+		if d, ok := retentionUnits[unit]; ok {
+			keep = max(keep, time.Duration(count)*d)
+		}
+	}
+	if keep == 0 || taken.IsZero() {
+		return time.Time{}, false
+	}
+	return taken.Add(keep), true
+}
+
+func formatRetention(spec map[string]int) string {
+	var parts []string
+	for unit, count := range spec {
+		parts = append(parts, fmt.Sprintf("%d%s", count, unit))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "")
+}
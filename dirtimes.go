@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dirTimes remembers the original times of every directory a run creates or
+// renames files in, since each rename bumps the directory mtime and breaks
+// mtime-based sync and backup tools.
+type dirTimes struct {
+	times map[string][2]time.Time
+}
+
+func newDirTimes() *dirTimes {
+	return &dirTimes{times: make(map[string][2]time.Time)}
+}
+
+// remember records the times of the directory containing path, unless it
+// was already recorded during this run.
+func (d *dirTimes) remember(path string) {
+	dir := filepath.Dir(path)
+	if _, ok := d.times[dir]; ok {
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	d.times[dir] = [2]time.Time{fileAtime(info), info.ModTime()}
+}
+
+// restore puts back the recorded times and returns how many directories
+// were restored.
+func (d *dirTimes) restore() int {
+	restored := 0
+	for dir, ts := range d.times {
+		if err := os.Chtimes(dir, ts[0], ts[1]); err != nil {
+			logf(LOG_WARN, "Warning: failed to restore times of %s: %v\n", displayPath(dir), err)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// manifestEntry is a file a previous run migrated. sum is the checksum of
+// its content when the manifest is an audit log.
+type manifestEntry struct {
+	path string
+	sum  []byte
+}
+
+// loadManifestEntries returns the files a previous real run migrated, read
+// from its --state-db or --audit-log file, in the order they were recorded.
+func loadManifestEntries(path string) ([]manifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []manifestEntry
+	index := make(map[string]int) // position of each path in entries, -1 once dropped
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		e := manifestEntry{}
+		migrated := true
+		if strings.HasPrefix(line, "{") {
+			var rec auditRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			e.path = rec.Path
+			e.sum, _ = hex.DecodeString(rec.SHA256)
+		} else {
+			fields := strings.SplitN(line, "\t", 4)
+			if len(fields) != 4 {
+				continue
+			}
+			// Later state entries override earlier ones for the same path.
+			e.path, migrated = fields[3], fields[0] == STATE_MIGRATED
+		}
+
+		i, seen := index[e.path]
+		switch {
+		case seen && i >= 0 && migrated:
+			entries[i] = e
+		case seen && i >= 0:
+			entries[i].path = ""
+			index[e.path] = -1
+		case migrated:
+			index[e.path] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(entries, func(e manifestEntry) bool { return e.path == "" }), nil
+}
+
+// loadManifest returns the set of paths a previous real run migrated.
+func loadManifest(path string) (map[string]bool, error) {
+	entries, err := loadManifestEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	migrated := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		migrated[e.path] = true
+	}
+	return migrated, nil
+}
+
+// printDryRunDiff lists the files a dry run selected that the previous run
+// did not migrate (+) and those it migrated that the dry run left out (-).
+func printDryRunDiff(previous, selected map[string]bool) {
+	var added, dropped []string
+	for path := range selected {
+		if !previous[path] {
+			added = append(added, path)
+		}
+	}
+	for path := range previous {
+		if !selected[path] {
+			dropped = append(dropped, path)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(dropped)
+
+	logf(LOG_INFO, "\nDifference from the previous run:\n")
+	for _, path := range added {
+		logf(LOG_INFO, "+ %s\n", displayPath(path))
+	}
+	for _, path := range dropped {
+		logf(LOG_INFO, "- %s\n", displayPath(path))
+	}
+	logf(LOG_INFO, "Would migrate now, not migrated before: %d\nMigrated before, not selected now:      %d\n", len(added), len(dropped))
+}
@@ -0,0 +1,17 @@
+package main
+
+import "strings"
+
+// EMULATE_PREFIX is prepended to ceph.* keys by --emulate. Unprivileged
+// user.* attributes work on XFS, ext4 and NFSv4.2, so a staging copy of a
+// tree can rehearse a migration with the layout stored in user.ceph.*.
+const EMULATE_PREFIX = "user."
+
+// emulatedKey maps a CephFS virtual xattr onto the user.* key that stands in
+// for it under --emulate. Other keys are returned unchanged.
+func emulatedKey(key string) string {
+	if strings.HasPrefix(key, "ceph.") {
+		return EMULATE_PREFIX + key
+	}
+	return key
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// errorCode is a stable, machine-readable failure class. Codes appear in the
+// logs, the failed-file, the run history and drive the exit status; never
+// rename an existing code.
+type errorCode string
+
+const (
+	E_UNKNOWN       errorCode = "E_UNKNOWN"
+	E_STAT          errorCode = "E_STAT"
+	E_VANISHED      errorCode = "E_VANISHED"
+	E_XATTR_READ    errorCode = "E_XATTR_READ"
+	E_POOL_MISMATCH errorCode = "E_POOL_MISMATCH"
+	E_CREATE        errorCode = "E_CREATE"
+	E_XATTR_SET     errorCode = "E_XATTR_SET"
+	E_OPEN          errorCode = "E_OPEN"
+	E_COPY          errorCode = "E_COPY"
+	E_CHMOD         errorCode = "E_CHMOD"
+	E_CHOWN         errorCode = "E_CHOWN"
+	E_UTIMES        errorCode = "E_UTIMES"
+	E_ACL           errorCode = "E_ACL"
+	E_RENAME        errorCode = "E_RENAME"
+	E_TIMEOUT       errorCode = "E_TIMEOUT"
+	E_VERIFY        errorCode = "E_VERIFY"
+	E_POOL_DENIED   errorCode = "E_POOL_DENIED"
+	E_CONFLICT      errorCode = "E_CONFLICT"
+	E_BATCH         errorCode = "E_BATCH"
+	E_CHECKSUM      errorCode = "E_CHECKSUM"
+	E_NOSPC         errorCode = "E_NOSPC"
+	E_MODIFIED      errorCode = "E_MODIFIED"
+)
+
+// Process exit statuses.
+const (
+	EXIT_OK            = 0
+	EXIT_FATAL         = 1
+	EXIT_INCOMPLETE    = 2
+	EXIT_FILE_ERRORS   = 3
+	EXIT_VERIFY_FAILED = 4
+)
+
+type codedError struct {
+	code errorCode
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code errorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+func codeErrorf(code errorCode, format string, args ...any) error {
+	return &codedError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// errorCodeOf returns the outermost code attached to err.
+func errorCodeOf(err error) errorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return E_UNKNOWN
+}
+
+// sortedCodes returns the codes in counts ordered by descending count.
+func sortedCodes(counts map[errorCode]int) []errorCode {
+	codes := make([]errorCode, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	slices.SortFunc(codes, func(a, b errorCode) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		if a < b {
+			return -1
+		}
+		return 1
+	})
+	return codes
+}
+
+// exitStatus maps the outcome of a pass to the process exit status.
+func exitStatus(stats *runStats) int {
+	switch {
+	case stats.verifyFailed > 0:
+		return EXIT_VERIFY_FAILED
+	case stats.errors > 0:
+		return EXIT_FILE_ERRORS
+	case stats.deadlineHit, stats.parityMismatch:
+		return EXIT_INCOMPLETE
+	default:
+		return EXIT_OK
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// errorSampleLimit is how many occurrences of the same error are logged
+	// in full before further ones are only counted.
+	errorSampleLimit    = 3
+	errorReportInterval = time.Minute
+)
+
+type errorKey struct {
+	cause string
+	dir   string
+}
+
+// errorLog writes every failure in full to the failed-file output and
+// aggregates repeated errors on stderr, so thousands of identical failures
+// under one subtree collapse into a periodic counter line.
+type errorLog struct {
+	mu         sync.Mutex
+	failed     *bufio.Writer
+	failedFile *os.File
+	seen       map[errorKey]int
+	suppressed map[errorKey]int
+	lastReport time.Time
+	triage     *triage // nil unless --triage-report is set
+}
+
+// newErrorLog opens failedPath (if set) for the full failure details. When
+// appending is false the file is truncated first.
+func newErrorLog(failedPath string, appending bool) (*errorLog, error) {
+	l := &errorLog{seen: make(map[errorKey]int), suppressed: make(map[errorKey]int), lastReport: time.Now()}
+	if failedPath == "" {
+		return l, nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(failedPath, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.failedFile = file
+	l.failed = bufio.NewWriter(file)
+	return l, nil
+}
+
+// report records a failure of path. dir is the subtree used for aggregation;
+// loud controls whether the error may be printed to stderr at all.
+func (l *errorLog) report(path, dir, what string, err error, loud bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	code := errorCodeOf(err)
+	if l.failed != nil {
+		fmt.Fprintf(l.failed, "%s\t%s\t%s: %v\n", path, code, what, err)
+	}
+	if l.triage != nil {
+		l.triage.add(errorCause(code, err), path)
+	}
+
+	if loud {
+		key := errorKey{cause: errorCause(code, err), dir: dir}
+		l.seen[key]++
+		if l.seen[key] <= errorSampleLimit {
+			fmt.Fprintf(os.Stderr, "[%s] %s %s: %s\n", code, what, displayPath(path), displayErr(path, err))
+			if l.seen[key] == errorSampleLimit {
+				fmt.Fprintf(os.Stderr, "Further %q errors under %s will be aggregated\n", key.cause, dir)
+			}
+		} else {
+			l.suppressed[key]++
+		}
+	}
+
+	if time.Since(l.lastReport) >= errorReportInterval {
+		l.reportSuppressedLocked()
+	}
+}
+
+// flush prints any pending aggregate counts and flushes the failed-file.
+func (l *errorLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reportSuppressedLocked()
+	if l.failed != nil {
+		if err := l.failed.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing failed-file: %v\n", err)
+		}
+	}
+}
+
+// writeTriage saves the failures grouped by cause and subtree to path.
+func (l *errorLog) writeTriage(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.triage.write(path)
+}
+
+func (l *errorLog) close() {
+	l.flush()
+	if l.failedFile != nil {
+		l.failedFile.Close()
+	}
+}
+
+func (l *errorLog) reportSuppressedLocked() {
+	l.lastReport = time.Now()
+	if len(l.suppressed) == 0 {
+		return
+	}
+
+	keys := make([]errorKey, 0, len(l.suppressed))
+	for key := range l.suppressed {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b errorKey) int {
+		return l.suppressed[b] - l.suppressed[a]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(os.Stderr, "%d more %q errors under %s (%d total)\n", l.suppressed[key], key.cause, key.dir, l.seen[key])
+	}
+	clear(l.suppressed)
+}
+
+// errorCause reduces an error to a path-independent description used to
+// group identical failures: the error code plus the errno where there is one.
+func errorCause(code errorCode, err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return string(code) + ": " + errno.Error()
+	}
+
+	msg := err.Error()
+	if i := strings.Index(msg, ": "); i >= 0 {
+		msg = msg[:i]
+	}
+	return string(code) + ": " + msg
+}
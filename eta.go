@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// throttledTime is the least time files and bytes can take under the
+// --bwlimit and --files-per-sec caps, or estimate if that is longer.
+func throttledTime(estimate time.Duration, files int, bytes int64, opts *options) time.Duration {
+	if opts.bwlimit > 0 {
+		estimate = max(estimate, time.Duration(float64(bytes)/float64(opts.bwlimit)*float64(time.Second)))
+	}
+	if opts.filesPerSec > 0 {
+		estimate = max(estimate, time.Duration(float64(files)/opts.filesPerSec*float64(time.Second)))
+	}
+	return estimate
+}
+
+// eta estimates how long the pass still runs from the source entries the
+// scan reached so far. The rates are measured over the time the pass was
+// active, so time held back by client throttling is spread over the rest
+// of the run in the same proportion: the result tells elapsed from active
+// time once they differ. It returns "" until there is something to go by.
+func (m *migrator) eta(elapsed time.Duration) string {
+	opts, stats := m.opts, m.stats
+	m.mu.Lock()
+	done, migrated, bytes, paused := stats.srcEntries, stats.migrated, stats.bytesTotal, stats.paused
+	if opts.redrain {
+		done = stats.total
+	}
+	m.mu.Unlock()
+
+	remaining := opts.expectedFiles - done
+	active := elapsed - paused
+	if done == 0 || remaining <= 0 || active <= 0 {
+		return ""
+	}
+	var remainingBytes int64
+	if migrated > 0 {
+		remainingBytes = bytes / int64(migrated) * int64(remaining)
+	}
+	activeLeft := time.Duration(float64(active) / float64(done) * float64(remaining))
+	activeLeft = throttledTime(activeLeft, remaining, remainingBytes, opts)
+	elapsedLeft := time.Duration(float64(activeLeft) * float64(elapsed) / float64(active))
+
+	s := "ETA " + formatETA(elapsedLeft)
+	if elapsedLeft-activeLeft > time.Minute {
+		s += fmt.Sprintf(" elapsed, %s active", formatETA(activeLeft))
+	}
+	if !opts.deadline.IsZero() && time.Now().Add(elapsedLeft).After(opts.deadline) {
+		s += ", past the deadline"
+	}
+	return s
+}
+
+// formatETA rounds d to what matters at its scale: seconds under an hour,
+// minutes under a day, hours beyond.
+func formatETA(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		d = d.Round(time.Hour)
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		d = d.Round(time.Minute)
+		return fmt.Sprintf("%dh%02dm", d/time.Hour, d%time.Hour/time.Minute)
+	default:
+		return d.Round(time.Second).String()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// eventQueueSize bounds the events waiting for the consumer. A slow or dead
+// consumer must never stall the migration, so further events are dropped.
+const eventQueueSize = 4096
+
+// fileEvent describes what happened to one file.
+type fileEvent struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Event   string    `json:"event"` // migrated, failed or verify_failed
+	Path    string    `json:"path"`
+	Size    int64     `json:"size,omitempty"`
+	SrcPool string    `json:"src_pool"`
+	DstPool string    `json:"dst_pool"`
+	Code    errorCode `json:"code,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// eventStream pipes one JSON event per line into the stdin of a long-running
+// command, e.g. "kcat -P -b broker:9092 -t migxattrs" to publish to Kafka.
+type eventStream struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	events  chan *fileEvent
+	done    chan error
+	dropped atomic.Int64
+	host    string
+}
+
+func startEventStream(command string) (*eventStream, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &eventStream{cmd: cmd, stdin: stdin, events: make(chan *fileEvent, eventQueueSize), done: make(chan error, 1)}
+	s.host, _ = os.Hostname()
+	go s.run()
+	return s, nil
+}
+
+func (s *eventStream) run() {
+	w := bufio.NewWriter(s.stdin)
+	enc := json.NewEncoder(w)
+	var err error
+	for ev := range s.events {
+		if err != nil {
+			s.dropped.Add(1)
+			continue
+		}
+		err = enc.Encode(ev)
+		// Flush when the queue drains so consumers see events promptly.
+		if err == nil && len(s.events) == 0 {
+			err = w.Flush()
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	s.stdin.Close()
+	if waitErr := s.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	s.done <- err
+}
+
+// send queues ev, dropping it if the consumer has fallen behind.
+func (s *eventStream) send(ev *fileEvent) {
+	ev.Time, ev.Host = time.Now(), s.host
+	ev.Path = displayPath(ev.Path)
+	select {
+	case s.events <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close flushes the remaining events and waits for the command to exit.
+func (s *eventStream) close() {
+	close(s.events)
+	if err := <-s.done; err != nil {
+		logf(LOG_WARN, "Warning: event command failed: %v\n", err)
+	}
+	if n := s.dropped.Load(); n > 0 {
+		logf(LOG_WARN, "Warning: %d file events were dropped\n", n)
+	}
+}
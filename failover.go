@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// failoverCheckInterval is how often the failover guard samples the
+	// pipeline and probes the MDS.
+	failoverCheckInterval = 5 * time.Second
+	// failoverStallAfter is how long no file may complete before the MDS
+	// is probed for a failover.
+	failoverStallAfter = 30 * time.Second
+	// mdsProbeTimeout is how long a metadata lookup may take before the
+	// MDS counts as unresponsive.
+	mdsProbeTimeout = 5 * time.Second
+	// failoverMaxExcuses bounds how often a file timing out during a
+	// failover is retried without counting as a failure.
+	failoverMaxExcuses = 3
+)
+
+// mdsRecoveringState matches the states "ceph mds stat" reports for a rank
+// taken over by a standby MDS that is not serving requests yet.
+var mdsRecoveringState = regexp.MustCompile(`up:(replay|resolve|reconnect|rejoin|clientreplay)`)
+
+// failoverEpisode is a period during which the MDS appeared to fail over.
+type failoverEpisode struct {
+	start, end time.Time // end is zero while it lasts
+	gaveUp     bool      // waited longer than --mds-failover-wait
+}
+
+// failoverGuard pauses dispatching while the MDS appears to fail over
+// (--mds-failover-wait): no file completes, and a lookup in the root hangs
+// or "ceph mds stat" shows a rank recovering. Dispatching resumes once files
+// complete again, or after the wait, and files that timed out during the
+// failover are retried instead of failing.
+type failoverGuard struct {
+	m       *migrator
+	wait    time.Duration
+	probing atomic.Bool // a probe is outstanding
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	episodes []failoverEpisode
+	excused  map[string]int // timeouts forgiven per file
+}
+
+func newFailoverGuard(m *migrator, wait time.Duration) *failoverGuard {
+	g := &failoverGuard{m: m, wait: wait, excused: make(map[string]int)}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// current returns the episode in progress, or nil.
+func (g *failoverGuard) current() *failoverEpisode {
+	if n := len(g.episodes); n > 0 && g.episodes[n-1].end.IsZero() {
+		return &g.episodes[n-1]
+	}
+	return nil
+}
+
+// hold blocks while a failover is in progress. A nil guard never blocks.
+func (g *failoverGuard) hold() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	for g.current() != nil && !g.current().gaveUp {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+// excuse reports whether absPath, dispatched at started, timed out because
+// of a failover and may be retried once more.
+func (g *failoverGuard) excuse(absPath string, started time.Time) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.excused[absPath] >= failoverMaxExcuses {
+		return false
+	}
+	for _, e := range g.episodes {
+		if !e.gaveUp && (e.end.IsZero() || e.end.After(started)) {
+			g.excused[absPath]++
+			return true
+		}
+	}
+	return false
+}
+
+// run watches the pipeline until the returned function is called.
+func (g *failoverGuard) run(alerts *alertMonitor) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(failoverCheckInterval)
+		defer ticker.Stop()
+		last, since := g.progress(), time.Now()
+		for {
+			select {
+			case <-quit:
+				g.end("run finished")
+				return
+			case <-ticker.C:
+			}
+			if n := g.progress(); n != last {
+				last, since = n, time.Now()
+				g.end("files are completing again")
+				continue
+			}
+			g.mu.Lock()
+			e := g.current()
+			g.mu.Unlock()
+			// The pipeline drains while dispatch is held, so only an idle
+			// pipeline outside a failover says nothing.
+			if e == nil && !g.m.queueDepths().pending() {
+				since = time.Now()
+				continue
+			}
+			switch {
+			case e == nil && time.Since(since) >= failoverStallAfter:
+				if reason := g.probe(); reason != "" {
+					g.begin(alerts, time.Since(since), reason)
+				}
+			case e != nil && !e.gaveUp && time.Since(e.start) >= g.wait:
+				g.giveUp(alerts)
+			case e != nil && g.probe() == "":
+				g.end("the MDS answers again")
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// progress counts the files that left the pipeline other than by timing
+// out, which files hanging on the MDS do.
+func (g *failoverGuard) progress() int64 {
+	g.m.mu.Lock()
+	timedOut := g.m.stats.timedOut
+	g.m.mu.Unlock()
+	return g.m.completions() - int64(timedOut)
+}
+
+// probe returns why the MDS seems to be failing over, or "" if it answers.
+func (g *failoverGuard) probe() string {
+	ctx, cancel := context.WithTimeout(context.Background(), mdsProbeTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "ceph", "mds", "stat").Output(); err == nil {
+		if state := mdsRecoveringState.Find(out); state != nil {
+			return "an MDS rank is in " + string(state)
+		}
+	}
+
+	// A lookup of a name that does not exist cannot be answered from the
+	// client's cache for long. A probe that still hangs from the last
+	// check counts as unanswered.
+	if !g.probing.CompareAndSwap(false, true) {
+		return "metadata lookups hang"
+	}
+	answered := make(chan struct{})
+	go func() {
+		os.Lstat(filepath.Join(g.m.cephRoot, fmt.Sprintf(".migxattrs-probe-%d", rand.Int63())))
+		g.probing.Store(false)
+		close(answered)
+	}()
+	select {
+	case <-answered:
+		return ""
+	case <-time.After(mdsProbeTimeout):
+		return fmt.Sprintf("a metadata lookup took over %v", mdsProbeTimeout)
+	}
+}
+
+// begin starts an episode, pausing dispatch.
+func (g *failoverGuard) begin(alerts *alertMonitor, stalled time.Duration, reason string) {
+	g.mu.Lock()
+	g.episodes = append(g.episodes, failoverEpisode{start: time.Now()})
+	g.mu.Unlock()
+	g.m.mu.Lock()
+	g.m.stats.failovers++
+	g.m.mu.Unlock()
+	alerts.send("mds_failover", fmt.Sprintf("MDS failover suspected: no file completed for %v and %s; dispatch paused for up to %v",
+		stalled.Round(time.Second), reason, g.wait))
+}
+
+// giveUp resumes dispatch although the MDS did not recover within the wait.
+// Files timing out from now on count as failures again.
+func (g *failoverGuard) giveUp(alerts *alertMonitor) {
+	g.mu.Lock()
+	e := g.current()
+	e.gaveUp = true
+	g.cond.Broadcast()
+	g.mu.Unlock()
+	alerts.send("mds_failover", fmt.Sprintf("MDS still unresponsive after %v; resuming dispatch", g.wait))
+}
+
+// end closes the episode in progress, if any, and resumes dispatch.
+func (g *failoverGuard) end(why string) {
+	g.mu.Lock()
+	e := g.current()
+	if e == nil {
+		g.mu.Unlock()
+		return
+	}
+	e.end = time.Now()
+	paused := e.end.Sub(e.start)
+	g.cond.Broadcast()
+	g.mu.Unlock()
+
+	g.m.mu.Lock()
+	g.m.stats.paused += paused
+	g.m.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\nMDS failover over after %v (%s); dispatch resumed\n", paused.Round(time.Second), why)
+}
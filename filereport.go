@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var fileReportHeader = []string{"time", "path", "size", "old_pool", "new_pool", "outcome", "duration_ms", "error_code", "error"}
+
+// fileReport appends a row per file a pass migrated or failed, or selected
+// in a dry run, to a CSV file (--file-report), so a drain can be reconciled
+// file by file for audit and chargeback long after the run. Failed files
+// have no pools, only the error.
+type fileReport struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+}
+
+func openFileReport(path string) (*fileReport, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &fileReport{file: file, w: csv.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		r.w.Write(fileReportHeader)
+	}
+	return r, nil
+}
+
+// record writes the row of absPath. d is the time taken to copy it.
+func (r *fileReport) record(absPath string, size int64, oldPool, newPool, outcome string, d time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	var code, msg string
+	if err != nil {
+		code, msg = string(errorCodeOf(err)), displayErr(absPath, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write([]string{time.Now().UTC().Format(time.RFC3339), absPath, strconv.FormatInt(size, 10), oldPool, newPool,
+		outcome, strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64), code, msg})
+}
+
+func (r *fileReport) close() error {
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
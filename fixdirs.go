@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// DIR_LAYOUT_XATTR is the default layout a directory passes on to the files
+// created in it. Directories without one of their own report no value and
+// inherit the layout of their parent.
+const DIR_LAYOUT_XATTR = "ceph.dir.layout.pool"
+
+// dirLayoutKey is DIR_LAYOUT_XATTR as stored in the tree: its user.* stand-in
+// under --emulate.
+var dirLayoutKey = DIR_LAYOUT_XATTR
+
+// runFixDirsCommand implements "migxattrs fix-dirs": it rewrites the default
+// layout of every directory under the root that names the source pool,
+// so new files land in the destination pool. No file data is moved.
+func runFixDirsCommand(args []string) int {
+	flags := pflag.NewFlagSet("fix-dirs", pflag.ExitOnError)
+	maxDepth := flags.Int("max-depth", -1, "Descend at most this many levels below CEPH_ROOT_DIR (0 = the root only, -1 = no limit)")
+	excludes := flags.StringArray("exclude", nil, "Skip directories whose path relative to CEPH_ROOT_DIR matches this glob, and everything below them (repeatable)")
+	dryRun := flags.Bool("dry-run", false, "List the directories that would be rewritten without changing them")
+	report := flags.String("report", "", "Write the outcome for every directory with a layout of its own to this file")
+	xattr := addXattrFlags(flags, true)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs fix-dirs [--max-depth N] [--exclude GLOB]... [--dry-run] [--report FILE] [--match-value POOL] [--set-value POOL] CEPH_ROOT_DIR\n")
+		return 1
+	}
+	for _, pattern := range *excludes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --exclude pattern %q: %v\n", pattern, err)
+			return 1
+		}
+	}
+	if !flags.Changed("xattr-key") {
+		*xattr.key = DIR_LAYOUT_XATTR
+	}
+	if err := xattr.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	cephRoot := filepath.Clean(flags.Arg(0))
+
+	var w *bufio.Writer
+	if *report != "" {
+		out, err := os.Create(*report)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating report: %v\n", err)
+			return 1
+		}
+		defer out.Close()
+		w = bufio.NewWriter(out)
+		defer w.Flush()
+	}
+	record := func(status, path, detail string) {
+		if w != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status, path, detail)
+		}
+	}
+
+	fixer := &dirFixer{key: xattrKey, match: *xattr.match, set: *xattr.set, maxDepth: *maxDepth, excludes: *excludes, dryRun: *dryRun, report: record}
+	startTime := time.Now()
+	if err := fixer.walk(cephRoot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error walking %s: %v\n", displayPath(cephRoot), err)
+		return 1
+	}
+	fmt.Printf("Directories checked: %d in %v\n", fixer.scanned, time.Since(startTime).Round(time.Millisecond))
+	fmt.Printf("Inheriting layout:   %d\nIn another pool:     %d\nExcluded subtrees:   %d\n", fixer.inherited, fixer.otherPool, fixer.excluded)
+	if *dryRun {
+		fmt.Printf("Would rewrite:       %d\n", fixer.rewritten)
+	} else {
+		fmt.Printf("Rewritten:           %d\n", fixer.rewritten)
+	}
+	fmt.Printf("Failed:              %d\n", fixer.failed)
+	if *report != "" {
+		fmt.Printf("Report written to %s\n", *report)
+	}
+	if fixer.rewritten > 0 && !*dryRun {
+		fmt.Println("New files in these directories go to " + *xattr.set + "; existing files still need a migration.")
+	}
+	if fixer.failed > 0 {
+		return EXIT_FILE_ERRORS
+	}
+	return EXIT_OK
+}
+
+// dirFixer rewrites the default layout of the directories whose layout
+// names the match pool, for fix-dirs and for migrate --fix-dirs.
+type dirFixer struct {
+	key, match, set string
+	maxDepth        int      // levels below the root, -1 for no limit
+	excludes        []string // globs of subtrees to skip
+	dryRun          bool
+	since           time.Time // only check directories changed after this, zero for all
+	report          func(status, path, detail string)
+
+	scanned, inherited, excluded, rewritten, otherPool, failed int
+}
+
+// walk checks every directory under cephRoot and rewrites those to fix.
+func (f *dirFixer) walk(cephRoot string) error {
+	record := f.report
+	if record == nil {
+		record = func(status, path, detail string) {}
+	}
+	return filepath.WalkDir(cephRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d == nil || d.IsDir() {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", displayPath(path), displayErr(path, err))
+				record("unreadable", path, err.Error())
+				f.failed++
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(cephRoot, path)
+		if rel != "." {
+			for _, pattern := range f.excludes {
+				if ok, _ := filepath.Match(pattern, rel); ok {
+					f.excluded++
+					return filepath.SkipDir
+				}
+			}
+		}
+		depth := 0
+		if rel != "." {
+			depth = strings.Count(rel, string(filepath.Separator)) + 1
+		}
+		if f.maxDepth >= 0 && depth > f.maxDepth {
+			return filepath.SkipDir
+		}
+		// Creating a directory, or setting its layout, moves its ctime.
+		if !f.since.IsZero() {
+			if info, err := d.Info(); err == nil && !fileCtime(info).After(f.since) {
+				return nil
+			}
+		}
+
+		f.scanned++
+		mdsOps(1)
+		value, err := getXattrValue(path, f.key)
+		switch {
+		case err != nil && xattrMissing(err):
+			f.inherited++
+			return nil
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error reading layout of %s: %s\n", displayPath(path), displayErr(path, err))
+			record("failed", path, err.Error())
+			f.failed++
+			return nil
+		case string(value) != f.match:
+			f.otherPool++
+			record("other", path, string(value))
+			return nil
+		}
+
+		if f.dryRun {
+			fmt.Printf("[DRY RUN] Would rewrite: %s\n", displayPath(path))
+			record("would-rewrite", path, f.match)
+			f.rewritten++
+			return nil
+		}
+		mdsOps(1)
+		if err := sysSetxattr(path, f.key, []byte(f.set)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rewriting layout of %s: %s\n", displayPath(path), displayErr(path, err))
+			record("failed", path, err.Error())
+			f.failed++
+			return nil
+		}
+		record("rewritten", path, f.set)
+		f.rewritten++
+		return nil
+	})
+}
+
+// dirCtimeSlack widens the window of directories a later pass checks, so a
+// client clock running behind ours does not hide new directories.
+const dirCtimeSlack = time.Minute
+
+// fixDirLayouts rewrites the default layout of the directories still naming
+// the source pool before a migration pass (--fix-dirs). The first pass
+// checks every directory; later passes of --loop only those created or
+// changed since the previous one, so directories created meanwhile, or
+// moved in, do not keep sending new files to the source pool.
+func (m *migrator) fixDirLayouts() {
+	opts := m.opts
+	fixer := &dirFixer{key: dirLayoutKey, match: opts.srcPool, set: opts.dstPool, maxDepth: -1, dryRun: opts.dryRun, since: opts.dirsCheckedAt}
+	started := time.Now()
+	if err := fixer.walk(m.cephRoot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error walking %s for directory layouts: %v\n", displayPath(m.cephRoot), err)
+	} else {
+		opts.dirsCheckedAt = started.Add(-dirCtimeSlack)
+	}
+	m.stats.dirsRewritten, m.stats.dirsFailed = fixer.rewritten, fixer.failed
+	logf(LOG_INFO, "Directory layouts: %d checked, %d rewritten, %d failed in %v\n",
+		fixer.scanned, fixer.rewritten, fixer.failed, time.Since(started).Round(time.Millisecond))
+}
@@ -3,6 +3,12 @@ module migxattrs
 go 1.24.1
 
 require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/spf13/pflag v1.0.6
 	golang.org/x/sys v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.4.1
 )
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// runRecord is one line of the run history file.
+type runRecord struct {
+	ID           string            `json:"id"`
+	Host         string            `json:"host"`
+	Root         string            `json:"root"`
+	ScanFile     string            `json:"scan_file"`
+	SrcPool      string            `json:"src_pool"`
+	DstPool      string            `json:"dst_pool"`
+	Options      map[string]string `json:"options,omitempty"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Outcome      string            `json:"outcome"`
+	Lines        int               `json:"lines"`
+	Migrated     int               `json:"migrated"`
+	Bytes        int64             `json:"bytes"`
+	Errors       int               `json:"errors"`
+	TimedOut     int               `json:"timed_out,omitempty"`
+	Quiesced     int               `json:"quiesced,omitempty"`
+	Verified     int               `json:"verified,omitempty"`
+	VerifyFailed int               `json:"verify_failed,omitempty"`
+
+	Dirs       map[string]*dirCounts `json:"dirs,omitempty"`
+	ErrorCodes map[errorCode]int     `json:"error_codes,omitempty"`
+}
+
+func (r *runRecord) duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// defaultHistoryPath follows the XDG base directory spec for state files.
+func defaultHistoryPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "migxattrs", "history.jsonl")
+}
+
+// changedFlags returns the command-line flags the operator set explicitly.
+func changedFlags(fs *pflag.FlagSet) map[string]string {
+	flags := make(map[string]string)
+	fs.Visit(func(f *pflag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
+
+// recordRun appends a summary of a finished pass to the history file,
+// writes it to --summary-json and counts it for the end of run alert.
+func recordRun(cephRoot, scanPath string, opts *options, stats *runStats, started time.Time, outcome string) {
+	opts.notifier.pass(stats)
+	if opts.historyFile == "" && opts.summaryJSON == "" {
+		return
+	}
+
+	host, _ := os.Hostname()
+	rec := runRecord{
+		ID:           started.Format("20060102T150405") + fmt.Sprintf("-%d", os.Getpid()),
+		Host:         host,
+		Root:         cephRoot,
+		ScanFile:     scanPath,
+		SrcPool:      opts.srcPool,
+		DstPool:      opts.dstPool,
+		Options:      opts.flags,
+		Started:      started,
+		Finished:     time.Now(),
+		Outcome:      outcome,
+		Lines:        stats.lineCount,
+		Migrated:     stats.migrated,
+		Bytes:        stats.bytesTotal,
+		Errors:       stats.errors,
+		TimedOut:     stats.timedOut,
+		Quiesced:     stats.quiesced,
+		Verified:     stats.verified,
+		VerifyFailed: stats.verifyFailed,
+		Dirs:         stats.dirs,
+		ErrorCodes:   stats.errorCodes,
+	}
+
+	if opts.historyFile != "" {
+		if err := appendHistory(opts.historyFile, &rec); err != nil {
+			logf(LOG_WARN, "Warning: could not record run history: %v\n", err)
+		}
+	}
+	if opts.summaryJSON != "" {
+		if err := writeSummaryJSON(opts.summaryJSON, &rec, stats); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", opts.summaryJSON, err)
+		}
+	}
+}
+
+// runSummary is the --summary-json of a pass: its history record with what
+// a wrapper deciding whether to go on needs on top.
+type runSummary struct {
+	*runRecord
+	DurationSec float64 `json:"duration_sec"`
+	FailedPaths int     `json:"failed_paths"`
+	ExitStatus  int     `json:"exit_status"`
+	OK          bool    `json:"ok"`
+}
+
+// writeSummaryJSON replaces path atomically, so a wrapper polling it never
+// reads half a summary; with --loop and --watch it holds the last pass.
+func writeSummaryJSON(path string, rec *runRecord, stats *runStats) error {
+	status := exitStatus(stats)
+	data, err := json.MarshalIndent(runSummary{
+		runRecord:   rec,
+		DurationSec: rec.duration().Seconds(),
+		FailedPaths: len(stats.failed),
+		ExitStatus:  status,
+		OK:          status == EXIT_OK,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func appendHistory(path string, rec *runRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// dryRunBytes returns the bytes a dry run of the same scan file and shard
+// would have migrated, which sizes the progress bar of the run it was a
+// rehearsal for, or 0 if the latest record of the scan is not such a dry
+// run: a run since has moved part of the data.
+func dryRunBytes(historyPath, cephRoot, scanPath string, opts *options) int64 {
+	if historyPath == "" {
+		return 0
+	}
+	records, err := loadHistory(historyPath)
+	if err != nil {
+		return 0
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := &records[i]
+		if rec.Root != cephRoot || rec.ScanFile != scanPath || rec.SrcPool != opts.srcPool || rec.Options["shard"] != opts.flags["shard"] {
+			continue
+		}
+		if rec.Outcome != "dry-run" || rec.Options["sample"] != "" {
+			return 0
+		}
+		return rec.Bytes
+	}
+	return 0
+}
+
+func loadHistory(path string) ([]runRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []runRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec runRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// findRun returns the run whose ID equals or uniquely starts with id.
+func findRun(records []runRecord, id string) (*runRecord, error) {
+	var match *runRecord
+	for i := range records {
+		if records[i].ID == id {
+			return &records[i], nil
+		}
+		if strings.HasPrefix(records[i].ID, id) {
+			if match != nil {
+				return nil, fmt.Errorf("run ID %q is ambiguous", id)
+			}
+			match = &records[i]
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no run with ID %q", id)
+	}
+	return match, nil
+}
+
+// runHistoryCommand implements "migxattrs history".
+func runHistoryCommand(args []string) int {
+	fs := pflag.NewFlagSet("history", pflag.ExitOnError)
+	historyFile := fs.String("history-file", defaultHistoryPath(), "Run history file")
+	root := fs.String("root", "", "Only show runs against this CEPH_ROOT_DIR")
+	last := fs.Int("last", 0, "Only show the most recent N runs (0 = all)")
+	fs.Parse(args)
+
+	records, err := loadHistory(*historyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history: %v\n", err)
+		return 1
+	}
+
+	if *root != "" {
+		filtered := records[:0]
+		for _, rec := range records {
+			if rec.Root == *root {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+	if *last > 0 && len(records) > *last {
+		records = records[len(records)-*last:]
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No runs recorded.")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTARTED\tDURATION\tOUTCOME\tMIGRATED\tMB\tERRORS\tROOT")
+	var runs, totalFiles, totalErrors int
+	var totalBytes int64
+	var totalTime time.Duration
+	for _, rec := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%d\t%.2f\t%d\t%s\n",
+			rec.ID, rec.Started.Format("2006-01-02 15:04"), rec.duration().Round(time.Second), rec.Outcome,
+			rec.Migrated, float64(rec.Bytes)/(1024*1024), rec.Errors, rec.Root)
+		if rec.Outcome == "dry-run" {
+			continue
+		}
+		runs++
+		totalFiles += rec.Migrated
+		totalErrors += rec.Errors
+		totalBytes += rec.Bytes
+		totalTime += rec.duration()
+	}
+	tw.Flush()
+
+	fmt.Println("\nTotals (excluding dry runs):")
+	fmt.Printf("Runs:             %d\nFiles migrated:   %d\nBytes migrated:   %.2f MB\nErrors:           %d\nTime spent:       %v\n",
+		runs, totalFiles, float64(totalBytes)/(1024*1024), totalErrors, totalTime.Round(time.Second))
+	if totalTime > 0 {
+		fmt.Printf("Avg throughput:   %.2f MB/s, %.1f files/s\n",
+			float64(totalBytes)/(1024*1024)/totalTime.Seconds(), float64(totalFiles)/totalTime.Seconds())
+	}
+	return 0
+}
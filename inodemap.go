@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// inodeMap records the old and new inode number of every migrated file so
+// tools keyed on st_ino (backup catalogs, dedupe indexes) can be re-keyed.
+type inodeMap struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// openInodeMap creates path, or appends to it when appending is set (a
+// resumed run).
+func openInodeMap(path string, appending bool) (*inodeMap, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &inodeMap{file: file, w: bufio.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		fmt.Fprintln(m.w, "# dev\told_ino\tnew_ino\tpath")
+	}
+	return m, nil
+}
+
+// record writes the mapping for path, whose original was described by info.
+func (m *inodeMap) record(path string, info os.FileInfo) error {
+	dev, oldIno, ok := fileID(info)
+	if !ok {
+		return nil
+	}
+	current, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	_, newIno, _ := fileID(current)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = fmt.Fprintf(m.w, "%d\t%d\t%d\t%s\n", dev, oldIno, newIno, path)
+	return err
+}
+
+func (m *inodeMap) close() error {
+	if err := m.w.Flush(); err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
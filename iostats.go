@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ioStatsThreads is how many of the busiest threads the summary lists.
+const ioStatsThreads = 8
+
+// ioCounters is the kernel's I/O accounting from /proc/.../io. The char
+// counters include page cache hits; the bytes counters are what reached or
+// was fetched from storage.
+type ioCounters struct {
+	rchar, wchar          int64 // bytes passed to read and write syscalls
+	syscr, syscw          int64 // read and write syscalls
+	readBytes, writeBytes int64 // bytes fetched from or sent to storage
+	cancelledWriteBytes   int64 // dirty page cache dropped before writeback
+}
+
+func (c ioCounters) sub(o ioCounters) ioCounters {
+	return ioCounters{c.rchar - o.rchar, c.wchar - o.wchar, c.syscr - o.syscr, c.syscw - o.syscw,
+		c.readBytes - o.readBytes, c.writeBytes - o.writeBytes, c.cancelledWriteBytes - o.cancelledWriteBytes}
+}
+
+func readIOCounters(path string) (ioCounters, error) {
+	var c ioCounters
+	file, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer file.Close()
+
+	fields := map[string]*int64{"rchar": &c.rchar, "wchar": &c.wchar, "syscr": &c.syscr, "syscw": &c.syscw,
+		"read_bytes": &c.readBytes, "write_bytes": &c.writeBytes, "cancelled_write_bytes": &c.cancelledWriteBytes}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ": ")
+		if p := fields[name]; ok && p != nil {
+			*p, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return c, scanner.Err()
+}
+
+// ioSnapshot is the accounting of the process and of each of its threads.
+type ioSnapshot struct {
+	process ioCounters
+	threads map[int]ioCounters
+}
+
+// takeIOSnapshot reads /proc/self/io and /proc/self/task/*/io. It fails
+// where the kernel offers no I/O accounting.
+func takeIOSnapshot() (*ioSnapshot, error) {
+	process, err := readIOCounters("/proc/self/io")
+	if err != nil {
+		return nil, err
+	}
+	s := &ioSnapshot{process: process, threads: make(map[int]ioCounters)}
+	entries, _ := os.ReadDir("/proc/self/task")
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if c, err := readIOCounters(filepath.Join("/proc/self/task", entry.Name(), "io")); err == nil {
+			s.threads[tid] = c
+		}
+	}
+	return s, nil
+}
+
+// threadIO is the I/O one thread did during the run.
+type threadIO struct {
+	tid int
+	ioCounters
+}
+
+// ioReport is the I/O done between two snapshots.
+type ioReport struct {
+	process ioCounters
+	threads []threadIO // busiest first; threads that exited are missing
+}
+
+func newIOReport(start, end *ioSnapshot) *ioReport {
+	r := &ioReport{process: end.process.sub(start.process)}
+	for tid, c := range end.threads {
+		d := c.sub(start.threads[tid])
+		if d.syscr+d.syscw > 0 {
+			r.threads = append(r.threads, threadIO{tid, d})
+		}
+	}
+	slices.SortFunc(r.threads, func(a, b threadIO) int {
+		if a.rchar+a.wchar != b.rchar+b.wchar {
+			return int((b.rchar + b.wchar) - (a.rchar + a.wchar))
+		}
+		return a.tid - b.tid
+	})
+	return r
+}
+
+func (r *ioReport) print() {
+	p := r.process
+	fmt.Printf("Kernel I/O:       read %.2f MB in %d syscalls, wrote %.2f MB in %d syscalls\n", mb(p.rchar), p.syscr, mb(p.wchar), p.syscw)
+	fmt.Printf("Storage I/O:      read %.2f MB, wrote %.2f MB (%.2f MB of writes cancelled)\n", mb(p.readBytes), mb(p.writeBytes), mb(p.cancelledWriteBytes))
+	if len(r.threads) == 0 {
+		return
+	}
+	fmt.Println("Busiest threads:")
+	for _, t := range r.threads[:min(len(r.threads), ioStatsThreads)] {
+		fmt.Printf("  %-8d read %.2f MB / %d calls, wrote %.2f MB / %d calls\n", t.tid, mb(t.rchar), t.syscr, mb(t.wchar), t.syscw)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logIdentifier names the process in syslog and the journal.
+const logIdentifier = "migxattrs"
+
+// journaldSocket is where journald takes native protocol datagrams.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// logWriter takes the output of the process line by line, with whether it
+// was written to stderr.
+type logWriter interface {
+	line(text string, isErr bool) error
+	close() error
+}
+
+// LOG_DESTS are the destinations selectable with --log-dest NAME[:ARG].
+// "stderr" merges stdout into stderr; the others take both from the pipes
+// redirectOutput puts in their place, so every message of the run reaches
+// them without the code printing it knowing.
+var LOG_DESTS = map[string]func(arg string) (logWriter, error){
+	"stderr":   nil,
+	"file":     openFileLog,
+	"syslog":   openSyslog,
+	"journald": openJournald,
+}
+
+// startLogDest applies --log-dest and returns the function flushing the
+// output to it, to be called before exiting.
+func startLogDest(spec string) (func(), error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	open, ok := LOG_DESTS[name]
+	if !ok {
+		names := make([]string, 0, len(LOG_DESTS))
+		for n := range LOG_DESTS {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown log destination %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	if open == nil {
+		os.Stdout = os.Stderr
+		return func() {}, nil
+	}
+	dest, err := open(arg)
+	if err != nil {
+		return nil, err
+	}
+	return redirectOutput(dest)
+}
+
+// redirectOutput replaces os.Stdout and os.Stderr with pipes whose lines
+// are written to dest. The carriage returns of the progress line end lines
+// too, since a log has no cursor to go back with.
+func redirectOutput(dest logWriter) (func(), error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var writers []*os.File
+	reported := false // the first error only, not one per line
+	forward := func(f **os.File, isErr bool) error {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		*f = w
+		writers = append(writers, w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scanner := bufio.NewScanner(r)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			scanner.Split(scanLogLines)
+			for scanner.Scan() {
+				text := strings.TrimSpace(scanner.Text())
+				if text == "" {
+					continue
+				}
+				mu.Lock()
+				if err := dest.line(text, isErr); err != nil && !reported {
+					reported = true
+					fmt.Fprintf(os.NewFile(2, "stderr"), "Error writing log: %v\n", err)
+				}
+				mu.Unlock()
+			}
+			r.Close()
+		}()
+		return nil
+	}
+	if err := forward(&os.Stdout, false); err != nil {
+		return nil, err
+	}
+	if err := forward(&os.Stderr, true); err != nil {
+		return nil, err
+	}
+	return func() {
+		for _, w := range writers {
+			w.Close()
+		}
+		wg.Wait()
+		dest.close()
+	}, nil
+}
+
+// scanLogLines splits at newlines and carriage returns.
+func scanLogLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		if b == '\n' || b == '\r' {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// fileLog appends timestamped lines to a file (file:PATH).
+type fileLog struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func openFileLog(path string) (logWriter, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing path, e.g. file:/var/log/migxattrs.log")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLog{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (l *fileLog) line(text string, isErr bool) error {
+	level := "INFO "
+	if isErr {
+		level = "ERROR"
+	}
+	fmt.Fprintf(l.w, "%s %s %s\n", time.Now().Format(time.RFC3339), level, text)
+	// A run can sit between passes for hours; whatever it said so far must
+	// be in the file.
+	return l.w.Flush()
+}
+
+func (l *fileLog) close() error {
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// journaldLog sends each line as a journal entry over the native protocol,
+// with the priority of its stream.
+type journaldLog struct {
+	conn net.Conn
+}
+
+func openJournald(arg string) (logWriter, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldLog{conn: conn}, nil
+}
+
+func (j *journaldLog) line(text string, isErr bool) error {
+	priority := 6 // info
+	if isErr {
+		priority = 3 // err
+	}
+	_, err := fmt.Fprintf(j.conn, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\nMESSAGE=%s\n", priority, logIdentifier, text)
+	return err
+}
+
+func (j *journaldLog) close() error { return j.conn.Close() }
@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+package main
+
+import "log/syslog"
+
+// syslogLog sends each line to the local syslog daemon, stdout at info and
+// stderr at err priority, with the daemon facility.
+type syslogLog struct {
+	w *syslog.Writer
+}
+
+func openSyslog(arg string) (logWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLog{w: w}, nil
+}
+
+func (s *syslogLog) line(text string, isErr bool) error {
+	if isErr {
+		return s.w.Err(text)
+	}
+	return s.w.Info(text)
+}
+
+func (s *syslogLog) close() error { return s.w.Close() }
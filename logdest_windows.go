@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// Windows has no syslog daemon; its event log is not supported.
+func openSyslog(arg string) (logWriter, error) {
+	return nil, errors.ErrUnsupported
+}
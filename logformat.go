@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// LOG_FORMATS are the values of --log-format.
+var LOG_FORMATS = []string{"text", "json"}
+
+// jsonLog receives the records of --log-format json, nil in text mode.
+var jsonLog *jsonLogger
+
+// logRecord is one line of --log-format json. Event is file_start,
+// file_done, file_requeued, file_error, verify_failed or summary.
+type logRecord struct {
+	Time       time.Time    `json:"time"`
+	Host       string       `json:"host"`
+	Level      string       `json:"level"` // info, warn or error
+	Event      string       `json:"event"`
+	Path       string       `json:"path,omitempty"`
+	Size       int64        `json:"size,omitempty"`
+	DurationMs float64      `json:"duration_ms,omitempty"`
+	ErrorClass errorCode    `json:"error_class,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Message    string       `json:"message,omitempty"`
+	Summary    *agentReport `json:"summary,omitempty"`
+}
+
+// jsonLogger writes a JSON record per line to the real stdout. The
+// human-readable output moves to stderr so that stdout stays parseable as a
+// whole by Loki, Elastic and the like.
+type jsonLogger struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	host string
+}
+
+// startJSONLog switches the process to --log-format json.
+func startJSONLog() {
+	host, _ := os.Hostname()
+	jsonLog = &jsonLogger{enc: json.NewEncoder(os.Stdout), host: host}
+	os.Stdout = os.Stderr
+}
+
+func (l *jsonLogger) log(r *logRecord) {
+	if l == nil {
+		return
+	}
+	r.Time, r.Host = time.Now(), l.host
+	if r.Level == "" {
+		r.Level = "info"
+	}
+	if r.Event != "summary" && !logShown(r.Level) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(r)
+}
+
+// logFile records an event of absPath, with the error class of err if any.
+func (l *jsonLogger) logFile(event, level, absPath string, size int64, d time.Duration, message string, err error) {
+	if l == nil {
+		return
+	}
+	r := &logRecord{Level: level, Event: event, Path: displayPath(absPath), Size: size, Message: message}
+	if d > 0 {
+		r.DurationMs = float64(d.Microseconds()) / 1000
+	}
+	if err != nil {
+		r.ErrorClass, r.Error = errorCodeOf(err), displayErr(absPath, err)
+	}
+	l.log(r)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+const (
+	LOG_DEBUG = "debug"
+	LOG_INFO  = "info"
+	LOG_WARN  = "warn"
+	LOG_ERROR = "error"
+)
+
+// LOG_LEVELS are the values of --log-level, from the most said to the least:
+// debug shows every decision about every file, info the progress of the run
+// as well, warn only the warnings and errors, and error only the errors. The
+// summary of each pass is shown at every level.
+var LOG_LEVELS = []string{LOG_DEBUG, LOG_INFO, LOG_WARN, LOG_ERROR}
+
+// logThreshold is the --log-level of the run, below which logf and the
+// records of --log-format json are dropped. It is set at startup and may be
+// changed by a reload while workers log, hence atomic.
+var logThreshold atomic.Value // string
+
+// setLogLevel changes the --log-level of the run.
+func setLogLevel(level string) {
+	logThreshold.Store(level)
+}
+
+// logShown reports whether messages of level are shown at the current
+// --log-level, info until one is set.
+func logShown(level string) bool {
+	threshold, _ := logThreshold.Load().(string)
+	if threshold == "" {
+		threshold = LOG_INFO
+	}
+	return levelShown(level, threshold)
+}
+
+// levelShown reports whether messages of level are shown at the --log-level
+// threshold.
+func levelShown(level, threshold string) bool {
+	return slices.Index(LOG_LEVELS, level) >= slices.Index(LOG_LEVELS, threshold)
+}
+
+// logOutput is where logf writes messages of level: stdout for debug and
+// info, stderr for warn and error. It is looked up on every message so that
+// --log-format json and --log-dest, which move stdout at startup, apply.
+func logOutput(level string) *os.File {
+	if levelShown(level, LOG_WARN) {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// logf prints a message of level if --log-level shows it. The summary of a
+// pass, the questions to the operator and the errors that end the run are
+// printed directly, as they are shown at every level.
+func logf(level, format string, args ...any) {
+	if !logShown(level) {
+		return
+	}
+	fmt.Fprintf(logOutput(level), format, args...)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLevelShown(t *testing.T) {
+	tests := []struct {
+		level, threshold string
+		want             bool
+	}{
+		{level: LOG_DEBUG, threshold: LOG_DEBUG, want: true},
+		{level: LOG_DEBUG, threshold: LOG_INFO, want: false},
+		{level: LOG_INFO, threshold: LOG_DEBUG, want: true},
+		{level: LOG_INFO, threshold: LOG_INFO, want: true},
+		{level: LOG_INFO, threshold: LOG_WARN, want: false},
+		{level: LOG_WARN, threshold: LOG_INFO, want: true},
+		{level: LOG_WARN, threshold: LOG_WARN, want: true},
+		{level: LOG_WARN, threshold: LOG_ERROR, want: false},
+		{level: LOG_ERROR, threshold: LOG_ERROR, want: true},
+	}
+	for _, tt := range tests {
+		if got := levelShown(tt.level, tt.threshold); got != tt.want {
+			t.Errorf("levelShown(%q, %q) = %v, want %v", tt.level, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	tests := []struct {
+		level string
+		want  *os.File
+	}{
+		{level: LOG_DEBUG, want: os.Stdout},
+		{level: LOG_INFO, want: os.Stdout},
+		{level: LOG_WARN, want: os.Stderr},
+		{level: LOG_ERROR, want: os.Stderr},
+	}
+	for _, tt := range tests {
+		if got := logOutput(tt.level); got != tt.want {
+			t.Errorf("logOutput(%q) = %s, want %s", tt.level, got.Name(), tt.want.Name())
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	t.Cleanup(func() { setLogLevel(LOG_INFO) })
+	setLogLevel(LOG_DEBUG)
+	if !logShown(LOG_DEBUG) {
+		t.Errorf("debug not shown at --log-level debug")
+	}
+	setLogLevel(LOG_WARN)
+	if logShown(LOG_INFO) {
+		t.Errorf("info shown at --log-level warn")
+	}
+	if !logShown(LOG_ERROR) {
+		t.Errorf("error not shown at --log-level warn")
+	}
+}
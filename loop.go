@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type loopConfig struct {
+	interval      time.Duration
+	maxIterations int
+	notifyCmd     string
+}
+
+// runLoop repeats re-drain passes over the scan file until a full pass leaves
+// no files in the source pool or the iteration limit is reached. It returns
+// the process exit code.
+func runLoop(cephRoot, scanPath, checkpointPath string, opts *options, exclude map[string]bool, cfg loopConfig) int {
+	loopStart := time.Now()
+	status := "drained"
+	exitCode := EXIT_OK
+	iteration := 0
+	sampleRate := opts.sampleRate
+	var stats *runStats
+
+	for {
+		iteration++
+		logf(LOG_INFO, "\n=== Pass %d (started %s) ===\n", iteration, time.Now().Format(time.RFC3339))
+
+		startTime := time.Now()
+		var err error
+		stats, err = runMigration(context.Background(), cephRoot, scanPath, opts, exclude)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening scan file: %v\n", err)
+			status, exitCode = "failed", EXIT_FATAL
+			break
+		}
+		printSummary(stats, opts, time.Since(startTime))
+		cpErr := finishCheckpoint(checkpointPath, scanPath, stats, opts)
+		recordRun(cephRoot, scanPath, opts, stats, startTime, runOutcome(stats, opts))
+		opts.resume = nil
+		opts.sampleRate = sampleRate
+
+		if cpErr != nil {
+			fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", cpErr)
+			status, exitCode = "failed", EXIT_FATAL
+			break
+		}
+		if stats.deadlineHit {
+			status, exitCode = "deadline", EXIT_INCOMPLETE
+			break
+		}
+		// The files of the pass that were not migrated may still be in
+		// the source pool. Only a pass that looked at every entry can
+		// tell it is empty; what a sampled pass left out may not be.
+		left := stats.inSource
+		if !opts.dryRun {
+			left = max(left-stats.migrated, 0)
+		}
+		sampleDrained := false
+		if left == 0 && stats.errors == 0 {
+			if stats.sampledOut == 0 {
+				logf(LOG_INFO, "\nSource pool %s is empty after %d passes.\n", opts.srcPool, iteration)
+				break
+			}
+			sampleDrained = true
+		}
+		left += stats.errors + stats.sampledOut
+		if opts.dryRun {
+			logf(LOG_INFO, "\nDry run: stopping after a single pass.\n")
+			status = "dry-run"
+			break
+		}
+		if cfg.maxIterations > 0 && iteration >= cfg.maxIterations {
+			logf(LOG_INFO, "\nReached maximum of %d passes with %d files possibly still in the source pool.\n", cfg.maxIterations, left)
+			status, exitCode = "incomplete", EXIT_INCOMPLETE
+			break
+		}
+
+		if sampleDrained {
+			logf(LOG_INFO, "\nThe sample is drained; checking the %d entries it left out with a full pass.\n", stats.sampledOut)
+			opts.sampleRate = 1
+			continue
+		}
+
+		if !opts.deadline.IsZero() && time.Now().Add(cfg.interval).After(opts.deadline) {
+			logf(LOG_INFO, "\n%d files possibly still in the source pool; next pass would start after the run deadline.\n", left)
+			status, exitCode = "deadline", EXIT_INCOMPLETE
+			break
+		}
+
+		logf(LOG_INFO, "\n%d files possibly still in the source pool; next pass in %v\n", left, cfg.interval)
+		time.Sleep(cfg.interval)
+	}
+
+	logf(LOG_INFO, "Loop finished (%s) after %d passes in %v\n", status, iteration, time.Since(loopStart))
+	if stats != nil {
+		reportResidual(cephRoot, scanPath, opts.residual, opts, stats)
+	}
+	if cfg.notifyCmd != "" {
+		notifyLoopDone(cfg.notifyCmd, status, iteration, opts.srcPool)
+	}
+	return exitCode
+}
+
+// notifyLoopDone runs the operator's notification command, split into its
+// program and arguments without a shell, with the outcome exposed through
+// the environment.
+func notifyLoopDone(notifyCmd, status string, iterations int, srcPool string) {
+	args := strings.Fields(notifyCmd)
+	if len(args) == 0 {
+		return
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MIGXATTRS_STATUS="+status,
+		fmt.Sprintf("MIGXATTRS_ITERATIONS=%d", iterations),
+		"MIGXATTRS_SRC_POOL="+srcPool,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running notify command: %v\n", err)
+	}
+}
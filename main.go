@@ -2,15 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -18,273 +20,1191 @@ const (
 	SRC_POOL  = "cephfs.ibu.data_ec42"
 	DST_POOL  = "cephfs.ibu.data_ec82"
 	SCAN_FILE = "pool_scan.tab"
+
+	CHECKPOINT_FILE = "migxattrs.checkpoint"
+	LOCK_FILE       = "migxattrs.lock"
+
+	XATTR_INITIAL_BUFFER = 256
+	XATTR_READ_RETRIES   = 5
+	XATTR_SIZE_MAX       = 65536 // Linux limit on a single xattr value
 )
 
-func main() {
-	dryRun := pflag.Bool("dry-run", false, "Perform dry run without making changes")
-	verbose := pflag.Bool("verbose", false, "Show verbose output")
-	pflag.Parse()
+// ACL_XATTRS are ACL attributes set by NFS-Ganesha and Samba exports that must
+// survive the rewrite. A file whose ACLs cannot be copied is not migrated.
+var ACL_XATTRS = []string{"system.nfs4_acl", "security.NTACL"}
 
-	if len(pflag.Args()) != 1 {
-		fmt.Fprintf(os.Stderr, "Usage: migxattrs [-dry-run] [-verbose] CEPH_ROOT_DIR\n")
-		os.Exit(1)
-	}
+// xattrKey is the attribute being rewritten, XATTR_KEY unless --xattr-key
+// names another one. The source and destination pools of the options are
+// then the values to match and set.
+var xattrKey = XATTR_KEY
 
-	cephRoot := pflag.Arg(0)
-	scanPath := filepath.Join(cephRoot, SCAN_FILE)
+type options struct {
+	srcPool string
+	dstPool string
 
-	fmt.Printf("Starting migration from %s to %s\nUsing scan file: %s\n", SRC_POOL, DST_POOL, scanPath)
-	if *dryRun {
-		fmt.Println("DRY RUN MODE - No changes will be made")
-	}
+	dryRun      bool
+	rehearse    bool // with dryRun, create and remove each temp file without copying
+	sampleRate  float64
+	redrain     bool
+	fileTimeout time.Duration
+	deadline    time.Time
+	logLevel    string // --log-level, applied with setLogLevel
+	resume      *checkpoint
 
-	poolStats, err := analyzePoolScan(scanPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error analyzing scan file: %v\n", err)
-		os.Exit(1)
+	checkpointPath     string
+	checkpointInterval time.Duration // 0 to checkpoint only at the deadline
+
+	verify        bool
+	verifyWorkers int
+	verifyQueue   int
+
+	historyFile string
+	summaryJSON string // statistics of the last pass for orchestration tooling
+	flags       map[string]string
+
+	alerts   alertConfig
+	notifier *runNotifier // nil without --alert-on-finish
+
+	failedFile   string
+	triageReport string // failures grouped by cause and subtree
+
+	clientStats      bool
+	clientAsok       string
+	clientMaxDirty   int64
+	clientMaxLatency time.Duration
+
+	agent     bool // report progress to a remote coordinator on stdout
+	progress  []progressSink
+	assumeYes bool // skip the confirmation prompt
+
+	tempName string // --temp-name template for the copy of each file
+
+	preserveDirTimes bool
+	quiesceWindow    time.Duration // skip files modified more recently than this
+	growthCheck      time.Duration // interval between the two stats of a growth check
+	retryGrowing     bool
+
+	started         time.Time // process start, which --max-duration counts from
+	eventsCmd       string    // command receiving a JSON event per file on stdin
+	inodeMap        string    // old to new inode number report
+	stateDB         string    // per-file outcomes kept across runs
+	btimeReport     string    // files whose birth time changed
+	diffAgainst     string    // manifest of a previous run to compare a dry run with
+	ioStats         bool      // report the kernel's I/O accounting
+	checksumDB      string    // CSV of the checksums of migrated files
+	fileReport      string    // CSV row per migrated or failed file
+	scan            bool      // build the scan file by walking the tree
+	dirBatch        int       // files per directory batch, 0 to migrate one by one
+	order           string    // --order of the work list, "scan" to keep it
+	shard           shardSpec // the scan entries of this host, all if zero
+	milestones      []string  // subtrees whose completion is announced
+	residual        string    // report of what is left in the source pool
+	decommission    string    // readiness report for removing the source pool
+	workers         int       // files migrated concurrently
+	adaptiveWorkers int       // upper bound of the tuned worker count, 0 for a fixed count
+	prefetch        int       // metadata lookups run ahead of the workers
+	bwlimit         int64     // bytes written per second, 0 for no cap
+	expectedFiles   int       // source entries the analyze phase found, for the ETA
+	expectedBytes   int64     // bytes the last dry run would have migrated, for the progress bar
+	filesPerSec     float64   // files started per second, 0 for no limit
+	mdsOpsPerSec    float64   // metadata operations per second, 0 for no limit
+
+	configPath  string          // --config file, re-read on SIGHUP
+	commandLine map[string]bool // flags given on the command line, which a reload leaves alone
+
+	stallTimeout  time.Duration // report a stall when no file completes for this long
+	failoverWait  time.Duration // pause dispatch up to this long during an MDS failover
+	fixDirs       bool          // rewrite directory layouts naming the source pool before each pass
+	dirsCheckedAt time.Time     // directories unchanged since are not checked again
+
+	placement placeMode
+	swapGrace time.Duration // how long --swap keeps original inodes
+
+	allowedPools map[string]bool // nil allows every pool
+
+	onMismatch        mismatchPolicy  // files found in an unexpected pool
+	extraSources      map[string]bool // pools migrated as well as srcPool
+	extraDestinations map[string]bool // pools counted as migrated with MISMATCH_MIGRATED
+
+	auditLog string // hash-chained record of every rewritten file
+	auditKey []byte // HMAC key for auditLog, nil for plain SHA-256
+
+	fileResults func(*fileEvent) // receives every per-file event in --coordinator worker mode
+}
+
+type runStats struct {
+	lineCount     int
+	total         int
+	migrated      int
+	errors        int
+	sampledOut    int
+	otherShards   int // scan entries left to the other --shard hosts
+	notInSource   int
+	inSource      int
+	timedOut      int
+	writtenTo     int           // copies aborted by --watch-writes
+	quiesced      int           // skipped because still being written
+	growing       int           // skipped because still being appended to
+	paused        time.Duration // dispatch held back by throttling, an MDS failover or SIGUSR1
+	failovers     int           // suspected MDS failovers
+	dirsRewritten int           // directory layouts rewritten by --fix-dirs
+	dirsFailed    int
+	workers       string // how --adaptive-workers tuned the pool
+	srcEntries    int    // scan entries listed in the source pool
+	excluded      int    // source entries skipped as canary files
+	alreadyDone   int    // source entries an earlier run recorded as migrated
+	mismatched    int    // source entries found in another pool and skipped
+	inDest        int    // source entries found already in a destination pool
+	notRegular    int    // source entries that are not regular files
+	requeued      []string
+	failed        map[string]bool    // paths that ended in an error
+	linked        map[[2]uint64]bool // device and inode of migrated files that had other links
+	selected      map[string]bool    // files a dry run would migrate, kept for --diff-against
+	io            *ioReport          // kernel I/O accounting, with --io-stats
+	queuePeak     queueDepths        // deepest each pipeline stage got
+	stalls        int                // times no file completed for --stall-timeout
+	bytesTotal    int64
+	deadlineHit   bool
+	stoppedAt     int // scan lines consumed when the run deadline was hit
+
+	parityMismatch bool // outcomes disagree with the analyze phase
+
+	verified     int
+	verifyFailed int
+
+	dirs       map[string]*dirCounts // keyed by top-level directory below the root
+	errorCodes map[errorCode]int
+}
+
+type dirCounts struct {
+	Migrated int   `json:"migrated"`
+	Bytes    int64 `json:"bytes"`
+	Errors   int   `json:"errors"`
+}
+
+func (s *runStats) dir(name string) *dirCounts {
+	if s.dirs == nil {
+		s.dirs = make(map[string]*dirCounts)
+	}
+	d, ok := s.dirs[name]
+	if !ok {
+		d = &dirCounts{}
+		s.dirs[name] = d
 	}
+	return d
+}
 
-	fmt.Println("\nSanity check - Pool distribution:")
-	for pool, count := range poolStats {
-		if pool == SRC_POOL {
-			fmt.Printf("Files in %s (source): %d\n", pool, count)
-		} else if pool == DST_POOL {
-			fmt.Printf("Files in %s (destination): %d\n", pool, count)
-		} else {
-			fmt.Printf("Files in %s: %d\n", pool, count)
+func main() {
+	if len(os.Args) > 1 {
+		if os.Args[1] == "help" {
+			printCommands()
+			os.Exit(0)
+		}
+		if cmd, ok := lookupCommand(os.Args[1]); ok {
+			os.Exit(cmd.run(os.Args[2:]))
 		}
 	}
+	os.Exit(runMigrateCommand(os.Args[1:]))
+}
 
-	if poolStats[SRC_POOL] == 0 {
-		fmt.Println("\nNo files found in source pool. Nothing to migrate.")
-		os.Exit(0)
-	}
+// runMigrateCommand implements "migxattrs migrate", which is also what runs
+// when no subcommand is given.
+func runMigrateCommand(args []string) (status int) {
 
-	fmt.Printf("\nProceeding with migration of %d files\n", poolStats[SRC_POOL])
+	dryRun := pflag.Bool("dry-run", false, "Perform dry run without making changes")
+	rehearse := pflag.Bool("rehearse", false, "Rehearse the metadata path: create each temp file with the destination layout, restore ownership, permissions, ACLs and times, then delete it, without copying data, renaming or throttling")
+	verbose := pflag.Bool("verbose", false, "Show every decision per file, as --log-level debug")
+	quiet := pflag.Bool("quiet", false, "Show only the summary and the errors, as --log-level error, for cron runs")
+	logLevel := pflag.String("log-level", "info", "Show messages of this level and above: debug, info, warn or error; the summary is always shown")
+	sample := pflag.String("sample", "", "Migrate only a random subset of eligible files (e.g. 1% or 0.01)")
+	canaryFile := pflag.String("canary", "", "File listing paths (relative to CEPH_ROOT_DIR) to migrate and verify before the bulk run")
+	canaryMaxFailures := pflag.Int("canary-max-failures", 0, "Maximum canary verification failures tolerated before aborting the bulk run")
+	redrain := pflag.Bool("redrain", false, "Re-check the live pool xattr of every scan entry and migrate only files still in the source pool")
+	loop := pflag.Bool("loop", false, "Repeat re-drain passes until no files remain in the source pool")
+	interval := pflag.Duration("interval", time.Hour, "Delay between passes in --loop or --watch mode")
+	watch := pflag.Bool("watch", false, "Keep running after the first pass, migrating the files that land in the source pool: rescan CEPH_ROOT_DIR every --interval, or take the paths written to --watch-feed")
+	watchFeed := pflag.String("watch-feed", "", "File or FIFO that new or changed paths (absolute or relative to CEPH_ROOT_DIR) are written to, one per line, migrated every --interval instead of rescanning")
+	maxIterations := pflag.Int("max-iterations", 0, "Maximum number of passes in --loop mode (0 = unlimited)")
+	notifyCmd := pflag.String("notify-cmd", "", "Command to run when --loop mode finishes, with its arguments separated by spaces and the outcome in $MIGXATTRS_STATUS, $MIGXATTRS_ITERATIONS and $MIGXATTRS_SRC_POOL")
+	fileTimeout := pflag.Duration("file-timeout", 0, "Abandon and requeue a file whose migration takes longer than this (0 = no timeout)")
+	maxDuration := pflag.Duration("max-duration", 0, "Checkpoint and exit cleanly after this much wall-clock time (0 = unlimited)")
+	resume := pflag.Bool("resume", false, "Continue from the checkpoint left by an interrupted or --max-duration run")
+	checkpointInterval := pflag.Duration("checkpoint-interval", 5*time.Minute, "How often to save the scan position and in-flight files for --resume (0 = only at the run deadline)")
+	cgroupPath := pflag.String("cgroup", "", "Join this cgroup v2 group (relative to /sys/fs/cgroup), creating it if needed")
+	cpuMax := pflag.Float64("cpu-max", 0, "Limit the cgroup to this many CPUs (writes cpu.max)")
+	memoryMax := pflag.String("memory-max", "", "Limit the cgroup memory (e.g. 4G, writes memory.max)")
+	ioMax := pflag.StringArray("io-max", nil, "io.max throttle line for the cgroup (e.g. \"253:0 wbps=104857600\"), repeatable")
+	verify := pflag.Bool("verify", false, "Verify each migrated file's checksum and pool xattr in a background worker pool")
+	verifyWorkers := pflag.Int("verify-workers", 2, "Number of verification workers")
+	verifyQueue := pflag.Int("verify-queue", 64, "Maximum number of migrated files waiting for verification before copies block")
+	nice := pflag.Int("nice", 0, "CPU scheduling niceness applied to all threads (-20..19)")
+	ioniceClass := pflag.String("ionice-class", "", "I/O scheduling class: idle, best-effort or realtime")
+	ioniceLevel := pflag.Int("ionice-level", 4, "I/O priority level within the class (0 = highest, 7 = lowest)")
+	alertErrorRate := pflag.Float64("alert-error-rate", 0, "Alert when the error rate exceeds this percentage (0 = disabled)")
+	alertMinThroughput := pflag.Float64("alert-min-throughput", 0, "Alert when throughput stays below this many MB/s (0 = disabled)")
+	alertThroughputWindow := pflag.Duration("alert-throughput-window", 10*time.Minute, "How long throughput must stay low before alerting")
+	alertMinFree := pflag.String("alert-min-free", "", "Alert when free space on CEPH_ROOT_DIR drops below this size (e.g. 50T)")
+	alertWebhooks := pflag.StringArray("alert-webhook", nil, "POST alerts as JSON to this URL, repeatable")
+	alertEmails := pflag.StringArray("alert-email", nil, "Mail alerts to this address via sendmail, repeatable")
+	summaryEmails := pflag.StringArray("summary-email", nil, "Mail the summary of the run, with the failed files attached, to this address over SMTP when it ends, repeatable")
+	smtpServer := pflag.String("smtp-server", "localhost:25", "SMTP relay (HOST:PORT) for --summary-email")
+	smtpFrom := pflag.String("smtp-from", "", "Sender of --summary-email (default: migxattrs@HOSTNAME)")
+	smtpUser := pflag.String("smtp-user", "", "Authenticate to --smtp-server as this user, with the password in $"+SMTP_PASSWORD_ENV)
+	alertOnFinish := pflag.Bool("alert-on-finish", false, "Also send the outcome of the run with its totals to the alert webhooks and emails when it completes, stops early or aborts")
+	clientStats := pflag.Bool("client-stats", false, "Sample Ceph client statistics (debugfs or ceph-fuse admin socket) and show them with progress")
+	clientAsok := pflag.String("client-asok", "", "ceph-fuse admin socket to sample (default: auto-detect)")
+	clientMaxDirty := pflag.String("client-max-dirty", "", "Pause dispatch while the client holds more dirty data than this (e.g. 2G)")
+	clientMaxLatency := pflag.Duration("client-max-latency", 0, "Pause dispatch while client write or metadata latency exceeds this")
+	onMismatch := pflag.String("on-mismatch", "error", "What to do with a file no longer in the source pool: error, skip, or migrated (count files in a destination pool as done, fail others)")
+	alsoSource := pflag.StringSlice("also-source", nil, "Comma-separated pools whose files are migrated as well when found in them, e.g. left there by an earlier partial migration")
+	alsoDestination := pflag.StringSlice("also-destination", nil, "Comma-separated pools that count as migrated with --on-mismatch migrated, besides the destination pool")
+	allowedPools := pflag.StringSlice("allowed-pools", nil, "Refuse to read from or write to any pool not in this comma-separated list")
+	checksumFlag := pflag.String("checksum", "", "Re-read every copy before it replaces the original and compare it with the source using xxhash, sha256 or blake3; --verify and --dir-batch use the same algorithm")
+	fileReport := pflag.String("file-report", "", "Append a CSV row per migrated or failed file (path, size, old and new pool, outcome, copy duration, error) to this file")
+	checksumDBFile := pflag.String("checksum-db", "", "Append the path, size, mtime and checksum of every migrated file to this CSV file (see \"migxattrs audit --checksum-db\")")
+	auditLog := pflag.String("audit-log", "", "Append a hash-chained JSONL record of every rewritten file (see \"migxattrs audit\")")
+	auditKeyFile := pflag.String("audit-key-file", "", "Sign --audit-log records with the HMAC key in this file")
+	tempName := pflag.String("temp-name", "visible", "Temp file naming: visible (NAME.mig), hidden (.NAME.mig), staging (.migxattrs-staging/NAME) or a template using {dir}, {name} and {ino}")
+	preserveDirTimes := pflag.Bool("preserve-dir-times", false, "Restore the original mtime of every directory touched by the run when it ends")
+	swap := pflag.Bool("swap", false, "Swap each copy in atomically with RENAME_EXCHANGE, keeping the original next to the temp name (TEMP.orig-INODE) for rollback")
+	swapGrace := pflag.Duration("swap-grace", 24*time.Hour, "How long --swap keeps originals before the end-of-run cleanup removes them")
+	noReplace := pflag.Bool("no-replace", false, "Place copies with RENAME_EXCHANGE and check the original was what they replaced, reporting E_CONFLICT instead of clobbering a path replaced after the copy")
+	quiesceWindow := pflag.Duration("quiesce-window", 0, "Requeue files modified within this window and skip them if still active on retry (0 = disabled)")
+	eventsCmd := pflag.String("events-cmd", "", "Pipe a JSON event per migrated or failed file to this command (e.g. \"kcat -P -b BROKER -t TOPIC\")")
+	inodeMapFile := pflag.String("inode-map", "", "Write the old and new inode number of every migrated file to this file")
+	btimeReport := pflag.String("btime-report", "", "Keep each file's original birth time in the "+BTIME_XATTR+" xattr and list files whose birth time changed in this file")
+	stateDBFile := pflag.String("state-db", "", "Record every file's outcome in this file and skip files it lists as migrated on later runs")
+	workers := pflag.Int("workers", 1, "Number of files migrated concurrently")
+	adaptiveWorkers := pflag.Int("adaptive-workers", 0, "Tune the worker count between 1 and this many, starting at --workers: add a worker while stat and copy latencies stay low, halve them when latencies spike (0 = fixed --workers)")
+	prefetch := pflag.Int("prefetch", 0, "Look up the pool xattr and stat of up to N upcoming files concurrently while files are copied (0 = off)")
+	order := pflag.String("order", "scan", "Order of the work list: scan (as listed), smallest-first (fast visible progress), largest-first or directory (files of a directory together, sparing the MDS on huge trees); the sizes cost a stat per file up front")
+	dirBatch := pflag.Int("dir-batch", 0, "Migrate consecutive files of a directory in batches of up to N: copy all, verify all, then rename all (0 = off)")
+	preallocateFlag := pflag.Bool("preallocate", true, "Reserve the full size of each copy with fallocate before copying, failing with E_NOSPC at once when the pool is full")
+	sparse := pflag.Bool("sparse", true, "Keep the holes of sparse files, found with SEEK_DATA/SEEK_HOLE, instead of writing them out as zeros")
+	bwlimit := pflag.String("bwlimit", "", "Cap the data this process writes per second (e.g. 200M), shared by all workers; re-read from --config on SIGHUP")
+	filesPerSec := pflag.Float64("files-per-sec", 0, "Start at most this many file migrations per second, shared by all workers, to spare the MDS on trees of small files (0 = no limit); re-read from --config on SIGHUP")
+	mdsOpsPerSec := pflag.Float64("mds-ops-per-sec", 0, "Cap the metadata operations (stat, getxattr, setxattr, open, chmod, chown, utimes, rename) sent to the MDS per second, shared by all workers and verifiers (0 = no limit); re-read from --config on SIGHUP")
+	bufferSize := pflag.String("buffer-size", "4M", "Buffer of copies made through user space (buffered, multi-stream and direct engines, sparse files), e.g. 4M to 64M to match the pool's stripe")
+	directIO := pflag.Bool("direct-io", false, "Copy with O_DIRECT and aligned buffers so migration traffic bypasses the client cache (same as --copy-engine direct)")
+	copyEngineName := pflag.String("copy-engine", defaultCopyEngine, "How file data is copied: buffered, copy_file_range, sendfile, splice, direct or multi-stream (copy_file_range falls back to sendfile, then buffered; kernel-side engines use buffered when checksums are needed)")
+	copyCmd := pflag.String("copy-cmd", "", "Copy each file's data with this shell command instead, given the source and temp file as $1 and $2 (e.g. 'rsync --inplace \"$1\" \"$2\"'); xattrs, metadata, rename and verification stay with migxattrs")
+	noCacheFlag := pflag.Bool("no-cache", false, "Read sources with sequential read-ahead and drop the cached pages of every file once copied (posix_fadvise), sparing the rest of the page cache")
+	maxCache := pflag.String("max-cache", "", "Cap the dirty page cache built up by the migration (e.g. 1G) by syncing once it is exceeded")
+	growthCheck := pflag.Duration("growth-check", 0, "Stat recently modified files twice this far apart and skip those still growing (0 = off)")
+	watchWritesFlag := pflag.Bool("watch-writes", false, "Watch each source with inotify from its copy until its rename and abort and requeue the copy on a write; only sees writes made through this host")
+	retryGrowing := pflag.Bool("retry-growing", false, "Retry files skipped by --growth-check once at the end of the run")
+	milestonesFile := pflag.String("milestones", "", "File listing subtrees (relative to CEPH_ROOT_DIR) to announce through the alert sinks once fully processed")
+	residualReport := pflag.String("residual-report", "", "After the run, sweep CEPH_ROOT_DIR for files and snapshots still in the source pool, write them to this file and print a checklist")
+	decommissionReport := pflag.String("decommission-report", "", "After the run, sweep CEPH_ROOT_DIR and write whether the source pool can be removed to this file: files and directory layouts still naming it, snapshots that may pin it with their snap-schedule expiry, failed and skipped leftovers")
+	failedFile := pflag.String("failed-file", "", "Write every failed path with its full error to this file")
+	triageReport := pflag.String("triage-report", "", "Write failures grouped by error cause and subtree, with counts and example paths, to this file")
+	summaryJSON := pflag.String("summary-json", "", "Write the statistics of the run (counts, bytes, duration, error codes, failed paths, exit status) to this JSON file when it finishes, after every pass with --loop or --watch")
+	historyFile := pflag.String("history-file", defaultHistoryPath(), "File recording a summary of every run (see \"migxattrs history\")")
+	noHistory := pflag.Bool("no-history", false, "Do not record this run in the history file")
+	redactPaths := pflag.Bool("redact-paths", false, "Replace file paths with salted hashes in logs, statistics and alerts (the failed-file and audit log keep full paths)")
+	redactSalt := pflag.String("redact-salt", "", "Salt for --redact-paths hashes, to correlate them across runs (default: random per run)")
+	chaosSpec := pflag.String("chaos", "", "Inject failures for resilience testing (e.g. copy=0.01,rename=0.01,latency=50ms)")
+	pflag.CommandLine.MarkHidden("chaos")
+	subvolume := pflag.String("subvolume", "", "Target the CephFS subvolume GROUP/NAME; CEPH_ROOT_DIR then optionally names the mount to use")
+	fsName := pflag.String("fs-name", "cephfs", "CephFS volume name used to resolve --subvolume")
+	shard := pflag.String("shard", "", "Work only on the scan entries whose path hashes to INDEX of COUNT (INDEX/COUNT, INDEX from 0), to run the same scan file on COUNT hosts at once, one shard each")
+	scan := pflag.Bool("scan", false, "Walk CEPH_ROOT_DIR and write the scan file before migrating instead of relying on an existing one")
+	scanFile := pflag.String("scan-file", "", "Scan file to use instead of CEPH_ROOT_DIR/"+SCAN_FILE)
+	progressSpecs := pflag.StringArray("progress", nil, "Where progress goes, repeatable: terminal (the default), jsonl:PATH[,INTERVAL] appending a JSON line per update, fd:N[,INTERVAL] writing the same lines to file descriptor N, status:PATH[,INTERVAL] keeping the latest as a JSON file, http:ADDR serving a dashboard and /progress.json, metrics:ADDR serving Prometheus metrics at /metrics")
+	logDest := pflag.String("log-dest", "", "Send all output to stderr, file:PATH, syslog or journald instead of the terminal, for runs started from systemd units or left unattended")
+	logFormat := pflag.String("log-format", "text", "Output format: text, or json for a JSON record per file started, done, requeued or failed and per summary on stdout, with the text output moved to stderr")
+	agent := pflag.Bool("agent", false, "Emit machine-readable progress for a remote coordinator")
+	pflag.CommandLine.MarkHidden("agent")
+	xattr := addXattrFlags(pflag.CommandLine, true)
+	coordinatorAddr := pflag.String("coordinator", "", "Work as a worker of \"migxattrs coordinate\" at HOST:PORT, migrating the batches it hands out instead of a scan file; pass the coordinator's token in $"+COORDINATOR_TOKEN_ENV)
+	mountsPath := pflag.String("mounts", "", "JSON file listing several CephFS mounts (root, scan file, pools) to migrate in one run")
+	fixDirs := pflag.Bool("fix-dirs", false, "Before migrating, rewrite the default layout ("+DIR_LAYOUT_XATTR+") of directories naming the source pool; with --loop every pass checks the directories created or changed since the previous one")
+	failoverWait := pflag.Duration("mds-failover-wait", 0, "When no file completes and the MDS stops answering or reports a rank recovering, pause dispatch for up to this long and retry the files that timed out meanwhile instead of failing them (0 = off)")
+	stallTimeout := pflag.Duration("stall-timeout", 0, "Report a stall, with a diagnostics dump and an alert, when files are in flight but none completes for this long; keep it above the time the largest file takes (0 = off)")
+	ioStats := pflag.Bool("io-stats", false, "Show the kernel's I/O accounting of the run (syscalls and bytes, total and per thread) in the summary")
+	diffAgainst := pflag.String("diff-against", "", "With --dry-run, list only the files selected differently than by the previous run whose --state-db or --audit-log this is")
+	preview := pflag.Bool("preview", true, "Before asking for confirmation, stat the files to migrate and show their size, largest file, top-level directories, destination headroom and estimated duration")
+	yes := pflag.Bool("yes", false, "Start without asking for confirmation (required when stdin is not a terminal)")
+	assumeYes := pflag.Bool("assume-yes", false, "Same as --yes")
+	configPath := pflag.String("config", "", "YAML or TOML file setting any of these flags by name; flags given on the command line take precedence. SIGHUP re-reads the workers, throttles, timeouts, alert thresholds, sample rate and log level from it")
+	pflag.CommandLine.Parse(args)
 
-	if !*dryRun {
-		fmt.Print("Continue with migration? [y/N]: ")
-		var response string
-		fmt.Scanln(&response)
-		if strings.ToLower(strings.TrimSpace(response)) != "y" && strings.ToLower(strings.TrimSpace(response)) != "yes" {
-			fmt.Println("Migration aborted.")
-			os.Exit(0)
+	commandLine := make(map[string]bool)
+	pflag.Visit(func(flag *pflag.Flag) { commandLine[flag.Name] = true })
+	if *configPath != "" {
+		if err := applyConfigFile(pflag.CommandLine, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config file: %v\n", err)
+			return 1
 		}
 	}
 
-	total, migrated, errors := 0, 0, 0
-	bytesTotal := int64(0)
-	startTime := time.Now()
+	if *rehearse && *loop {
+		fmt.Fprintf(os.Stderr, "--rehearse cannot be combined with --loop\n")
+		return 1
+	}
+	if *diffAgainst != "" && (!*dryRun || *loop || *watch || *mountsPath != "") {
+		fmt.Fprintf(os.Stderr, "--diff-against needs --dry-run and cannot be combined with --loop, --watch or --mounts\n")
+		return 1
+	}
+	if *watchFeed != "" && !*watch {
+		fmt.Fprintf(os.Stderr, "--watch-feed needs --watch\n")
+		return 1
+	}
+	if *watch && (*loop || *mountsPath != "") {
+		fmt.Fprintf(os.Stderr, "--watch cannot be combined with --loop or --mounts\n")
+		return 1
+	}
 
-	file, err := os.Open(scanPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening scan file: %v\n", err)
-		os.Exit(1)
+	if *mountsPath != "" {
+		if len(pflag.Args()) != 0 || *subvolume != "" || *canaryFile != "" || *loop {
+			fmt.Fprintf(os.Stderr, "--mounts cannot be combined with CEPH_ROOT_DIR, --subvolume, --canary or --loop\n")
+			return 1
+		}
+	} else if len(pflag.Args()) != 1 && (*subvolume == "" || len(pflag.Args()) > 1) {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs [-dry-run] [-verbose] [-sample RATE] [-canary FILE] [-redrain] [-loop] [-max-duration D] [-resume] CEPH_ROOT_DIR\n")
+		fmt.Fprintf(os.Stderr, "       migxattrs [flags] --subvolume GROUP/NAME [MOUNT_POINT]\n")
+		fmt.Fprintf(os.Stderr, "       migxattrs [flags] --mounts FILE\n")
+		return 1
 	}
-	defer file.Close()
 
+	if !slices.Contains(LOG_LEVELS, *logLevel) {
+		fmt.Fprintf(os.Stderr, "Invalid --log-level value %q (want %s)\n", *logLevel, strings.Join(LOG_LEVELS, ", "))
+		return 1
+	}
+	if *verbose && *quiet || (*verbose || *quiet) && pflag.CommandLine.Changed("log-level") {
+		fmt.Fprintf(os.Stderr, "--verbose, --quiet and --log-level cannot be combined\n")
+		return 1
+	}
 	if *verbose {
-		fmt.Println("Reading scan file...")
+		*logLevel = LOG_DEBUG
+	} else if *quiet {
+		*logLevel = LOG_ERROR
 	}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	// Every pass after the first works from a stale scan file, so loop mode
+	// always relies on the live xattr.
+	opts := &options{srcPool: *xattr.match, dstPool: *xattr.set, dryRun: *dryRun || *rehearse, rehearse: *rehearse, logLevel: *logLevel, sampleRate: 1.0, redrain: *redrain || *loop, fileTimeout: *fileTimeout,
+		verify: *verify, verifyWorkers: max(1, *verifyWorkers), verifyQueue: max(0, *verifyQueue)}
+	if err := xattr.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	// The remaining Ceph integrations need a real cluster.
+	if *xattr.emulate && (*subvolume != "" || *clientStats || *clientAsok != "") {
+		fmt.Fprintf(os.Stderr, "--emulate cannot be combined with --subvolume, --client-stats or --client-asok\n")
+		return 1
+	}
+	if size, err := parseSize(*bufferSize); err != nil || size < 4<<10 || size > 1<<30 {
+		fmt.Fprintf(os.Stderr, "Invalid --buffer-size value %q: want a size from 4K to 1G\n", *bufferSize)
+		return 1
+	} else {
+		copyBufferSize = int(size)
+	}
+	if *bwlimit != "" {
+		rate, err := parseSize(*bwlimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --bwlimit value: %v\n", err)
+			return 1
+		}
+		opts.bwlimit = rate
+		setBandwidth(rate)
+	}
+	if *directIO {
+		if pflag.CommandLine.Changed("copy-engine") && *copyEngineName != "direct" {
+			fmt.Fprintf(os.Stderr, "--direct-io cannot be combined with --copy-engine %s\n", *copyEngineName)
+			return 1
+		}
+		if _, ok := COPY_ENGINES["direct"]; !ok {
+			fmt.Fprintf(os.Stderr, "--direct-io is only supported on Linux\n")
+			return 1
+		}
+		*copyEngineName = "direct"
+	}
+	if *copyCmd != "" {
+		if pflag.CommandLine.Changed("copy-engine") || *directIO {
+			fmt.Fprintf(os.Stderr, "--copy-cmd cannot be combined with --copy-engine or --direct-io\n")
+			return 1
+		}
+		engine = commandEngine{command: *copyCmd}
+	} else if e, err := parseCopyEngine(*copyEngineName); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --copy-engine value: %v\n", err)
+		return 1
+	} else {
+		engine = e
+	}
+	sparseCopies = *sparse
+	preallocateCopies = *preallocateFlag
+	noCache = *noCacheFlag
+	if *maxCache != "" {
+		limit, err := parseSize(*maxCache)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --max-cache value: %v\n", err)
+			return 1
+		}
+		pageCache = newCacheLimiter(limit)
+	}
+	if *redactPaths {
+		redactor = newPathRedactor(*redactSalt)
+	}
+	if *chaosSpec != "" {
+		cfg, err := parseChaos(*chaosSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --chaos value: %v\n", err)
+			return 1
+		}
+		chaos = cfg
+		logf(LOG_INFO, "CHAOS MODE - Failures will be injected deliberately\n")
+	}
 
-	lineCount := 0
-	lastProgressTime := time.Now()
-	progressInterval := 5 * time.Second
+	if policy, err := parseMismatchPolicy(*onMismatch); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --on-mismatch value: %v\n", err)
+		return 1
+	} else {
+		opts.onMismatch = policy
+	}
+	for _, pool := range *alsoSource {
+		if opts.extraSources == nil {
+			opts.extraSources = make(map[string]bool)
+		}
+		opts.extraSources[pool] = true
+	}
+	for _, pool := range *alsoDestination {
+		if opts.extraDestinations == nil {
+			opts.extraDestinations = make(map[string]bool)
+		}
+		opts.extraDestinations[pool] = true
+	}
+	if opts.extraSources[opts.dstPool] || opts.extraSources[opts.srcPool] {
+		fmt.Fprintf(os.Stderr, "--also-source must not list the source or destination pool\n")
+		return 1
+	}
+	for pool := range opts.extraSources {
+		if opts.extraDestinations[pool] {
+			fmt.Fprintf(os.Stderr, "Pool %s is listed in both --also-source and --also-destination\n", pool)
+			return 1
+		}
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineCount++
+	if len(*allowedPools) > 0 {
+		opts.allowedPools = make(map[string]bool)
+		for _, pool := range *allowedPools {
+			opts.allowedPools[pool] = true
+		}
+		if err := checkPoolsAllowed(opts, append([]string{opts.srcPool, opts.dstPool}, *alsoSource...)...); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	opts.failedFile = *failedFile
+	opts.triageReport = *triageReport
+	opts.preserveDirTimes = *preserveDirTimes
+	opts.quiesceWindow = *quiesceWindow
+	opts.growthCheck = *growthCheck
+	opts.retryGrowing = *retryGrowing
+	opts.eventsCmd = *eventsCmd
+	opts.inodeMap = *inodeMapFile
+	opts.stateDB = *stateDBFile
+	opts.assumeYes = *yes || *assumeYes
+	opts.diffAgainst = *diffAgainst
+	opts.ioStats = *ioStats
+	opts.stallTimeout = *stallTimeout
+	opts.failoverWait = *failoverWait
+	opts.fixDirs = *fixDirs
+	opts.filesPerSec = *filesPerSec
+	opts.mdsOpsPerSec = *mdsOpsPerSec
+	setMDSBudget(opts.mdsOpsPerSec)
+	opts.btimeReport = *btimeReport
+	recordBtime = *btimeReport != ""
+	opts.scan = *scan
+	if *shard != "" {
+		spec, err := parseShard(*shard)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --shard value: %v\n", err)
+			return 1
+		}
+		if opts.scan || *watch && *watchFeed == "" {
+			// Every shard would rewrite the scan file the others read.
+			fmt.Fprintf(os.Stderr, "--shard cannot be combined with --scan or a rescanning --watch: build the scan file once with \"migxattrs scan\"\n")
+			return 1
+		}
+		opts.shard = spec
+	}
+	opts.dirBatch = max(0, *dirBatch)
+	if !slices.Contains(ORDERS, *order) {
+		fmt.Fprintf(os.Stderr, "Invalid --order value %q (want %s)\n", *order, strings.Join(ORDERS, ", "))
+		return 1
+	}
+	opts.order = *order
+	opts.residual = *residualReport
+	opts.decommission = *decommissionReport
+	opts.checkpointInterval = *checkpointInterval
+	opts.workers = max(1, *workers)
+	opts.prefetch = max(0, *prefetch)
+	if opts.workers > 1 && opts.dirBatch > 0 {
+		fmt.Fprintf(os.Stderr, "--workers cannot be combined with --dir-batch\n")
+		return 1
+	}
+	opts.adaptiveWorkers = *adaptiveWorkers
+	if opts.adaptiveWorkers > 0 && opts.dirBatch > 0 {
+		fmt.Fprintf(os.Stderr, "--adaptive-workers cannot be combined with --dir-batch\n")
+		return 1
+	}
+	if opts.adaptiveWorkers > 0 && opts.adaptiveWorkers < opts.workers {
+		fmt.Fprintf(os.Stderr, "--adaptive-workers (%d) must be at least --workers (%d)\n", opts.adaptiveWorkers, opts.workers)
+		return 1
+	}
+	if *milestonesFile != "" {
+		paths, err := readPathList(*milestonesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading milestones file: %v\n", err)
+			return 1
+		}
+		opts.milestones = paths
+	}
+	if *swap && *noReplace {
+		fmt.Fprintf(os.Stderr, "--swap and --no-replace are mutually exclusive\n")
+		return 1
+	} else if *swap {
+		opts.placement = PLACE_EXCHANGE
+	} else if *noReplace {
+		opts.placement = PLACE_NOREPLACE
+	}
+	opts.swapGrace = *swapGrace
+	if tmpl, err := parseTempName(*tempName); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --temp-name value: %v\n", err)
+		return 1
+	} else {
+		opts.tempName = tmpl
+	}
+	opts.auditLog = *auditLog
+	opts.checksumDB = *checksumDBFile
+	opts.fileReport = *fileReport
+	if *checksumFlag != "" {
+		fn, err := parseChecksum(*checksumFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --checksum value: %v\n", err)
+			return 1
+		}
+		// Audit records carry SHA-256 sums.
+		if opts.auditLog != "" && *checksumFlag != "sha256" {
+			fmt.Fprintf(os.Stderr, "--audit-log requires --checksum sha256\n")
+			return 1
+		}
+		newChecksum, checksumName, verifyCopies = fn, *checksumFlag, true
+	}
+	if key, err := readAuditKey(*auditKeyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading audit key: %v\n", err)
+		return 1
+	} else {
+		opts.auditKey = key
+	}
+	opts.agent = *agent
+	if *logDest != "" {
+		if opts.agent {
+			fmt.Fprintf(os.Stderr, "--log-dest cannot be combined with --agent\n")
+			return 1
+		}
+		stop, err := startLogDest(*logDest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --log-dest value: %v\n", err)
+			return 1
+		}
+		defer stop()
+	}
+	if !slices.Contains(LOG_FORMATS, *logFormat) {
+		fmt.Fprintf(os.Stderr, "Invalid --log-format value %q (want %s)\n", *logFormat, strings.Join(LOG_FORMATS, ", "))
+		return 1
+	}
+	if *logFormat == "json" {
+		if opts.agent {
+			// The coordinator reads the agent lines from stdout.
+			fmt.Fprintf(os.Stderr, "--log-format json cannot be combined with --agent\n")
+			return 1
+		}
+		startJSONLog()
+	}
+	setLogLevel(opts.logLevel)
+	if sinks, err := parseProgressSinks(*progressSpecs, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --progress value: %v\n", err)
+		return 1
+	} else {
+		opts.progress = sinks
+	}
+	opts.clientAsok = *clientAsok
+	opts.clientMaxLatency = *clientMaxLatency
+	if *clientMaxDirty != "" {
+		limit, err := parseSize(*clientMaxDirty)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --client-max-dirty value: %v\n", err)
+			return 1
+		}
+		opts.clientMaxDirty = limit
+	}
+	opts.clientStats = *clientStats || *clientAsok != "" || opts.clientMaxDirty > 0 || opts.clientMaxLatency > 0
+	if !*noHistory {
+		opts.historyFile = *historyFile
+	}
+	opts.summaryJSON = *summaryJSON
+	opts.flags = changedFlags(pflag.CommandLine)
+	if *sample != "" {
+		rate, err := parseSampleRate(*sample)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --sample value: %v\n", err)
+			return 1
+		}
+		opts.sampleRate = rate
+	}
 
-		if *verbose && lineCount%10000 == 0 {
-			fmt.Printf("Processed %d lines...\n", lineCount)
-		} else if !*verbose && time.Since(lastProgressTime) > progressInterval {
-			fmt.Printf("Processed %d lines...\r", lineCount)
-			lastProgressTime = time.Now()
+	opts.alerts = alertConfig{
+		errorRate:        *alertErrorRate,
+		errorRateMinimum: 100,
+		minThroughput:    *alertMinThroughput,
+		throughputWindow: *alertThroughputWindow,
+		webhooks:         *alertWebhooks,
+		emails:           *alertEmails,
+		onFinish:         *alertOnFinish,
+		summaryMail: summaryMailConfig{server: *smtpServer, from: *smtpFrom, user: *smtpUser,
+			password: os.Getenv(SMTP_PASSWORD_ENV), to: *summaryEmails},
+	}
+	if opts.alerts.summaryMail.from == "" {
+		host, _ := os.Hostname()
+		opts.alerts.summaryMail.from = "migxattrs@" + host
+	}
+	// Addresses end up in mail headers: one smuggling in a line break
+	// would add recipients of its own.
+	if err := parseMailAddresses(opts.alerts.emails); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --alert-email value: %v\n", err)
+		return 1
+	}
+	if err := parseMailAddresses(opts.alerts.summaryMail.to); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --summary-email value: %v\n", err)
+		return 1
+	}
+	if from, err := parseMailAddress(opts.alerts.summaryMail.from); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --smtp-from value: %v\n", err)
+		return 1
+	} else {
+		opts.alerts.summaryMail.from = from
+	}
+	if *alertMinFree != "" {
+		minFree, err := parseSize(*alertMinFree)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --alert-min-free value: %v\n", err)
+			return 1
 		}
+		opts.alerts.minFree = minFree
+	}
 
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+	cgCfg := cgroupConfig{path: *cgroupPath, cpuMax: *cpuMax, ioMax: *ioMax}
+	if *memoryMax != "" {
+		limit, err := parseSize(*memoryMax)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --memory-max value: %v\n", err)
+			return 1
 		}
+		cgCfg.memoryMax = limit
+	}
+	if err := setupCgroup(cgCfg); err != nil {
+		if cgCfg.requested() {
+			fmt.Fprintf(os.Stderr, "Error setting up cgroup: %v\n", err)
+			return 1
+		}
+		logf(LOG_DEBUG, "Warning: %v\n", err)
+	}
 
-		total++
-		pool := fields[0]
-		if pool != SRC_POOL {
-			continue
+	if *nice != 0 || *ioniceClass != "" {
+		ioClass := 0
+		if *ioniceClass != "" {
+			class, err := parseIoniceClass(*ioniceClass)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --ionice-class value: %v\n", err)
+				return 1
+			}
+			ioClass = class
+		}
+		if *ioniceLevel < 0 || *ioniceLevel > 7 {
+			fmt.Fprintf(os.Stderr, "Invalid --ionice-level value: %d (want 0-7)\n", *ioniceLevel)
+			return 1
+		}
+		if err := setPriority(*nice, ioClass, *ioniceLevel); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting process priority: %v\n", err)
+			return 1
 		}
+	}
 
-		absPath := filepath.Join(cephRoot, fields[1])
-		info, err := os.Stat(absPath)
-		if err != nil {
-			if *verbose {
-				fmt.Fprintf(os.Stderr, "Error accessing %s: %v\n", absPath, err)
+	opts.started = time.Now()
+	if *maxDuration > 0 {
+		opts.deadline = opts.started.Add(*maxDuration)
+	}
+	if *configPath != "" {
+		opts.configPath, opts.commandLine = *configPath, commandLine
+		watchReloadSignal()
+	}
+	watchPauseSignals()
+
+	if *coordinatorAddr != "" {
+		// The coordinator owns the scan file and the bookkeeping of
+		// what is left; a worker only sees one batch at a time.
+		for name, set := range map[string]bool{"--mounts": *mountsPath != "", "--resume": *resume, "--scan": opts.scan,
+			"--scan-file": *scanFile != "", "--shard": opts.shard.enabled(), "--loop": *loop, "--watch": *watch, "--canary": *canaryFile != ""} {
+			if set {
+				fmt.Fprintf(os.Stderr, "--coordinator cannot be combined with %s\n", name)
+				return 1
 			}
-			errors++
-			continue
 		}
+	}
 
-		if info.IsDir() {
-			continue
+	if *mountsPath != "" {
+		mf, err := loadMounts(*mountsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading mounts: %v\n", err)
+			return 1
 		}
+		return runMounts(mf, opts, *resume)
+	}
 
-		currentPool, err := getXattr(absPath)
-		if err != nil || string(currentPool) != SRC_POOL {
-			if *verbose {
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error reading xattr for %s: %v\n", absPath, err)
-				} else {
-					fmt.Fprintf(os.Stderr, "Pool mismatch for %s: expected %s, got %s\n", absPath, SRC_POOL, string(currentPool))
-				}
-			}
-			errors++
-			continue
+	cephRoot := pflag.Arg(0)
+	if *subvolume != "" {
+		resolved, err := resolveSubvolume(*subvolume, *fsName, cephRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error resolving subvolume: %v\n", err)
+			return 1
 		}
+		logf(LOG_INFO, "Subvolume %s resolved to %s\n", *subvolume, resolved)
+		cephRoot = resolved
+	}
+	if *watchWritesFlag {
+		// Find out now, not at the first file, that inotify is unavailable.
+		stop, err := watchWrites(cephRoot, func() {})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting up --watch-writes: %v\n", err)
+			return 1
+		}
+		stop()
+		watchSources = true
+	}
+	// Every run over the root locks it, whatever scan file it reads.
+	lock, err := lockRun(cephRoot, opts.shard, *coordinatorAddr != "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locking %s: %v\n", displayPath(cephRoot), err)
+		return 1
+	}
+	defer lock.release()
+	if *coordinatorAddr != "" {
+		return runWorker(cephRoot, *coordinatorAddr, opts)
+	}
+	scanPath := filepath.Join(cephRoot, SCAN_FILE)
+	checkpointPath := filepath.Join(cephRoot, CHECKPOINT_FILE)
+	if *scanFile != "" {
+		// Runs over different scan files of the same root (e.g. remote
+		// agents) must not share a checkpoint.
+		scanPath = *scanFile
+		checkpointPath = scanPath + ".checkpoint"
+	}
+	checkpointPath += opts.shard.suffix()
+
+	defer notifySystemdReady()()
+	opts.notifier = newRunNotifier(&opts.alerts, cephRoot)
+	defer func() { opts.notifier.finish(status) }()
 
-		if *verbose {
-			fmt.Printf("Migrating: %s (%.2f MB)\n", absPath, float64(info.Size())/(1024*1024))
+	opts.checkpointPath = checkpointPath
+	if *resume {
+		cp, err := loadCheckpoint(checkpointPath, scanPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading checkpoint: %v\n", err)
+			return 1
 		}
+		opts.resume = cp
+	}
 
-		if !*dryRun {
-			if err := migrateFile(absPath, info); err != nil {
-				fmt.Fprintf(os.Stderr, "Error migrating %s: %v\n", absPath, err)
-				errors++
-			} else {
-				migrated++
-				bytesTotal += info.Size()
-				if *verbose && migrated%100 == 0 {
-					fmt.Printf("Migrated %d files so far\n", migrated)
-				}
-			}
-		} else {
-			if *verbose {
-				fmt.Printf("[DRY RUN] Would migrate: %s (%.2f MB)\n", absPath, float64(info.Size())/(1024*1024))
-			}
-			migrated++
-			bytesTotal += info.Size()
+	if *xattr.emulate {
+		logf(LOG_INFO, "EMULATION MODE - Layouts are read from and written to %s\n", xattrKey)
+	} else if xattrKey != XATTR_KEY {
+		logf(LOG_INFO, "Rewriting xattr %s\n", xattrKey)
+	}
+	logf(LOG_INFO, "Starting migration from %s to %s\nUsing scan file: %s\n", opts.srcPool, opts.dstPool, scanPath)
+	if opts.rehearse {
+		logf(LOG_INFO, "REHEARSAL MODE - Temp files are created and removed; no data is copied or renamed\n")
+	} else if opts.dryRun {
+		logf(LOG_INFO, "DRY RUN MODE - No changes will be made\n")
+	}
+	if opts.redrain {
+		logf(LOG_INFO, "RE-DRAIN MODE - Live pool xattr is checked for every scan entry\n")
+	}
+	if opts.resume != nil {
+		logf(LOG_INFO, "RESUMING after line %d of the scan file (%d pending files)\n", opts.resume.Line, len(opts.resume.Pending))
+	}
+	if !opts.deadline.IsZero() {
+		logf(LOG_INFO, "Run deadline: %s\n", opts.deadline.Format(time.RFC3339))
+	}
+	if opts.shard.enabled() {
+		logf(LOG_INFO, "SHARD MODE - Working on shard %s of the scan entries\n", opts.shard)
+	}
+	if opts.sampleRate < 1 {
+		logf(LOG_INFO, "SAMPLE MODE - Migrating a random %.2f%% of eligible files\n", opts.sampleRate*100)
+	}
+
+	if needsScan(scanPath, opts) {
+		if _, err := buildScanFile(cephRoot, scanPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning %s: %v\n", displayPath(cephRoot), err)
+			return 1
 		}
 	}
 
-	if !*verbose {
-		fmt.Println()
+	poolStats, err := analyzePoolScan(scanPath, opts.shard)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error analyzing scan file: %v\n", err)
+		return 1
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading scan file: %v\n", err)
+	logf(LOG_INFO, "\nSanity check - Pool distribution:\n")
+	for pool, count := range poolStats {
+		if pool == opts.srcPool {
+			logf(LOG_INFO, "Files in %s (source): %d\n", pool, count)
+		} else if pool == opts.dstPool {
+			logf(LOG_INFO, "Files in %s (destination): %d\n", pool, count)
+		} else {
+			logf(LOG_INFO, "Files in %s: %d\n", pool, count)
+		}
 	}
 
-	elapsed := time.Since(startTime)
-	fmt.Println("\nMigration Summary:")
-	fmt.Printf("Lines processed:  %d\nFiles migrated:   %d\nBytes migrated:   %.2f MB\nErrors:           %d\nTime elapsed:     %v\n",
-		lineCount, migrated, float64(bytesTotal)/(1024*1024), errors, elapsed)
-	if *dryRun {
-		fmt.Println("\nThis was a dry run. No changes were made.")
+	if poolStats[opts.srcPool] == 0 && !opts.redrain && !*watch {
+		logf(LOG_INFO, "\nNo files found in source pool. Nothing to migrate.\n")
+		return 0
 	}
-}
 
-func analyzePoolScan(scanPath string) (map[string]int, error) {
-	if _, err := os.Stat(scanPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("scan file does not exist: %s", scanPath)
+	if opts.redrain {
+		entries := 0
+		for _, count := range poolStats {
+			entries += count
+		}
+		opts.expectedFiles = entries
+		logf(LOG_INFO, "\nProceeding with re-drain of %d scan entries\n", entries)
+	} else if opts.sampleRate < 1 {
+		opts.expectedFiles = poolStats[opts.srcPool]
+		logf(LOG_INFO, "\nProceeding with migration of ~%d of %d files (sampled)\n", int(float64(poolStats[opts.srcPool])*opts.sampleRate), poolStats[opts.srcPool])
+	} else {
+		opts.expectedFiles = poolStats[opts.srcPool]
+		if !opts.dryRun {
+			opts.expectedBytes = dryRunBytes(*historyFile, cephRoot, scanPath, opts)
+		}
+		if opts.expectedBytes > 0 {
+			logf(LOG_INFO, "\nProceeding with migration of %d files (%.2f MB in the last dry run)\n", poolStats[opts.srcPool], mb(opts.expectedBytes))
+		} else {
+			logf(LOG_INFO, "\nProceeding with migration of %d files\n", poolStats[opts.srcPool])
+		}
 	}
 
-	file, err := os.Open(scanPath)
-	if err != nil {
-		return nil, err
+	// Agents are started by a coordinator that has already asked.
+	if !opts.dryRun && !opts.agent {
+		if *preview && !opts.assumeYes && isTerminal(os.Stdin) {
+			if p, err := buildPreview(cephRoot, scanPath, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error building preview: %v\n", err)
+			} else {
+				p.print(cephRoot, opts)
+			}
+		}
+		if proceed, status := confirmMigration(opts.assumeYes); !proceed {
+			return status
+		}
 	}
-	defer file.Close()
 
-	poolStats := make(map[string]int)
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	startTime := time.Now()
+	var exclude map[string]bool
+	if *canaryFile != "" {
+		canaryPaths, err := readPathList(*canaryFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading canary file: %v\n", err)
+			return 1
+		}
 
-	fmt.Println("Analyzing pool distribution...")
+		failures := runCanary(cephRoot, canaryPaths, opts)
+		if failures > *canaryMaxFailures {
+			fmt.Fprintf(os.Stderr, "\nCanary gate failed: %d failures (max %d). Bulk migration aborted.\n", failures, *canaryMaxFailures)
+			return 1
+		}
+		logf(LOG_INFO, "\nCanary gate passed (%d failures, max %d). Proceeding with bulk migration.\n", failures, *canaryMaxFailures)
 
-	for scanner.Scan() {
-		lineCount++
-		if lineCount%100000 == 0 {
-			fmt.Printf("Analyzed %d lines...\r", lineCount)
+		exclude = make(map[string]bool, len(canaryPaths))
+		for _, p := range canaryPaths {
+			exclude[filepath.Clean(p)] = true
 		}
+	}
 
-		fields := strings.Fields(scanner.Text())
-		if len(fields) >= 2 {
-			poolStats[fields[0]]++
+	if *loop {
+		cfg := loopConfig{interval: *interval, maxIterations: *maxIterations, notifyCmd: *notifyCmd}
+		return runLoop(cephRoot, scanPath, checkpointPath, opts, exclude, cfg)
+	}
+	if *watch {
+		return runWatch(cephRoot, scanPath, checkpointPath, opts, exclude, watchConfig{interval: *interval, feed: *watchFeed})
+	}
+
+	var previous map[string]bool
+	if opts.diffAgainst != "" {
+		if previous, err = loadManifest(opts.diffAgainst); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", opts.diffAgainst, err)
+			return 1
 		}
 	}
 
-	fmt.Printf("Analyzed %d lines in %v\n", lineCount, time.Since(startTime))
-	return poolStats, scanner.Err()
+	startTime := time.Now()
+	stats, err := runMigration(context.Background(), cephRoot, scanPath, opts, exclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening scan file: %v\n", err)
+		return 1
+	}
+
+	if previous != nil {
+		printDryRunDiff(previous, stats.selected)
+	}
+	printSummary(stats, opts, time.Since(startTime))
+	checkParity(stats, opts, poolStats[opts.srcPool])
+	reportResidual(cephRoot, scanPath, opts.residual, opts, stats)
+	cpErr := finishCheckpoint(checkpointPath, scanPath, stats, opts)
+	recordRun(cephRoot, scanPath, opts, stats, startTime, runOutcome(stats, opts))
+	if cpErr != nil {
+		fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", cpErr)
+		return EXIT_FATAL
+	}
+	if opts.agent {
+		emitAgentLine(AGENT_RESULT_PREFIX, newAgentReport(stats, time.Since(startTime)))
+	}
+	return exitStatus(stats)
 }
 
-func getXattr(path string) ([]byte, error) {
-	size, err := unix.Getxattr(path, XATTR_KEY, nil)
-	if err != nil {
-		return nil, err
+// confirmMigration asks before a run makes changes, unless assumeYes is
+// set. Without a terminal on stdin there is nobody to answer, so the run is
+// aborted with a failing status instead of blocking. proceed is false when
+// the run must stop with status.
+func confirmMigration(assumeYes bool) (proceed bool, status int) {
+	if assumeYes {
+		return true, EXIT_OK
+	}
+	if !isTerminal(os.Stdin) {
+		fmt.Fprintf(os.Stderr, "Migration aborted: stdin is not a terminal, pass --yes to run unattended.\n")
+		return false, EXIT_FATAL
 	}
+	fmt.Print("Continue with migration? [y/N]: ")
+	var response string
+	fmt.Scanln(&response)
+	if response = strings.ToLower(strings.TrimSpace(response)); response != "y" && response != "yes" {
+		fmt.Println("Migration aborted.")
+		return false, EXIT_OK
+	}
+	return true, EXIT_OK
+}
 
-	value := make([]byte, size)
-	_, err = unix.Getxattr(path, XATTR_KEY, value)
-	return value, err
+// runOutcome classifies a finished pass for the run history.
+func runOutcome(stats *runStats, opts *options) string {
+	switch {
+	case opts.rehearse:
+		return "rehearsal"
+	case opts.dryRun:
+		return "dry-run"
+	case stats.deadlineHit:
+		return "deadline"
+	case stats.errors > 0 || stats.verifyFailed > 0:
+		return "completed-with-errors"
+	default:
+		return "completed"
+	}
 }
 
-func migrateFile(path string, info os.FileInfo) error {
-	tmpPath := path + ".mig"
+// finishCheckpoint records where a run stopped at its deadline, or removes a
+// stale checkpoint once a resumed or periodically checkpointed run has
+// completed. It fails if the checkpoint of a stopped run cannot be saved,
+// which leaves nothing to resume from.
+func finishCheckpoint(checkpointPath, scanPath string, stats *runStats, opts *options) error {
+	if opts.dryRun {
+		return nil
+	}
 
-	if tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, info.Mode()); err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	} else {
-		tmpFile.Close()
+	if !stats.deadlineHit {
+		if opts.resume != nil || opts.checkpointInterval > 0 {
+			if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error removing checkpoint: %v\n", err)
+			}
+		}
+		return nil
 	}
 
-	if err := unix.Setxattr(tmpPath, XATTR_KEY, []byte(DST_POOL), 0); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to set xattr: %w", err)
+	cp := &checkpoint{ScanFile: scanPath, Line: stats.stoppedAt, Pending: stats.requeued, SavedAt: time.Now()}
+	if err := saveCheckpoint(checkpointPath, cp); err != nil {
+		return err
 	}
+	logf(LOG_INFO, "\nRun deadline reached. Checkpoint saved to %s; rerun with --resume to continue.\n", checkpointPath)
+	return nil
+}
 
-	srcFile, err := os.Open(path)
-	if err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to open source file: %w", err)
+func printSummary(stats *runStats, opts *options, elapsed time.Duration) {
+	fmt.Println("\nMigration Summary:")
+	fmt.Printf("Lines processed:  %d\nFiles migrated:   %d\nBytes migrated:   %.2f MB\nErrors:           %d\nTime elapsed:     %v\n",
+		stats.lineCount, stats.migrated, float64(stats.bytesTotal)/(1024*1024), stats.errors, elapsed)
+	if opts.shard.enabled() {
+		fmt.Printf("Other shards:     %d\n", stats.otherShards)
+	}
+	if opts.sampleRate < 1 {
+		fmt.Printf("Sampled out:      %d\n", stats.sampledOut)
+	}
+	if opts.redrain || opts.resume != nil {
+		fmt.Printf("Not in source:    %d\n", stats.notInSource)
+	}
+	if opts.stateDB != "" {
+		fmt.Printf("Already migrated: %d\n", stats.alreadyDone)
+	}
+	switch opts.onMismatch {
+	case MISMATCH_SKIP:
+		fmt.Printf("In other pools:   %d\n", stats.mismatched)
+	case MISMATCH_MIGRATED:
+		fmt.Printf("In destination:   %d\n", stats.inDest)
+	}
+	if opts.fileTimeout > 0 {
+		fmt.Printf("Timed out:        %d\n", stats.timedOut)
+	}
+	if watchSources {
+		fmt.Printf("Written to:       %d copies aborted\n", stats.writtenTo)
+	}
+	if opts.quiesceWindow > 0 {
+		fmt.Printf("Still active:     %d\n", stats.quiesced)
+	}
+	if opts.growthCheck > 0 {
+		fmt.Printf("Growing files:    %d\n", stats.growing)
+	}
+	if opts.mdsOpsPerSec > 0 {
+		ops := mdsOpCount.Load()
+		fmt.Printf("Metadata ops:     %d (%.0f/s, cap %g/s)\n", ops, float64(ops)/elapsed.Seconds(), opts.mdsOpsPerSec)
+	}
+	if stats.workers != "" {
+		fmt.Printf("Workers:          %s\n", stats.workers)
+	}
+	if opts.failoverWait > 0 {
+		fmt.Printf("MDS failovers:    %d\n", stats.failovers)
+	}
+	if opts.fixDirs {
+		fmt.Printf("Dir layouts:      %d rewritten, %d failed\n", stats.dirsRewritten, stats.dirsFailed)
+	}
+	if stats.paused > 0 {
+		fmt.Printf("Paused for:       %v\n", stats.paused.Round(time.Second))
+	}
+	if peak := stats.queuePeak; peak.pending() {
+		fmt.Printf("Peak queues:      %s\n", peak)
+	}
+	if opts.stallTimeout > 0 {
+		fmt.Printf("Stalls:           %d\n", stats.stalls)
+	}
+	if stats.io != nil {
+		stats.io.print()
+	}
+	if n := sparseStats.files.Load(); n > 0 {
+		holes := sparseStats.holeBytes.Load()
+		fmt.Printf("Physical bytes:   %.2f MB (holes of %d sparse files kept)\n", mb(stats.bytesTotal-holes), n)
+	}
+	if pageCache != nil {
+		fmt.Printf("Cache syncs:      %d\n", pageCache.syncs.Load())
+	}
+	if opts.verify && !opts.dryRun {
+		fmt.Printf("Verified:         %d passed, %d failed\n", stats.verified, stats.verifyFailed)
+	}
+	if len(stats.errorCodes) > 0 {
+		fmt.Println("Errors by code:")
+		for _, code := range sortedCodes(stats.errorCodes) {
+			fmt.Printf("  %-16s%d\n", code, stats.errorCodes[code])
+		}
 	}
+	if stats.deadlineHit {
+		fmt.Printf("Stopped at line:  %d (run deadline reached)\n", stats.stoppedAt)
+	}
+	if opts.rehearse {
+		fmt.Printf("Metadata rate:    %.1f files/s\n", float64(stats.migrated+stats.errors)/elapsed.Seconds())
+		fmt.Println("\nThis was a rehearsal. Temp files were created and removed; no data was copied.")
+	} else if opts.dryRun {
+		fmt.Println("\nThis was a dry run. No changes were made.")
+	}
+	jsonLog.log(&logRecord{Event: "summary", Summary: newAgentReport(stats, elapsed)})
+}
 
-	dstFile, err := os.OpenFile(tmpPath, os.O_WRONLY, 0)
+// parseSampleRate accepts either a percentage ("1%") or a fraction ("0.01")
+// and returns the fraction of eligible files to migrate.
+func parseSampleRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%")
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
 	if err != nil {
-		srcFile.Close()
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to open temp file for writing: %w", err)
+		return 0, err
+	}
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("rate must be a finite number, got %s", s)
 	}
+	if percent {
+		rate /= 100
+	}
+	if rate <= 0 || rate > 1 {
+		return 0, fmt.Errorf("rate must be between 0%% and 100%%, got %s", s)
+	}
+	return rate, nil
+}
 
-	_, err = io.Copy(dstFile, srcFile)
-	srcFile.Close()
-	dstFile.Close()
-	if err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to copy data: %w", err)
+// parseSize parses a byte count with an optional binary suffix (K, M, G, T).
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
 	}
 
-	if err := os.Chmod(tmpPath, info.Mode()); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to set permissions: %w", err)
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("size must not be negative")
 	}
+	return int64(value * float64(multiplier)), nil
+}
 
-	if stat, ok := info.Sys().(*unix.Stat_t); ok {
-		if err := os.Chown(tmpPath, int(stat.Uid), int(stat.Gid)); err != nil {
-			os.Remove(tmpPath)
-			return fmt.Errorf("failed to set ownership: %w", err)
-		}
+func analyzePoolScan(scanPath string, shard shardSpec) (map[string]int, error) {
+	if _, err := os.Stat(scanPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("scan file does not exist: %s", scanPath)
 	}
 
-	if err := os.Chtimes(tmpPath, time.Now(), info.ModTime()); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to set timestamps: %w", err)
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
+
+	poolStats := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	lineCount := 0
+	startTime := time.Now()
 
-	if err := os.Rename(tmpPath, path); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to rename: %w", err)
+	logf(LOG_INFO, "Analyzing pool distribution...\n")
+
+	for scanner.Scan() {
+		lineCount++
+		if lineCount%100000 == 0 {
+			logf(LOG_INFO, "Analyzed %d lines...\r", lineCount)
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && shard.owns(fields[1]) {
+			poolStats[fields[0]]++
+		}
 	}
 
-	return nil
+	logf(LOG_INFO, "Analyzed %d lines in %v\n", lineCount, time.Since(startTime))
+	return poolStats, scanner.Err()
 }
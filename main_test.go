@@ -0,0 +1,60 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSampleRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "0.25", want: 0.25},
+		{in: "1", want: 1},
+		{in: "10%", want: 0.1},
+		{in: " 100% ", want: 1},
+		{in: "0", wantErr: true},
+		{in: "-0.5", wantErr: true},
+		{in: "1.5", wantErr: true},
+		{in: "150%", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "NaN%", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "-Inf", wantErr: true},
+		{in: "+Inf%", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSampleRate(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSampleRate(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSampleRate(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAnalyzePoolScanLongPaths(t *testing.T) {
+	scanPath := filepath.Join(t.TempDir(), SCAN_FILE)
+	long := strings.Repeat("d/", 50*1024) + "file" // past the default 64 KiB token
+	scan := "src\ta/one\nsrc\t" + long + "\ndst\tb/two\nsrc\tc/three\n"
+	if err := os.WriteFile(scanPath, []byte(scan), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := analyzePoolScan(scanPath, shardSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"src": 3, "dst": 1}; !maps.Equal(got, want) {
+		t.Errorf("analyzePoolScan = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "sync/atomic"
+
+// mdsBudget caps the metadata operations the migration sends to the MDS per
+// second (--mds-ops-per-sec), shared by the workers and the verifiers. It is
+// nil when there is no cap, and atomic because a reload of --config can replace it
+// while verifications run.
+var mdsBudget atomic.Pointer[rateLimiter]
+
+// mdsOpCount counts the metadata operations charged so far.
+var mdsOpCount atomic.Int64
+
+// mdsOps charges n metadata operations (stats, opens, creates, xattr reads
+// and writes, chmod, chown, utimes, renames, removes) to the budget, waiting
+// until it allows them.
+func mdsOps(n int) {
+	mdsOpCount.Add(int64(n))
+	mdsBudget.Load().take(n)
+}
+
+// setMDSBudget replaces the cap; 0 removes it.
+func setMDSBudget(rate float64) {
+	if rate <= 0 {
+		mdsBudget.Store(nil)
+	} else {
+		mdsBudget.Store(newRateLimiter(rate))
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copyDurationBuckets are the upper bounds, in seconds, of the copy duration
+// histogram: from small files to the multi-hour copies of the largest ones.
+var copyDurationBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 14400}
+
+// copyObserver is implemented by the progress sinks that want the duration
+// of every file copy, which snapshots do not carry.
+type copyObserver interface {
+	observeCopy(d time.Duration, size int64)
+}
+
+// metricsSink serves Prometheus metrics at /metrics (metrics:ADDR), in the
+// text exposition format so no client library is needed. Counters add up
+// over the passes of --loop and --watch; the queue depths are those of the
+// running pass.
+type metricsSink struct {
+	every progressTimer
+
+	mu      sync.Mutex
+	totals  map[string]*metricsTotals    // finished passes, per root
+	current map[string]*progressSnapshot // running pass, per root
+	copies  []uint64                     // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+type metricsTotals struct {
+	passes       int
+	lines        int
+	migrated     int
+	bytes        int64
+	verifyFailed int
+	errorCodes   map[errorCode]int
+	expected     int
+}
+
+func newMetricsSink(arg string, opts *options) (progressSink, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("missing listen address, e.g. metrics::9431")
+	}
+	ln, err := net.Listen("tcp", arg)
+	if err != nil {
+		return nil, err
+	}
+	s := &metricsSink{every: progressTimer{interval: httpSinkInterval}, totals: make(map[string]*metricsTotals),
+		current: make(map[string]*progressSnapshot), copies: make([]uint64, len(copyDurationBuckets))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.write(w)
+	})
+	go http.Serve(ln, mux)
+	return s, nil
+}
+
+func (s *metricsSink) due(now time.Time, lines int) bool { return s.every.due(now) }
+
+func (s *metricsSink) report(snap *progressSnapshot) {
+	s.mu.Lock()
+	s.current[snap.Root] = snap
+	s.mu.Unlock()
+}
+
+func (s *metricsSink) finish(snap *progressSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.current, snap.Root)
+	t := s.totals[snap.Root]
+	if t == nil {
+		t = &metricsTotals{errorCodes: make(map[errorCode]int)}
+		s.totals[snap.Root] = t
+	}
+	t.passes++
+	t.lines += snap.Lines
+	t.migrated += snap.Migrated
+	t.bytes += snap.Bytes
+	t.verifyFailed += snap.VerifyFailed
+	for code, n := range snap.ErrorCodes {
+		t.errorCodes[code] += n
+	}
+	t.expected = snap.Expected
+}
+
+func (s *metricsSink) observeCopy(d time.Duration, size int64) {
+	sec := d.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := sort.SearchFloat64s(copyDurationBuckets, sec); i < len(s.copies) {
+		s.copies[i]++
+	}
+	s.count++
+	s.sum += sec
+}
+
+// write renders the metrics of every root.
+func (s *metricsSink) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roots := make([]string, 0, len(s.totals)+len(s.current))
+	for root := range s.totals {
+		roots = append(roots, root)
+	}
+	for root := range s.current {
+		if s.totals[root] == nil {
+			roots = append(roots, root)
+		}
+	}
+	sort.Strings(roots)
+
+	// The running pass counts on top of the finished ones.
+	merged := make(map[string]*metricsTotals, len(roots))
+	for _, root := range roots {
+		t := &metricsTotals{errorCodes: make(map[errorCode]int)}
+		if done := s.totals[root]; done != nil {
+			*t = *done
+			t.errorCodes = make(map[errorCode]int, len(done.errorCodes))
+			for code, n := range done.errorCodes {
+				t.errorCodes[code] = n
+			}
+		}
+		if cur := s.current[root]; cur != nil {
+			t.lines += cur.Lines
+			t.migrated += cur.Migrated
+			t.bytes += cur.Bytes
+			t.verifyFailed += cur.VerifyFailed
+			for code, n := range cur.ErrorCodes {
+				t.errorCodes[code] += n
+			}
+			t.expected = cur.Expected
+		}
+		merged[root] = t
+	}
+
+	metric := func(name, kind, help string, value func(root string, t *metricsTotals)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, root := range roots {
+			value(root, merged[root])
+		}
+	}
+	metric("migxattrs_passes_total", "counter", "Passes finished.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_passes_total{root=%s} %d\n", promLabel(root), t.passes)
+	})
+	metric("migxattrs_pass_running", "gauge", "Whether a pass is running.", func(root string, t *metricsTotals) {
+		running := 0
+		if s.current[root] != nil {
+			running = 1
+		}
+		fmt.Fprintf(w, "migxattrs_pass_running{root=%s} %d\n", promLabel(root), running)
+	})
+	metric("migxattrs_scan_lines_total", "counter", "Scan file lines processed.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_scan_lines_total{root=%s} %d\n", promLabel(root), t.lines)
+	})
+	metric("migxattrs_expected_files", "gauge", "Files the last or running pass set out to migrate.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_expected_files{root=%s} %d\n", promLabel(root), t.expected)
+	})
+	metric("migxattrs_files_migrated_total", "counter", "Files migrated.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_files_migrated_total{root=%s} %d\n", promLabel(root), t.migrated)
+	})
+	metric("migxattrs_bytes_migrated_total", "counter", "Bytes migrated.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_bytes_migrated_total{root=%s} %d\n", promLabel(root), t.bytes)
+	})
+	metric("migxattrs_errors_total", "counter", "Files that failed, by error code.", func(root string, t *metricsTotals) {
+		codes := make([]string, 0, len(t.errorCodes))
+		for code := range t.errorCodes {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "migxattrs_errors_total{root=%s,code=%s} %d\n", promLabel(root), promLabel(code), t.errorCodes[errorCode(code)])
+		}
+	})
+	metric("migxattrs_verify_failed_total", "counter", "Migrated files that failed verification.", func(root string, t *metricsTotals) {
+		fmt.Fprintf(w, "migxattrs_verify_failed_total{root=%s} %d\n", promLabel(root), t.verifyFailed)
+	})
+	metric("migxattrs_queue_depth", "gauge", "Files in each stage of the running pass.", func(root string, t *metricsTotals) {
+		cur := s.current[root]
+		if cur == nil {
+			return
+		}
+		queues := make([]string, 0, len(cur.Queues))
+		for queue := range cur.Queues {
+			queues = append(queues, queue)
+		}
+		sort.Strings(queues)
+		for _, queue := range queues {
+			fmt.Fprintf(w, "migxattrs_queue_depth{root=%s,queue=%s} %d\n", promLabel(root), promLabel(queue), cur.Queues[queue])
+		}
+	})
+
+	fmt.Fprintf(w, "# HELP migxattrs_copy_duration_seconds Time taken to copy a file and swap it in.\n")
+	fmt.Fprintf(w, "# TYPE migxattrs_copy_duration_seconds histogram\n")
+	var cumulative uint64
+	for i, le := range copyDurationBuckets {
+		cumulative += s.copies[i]
+		fmt.Fprintf(w, "migxattrs_copy_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "migxattrs_copy_duration_seconds_bucket{le=\"+Inf\"} %d\n", s.count)
+	fmt.Fprintf(w, "migxattrs_copy_duration_seconds_sum %g\n", s.sum)
+	fmt.Fprintf(w, "migxattrs_copy_duration_seconds_count %d\n", s.count)
+}
+
+// promLabel quotes a label value as the exposition format wants it.
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
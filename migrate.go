@@ -0,0 +1,1117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// migrator holds the state shared by every file processed in one pass over
+// the scan file.
+type migrator struct {
+	ctx        context.Context // of the run, cancelled to stop it early
+	cephRoot   string
+	opts       *options
+	stats      *runStats
+	verifier   *verifier
+	alerts     *alertMonitor
+	errlog     *errorLog
+	client     *clientMonitor
+	audit      *auditLog
+	dirTimes   *dirTimes
+	swaps      *swapJournal
+	events     *eventStream
+	inodes     *inodeMap
+	state      *stateDB
+	btimes     *btimeReport
+	sums       *checksumDB
+	fileRows   *fileReport
+	batch      *dirBatch
+	milestones *milestoneTracker
+	pool       *workerPool
+	prefetch   *workerPool      // nil unless --prefetch is set
+	fileRate   *rateLimiter     // files started per second, nil unless --files-per-sec is set
+	adaptive   *adaptiveWorkers // nil unless --adaptive-workers is set
+	failover   *failoverGuard   // nil unless --mds-failover-wait is set
+	progress   *progressReporter
+	inflight   map[string]time.Time // files handed to a worker and not yet done, by dispatch time
+	completed  atomic.Int64         // files processed, for the stall watchdog
+
+	// mu guards stats and the per-file reports against concurrent workers.
+	mu        sync.Mutex
+	reloadGen int64 // last SIGHUP generation applied
+}
+
+// runMigration walks the scan file and migrates every entry still in the
+// source pool. Paths in exclude (relative to cephRoot) are skipped.
+// Cancelling ctx stops the run: nothing more is dispatched, and the files
+// in flight are abandoned before their rename.
+func runMigration(ctx context.Context, cephRoot, scanPath string, opts *options, exclude map[string]bool) (*runStats, error) {
+	stats := &runStats{errorCodes: make(map[errorCode]int), failed: make(map[string]bool),
+		linked: make(map[[2]uint64]bool)}
+	m := &migrator{ctx: ctx, cephRoot: cephRoot, opts: opts, stats: stats, pool: newWorkerPool(opts.workers),
+		inflight: make(map[string]time.Time)}
+	if opts.prefetch > 0 {
+		m.prefetch = newWorkerPool(opts.prefetch)
+	}
+	m.setFileRate(opts.filesPerSec)
+	if opts.diffAgainst != "" {
+		stats.selected = make(map[string]bool)
+	}
+	if opts.ioStats {
+		if start, err := takeIOSnapshot(); err != nil {
+			logf(LOG_WARN, "Warning: kernel I/O accounting unavailable: %v\n", err)
+		} else {
+			defer func() {
+				if end, err := takeIOSnapshot(); err == nil {
+					stats.io = newIOReport(start, end)
+				}
+			}()
+		}
+	}
+
+	// Checkpoints name the scan file as given, whose ordered copy --resume
+	// goes back to.
+	scanFile := scanPath
+	if opts.order != "scan" {
+		var err error
+		if scanPath, err = orderScanFile(cephRoot, scanPath, opts); err != nil {
+			return nil, fmt.Errorf("failed to order it: %w", err)
+		}
+	}
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m.errlog, err = newErrorLog(opts.failedFile, opts.resume != nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open failed-file: %w", err)
+	}
+	defer m.errlog.close()
+	if opts.triageReport != "" {
+		m.errlog.triage = newTriage()
+		defer func() {
+			if err := m.errlog.writeTriage(opts.triageReport); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing triage report: %v\n", err)
+			} else if stats.errors > 0 {
+				logf(LOG_INFO, "Failures grouped by cause and subtree in %s\n", opts.triageReport)
+			}
+		}()
+	}
+
+	if opts.auditLog != "" && !opts.dryRun {
+		m.audit, err = openAuditLog(opts.auditLog, opts.auditKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer m.audit.close()
+	}
+
+	if opts.preserveDirTimes && (!opts.dryRun || opts.rehearse) {
+		m.dirTimes = newDirTimes()
+		defer func() {
+			restored := m.dirTimes.restore()
+			logf(LOG_DEBUG, "Restored times of %d directories\n", restored)
+		}()
+	}
+
+	if opts.placement == PLACE_EXCHANGE && !opts.dryRun {
+		journalPath := filepath.Join(cephRoot, SWAP_JOURNAL)
+		m.swaps, err = openSwapJournal(journalPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open swap journal: %w", err)
+		}
+		defer func() {
+			m.swaps.close()
+			removed, err := cleanupSwapped(journalPath, opts.swapGrace)
+			if err != nil {
+				logf(LOG_WARN, "Warning: swap cleanup failed: %v\n", err)
+			} else {
+				logf(LOG_DEBUG, "Removed %d swapped-out originals older than %v\n", removed, opts.swapGrace)
+			}
+		}()
+	}
+
+	if opts.inodeMap != "" && !opts.dryRun {
+		m.inodes, err = openInodeMap(opts.inodeMap, opts.resume != nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open inode map: %w", err)
+		}
+		defer m.inodes.close()
+	}
+
+	if opts.btimeReport != "" && !opts.dryRun {
+		m.btimes, err = openBtimeReport(opts.btimeReport, opts.resume != nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open btime report: %w", err)
+		}
+		defer m.btimes.close()
+	}
+
+	if opts.checksumDB != "" && !opts.dryRun {
+		m.sums, err = openChecksumDB(opts.checksumDB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open checksum database: %w", err)
+		}
+		defer m.sums.close()
+	}
+
+	if opts.fileReport != "" {
+		m.fileRows, err = openFileReport(opts.fileReport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file report: %w", err)
+		}
+		defer m.fileRows.close()
+	}
+
+	if opts.stateDB != "" && !opts.dryRun {
+		m.state, err = openStateDB(opts.stateDB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open state database: %w", err)
+		}
+		defer m.state.close()
+	}
+
+	if opts.eventsCmd != "" && !opts.dryRun {
+		m.events, err = startEventStream(opts.eventsCmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start event command: %w", err)
+		}
+		defer m.events.close()
+	}
+
+	if opts.dirBatch > 0 && !opts.dryRun {
+		journalPath := filepath.Join(cephRoot, BATCH_JOURNAL)
+		m.batch, err = openDirBatch(journalPath, opts.dirBatch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open batch journal: %w", err)
+		}
+		defer func() {
+			m.batch.close()
+			os.Remove(journalPath)
+		}()
+	}
+
+	// Batches verify their copies before renaming them.
+	if opts.verify && !opts.dryRun && m.batch == nil {
+		m.verifier = newVerifier(opts.dstPool, opts.verifyWorkers, opts.verifyQueue, func(path string, err error) {
+			m.errlog.report(path, m.topDir(path), "Verification failed", err, true)
+			jsonLog.logFile("verify_failed", "error", path, 0, 0, "", err)
+			m.fileRows.record(path, 0, "", "", "verify_failed", 0, err)
+			m.sendEvent("verify_failed", path, 0, err)
+		})
+	}
+
+	if opts.alerts.enabled() {
+		m.alerts = newAlertMonitor(&opts.alerts, cephRoot)
+	}
+
+	if len(opts.milestones) > 0 {
+		alerts := m.alerts
+		if alerts == nil {
+			alerts = newAlertMonitor(&opts.alerts, cephRoot)
+		}
+		m.milestones, err = newMilestoneTracker(cephRoot, scanPath, opts.milestones, opts, alerts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count milestone entries: %w", err)
+		}
+	}
+
+	if opts.clientStats {
+		m.client, err = newClientMonitor(opts.clientAsok, opts.clientMaxDirty, opts.clientMaxLatency)
+		if err != nil {
+			logf(LOG_WARN, "Warning: Ceph client statistics unavailable: %v\n", err)
+		}
+	}
+
+	if opts.stallTimeout > 0 {
+		defer m.watchStalls(opts.stallTimeout)()
+	}
+
+	if opts.failoverWait > 0 {
+		alerts := m.alerts
+		if alerts == nil {
+			alerts = newAlertMonitor(&opts.alerts, cephRoot)
+		}
+		m.failover = newFailoverGuard(m, opts.failoverWait)
+		defer m.failover.run(alerts)()
+	}
+
+	if opts.adaptiveWorkers > 0 {
+		m.adaptive = newAdaptiveWorkers(m.pool, opts.workers, opts.adaptiveWorkers)
+		defer func() { stats.workers = m.adaptive.String() }()
+		defer m.adaptive.run()()
+	}
+
+	if opts.fixDirs {
+		m.fixDirLayouts()
+	}
+
+	logf(LOG_DEBUG, "Reading scan file...\n")
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	progress := newProgressReporter(m, opts.progress)
+	m.progress = progress
+
+	startLine := 0
+	if opts.resume != nil {
+		startLine = opts.resume.Line
+		m.resumePending(opts.resume.Pending)
+	}
+	lastCheckpoint := time.Now()
+
+	m.reloadGen = reloadGeneration.Load()
+	for scanner.Scan() {
+		m.reload()
+		if ctx.Err() != nil {
+			m.drain()
+			m.flushBatch()
+			break
+		}
+		if !opts.deadline.IsZero() && time.Now().After(opts.deadline) {
+			stats.deadlineHit = true
+			stats.stoppedAt = stats.lineCount
+			m.drain()
+			m.flushBatch()
+			break
+		}
+		if opts.checkpointInterval > 0 && !opts.dryRun && time.Since(lastCheckpoint) > opts.checkpointInterval {
+			m.saveCheckpoint(scanFile)
+			lastCheckpoint = time.Now()
+		}
+
+		if m.alerts != nil {
+			m.mu.Lock()
+			m.alerts.check(stats)
+			m.mu.Unlock()
+		}
+
+		line := scanner.Text()
+		stats.lineCount++
+		if stats.lineCount <= startLine {
+			continue
+		}
+
+		progress.tick(stats.lineCount)
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if !opts.shard.owns(fields[1]) {
+			stats.otherShards++
+			continue
+		}
+
+		stats.total++
+		pool := fields[0]
+		if pool == opts.srcPool {
+			stats.srcEntries++
+		}
+		if err := checkPoolsAllowed(opts, pool); err != nil {
+			m.fail(filepath.Join(cephRoot, fields[1]), "Rejected scan entry", err, true)
+			continue
+		}
+		if pool != opts.srcPool && !opts.redrain {
+			continue
+		}
+
+		if exclude[filepath.Clean(fields[1])] {
+			if pool == opts.srcPool {
+				stats.excluded++
+			}
+			m.milestones.settle(filepath.Join(cephRoot, fields[1]))
+			continue
+		}
+
+		// Files an earlier run migrated, and unchanged since, are skipped
+		// without a getxattr.
+		if m.state != nil && pool == opts.srcPool && m.state.migrated(filepath.Join(cephRoot, fields[1])) {
+			stats.alreadyDone++
+			m.milestones.settle(filepath.Join(cephRoot, fields[1]))
+			continue
+		}
+
+		if opts.sampleRate < 1 && rand.Float64() >= opts.sampleRate {
+			stats.sampledOut++
+			m.milestones.settle(filepath.Join(cephRoot, fields[1]))
+			continue
+		}
+
+		if m.client != nil && !opts.rehearse {
+			if paused := m.client.throttle(); paused > 0 {
+				m.mu.Lock()
+				stats.paused += paused
+				m.mu.Unlock()
+			}
+		}
+
+		absPath := filepath.Join(cephRoot, fields[1])
+		m.dispatch(absPath, false)
+	}
+
+	if !logShown(LOG_DEBUG) {
+		logf(LOG_INFO, "\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading scan file: %v\n", err)
+	}
+
+	m.drain()
+	m.flushBatch()
+	// Files that time out during an MDS failover are requeued again.
+	for len(stats.requeued) > 0 && !stats.deadlineHit && ctx.Err() == nil {
+		retry := stats.requeued
+		stats.requeued = nil
+		logf(LOG_INFO, "Retrying %d requeued files...\n", len(retry))
+		for _, absPath := range retry {
+			m.dispatch(absPath, true)
+		}
+		m.drain()
+		m.flushBatch()
+	}
+
+	if m.verifier != nil {
+		logf(LOG_INFO, "Waiting for verification to finish...\n")
+		stats.verified, stats.verifyFailed = m.verifier.wait()
+		if stats.verifyFailed > 0 {
+			stats.errorCodes[E_VERIFY] += stats.verifyFailed
+		}
+	}
+	progress.finish()
+
+	return stats, nil
+}
+
+// processFile checks that absPath is a regular file still in the source pool
+// and migrates it, updating stats accordingly. l holds its metadata when the
+// prefetch stage already looked it up. In re-drain mode entries that already
+// left the source pool, or carry no pool at all, cost a single getxattr and
+// are not counted as errors; failing to read the pool is. A file that exceeds
+// the per-file timeout is requeued once; on the final attempt it counts as an
+// error. A file modified within the quiesce window is requeued the same way
+// and skipped if it is still active on the final attempt.
+func (m *migrator) processFile(absPath string, finalAttempt bool, l *fileLookup) {
+	opts, stats := m.opts, m.stats
+	var unlock func()
+	if l == nil {
+		unlock = pathLocks.lock(absPath)
+		l = m.lookupFile(absPath)
+	} else {
+		var changed bool
+		if unlock, changed = l.ticket.lock(); changed {
+			// Another stage had the path since the prefetch lookup.
+			l = m.lookupFile(absPath)
+		}
+	}
+	defer unlock()
+
+	if opts.redrain {
+		if l.poolErr != nil && !xattrMissing(l.poolErr) {
+			code := E_XATTR_READ
+			if os.IsNotExist(l.poolErr) {
+				code = E_VANISHED
+			}
+			m.fail(absPath, "Error checking pool of", codeErrorf(code, "failed to read xattr: %w", l.poolErr), false)
+			return
+		}
+		if l.poolErr != nil || !opts.isSource(string(l.pool)) {
+			m.skip(&stats.notInSource, absPath)
+			return
+		}
+		m.count(&stats.inSource)
+	}
+
+	info, err := l.info, l.statErr
+	if err != nil {
+		code := E_STAT
+		if os.IsNotExist(err) {
+			code = E_VANISHED
+		}
+		m.fail(absPath, "Error accessing", withCode(code, err), false)
+		return
+	}
+
+	if info.IsDir() {
+		m.skip(&stats.notRegular, absPath)
+		return
+	}
+
+	if opts.quiesceWindow > 0 && time.Since(info.ModTime()) < opts.quiesceWindow {
+		if finalAttempt {
+			m.skip(&stats.quiesced, absPath)
+			logf(LOG_DEBUG, "Skipping active file: %s\n", displayPath(absPath))
+		} else {
+			m.requeue(absPath)
+		}
+		return
+	}
+
+	if opts.growthCheck > 0 && time.Since(info.ModTime()) < growthCheckAge && isGrowing(absPath, info, opts.growthCheck) {
+		if opts.retryGrowing && !finalAttempt {
+			m.requeue(absPath)
+		} else {
+			m.skip(&stats.growing, absPath)
+			logf(LOG_DEBUG, "Skipping growing file: %s\n", displayPath(absPath))
+		}
+		return
+	}
+
+	if !opts.redrain {
+		err := checkPoolValue(l.pool, l.poolErr, opts.srcPool)
+		if err != nil && l.poolErr == nil && opts.extraSources[string(l.pool)] {
+			err = nil
+		}
+		if err != nil {
+			// A resumed run revisits the files the interrupted run migrated
+			// after its last checkpoint.
+			if opts.resume != nil && string(l.pool) == opts.dstPool {
+				m.skip(&stats.notInSource, absPath)
+				return
+			}
+			if l.poolErr == nil && m.handleMismatch(absPath, string(l.pool)) {
+				return
+			}
+			m.fail(absPath, "Error checking pool of", err, false)
+			return
+		}
+		m.count(&stats.inSource)
+	}
+
+	logf(LOG_DEBUG, "Migrating: %s (%.2f MB)\n", displayPath(absPath), float64(info.Size())/(1024*1024))
+
+	if !opts.dryRun {
+		if m.dirTimes != nil {
+			m.mu.Lock()
+			m.dirTimes.remember(absPath)
+			m.mu.Unlock()
+		}
+
+		if m.batch != nil {
+			m.batchFile(absPath, string(l.pool), info, finalAttempt)
+			return
+		}
+
+		tmpPath := attemptTempPath(tempPath(opts.tempName, absPath, info))
+		var h hash.Hash
+		if m.verifier != nil || m.audit != nil || m.sums != nil || verifyCopies {
+			h = newChecksum()
+		}
+
+		jsonLog.logFile("file_start", "", absPath, info.Size(), 0, "", nil)
+		start := time.Now()
+		if err := migrateFileWithTimeout(m.ctx, absPath, tmpPath, info, opts.dstPool, opts.placement, opts.fileTimeout, h); err != nil {
+			m.migrateFailed(absPath, err, finalAttempt)
+		} else {
+			m.adaptive.observeCopy(time.Since(start), info.Size())
+			m.progress.observeCopy(time.Since(start), info.Size())
+			jsonLog.logFile("file_done", "", absPath, info.Size(), time.Since(start), "", nil)
+			m.fileRows.record(absPath, info.Size(), string(l.pool), opts.dstPool, "migrated", time.Since(start), nil)
+			var sum []byte
+			if h != nil {
+				sum = h.Sum(nil)
+			}
+			m.recordMigrated(absPath, tmpPath, info, sum)
+			if m.verifier != nil {
+				// A full verify queue must not block a verifier
+				// waiting for this path.
+				unlock()
+				m.verifier.submit(verifyJob{path: absPath, sum: sum})
+			}
+		}
+	} else {
+		if opts.rehearse {
+			if err := m.rehearseFile(absPath, info); err != nil {
+				m.fail(absPath, "Rehearsal failed for", err, true)
+				return
+			}
+		} else {
+			logf(LOG_DEBUG, "[DRY RUN] Would migrate: %s (%.2f MB)\n", displayPath(absPath), float64(info.Size())/(1024*1024))
+		}
+		m.fileRows.record(absPath, info.Size(), string(l.pool), opts.dstPool, "dry-run", 0, nil)
+		m.mu.Lock()
+		m.countMigrated(absPath, info.Size())
+		if m.stats.selected != nil {
+			m.stats.selected[absPath] = true
+		}
+		m.mu.Unlock()
+	}
+}
+
+// dispatch hands absPath to the worker pool, blocking while every worker is
+// busy. With --prefetch its metadata is looked up by the prefetch stage
+// first, which blocks instead once that many lookups are waiting for a
+// worker.
+func (m *migrator) dispatch(absPath string, finalAttempt bool) {
+	if paused := dispatchPause.wait(); paused > 0 {
+		m.mu.Lock()
+		m.stats.paused += paused
+		m.mu.Unlock()
+	}
+	m.failover.hold()
+	m.fileRate.take(1)
+	m.mu.Lock()
+	m.inflight[absPath] = time.Now()
+	m.mu.Unlock()
+	migrate := func(l *fileLookup) {
+		m.pool.submit(func() {
+			m.processFile(absPath, finalAttempt, l)
+			m.completed.Add(1)
+			m.mu.Lock()
+			delete(m.inflight, absPath)
+			m.mu.Unlock()
+		})
+	}
+	if m.prefetch == nil {
+		migrate(nil)
+		return
+	}
+	m.prefetch.submit(func() {
+		ticket := pathLocks.ticket(absPath)
+		l := m.lookupFile(absPath)
+		l.ticket = ticket
+		migrate(l)
+	})
+}
+
+// setFileRate replaces the --files-per-sec limit; 0 removes it. Nothing
+// may be dispatched concurrently.
+func (m *migrator) setFileRate(rate float64) {
+	if rate <= 0 {
+		m.fileRate = nil
+	} else {
+		m.fileRate = newRateLimiter(rate)
+	}
+}
+
+// drain waits until every dispatched file has been processed.
+func (m *migrator) drain() {
+	if m.prefetch != nil {
+		m.prefetch.wait()
+	}
+	m.pool.wait()
+}
+
+// saveCheckpoint records the scan lines consumed so far together with the
+// files still in flight or requeued, so a run that dies can be resumed.
+func (m *migrator) saveCheckpoint(scanPath string) {
+	m.mu.Lock()
+	pending := slices.Clone(m.stats.requeued)
+	for absPath := range m.inflight {
+		pending = append(pending, absPath)
+	}
+	cp := &checkpoint{ScanFile: scanPath, Line: m.stats.lineCount, Pending: pending, SavedAt: time.Now()}
+	m.mu.Unlock()
+
+	if err := saveCheckpoint(m.opts.checkpointPath, cp); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving checkpoint: %v\n", err)
+	}
+}
+
+// resumePending retries the files a checkpoint left pending. A run that died
+// may have finished some of them, or left their temp file behind.
+func (m *migrator) resumePending(pending []string) {
+	for _, absPath := range pending {
+		if value, err := getXattr(absPath); err == nil && string(value) == m.opts.dstPool {
+			continue
+		}
+		if info, err := os.Stat(absPath); err == nil && !m.opts.dryRun {
+			if tmpPath := tempPath(m.opts.tempName, absPath, info); ownedTemp(tmpPath, info) {
+				os.Remove(tmpPath)
+			}
+		}
+		m.dispatch(absPath, false)
+	}
+}
+
+// count increments one of the stats counters.
+func (m *migrator) count(counter *int) {
+	m.mu.Lock()
+	*counter++
+	m.mu.Unlock()
+}
+
+// skip counts a scan entry that is deliberately left in the source pool.
+func (m *migrator) skip(counter *int, absPath string) {
+	m.count(counter)
+	m.milestones.settle(absPath)
+}
+
+// requeue schedules absPath for the retry pass at the end of the run.
+func (m *migrator) requeue(absPath string) {
+	m.mu.Lock()
+	m.stats.requeued = append(m.stats.requeued, absPath)
+	m.mu.Unlock()
+}
+
+func (m *migrator) countMigrated(absPath string, size int64) {
+	m.stats.migrated++
+	m.stats.bytesTotal += size
+	d := m.stats.dir(m.topDir(absPath))
+	d.Migrated++
+	d.Bytes += size
+	m.milestones.migrated(absPath, size)
+	m.milestones.settle(absPath)
+}
+
+// migrateFailed handles a failed migration attempt: a timeout or a write to
+// the source during the copy is requeued unless this was the final attempt,
+// anything else counts as an error. A timeout during an MDS failover is
+// requeued even on the final attempt.
+func (m *migrator) migrateFailed(absPath string, err error, finalAttempt bool) {
+	reason := "Timed out migrating"
+	switch {
+	case errors.Is(err, errFileTimeout):
+		m.count(&m.stats.timedOut)
+	case errors.Is(err, errSourceModified):
+		m.count(&m.stats.writtenTo)
+		reason = "Source written to while migrating"
+	default:
+		m.fail(absPath, "Error migrating", err, true)
+		return
+	}
+	if finalAttempt && errors.Is(err, errFileTimeout) && m.failover != nil {
+		m.mu.Lock()
+		started := m.inflight[absPath]
+		m.mu.Unlock()
+		if m.failover.excuse(absPath, started) {
+			finalAttempt = false
+			reason = "Timed out during an MDS failover migrating"
+		}
+	}
+	if finalAttempt {
+		m.fail(absPath, "Error migrating", err, true)
+		return
+	}
+	logf(LOG_DEBUG, "%s %s, requeued for retry\n", reason, displayPath(absPath))
+	jsonLog.logFile("file_requeued", "warn", absPath, 0, 0, reason, err)
+	m.requeue(absPath)
+}
+
+// recordMigrated updates the statistics and every per-file report for a file
+// that is now in place. sum is the source checksum, if one was computed.
+func (m *migrator) recordMigrated(absPath, tmpPath string, info os.FileInfo, sum []byte) {
+	opts := m.opts
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.countMigrated(absPath, info.Size())
+	if fileLinks(info) > 1 {
+		// The other names still point at the old inode in the source pool.
+		if dev, ino, ok := fileID(info); ok {
+			m.stats.linked[[2]uint64{dev, ino}] = true
+		}
+	}
+	// The copy now in place, which a later run or a rollback compares with.
+	var placed os.FileInfo
+	var placedErr error
+	if m.swaps != nil || m.state != nil {
+		mdsOps(1)
+		placed, placedErr = os.Lstat(absPath)
+	}
+	if m.swaps != nil {
+		err := placedErr
+		if err == nil {
+			err = m.swaps.add(absPath, swappedPath(tmpPath, info), placed)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording swap of %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	m.sendEvent("migrated", absPath, info.Size(), nil)
+	if m.inodes != nil {
+		if err := m.inodes.record(absPath, info); err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording inode of %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	if m.sums != nil && sum != nil {
+		if err := m.sums.record(absPath, info, sum); err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording checksum of %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	if m.btimes != nil {
+		if err := m.btimes.record(absPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording birth time of %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	if m.state != nil {
+		err := placedErr
+		if err == nil {
+			err = m.state.record(absPath, STATE_MIGRATED, placed)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error recording state of %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	if m.audit != nil {
+		if err := m.audit.record(absPath, info.Size(), opts.srcPool, opts.dstPool, sum); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit record for %s: %s\n", displayPath(absPath), displayErr(absPath, err))
+		}
+	}
+	if m.stats.migrated%100 == 0 {
+		logf(LOG_DEBUG, "Migrated %d files so far\n", m.stats.migrated)
+	}
+}
+
+// fail counts a failure and reports it. Errors that are not always worth
+// printing (alwaysLog false) reach stderr only at --log-level debug but are still
+// written to the failed-file.
+func (m *migrator) fail(absPath, what string, err error, alwaysLog bool) {
+	m.mu.Lock()
+	m.countError(absPath, errorCodeOf(err))
+	m.mu.Unlock()
+	if m.state != nil && errorCodeOf(err) != E_POOL_DENIED {
+		if serr := m.state.record(absPath, STATE_FAILED, nil); serr != nil {
+			fmt.Fprintf(os.Stderr, "Error recording state of %s: %s\n", displayPath(absPath), displayErr(absPath, serr))
+		}
+	}
+	m.errlog.report(absPath, m.topDir(absPath), what, err, alwaysLog || logShown(LOG_DEBUG))
+	jsonLog.logFile("file_error", "error", absPath, 0, 0, what, err)
+	m.fileRows.record(absPath, 0, "", "", "failed", 0, err)
+	m.sendEvent("failed", absPath, 0, err)
+}
+
+// sendEvent publishes a per-file event when --events-cmd is set, and hands
+// it to the coordinator's collector in worker mode.
+func (m *migrator) sendEvent(event, absPath string, size int64, err error) {
+	if m.events == nil && m.opts.fileResults == nil {
+		return
+	}
+	ev := &fileEvent{Event: event, Path: absPath, Size: size, SrcPool: m.opts.srcPool, DstPool: m.opts.dstPool}
+	if err != nil {
+		ev.Code, ev.Error = errorCodeOf(err), displayErr(absPath, err)
+	}
+	if m.opts.fileResults != nil {
+		m.opts.fileResults(ev)
+	}
+	if m.events != nil {
+		m.events.send(ev)
+	}
+}
+
+func (m *migrator) countError(absPath string, code errorCode) {
+	m.stats.errors++
+	m.stats.errorCodes[code]++
+	m.stats.dir(m.topDir(absPath)).Errors++
+	if code != E_POOL_DENIED {
+		m.stats.failed[absPath] = true
+	}
+	m.milestones.failed(absPath)
+	// Rejected entries of other pools are not counted towards milestones
+	// outside re-drain mode.
+	if code != E_POOL_DENIED || m.opts.redrain {
+		m.milestones.settle(absPath)
+	}
+}
+
+// topDir returns the first path component of absPath below the CephFS root,
+// which is the granularity used for per-directory progress. The name is
+// redacted with --redact-paths since it ends up in history and reports.
+func (m *migrator) topDir(absPath string) string {
+	rel, err := filepath.Rel(m.cephRoot, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "."
+	}
+	if i := strings.IndexByte(rel, filepath.Separator); i >= 0 {
+		return displayPath(rel[:i])
+	}
+	return "."
+}
+
+// growthCheckAge limits the growth check to files modified this recently;
+// older files are not being appended to.
+const growthCheckAge = time.Hour
+
+// isGrowing stats path again after interval and reports whether it changed
+// size or mtime since info was taken, the signature of a file being
+// appended to. Copying such a file loses whatever is appended before the
+// rename.
+func isGrowing(path string, info os.FileInfo, interval time.Duration) bool {
+	time.Sleep(interval)
+	mdsOps(1)
+	again, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return again.Size() != info.Size() || !again.ModTime().Equal(info.ModTime())
+}
+
+// checkPoolsAllowed rejects pools missing from the --allowed-pools whitelist.
+func checkPoolsAllowed(opts *options, pools ...string) error {
+	if opts.allowedPools == nil {
+		return nil
+	}
+	for _, pool := range pools {
+		if !opts.allowedPools[pool] {
+			return codeErrorf(E_POOL_DENIED, "pool %s is not in the allowed pools", pool)
+		}
+	}
+	return nil
+}
+
+// checkPoolValue confirms that currentPool, the pool xattr as read with
+// error err, reports the source pool.
+func checkPoolValue(currentPool []byte, err error, srcPool string) error {
+	if err != nil {
+		return codeErrorf(E_XATTR_READ, "failed to read xattr: %w", err)
+	}
+	if string(currentPool) != srcPool {
+		return codeErrorf(E_POOL_MISMATCH, "pool mismatch: expected %s, got %s", srcPool, string(currentPool))
+	}
+	return nil
+}
+
+func getXattr(path string) ([]byte, error) {
+	return getXattrValue(path, xattrKey)
+}
+
+// getXattrValue reads an extended attribute without trusting a separate size
+// probe: the value can change between probing and reading, which either fails
+// with ERANGE or, if it shrank, would leave stale bytes at the end. The read
+// is retried with a larger buffer on ERANGE and the result is trimmed to the
+// length actually returned.
+func getXattrValue(path, name string) ([]byte, error) {
+	buf := make([]byte, XATTR_INITIAL_BUFFER)
+	for attempt := 0; ; attempt++ {
+		n, err := sysGetxattr(path, name, buf)
+		if err == nil {
+			return buf[:n], nil
+		}
+		if !xattrTooSmall(err) || attempt >= XATTR_READ_RETRIES || len(buf) >= XATTR_SIZE_MAX {
+			return nil, err
+		}
+
+		size, err := sysGetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Leave headroom in case the value keeps growing.
+		buf = make([]byte, min(max(size+size/4, len(buf)*2), XATTR_SIZE_MAX))
+	}
+}
+
+// copyACLXattrs copies the ACL attributes kept by NFS-Ganesha and Samba from
+// src to dst. Attributes the source does not carry are skipped.
+func copyACLXattrs(src, dst string) error {
+	for _, name := range ACL_XATTRS {
+		mdsOps(1)
+		value, err := getXattrValue(src, name)
+		if xattrMissing(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		mdsOps(1)
+		if err := sysSetxattr(dst, name, value); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// migrateFile rewrites path through the temp file tmpPath created with the
+// destination pool layout. If h is non-nil the source data is hashed as it is
+// copied. With --watch-writes a write to path before the rename aborts it.
+func migrateFile(ctx context.Context, path, tmpPath string, info os.FileInfo, dstPool string, mode placeMode, h hash.Hash) error {
+	err := watchedCopy(ctx, path, tmpPath, func(ctx context.Context) error {
+		if err := copyToTemp(ctx, path, tmpPath, info, dstPool, h); err != nil {
+			return err
+		}
+		if verifyCopies && h != nil {
+			if err := checkCopy(tmpPath, h.Sum(nil)); err != nil {
+				os.Remove(tmpPath)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// An attempt the timeout gave up on leaves the file to its retry.
+	if ctx.Err() != nil {
+		os.Remove(tmpPath)
+		return stoppedErr(ctx)
+	}
+	return commitTemp(path, tmpPath, info, mode)
+}
+
+// copyToTemp creates tmpPath with the destination pool layout and copies
+// data, ownership, ACLs and times of path into it. On failure the temp file
+// is removed.
+func copyToTemp(ctx context.Context, path, tmpPath string, info os.FileInfo, dstPool string, h hash.Hash) error {
+	if err := createTemp(path, tmpPath, info, dstPool); err != nil {
+		return err
+	}
+
+	mdsOps(2) // both opens
+	srcFile, err := os.Open(path)
+	if err != nil {
+		os.Remove(tmpPath)
+		code := E_OPEN
+		if os.IsNotExist(err) {
+			code = E_VANISHED
+		}
+		return codeErrorf(code, "failed to open source file: %w", err)
+	}
+	if noCache {
+		adviseSequential(srcFile)
+	}
+
+	dstFile, err := os.OpenFile(tmpPath, os.O_WRONLY, 0)
+	if err != nil {
+		srcFile.Close()
+		os.Remove(tmpPath)
+		return codeErrorf(E_OPEN, "failed to open temp file for writing: %w", err)
+	}
+
+	err = copyFileData(ctx, dstFile, srcFile, info.Size(), h)
+	dropCache(srcFile, dstFile)
+	srcFile.Close()
+	dstFile.Close()
+	if err == nil {
+		err = chaosPoint("copy")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		if errorCodeOf(err) == E_NOSPC {
+			return err
+		}
+		return codeErrorf(E_COPY, "failed to copy data: %w", err)
+	}
+
+	return finishTemp(ctx, path, tmpPath, info)
+}
+
+// createTemp creates tmpPath, the temp file for path, with the destination
+// pool layout and TEMP_MARKER_XATTR. On failure the temp file, if it created
+// it, is removed.
+func createTemp(path, tmpPath string, info os.FileInfo, dstPool string) error {
+	if dir := filepath.Dir(tmpPath); dir != filepath.Dir(path) {
+		mdsOps(1)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return codeErrorf(E_CREATE, "failed to create staging directory: %w", err)
+		}
+	}
+
+	// A temp file that already exists belongs to something else: another
+	// copy writing it, or a run that died before removing it.
+	mdsOps(3) // create and both setxattrs
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode())
+	if err != nil {
+		if os.IsExist(err) {
+			return codeErrorf(E_CREATE, "temp file %s already exists (see migxattrs cleanup): %w", displayPath(tmpPath), err)
+		}
+		return codeErrorf(E_CREATE, "failed to create temp file: %w", err)
+	}
+	// The marker goes on through the descriptor, so it can only land on
+	// the file this call created.
+	err = sysFsetxattr(tmpFile, TEMP_MARKER_XATTR, tempMarker(info))
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_XATTR_SET, "failed to mark temp file: %w", err)
+	}
+
+	err = sysSetxattr(tmpPath, xattrKey, []byte(dstPool))
+	if err == nil {
+		err = chaosPoint("setxattr")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_XATTR_SET, "failed to set xattr: %w", err)
+	}
+	return nil
+}
+
+// finishTemp gives tmpPath the permissions, ownership, ACLs and times of
+// path. On failure the temp file is removed.
+func finishTemp(ctx context.Context, path, tmpPath string, info os.FileInfo) error {
+	mdsOps(3) // chmod, chown and utimes
+	if err := os.Chmod(tmpPath, info.Mode()); err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_CHMOD, "failed to set permissions: %w", err)
+	}
+
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Chown(tmpPath, uid, gid); err != nil {
+			os.Remove(tmpPath)
+			return codeErrorf(E_CHOWN, "failed to set ownership: %w", err)
+		}
+	}
+
+	// ACLs go on after chmod, which would otherwise rewrite an NFSv4 ACL
+	// to match the mode bits.
+	if err := copyACLXattrs(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return withCode(E_ACL, err)
+	}
+
+	if recordBtime {
+		if err := copyBirthTime(path, tmpPath, info); err != nil {
+			os.Remove(tmpPath)
+			return withCode(E_XATTR_SET, err)
+		}
+	}
+
+	if err := os.Chtimes(tmpPath, time.Now(), info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_UTIMES, "failed to set timestamps: %w", err)
+	}
+
+	// The migrated file keeps no trace of having been a temp file. Should
+	// the run die before the rename, this temp is left for an operator to
+	// remove: cleanup no longer recognises it.
+	mdsOps(1)
+	if err := sysRemovexattr(tmpPath, TEMP_MARKER_XATTR); err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_XATTR_SET, "failed to unmark temp file: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_TIMEOUT, "aborted before rename: %w", err)
+	}
+	return nil
+}
+
+// commitTemp moves the finished temp file into place at path.
+func commitTemp(path, tmpPath string, info os.FileInfo, mode placeMode) error {
+	err := chaosPoint("rename")
+	if err == nil {
+		err = placeFile(tmpPath, path, info, mode)
+	}
+	if errors.Is(err, errPlaceStranded) {
+		return withCode(E_CONFLICT, err)
+	} else if errors.Is(err, errPlaceConflict) {
+		os.Remove(tmpPath)
+		return withCode(E_CONFLICT, err)
+	} else if err != nil {
+		os.Remove(tmpPath)
+		return codeErrorf(E_RENAME, "failed to rename: %w", err)
+	}
+
+	// A per-directory staging folder is removed once empty so it does not
+	// linger next to user data.
+	if dir := filepath.Dir(tmpPath); filepath.Dir(dir) == filepath.Dir(path) && dir != filepath.Dir(path) {
+		mdsOps(1)
+		os.Remove(dir)
+	}
+
+	return nil
+}
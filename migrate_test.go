@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateTempRefusesExisting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	tmpPath := path + ".mig"
+	if err := os.WriteFile(path, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else's file, or the copy of another worker.
+	if err := os.WriteFile(tmpPath, []byte("not ours"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = createTemp(path, tmpPath, info, "dst")
+	if err == nil {
+		t.Fatal("createTemp over an existing file succeeded")
+	}
+	if code := errorCodeOf(err); code != E_CREATE {
+		t.Errorf("error code = %s, want %s", code, E_CREATE)
+	}
+	if data, err := os.ReadFile(tmpPath); err != nil || string(data) != "not ours" {
+		t.Errorf("existing file = %q, %v, want it untouched", data, err)
+	}
+}
+
+// useTestXattrKey makes the pool a user xattr for the duration of the test,
+// which any filesystem with xattrs takes, and skips the test without them.
+func useTestXattrKey(t *testing.T, dir string) {
+	t.Helper()
+	key := "user.migxattrs.test.pool"
+	probe := filepath.Join(dir, ".xattr-probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe)
+	if err := sysSetxattr(probe, key, []byte("probe")); err != nil {
+		t.Skipf("no user xattrs in %s: %v", dir, err)
+	}
+	prev := xattrKey
+	xattrKey = key
+	t.Cleanup(func() { xattrKey = prev })
+}
+
+func TestMigrateFileAbandonedKeepsOriginal(t *testing.T) {
+	dir := t.TempDir()
+	useTestXattrKey(t, dir)
+	path := filepath.Join(dir, "file")
+	tmpPath := path + ".mig"
+	if err := os.WriteFile(path, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sysSetxattr(path, xattrKey, []byte("src")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The timeout gave up on the attempt once its copy was done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = migrateFile(ctx, path, tmpPath, info, "dst", PLACE_RENAME, nil)
+	if !errors.Is(err, errFileTimeout) && errorCodeOf(err) != E_COPY {
+		t.Fatalf("migrateFile with a cancelled context = %v, want it to give up", err)
+	}
+	if pool, err := getXattr(path); err != nil || string(pool) != "src" {
+		t.Errorf("pool of the original = %q, %v, want it not replaced", pool, err)
+	}
+	if _, err := os.Lstat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestXattrKey(t, dir)
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("source data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := sysSetxattr(path, xattrKey, []byte("src")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateFile(context.Background(), path, path+".mig", info, "dst", PLACE_RENAME, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pool, err := getXattr(path); err != nil || string(pool) != "dst" {
+		t.Errorf("pool = %q, %v, want dst", pool, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "source data" {
+		t.Errorf("data = %q, %v", data, err)
+	}
+	if newInfo, err := os.Lstat(path); err != nil || newInfo.Mode() != info.Mode() || os.SameFile(newInfo, info) {
+		t.Errorf("migrated file %v, %v: want a new inode with mode %v", newInfo, err, info.Mode())
+	}
+	if _, err := os.Lstat(path + ".mig"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+	if _, err := getXattrValue(path, TEMP_MARKER_XATTR); !xattrMissing(err) {
+		t.Errorf("migrated file still carries %s: %v", TEMP_MARKER_XATTR, err)
+	}
+}
+
+func TestOwnedTemp(t *testing.T) {
+	dir := t.TempDir()
+	useTestXattrKey(t, dir)
+	path := filepath.Join(dir, "file")
+	other := filepath.Join(dir, "other")
+	info := writeFile(t, path, "source")
+	otherInfo := writeFile(t, other, "other source")
+
+	tmpPath := path + ".mig"
+	if err := createTemp(path, tmpPath, info, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if !ownedTemp(tmpPath, info) {
+		t.Error("temp created for the file not recognised as its temp")
+	}
+	if ownedTemp(tmpPath, otherInfo) {
+		t.Error("temp created for the file recognised as the temp of another")
+	}
+	if ownedTemp(path, info) {
+		t.Error("the file itself recognised as its temp")
+	}
+
+	// A user's file of the temp name, even in the destination pool.
+	userFile := other + ".mig"
+	writeFile(t, userFile, "user data")
+	if err := sysSetxattr(userFile, xattrKey, []byte("dst")); err != nil {
+		t.Fatal(err)
+	}
+	if ownedTemp(userFile, otherInfo) {
+		t.Error("unmarked file recognised as a temp")
+	}
+
+	// Once finished the temp is about to become the file: no longer ours
+	// to delete.
+	if err := finishTemp(context.Background(), path, tmpPath, info); err != nil {
+		t.Fatal(err)
+	}
+	if ownedTemp(tmpPath, info) {
+		t.Error("finished temp still recognised as a leftover")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// milestone is a subtree whose completion is announced to the data owners.
+type milestone struct {
+	path     string // relative to the CephFS root
+	total    int    // scan entries under path the run will process
+	settled  int
+	migrated int
+	errors   int
+	bytes    int64
+	reached  bool
+}
+
+// milestoneTracker counts outcomes per milestone subtree and sends an alert
+// with a short report when every entry of a subtree has been processed.
+type milestoneTracker struct {
+	cephRoot   string
+	milestones []*milestone
+	alerts     *alertMonitor
+	started    time.Time
+	mu         sync.Mutex
+}
+
+// newMilestoneTracker counts the scan entries under each milestone: entries
+// in the source pool, or every entry in re-drain mode.
+func newMilestoneTracker(cephRoot, scanPath string, paths []string, opts *options, alerts *alertMonitor) (*milestoneTracker, error) {
+	t := &milestoneTracker{cephRoot: cephRoot, alerts: alerts, started: time.Now()}
+	for _, p := range paths {
+		t.milestones = append(t.milestones, &milestone{path: filepath.Clean(strings.TrimPrefix(p, "/"))})
+	}
+
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || (fields[0] != opts.srcPool && !opts.redrain) || !opts.shard.owns(fields[1]) {
+			continue
+		}
+		for _, ms := range t.match(filepath.Clean(fields[1])) {
+			ms.total++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, ms := range t.milestones {
+		if ms.total == 0 {
+			logf(LOG_WARN, "Warning: milestone %s has no files to migrate\n", displayPath(filepath.Join(cephRoot, ms.path)))
+		}
+	}
+	return t, nil
+}
+
+// match returns the milestones containing rel, a path relative to the root.
+func (t *milestoneTracker) match(rel string) []*milestone {
+	var found []*milestone
+	for _, ms := range t.milestones {
+		if rel == ms.path || strings.HasPrefix(rel, ms.path+"/") {
+			found = append(found, ms)
+		}
+	}
+	return found
+}
+
+func (t *milestoneTracker) forPath(absPath string) []*milestone {
+	if t == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(t.cephRoot, absPath)
+	if err != nil {
+		return nil
+	}
+	return t.match(rel)
+}
+
+func (t *milestoneTracker) migrated(absPath string, size int64) {
+	found := t.forPath(absPath)
+	if len(found) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ms := range found {
+		ms.migrated++
+		ms.bytes += size
+	}
+}
+
+func (t *milestoneTracker) failed(absPath string) {
+	found := t.forPath(absPath)
+	if len(found) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ms := range found {
+		ms.errors++
+	}
+}
+
+// settle marks the scan entry absPath as done, whatever its outcome.
+func (t *milestoneTracker) settle(absPath string) {
+	found := t.forPath(absPath)
+	if len(found) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ms := range found {
+		ms.settled++
+		if !ms.reached && ms.settled >= ms.total {
+			ms.reached = true
+			t.announce(ms)
+		}
+	}
+}
+
+func (t *milestoneTracker) announce(ms *milestone) {
+	message := fmt.Sprintf("subtree %s complete: %d of %d files migrated (%.2f MB), %d errors, %v after start of run",
+		displayPath(filepath.Join(t.cephRoot, ms.path)), ms.migrated, ms.total, mb(ms.bytes), ms.errors, time.Since(t.started).Round(time.Second))
+	t.alerts.send("milestone", message)
+}
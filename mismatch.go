@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// mismatchPolicy decides what happens to a file whose pool, read just before
+// it is migrated, is neither the source pool nor one of the --also-source
+// pools.
+type mismatchPolicy int
+
+const (
+	// MISMATCH_ERROR fails the file with E_POOL_MISMATCH.
+	MISMATCH_ERROR mismatchPolicy = iota
+	// MISMATCH_SKIP leaves the file where it is without an error.
+	MISMATCH_SKIP
+	// MISMATCH_MIGRATED counts a file in the destination pool or one of the
+	// --also-destination pools as already migrated, and fails any other.
+	MISMATCH_MIGRATED
+)
+
+// MISMATCH_POLICIES are the values of --on-mismatch.
+var MISMATCH_POLICIES = map[string]mismatchPolicy{
+	"error":    MISMATCH_ERROR,
+	"skip":     MISMATCH_SKIP,
+	"migrated": MISMATCH_MIGRATED,
+}
+
+func parseMismatchPolicy(name string) (mismatchPolicy, error) {
+	if p, ok := MISMATCH_POLICIES[name]; ok {
+		return p, nil
+	}
+	names := make([]string, 0, len(MISMATCH_POLICIES))
+	for n := range MISMATCH_POLICIES {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown policy %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// isSource reports whether files in pool are to be migrated.
+func (o *options) isSource(pool string) bool {
+	return pool == o.srcPool || o.extraSources[pool]
+}
+
+// isDestination reports whether files in pool count as migrated.
+func (o *options) isDestination(pool string) bool {
+	return pool == o.dstPool || o.extraDestinations[pool]
+}
+
+// handleMismatch applies --on-mismatch to absPath, found in pool instead of
+// a source pool. It reports whether the policy dealt with the file; if not,
+// the caller fails it with E_POOL_MISMATCH.
+func (m *migrator) handleMismatch(absPath, pool string) bool {
+	switch {
+	case m.opts.onMismatch == MISMATCH_SKIP:
+		m.skip(&m.stats.mismatched, absPath)
+	case m.opts.onMismatch == MISMATCH_MIGRATED && m.opts.isDestination(pool):
+		m.skip(&m.stats.inDest, absPath)
+	default:
+		return false
+	}
+	logf(LOG_DEBUG, "Skipping %s: in %s\n", displayPath(absPath), pool)
+	return true
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// mountConfig describes one CephFS mount processed in multi-mount mode.
+type mountConfig struct {
+	Name     string `json:"name"`
+	Root     string `json:"root"`
+	ScanFile string `json:"scan_file,omitempty"` // relative paths are resolved against Root
+	SrcPool  string `json:"src_pool"`
+	DstPool  string `json:"dst_pool"`
+}
+
+type mountsFile struct {
+	Mounts     []mountConfig `json:"mounts"`
+	Concurrent bool          `json:"concurrent"`
+}
+
+func loadMounts(path string) (*mountsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mf mountsFile
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, fmt.Errorf("invalid mounts file %s: %w", path, err)
+	}
+	if len(mf.Mounts) == 0 {
+		return nil, fmt.Errorf("mounts file %s lists no mounts", path)
+	}
+
+	names := make(map[string]bool)
+	for i := range mf.Mounts {
+		mnt := &mf.Mounts[i]
+		if mnt.Root == "" || mnt.SrcPool == "" || mnt.DstPool == "" {
+			return nil, fmt.Errorf("mount %d: root, src_pool and dst_pool are required", i+1)
+		}
+		if mnt.Name == "" {
+			mnt.Name = filepath.Base(mnt.Root)
+		}
+		if names[mnt.Name] {
+			return nil, fmt.Errorf("duplicate mount name %q", mnt.Name)
+		}
+		names[mnt.Name] = true
+
+		if mnt.ScanFile == "" {
+			mnt.ScanFile = SCAN_FILE
+		}
+		if !filepath.IsAbs(mnt.ScanFile) {
+			mnt.ScanFile = filepath.Join(mnt.Root, mnt.ScanFile)
+		}
+	}
+	return &mf, nil
+}
+
+type mountRun struct {
+	cfg     mountConfig
+	opts    options
+	stats   *runStats
+	err     error
+	elapsed time.Duration
+
+	analyzed int // source-pool entries counted by the analyze phase
+}
+
+// runMounts analyzes every configured mount, asks for a single confirmation
+// and then migrates them one after another or all at once, finishing with a
+// combined report. With resume set, each mount continues from its own
+// checkpoint if it has one. It returns the process exit status.
+func runMounts(mf *mountsFile, base *options, resume bool) (status int) {
+	runs := make([]*mountRun, len(mf.Mounts))
+	toMigrate := 0
+
+	for i, cfg := range mf.Mounts {
+		run := &mountRun{cfg: cfg, opts: *base}
+		run.opts.srcPool, run.opts.dstPool = cfg.SrcPool, cfg.DstPool
+		if err := checkPoolsAllowed(&run.opts, cfg.SrcPool, cfg.DstPool); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] Error: %v\n", cfg.Name, err)
+			return EXIT_FATAL
+		}
+		if base.failedFile != "" {
+			run.opts.failedFile = base.failedFile + "." + cfg.Name
+		}
+		if base.triageReport != "" {
+			run.opts.triageReport = base.triageReport + "." + cfg.Name
+		}
+		if base.inodeMap != "" {
+			run.opts.inodeMap = base.inodeMap + "." + cfg.Name
+		}
+		if base.btimeReport != "" {
+			run.opts.btimeReport = base.btimeReport + "." + cfg.Name
+		}
+		if base.summaryJSON != "" {
+			run.opts.summaryJSON = base.summaryJSON + "." + cfg.Name
+		}
+		if base.fileReport != "" {
+			run.opts.fileReport = base.fileReport + "." + cfg.Name
+		}
+		if base.checksumDB != "" {
+			run.opts.checksumDB = base.checksumDB + "." + cfg.Name
+		}
+		if base.stateDB != "" {
+			run.opts.stateDB = base.stateDB + "." + cfg.Name
+		}
+		if base.residual != "" {
+			run.opts.residual = base.residual + "." + cfg.Name
+		}
+		if base.auditLog != "" {
+			run.opts.auditLog = base.auditLog + "." + cfg.Name
+		}
+		lock, err := lockRun(cfg.Root, shardSpec{}, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] Error locking %s: %v\n", cfg.Name, cfg.Root, err)
+			return EXIT_FATAL
+		}
+		defer lock.release()
+		run.opts.checkpointPath = filepath.Join(cfg.Root, CHECKPOINT_FILE)
+		if resume {
+			cp, err := loadCheckpoint(run.opts.checkpointPath, cfg.ScanFile)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "[%s] Error loading checkpoint: %v\n", cfg.Name, err)
+				return EXIT_FATAL
+			}
+			run.opts.resume = cp
+		}
+		runs[i] = run
+
+		logf(LOG_INFO, "\n[%s] %s: %s -> %s (scan file %s)\n", cfg.Name, cfg.Root, cfg.SrcPool, cfg.DstPool, cfg.ScanFile)
+		if needsScan(cfg.ScanFile, &run.opts) {
+			if _, err := buildScanFile(cfg.Root, cfg.ScanFile); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] Error scanning %s: %v\n", cfg.Name, cfg.Root, err)
+				return EXIT_FATAL
+			}
+		}
+		poolStats, err := analyzePoolScan(cfg.ScanFile, shardSpec{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] Error analyzing scan file: %v\n", cfg.Name, err)
+			return EXIT_FATAL
+		}
+		logf(LOG_INFO, "[%s] Files in source pool: %d\n", cfg.Name, poolStats[cfg.SrcPool])
+		toMigrate += poolStats[cfg.SrcPool]
+		run.analyzed = poolStats[cfg.SrcPool]
+	}
+
+	defer notifySystemdReady()()
+	roots := make([]string, len(mf.Mounts))
+	for i, cfg := range mf.Mounts {
+		roots[i] = cfg.Root
+	}
+	notifier := newRunNotifier(&base.alerts, strings.Join(roots, ","))
+	for _, run := range runs {
+		run.opts.notifier = notifier
+	}
+	defer func() { notifier.finish(status) }()
+
+	mode := "sequentially"
+	if mf.Concurrent {
+		mode = "concurrently"
+	}
+	logf(LOG_INFO, "\nProceeding with migration of %d files across %d mounts (%s)\n", toMigrate, len(runs), mode)
+
+	if !base.dryRun {
+		if proceed, status := confirmMigration(base.assumeYes); !proceed {
+			return status
+		}
+	}
+
+	migrate := func(run *mountRun) {
+		startTime := time.Now()
+		run.stats, run.err = runMigration(context.Background(), run.cfg.Root, run.cfg.ScanFile, &run.opts, nil)
+		run.elapsed = time.Since(startTime)
+		if run.err == nil {
+			cpErr := finishCheckpoint(filepath.Join(run.cfg.Root, CHECKPOINT_FILE), run.cfg.ScanFile, run.stats, &run.opts)
+			recordRun(run.cfg.Root, run.cfg.ScanFile, &run.opts, run.stats, startTime, runOutcome(run.stats, &run.opts))
+			if cpErr != nil {
+				run.err = fmt.Errorf("saving checkpoint: %w", cpErr)
+			}
+		}
+	}
+
+	if mf.Concurrent {
+		var wg sync.WaitGroup
+		for _, run := range runs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				migrate(run)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for _, run := range runs {
+			logf(LOG_INFO, "\n=== Mount %s ===\n", run.cfg.Name)
+			migrate(run)
+		}
+	}
+
+	return printMountsReport(runs, base)
+}
+
+func printMountsReport(runs []*mountRun, base *options) int {
+	status := EXIT_OK
+	for _, run := range runs {
+		if run.err != nil {
+			continue
+		}
+		fmt.Printf("\n[%s]", run.cfg.Name)
+		printSummary(run.stats, &run.opts, run.elapsed)
+		checkParity(run.stats, &run.opts, run.analyzed)
+		reportResidual(run.cfg.Root, run.cfg.ScanFile, run.opts.residual, &run.opts, run.stats)
+	}
+
+	fmt.Println("\nCombined Report:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MOUNT\tSOURCE\tDESTINATION\tMIGRATED\tMB\tERRORS\tELAPSED\tOUTCOME")
+	var files, errors int
+	var bytes int64
+	for _, run := range runs {
+		if run.err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\tfailed: %v\n", run.cfg.Name, run.cfg.SrcPool, run.cfg.DstPool, run.err)
+			status = max(status, EXIT_FATAL)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.2f\t%d\t%v\t%s\n", run.cfg.Name, run.cfg.SrcPool, run.cfg.DstPool,
+			run.stats.migrated, mb(run.stats.bytesTotal), run.stats.errors, run.elapsed.Round(time.Second), runOutcome(run.stats, &run.opts))
+		files += run.stats.migrated
+		errors += run.stats.errors
+		bytes += run.stats.bytesTotal
+		status = max(status, exitStatus(run.stats))
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t\t%d\t%.2f\t%d\t\t\n", files, mb(bytes), errors)
+	tw.Flush()
+
+	if base.dryRun {
+		fmt.Println("\nThis was a dry run. No changes were made.")
+	}
+	return status
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ORDERS are the work orders selectable with --order. "scan" keeps the order
+// of the scan file.
+var ORDERS = []string{"scan", "smallest-first", "largest-first", "directory"}
+
+// orderStatWorkers is how many files are stat'ed concurrently to order them
+// by size.
+const orderStatWorkers = 16
+
+// orderedEntry is a scan file line with what it is sorted by.
+type orderedEntry struct {
+	line string
+	dir  string
+	size int64 // -1 if it could not be stat'ed
+}
+
+// orderedScanPath is where the reordered copy of scanPath is written. The
+// line numbers of a checkpoint refer to it, so --resume reuses it.
+func orderedScanPath(scanPath string) string {
+	return scanPath + ".ordered"
+}
+
+// orderScanFile writes the entries of scanPath the pass works on in the order
+// of --order and returns the path of the copy. Smallest-first shows progress
+// early, largest-first gets the long copies going while there is plenty of
+// work left to overlap them with, and directory keeps the files of each
+// directory together so their parent stays in the client's cache (and its
+// capabilities with this client) instead of being looked up again and again.
+// Entries the pass only counts, or leaves to other shards, keep their order
+// at the end.
+func orderScanFile(cephRoot, scanPath string, opts *options) (string, error) {
+	orderedPath := orderedScanPath(scanPath) + opts.shard.suffix()
+	if opts.resume != nil {
+		if _, err := os.Stat(orderedPath); err != nil {
+			return "", fmt.Errorf("the checkpoint refers to the lines of %s: %w", orderedPath, err)
+		}
+		return orderedPath, nil
+	}
+
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	start := time.Now()
+	var work []*orderedEntry
+	var rest []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != opts.srcPool && !opts.redrain || !opts.shard.owns(fields[1]) {
+			rest = append(rest, line)
+			continue
+		}
+		work = append(work, &orderedEntry{line: line, dir: filepath.Dir(filepath.Clean(fields[1]))})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	switch opts.order {
+	case "smallest-first", "largest-first":
+		logf(LOG_DEBUG, "Sizing %d files for --order %s...\n", len(work), opts.order)
+		statSizes(cephRoot, work)
+		largest := opts.order == "largest-first"
+		slices.SortStableFunc(work, func(a, b *orderedEntry) int {
+			// Files that could not be stat'ed go last either way; the
+			// pass reports them.
+			switch {
+			case a.size == b.size:
+				return 0
+			case a.size < 0:
+				return 1
+			case b.size < 0:
+				return -1
+			case largest == (a.size > b.size):
+				return -1
+			default:
+				return 1
+			}
+		})
+	case "directory":
+		slices.SortStableFunc(work, func(a, b *orderedEntry) int { return strings.Compare(a.dir, b.dir) })
+	}
+
+	tmpPath := orderedPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(out)
+	for _, e := range work {
+		fmt.Fprintln(w, e.line)
+	}
+	for _, line := range rest {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, orderedPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	logf(LOG_INFO, "Put %d files in %s order (%v)\n", len(work), opts.order, time.Since(start).Round(time.Millisecond))
+	return orderedPath, nil
+}
+
+// statSizes fills in the size of every entry.
+func statSizes(cephRoot string, entries []*orderedEntry) {
+	var wg sync.WaitGroup
+	next := make(chan *orderedEntry)
+	for range orderStatWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range next {
+				e.size = -1
+				mdsOps(1)
+				if info, err := os.Stat(filepath.Join(cephRoot, strings.Fields(e.line)[1])); err == nil && info.Mode().IsRegular() {
+					e.size = info.Size()
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		next <- e
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pageCacheCheckInterval limits how often /proc/meminfo is read.
+const pageCacheCheckInterval = time.Second
+
+// pageCache is set by --max-cache. It caps the dirty page-cache data the
+// migration can build up on the client: written bytes are counted, and once
+// they (or the dirty and writeback totals in /proc/meminfo) exceed the cap
+// the writer blocks in syncfs until the data has reached the OSDs. Pages of
+// finished files are dropped with fadvise so clean cache does not pile up
+// either. It is nil when no cap is set.
+var pageCache *cacheLimiter
+
+// noCache is set by --no-cache: sources are read with sequential read-ahead
+// and the pages of every file are dropped once it is copied, so a bulk
+// migration does not evict the rest of the client's page cache. Pages of a
+// copy that are still dirty stay until written back.
+var noCache bool
+
+type cacheLimiter struct {
+	max       int64
+	written   atomic.Int64 // bytes written since the last sync
+	syncs     atomic.Int64
+	mu        sync.Mutex // serializes syncs
+	checkMu   sync.Mutex
+	lastCheck time.Time
+}
+
+func newCacheLimiter(max int64) *cacheLimiter {
+	return &cacheLimiter{max: max}
+}
+
+// wrote accounts n bytes written to f and syncs the filesystem of f when
+// the cap is exceeded.
+func (c *cacheLimiter) wrote(f *os.File, n int) {
+	over := c.written.Add(int64(n)) > c.max
+	if !over && !c.systemDirty() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another writer may have synced while this one waited.
+	if over && c.written.Load() <= c.max {
+		return
+	}
+	syncFilesystem(f)
+	c.written.Store(0)
+	c.syncs.Add(1)
+}
+
+// systemDirty reports whether /proc/meminfo shows more dirty and writeback
+// data than the cap, checking at most once per pageCacheCheckInterval.
+func (c *cacheLimiter) systemDirty() bool {
+	c.checkMu.Lock()
+	defer c.checkMu.Unlock()
+	if time.Since(c.lastCheck) < pageCacheCheckInterval {
+		return false
+	}
+	c.lastCheck = time.Now()
+	dirty, err := meminfoDirty()
+	return err == nil && dirty > c.max
+}
+
+// cacheWriter feeds every write to a file into accountWrite.
+type cacheWriter struct {
+	f *os.File
+}
+
+func (w cacheWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	accountWrite(w.f, n)
+	return n, err
+}
+
+// cappedWriter returns dst itself when neither the page cache nor the
+// bandwidth is capped.
+func cappedWriter(dst *os.File) io.Writer {
+	if pageCache == nil && bandwidth == nil {
+		return dst
+	}
+	return cacheWriter{f: dst}
+}
+
+// dropCache asks the kernel to drop the cached pages of files the
+// migration is done with.
+func dropCache(files ...*os.File) {
+	if pageCache == nil && !noCache {
+		return
+	}
+	for _, f := range files {
+		dropFileCache(f)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkParity cross-checks a completed pass against the analyze phase: the
+// migration must have seen as many source-pool entries as analyze counted,
+// and every one of them must have ended in exactly one outcome. Re-drain,
+// resumed and deadline-limited runs cover a different set of entries and are
+// not checked. It reports whether the counts agree.
+func checkParity(stats *runStats, opts *options, analyzed int) bool {
+	if opts.redrain || opts.resume != nil || stats.deadlineHit {
+		return true
+	}
+
+	failed := stats.errors - stats.errorCodes[E_POOL_DENIED]
+	accounted := stats.migrated + failed + stats.sampledOut + stats.quiesced + stats.growing + stats.excluded + stats.notRegular + stats.alreadyDone +
+		stats.mismatched + stats.inDest
+	if stats.srcEntries == analyzed && accounted == stats.srcEntries {
+		logf(LOG_INFO, "Parity check:     OK (%d source entries)\n", analyzed)
+		return true
+	}
+
+	stats.parityMismatch = true
+	fmt.Fprintf(os.Stderr, "\n*** PARITY CHECK FAILED ***\n")
+	fmt.Fprintf(os.Stderr, "Analyze counted %d source-pool entries, the migration pass saw %d.\n", analyzed, stats.srcEntries)
+	fmt.Fprintf(os.Stderr, "Outcomes account for %d: migrated %d + failed %d + sampled out %d + still active %d + growing %d + canary %d + not regular %d + already migrated %d + other pool %d + in destination %d.\n",
+		accounted, stats.migrated, failed, stats.sampledOut, stats.quiesced, stats.growing, stats.excluded, stats.notRegular, stats.alreadyDone, stats.mismatched, stats.inDest)
+	return false
+}
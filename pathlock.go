@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pathLocks serializes the stages working on the same path: a worker
+// migrating a file holds it from its lookup to its rename, and a verifier
+// holds it while checking the result, so neither sees the path between the
+// rename and the bookkeeping of the other. A scan file listing a path twice
+// would otherwise let two workers copy into the same temp file.
+var pathLocks keyedMutex
+
+// keyedMutex is a mutex per key. Keys nobody holds or waits for take no
+// memory.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu       sync.Mutex
+	refs     int // tickets not unlocked yet
+	releases atomic.Uint64
+}
+
+// keyTicket is a claim on a key taken before locking it, e.g. when the
+// prefetch stage looks a file up ahead of its worker. Every ticket must be
+// locked and unlocked once.
+type keyTicket struct {
+	k        *keyedMutex
+	key      string
+	l        *keyedLock
+	releases uint64
+}
+
+func (k *keyedMutex) ticket(key string) *keyTicket {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l := k.locks[key]
+	if l == nil {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return &keyTicket{k: k, key: key, l: l, releases: l.releases.Load()}
+}
+
+// lock acquires key and returns the function releasing it, which may be
+// called more than once.
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	unlock, _ = k.ticket(key).lock()
+	return unlock
+}
+
+// lock acquires the key of the ticket and reports whether another holder
+// released it since the ticket was taken, which makes anything learned about
+// the path in between stale.
+func (t *keyTicket) lock() (unlock func(), changed bool) {
+	t.l.mu.Lock()
+	changed = t.l.releases.Load() != t.releases
+	released := false
+	return func() {
+		if released {
+			return
+		}
+		released = true
+		t.l.releases.Add(1)
+		t.l.mu.Unlock()
+		t.k.mu.Lock()
+		if t.l.refs--; t.l.refs == 0 {
+			delete(t.k.locks, t.key)
+		}
+		t.k.mu.Unlock()
+	}, changed
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// pauseGate holds dispatch while the operator has paused the run with
+// pauseSignal, until resumeSignal. Files in flight carry on.
+type pauseGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	since  time.Time
+}
+
+var dispatchPause = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused, g.since = true, time.Now()
+		fmt.Fprintln(os.Stderr, "\nPaused: files in flight finish, no new ones start until SIGUSR2")
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		g.cond.Broadcast()
+		fmt.Fprintf(os.Stderr, "\nResumed after %v\n", time.Since(g.since).Round(time.Second))
+	}
+}
+
+// wait blocks while the run is paused and returns how long it blocked.
+func (g *pauseGate) wait() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return 0
+	}
+	start := time.Now()
+	for g.paused {
+		g.cond.Wait()
+	}
+	return time.Since(start)
+}
+
+// watchPauseSignals pauses dispatch on pauseSignal and resumes it on
+// resumeSignal, on platforms that have them.
+func watchPauseSignals() {
+	if pauseSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, pauseSignal, resumeSignal)
+	go func() {
+		for sig := range ch {
+			if sig == pauseSignal {
+				dispatchPause.pause()
+			} else {
+				dispatchPause.resume()
+			}
+		}
+	}()
+}
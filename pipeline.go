@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stallCheckInterval is how often the stall watchdog samples the pipeline.
+const stallCheckInterval = 10 * time.Second
+
+// queueDepths is a sample of the files each pipeline stage holds. A stage
+// whose upstream is waiting to hand it work is the bottleneck.
+type queueDepths struct {
+	scanWait   int // scan loop blocked on a full stage
+	lookup     int // pool xattr and stat lookups running (--prefetch)
+	copyWait   int // files looked up and waiting for a worker
+	copying    int // files being copied and renamed
+	verifyWait int // migrated files queued for verification
+	verifying  int
+}
+
+// pending reports whether any file is between dispatch and its last stage.
+func (q queueDepths) pending() bool {
+	return q.lookup+q.copyWait+q.copying+q.verifyWait+q.verifying > 0
+}
+
+func (q queueDepths) max(o queueDepths) queueDepths {
+	return queueDepths{max(q.scanWait, o.scanWait), max(q.lookup, o.lookup), max(q.copyWait, o.copyWait),
+		max(q.copying, o.copying), max(q.verifyWait, o.verifyWait), max(q.verifying, o.verifying)}
+}
+
+func (q queueDepths) String() string {
+	parts := []string{fmt.Sprintf("copy %d+%d waiting", q.copying, q.copyWait)}
+	if q.lookup > 0 {
+		parts = append([]string{fmt.Sprintf("lookup %d", q.lookup)}, parts...)
+	}
+	if q.verifying+q.verifyWait > 0 {
+		parts = append(parts, fmt.Sprintf("verify %d+%d queued", q.verifying, q.verifyWait))
+	}
+	if q.scanWait > 0 {
+		parts = append(parts, "scan blocked")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// queueDepths samples every stage and records the peaks in the stats.
+func (m *migrator) queueDepths() queueDepths {
+	var q queueDepths
+	q.copying, q.copyWait = m.pool.depth()
+	if m.prefetch != nil {
+		lookups, blocked := m.prefetch.depth()
+		// Prefetch jobs hand their file to the workers themselves, so the
+		// ones waiting for a worker are still counted as active here.
+		q.lookup, q.scanWait = max(0, lookups-q.copyWait), blocked
+	} else {
+		q.scanWait, q.copyWait = q.copyWait, 0
+	}
+	if m.verifier != nil {
+		q.verifying, q.verifyWait = m.verifier.depth()
+	}
+
+	m.mu.Lock()
+	m.stats.queuePeak = m.stats.queuePeak.max(q)
+	m.mu.Unlock()
+	return q
+}
+
+// completions counts the files that left the pipeline so far.
+func (m *migrator) completions() int64 {
+	n := m.completed.Load()
+	if m.verifier != nil {
+		n += m.verifier.completed.Load()
+	}
+	return n
+}
+
+// watchStalls starts a watchdog that reports a stall when the pipeline holds
+// files but none completes within timeout, as happens when an MDS session
+// hangs. Each stall is reported once, with a diagnostics dump, and the
+// watchdog re-arms when files complete again. The returned function stops it.
+func (m *migrator) watchStalls(timeout time.Duration) (stop func()) {
+	alerts := m.alerts
+	if alerts == nil {
+		alerts = newAlertMonitor(&m.opts.alerts, m.cephRoot)
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(min(stallCheckInterval, timeout))
+		defer ticker.Stop()
+
+		last, since, stalled := m.completions(), time.Now(), false
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			q := m.queueDepths()
+			if n := m.completions(); n != last || !q.pending() {
+				if stalled {
+					fmt.Fprintf(os.Stderr, "\nPipeline moving again after %v\n", time.Since(since).Round(time.Second))
+					systemdWatchdog.setStalled(false)
+				}
+				last, since, stalled = n, time.Now(), false
+				continue
+			}
+			if !stalled && time.Since(since) >= timeout {
+				stalled = true
+				m.reportStall(alerts, time.Since(since), q)
+				systemdWatchdog.setStalled(true)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// reportStall counts a stall, writes the diagnostics dump and alerts.
+func (m *migrator) reportStall(alerts *alertMonitor, stalled time.Duration, q queueDepths) {
+	m.mu.Lock()
+	m.stats.stalls++
+	m.mu.Unlock()
+
+	message := fmt.Sprintf("no file completed for %v (%s)", stalled.Round(time.Second), q)
+	dumpPath := filepath.Join(os.TempDir(), fmt.Sprintf("migxattrs-stall-%d-%s.txt", os.Getpid(), time.Now().Format("20060102T150405")))
+	if err := m.writeStallDump(dumpPath, message, q); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError writing stall diagnostics: %v\n", err)
+	} else {
+		message += "; diagnostics in " + dumpPath
+	}
+	alerts.send("stall", message)
+}
+
+// writeStallDump saves what is needed to find out where the pipeline hangs:
+// the files in flight with their age, the requests the Ceph client is
+// waiting on, and the stack of every goroutine.
+func (m *migrator) writeStallDump(path, message string, q queueDepths) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "migxattrs stall at %s: %s\n\n", time.Now().Format(time.RFC3339), message)
+
+	m.mu.Lock()
+	type inflight struct {
+		path string
+		age  time.Duration
+	}
+	files := make([]inflight, 0, len(m.inflight))
+	for absPath, started := range m.inflight {
+		files = append(files, inflight{absPath, time.Since(started)})
+	}
+	m.mu.Unlock()
+	slices.SortFunc(files, func(a, b inflight) int { return int(b.age - a.age) })
+	fmt.Fprintf(w, "Files in flight (%d), oldest first:\n", len(files))
+	for _, f := range files {
+		fmt.Fprintf(w, "  %10v  %s\n", f.age.Round(time.Second), displayPath(f.path))
+	}
+
+	fmt.Fprintln(w, "\nCeph client requests:")
+	writeClientRequests(w, m.opts.clientAsok)
+
+	fmt.Fprintln(w, "\nGoroutines:")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeClientRequests copies the MDS and OSD requests the kernel clients
+// have outstanding, or those of a ceph-fuse admin socket, into w.
+func writeClientRequests(w *bufio.Writer, asok string) {
+	dirs, _ := filepath.Glob(filepath.Join(CEPH_DEBUGFS, "*"))
+	for _, dir := range dirs {
+		for _, name := range []string{"mdsc", "osdc"} {
+			if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				fmt.Fprintf(w, "%s:\n%s\n", filepath.Join(dir, name), data)
+			}
+		}
+	}
+	if asok == "" {
+		if socks, _ := filepath.Glob(CEPH_ASOK_GLOB); len(socks) > 0 {
+			asok = socks[0]
+		}
+	}
+	if asok != "" {
+		if data, err := adminSocketCommand(asok, "mds_requests"); err == nil {
+			fmt.Fprintf(w, "%s mds_requests:\n%s\n", asok, data)
+		} else {
+			fmt.Fprintf(w, "%s: %v\n", asok, err)
+		}
+	}
+	if len(dirs) == 0 && asok == "" {
+		fmt.Fprintf(w, "  none found in %s or %s\n", CEPH_DEBUGFS, CEPH_ASOK_GLOB)
+	}
+}
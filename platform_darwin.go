@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const errnoNoXattr = unix.ENOATTR
+
+var pauseSignal, resumeSignal os.Signal = unix.SIGUSR1, unix.SIGUSR2
+
+func renameExchange(from, to string) error {
+	return unix.RenamexNp(from, to, unix.RENAME_SWAP)
+}
+
+func renameNoReplace(from, to string) error {
+	return unix.RenamexNp(from, to, unix.RENAME_EXCL)
+}
+
+// syncFilesystem has no per-filesystem variant on macOS and syncs everything.
+func syncFilesystem(f *os.File) {
+	unix.Sync()
+}
+
+func adviseSequential(f *os.File) {}
+
+func dropFileCache(f *os.File) {}
+
+func sysFallocate(f *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
+
+func watchWrites(path string, onWrite func()) (stop func() bool, err error) {
+	return nil, errors.New("watching for writes is only supported on Linux")
+}
+
+func setPriority(nice, ioClass, ioLevel int) error {
+	if ioClass != 0 {
+		return errors.New("I/O priorities are only supported on Linux")
+	}
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, nice)
+}
+
+func statAtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atimespec.Unix())
+}
+
+func statCtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctimespec.Unix())
+}
+
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Birthtimespec.Unix()), true
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TIOCGETA)
+	return err == nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const errnoNoXattr = unix.ENODATA
+
+// pauseSignal and resumeSignal pause and resume dispatching new files.
+var pauseSignal, resumeSignal os.Signal = unix.SIGUSR1, unix.SIGUSR2
+
+func sysFallocate(f *os.File, size int64) error {
+	return unix.Fallocate(int(f.Fd()), 0, 0, size)
+}
+
+func renameExchange(from, to string) error {
+	return unix.Renameat2(unix.AT_FDCWD, from, unix.AT_FDCWD, to, unix.RENAME_EXCHANGE)
+}
+
+func renameNoReplace(from, to string) error {
+	return unix.Renameat2(unix.AT_FDCWD, from, unix.AT_FDCWD, to, unix.RENAME_NOREPLACE)
+}
+
+// syncFilesystem flushes the dirty data of the whole filesystem holding f.
+func syncFilesystem(f *os.File) {
+	unix.Syncfs(int(f.Fd()))
+}
+
+func adviseSequential(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+func dropFileCache(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// setPriority applies the nice value and I/O priority to every thread of the
+// process. On Linux both are per-thread attributes; threads the Go runtime
+// starts later are cloned from existing ones and inherit them.
+func setPriority(nice, ioClass, ioLevel int) error {
+	tids, err := processThreads()
+	if err != nil {
+		return err
+	}
+
+	for _, tid := range tids {
+		if nice != 0 {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+				return fmt.Errorf("failed to set nice %d on thread %d: %w", nice, tid, err)
+			}
+		}
+		if ioClass != 0 {
+			prio := ioClass<<IOPRIO_CLASS_SHIFT | ioLevel
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, uintptr(tid), uintptr(prio)); errno != 0 {
+				return fmt.Errorf("failed to set I/O priority on thread %d: %w", tid, errno)
+			}
+		}
+	}
+	return nil
+}
+
+func processThreads() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+
+	tids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+func statAtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atim.Unix())
+}
+
+func statCtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctim.Unix())
+}
+
+// fileBirthTime reads the birth time with statx, which reports whether the
+// filesystem provides one.
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// watchWrites reports writes to path through inotify until stop is called:
+// onWrite runs once on the first IN_MODIFY or IN_CLOSE_WRITE, and stop
+// returns whether there was one, including any still queued. Only writes
+// made through this host's mount are seen.
+func watchWrites(path string, onWrite func()) (stop func() bool, err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, path, unix.IN_MODIFY|unix.IN_CLOSE_WRITE); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// A non-blocking descriptor is read through the runtime poller, so a
+	// read deadline can end the watch.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	var written atomic.Bool
+	done := make(chan struct{})
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	go func() {
+		defer close(done)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if inotifyWrite(buf[:n]) && !written.Swap(true) {
+				onWrite()
+			}
+		}
+	}()
+	return func() bool {
+		f.SetReadDeadline(time.Now())
+		<-done
+		if conn, err := f.SyscallConn(); err == nil && !written.Load() {
+			conn.Read(func(fd uintptr) bool {
+				if n, err := unix.Read(int(fd), buf); err == nil && inotifyWrite(buf[:n]) {
+					written.Store(true)
+				}
+				return true
+			})
+		}
+		f.Close()
+		return written.Load()
+	}, nil
+}
+
+// inotifyWrite reports whether the inotify events in buf include a write,
+// or an overflow that may have hidden one.
+func inotifyWrite(buf []byte) bool {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		if ev.Mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE|unix.IN_Q_OVERFLOW) != 0 {
+			return true
+		}
+		buf = buf[min(len(buf), unix.SizeofInotifyEvent+int(ev.Len)):]
+	}
+	return false
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows has no user signals to pause and resume a run with.
+var pauseSignal, resumeSignal os.Signal
+
+func renameExchange(from, to string) error {
+	return errors.ErrUnsupported
+}
+
+// renameNoReplace relies on MoveFileEx failing when to exists, since it is
+// called without MOVEFILE_REPLACE_EXISTING.
+func renameNoReplace(from, to string) error {
+	fromPtr, err := windows.UTF16PtrFromString(from)
+	if err != nil {
+		return err
+	}
+	toPtr, err := windows.UTF16PtrFromString(to)
+	if err != nil {
+		return err
+	}
+	return windows.MoveFileEx(fromPtr, toPtr, 0)
+}
+
+func syncFilesystem(f *os.File) {
+	f.Sync()
+}
+
+func adviseSequential(f *os.File) {}
+
+func dropFileCache(f *os.File) {}
+
+func sysFallocate(f *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
+
+func watchWrites(path string, onWrite func()) (stop func() bool, err error) {
+	return nil, errors.New("watching for writes is only supported on Linux")
+}
+
+func setPriority(nice, ioClass, ioLevel int) error {
+	return errors.New("process priorities are not supported on Windows")
+}
+
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
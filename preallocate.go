@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// preallocateCopies makes copies reserve their full size before the data is
+// written (--preallocate).
+var preallocateCopies bool
+
+// preallocate reserves size bytes for dst before the copy starts, letting
+// CephFS allocate the layout up front and a full pool fail the file at once
+// rather than after most of it was copied. Where fallocate is unsupported,
+// as by the CephFS kernel client, the free space the filesystem reports is
+// checked instead.
+func preallocate(dst *os.File, size int64) error {
+	if !preallocateCopies || size == 0 {
+		return nil
+	}
+	err := sysFallocate(dst, size)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return codeErrorf(E_NOSPC, "failed to preallocate %.2f MB: %w", mb(size), err)
+	}
+	if free, err := freeSpace(filepath.Dir(dst.Name())); err == nil && free < size {
+		return codeErrorf(E_NOSPC, "only %.2f MB free for a %.2f MB file", mb(free), mb(size))
+	}
+	return nil
+}
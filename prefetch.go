@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileLookup is the metadata of a scan entry, read by the prefetch stage
+// while earlier files are still being copied.
+type fileLookup struct {
+	pool    []byte
+	poolErr error
+	info    os.FileInfo
+	statErr error
+	ticket  *keyTicket // taken before the lookup by the prefetch stage
+}
+
+// lookupFile reads the pool xattr and stats absPath. In re-drain mode a file
+// that already left the source pools is not stat'ed.
+func lookupFile(absPath string, opts *options) *fileLookup {
+	l := &fileLookup{}
+	mdsOps(1)
+	l.pool, l.poolErr = getXattr(absPath)
+	if opts.redrain && (l.poolErr != nil || !opts.isSource(string(l.pool))) {
+		return l
+	}
+	mdsOps(1)
+	l.info, l.statErr = os.Stat(absPath)
+	return l
+}
+
+// lookupFile looks up absPath and reports the latency to the adaptive
+// controller.
+func (m *migrator) lookupFile(absPath string) *fileLookup {
+	start := time.Now()
+	l := lookupFile(absPath, m.opts)
+	m.adaptive.observeStat(time.Since(start))
+	return l
+}
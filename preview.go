@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// previewWorkers is how many files the preview stats concurrently.
+	previewWorkers = 16
+	// previewTopDirs is how many top-level directories the preview lists.
+	previewTopDirs = 10
+	// cephDfTimeout bounds the "ceph df" query for the destination pool.
+	cephDfTimeout = 10 * time.Second
+)
+
+// previewDir is the share of one top-level directory in a preview.
+type previewDir struct {
+	name  string
+	files int
+	bytes int64
+}
+
+// migrationPreview describes what a run is about to migrate, gathered from
+// the source-pool entries of the scan file before the operator confirms.
+type migrationPreview struct {
+	files       int
+	missing     int // entries that could not be stat'ed
+	bytes       int64
+	largest     string
+	largestSize int64
+	dirs        map[string]*previewDir
+}
+
+// buildPreview stats every source-pool entry of the scan file.
+func buildPreview(cephRoot, scanPath string, opts *options) (*migrationPreview, error) {
+	paths, err := loadScanPool(scanPath, opts.srcPool)
+	if err != nil {
+		return nil, err
+	}
+	paths = slices.DeleteFunc(paths, func(rel string) bool { return !opts.shard.owns(rel) })
+	logf(LOG_INFO, "\nGathering a preview of %d files...\n", len(paths))
+
+	p := &migrationPreview{dirs: make(map[string]*previewDir)}
+	var mu sync.Mutex
+	pool := newWorkerPool(previewWorkers)
+	for _, rel := range paths {
+		pool.submit(func() {
+			info, err := os.Stat(filepath.Join(cephRoot, rel))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || !info.Mode().IsRegular() {
+				p.missing++
+				return
+			}
+			top, _, _ := strings.Cut(rel, string(filepath.Separator))
+			if top == rel {
+				top = "."
+			}
+			d := p.dirs[top]
+			if d == nil {
+				d = &previewDir{name: top}
+				p.dirs[top] = d
+			}
+			d.files++
+			d.bytes += info.Size()
+			p.files++
+			p.bytes += info.Size()
+			if info.Size() > p.largestSize || p.largest == "" {
+				p.largest, p.largestSize = filepath.Join(cephRoot, rel), info.Size()
+			}
+		})
+	}
+	pool.wait()
+	return p, nil
+}
+
+// print shows the preview together with the destination pool headroom and
+// an estimate of the duration from earlier runs in the history.
+func (p *migrationPreview) print(cephRoot string, opts *options) {
+	scale := opts.sampleRate
+	files, bytes := int(float64(p.files)*scale), int64(float64(p.bytes)*scale)
+
+	logf(LOG_INFO, "\nPreview:\n")
+	logf(LOG_INFO, "  Files:          %d (%.2f GB)\n", files, gb(bytes))
+	if opts.sampleRate < 1 {
+		logf(LOG_INFO, "                  sampled from %d files (%.2f GB)\n", p.files, gb(p.bytes))
+	}
+	if p.missing > 0 {
+		logf(LOG_INFO, "  Not found:      %d scan entries\n", p.missing)
+	}
+	if p.largest != "" {
+		logf(LOG_INFO, "  Largest file:   %s (%.2f GB)\n", displayPath(p.largest), gb(p.largestSize))
+	}
+
+	dirs := make([]*previewDir, 0, len(p.dirs))
+	for _, d := range p.dirs {
+		dirs = append(dirs, d)
+	}
+	slices.SortFunc(dirs, func(a, b *previewDir) int {
+		if a.bytes != b.bytes {
+			return int(b.bytes - a.bytes)
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	logf(LOG_INFO, "  By top-level directory:\n")
+	for i, d := range dirs {
+		if i == previewTopDirs {
+			var rest previewDir
+			for _, d := range dirs[i:] {
+				rest.files += d.files
+				rest.bytes += d.bytes
+			}
+			logf(LOG_INFO, "    %10d files %10.2f GB  (%d more directories)\n", rest.files, gb(rest.bytes), len(dirs)-i)
+			break
+		}
+		logf(LOG_INFO, "    %10d files %10.2f GB  %s\n", d.files, gb(d.bytes), displayPath(d.name))
+	}
+
+	if avail, source, err := poolAvailable(opts.dstPool, cephRoot); err != nil {
+		logf(LOG_INFO, "  Destination:    free space unknown: %v\n", err)
+	} else if avail < bytes {
+		logf(LOG_INFO, "  Destination:    %.2f GB available (%s), %.2f GB SHORT of the data to migrate\n", gb(avail), source, gb(bytes-avail))
+	} else {
+		logf(LOG_INFO, "  Destination:    %.2f GB available (%s), %.2f GB left after the migration\n", gb(avail), source, gb(avail-bytes))
+	}
+
+	if rate, runs := historyThroughput(opts.historyFile, cephRoot); rate > 0 {
+		eta := time.Duration(float64(bytes) / rate * float64(time.Second))
+		if capped := throttledTime(eta, files, bytes, opts); capped > eta {
+			logf(LOG_INFO, "  Estimated time: %s with the configured limits, %s at the %.2f MB/s of %d earlier runs\n", formatETA(capped), formatETA(eta), mb(int64(rate)), runs)
+		} else {
+			logf(LOG_INFO, "  Estimated time: %s at %.2f MB/s (from %d earlier runs)\n", formatETA(eta), mb(int64(rate)), runs)
+		}
+	} else {
+		logf(LOG_INFO, "  Estimated time: unknown, no earlier runs of this root in the history\n")
+	}
+}
+
+func gb(bytes int64) float64 {
+	return float64(bytes) / (1 << 30)
+}
+
+// poolAvailable returns the space pool can still take, from "ceph df" when
+// the cluster can be queried, or else the free space of the filesystem
+// holding cephRoot. source says which one it is.
+func poolAvailable(pool, cephRoot string) (avail int64, source string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cephDfTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, "ceph", "df", "--format", "json").Output(); err == nil {
+		var df struct {
+			Pools []struct {
+				Name  string `json:"name"`
+				Stats struct {
+					MaxAvail int64 `json:"max_avail"`
+				} `json:"stats"`
+			} `json:"pools"`
+		}
+		if err := json.Unmarshal(out, &df); err == nil {
+			for _, p := range df.Pools {
+				if p.Name == pool {
+					return p.Stats.MaxAvail, "ceph df", nil
+				}
+			}
+		}
+	}
+	free, err := freeSpace(cephRoot)
+	return free, "filesystem free space", err
+}
+
+// historyThroughput returns the average bytes per second of the earlier
+// runs over cephRoot that migrated data, and how many there were.
+func historyThroughput(historyFile, cephRoot string) (float64, int) {
+	if historyFile == "" {
+		return 0, 0
+	}
+	records, err := loadHistory(historyFile)
+	if err != nil {
+		return 0, 0
+	}
+	var bytes int64
+	var elapsed time.Duration
+	runs := 0
+	for _, rec := range records {
+		if rec.Root != cephRoot || rec.Bytes == 0 || rec.duration() <= 0 {
+			continue
+		}
+		bytes += rec.Bytes
+		elapsed += rec.duration()
+		runs++
+	}
+	if runs == 0 {
+		return 0, 0
+	}
+	return float64(bytes) / elapsed.Seconds(), runs
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	IOPRIO_CLASS_SHIFT = 13
+	IOPRIO_WHO_PROCESS = 1
+)
+
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// parseIoniceClass accepts a class name or its numeric value (1-3).
+func parseIoniceClass(s string) (int, error) {
+	if class, ok := ioniceClasses[s]; ok {
+		return class, nil
+	}
+	class, err := strconv.Atoi(s)
+	if err != nil || class < 1 || class > 3 {
+		return 0, fmt.Errorf("unknown ionice class %q (want idle, best-effort or realtime)", s)
+	}
+	return class, nil
+}
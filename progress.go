@@ -0,0 +1,569 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// terminalProgressInterval is how often the progress line is redrawn.
+	terminalProgressInterval = 5 * time.Second
+	// verboseProgressLines is how many scan lines apart --log-level debug prints
+	// the progress line, between the per-file messages.
+	verboseProgressLines = 10000
+	// progressRateWindow is about how far back the throughput on the
+	// progress line, and the ETA drawn from it, reaches.
+	progressRateWindow = time.Minute
+	// progressBarWidth is the number of cells of the progress bar.
+	progressBarWidth = 20
+)
+
+// progressSnapshot is the state of a pass handed to the progress sinks.
+type progressSnapshot struct {
+	Time         time.Time         `json:"time"`
+	Host         string            `json:"host"`
+	Root         string            `json:"root"`
+	Lines        int               `json:"lines"`
+	SrcEntries   int               `json:"src_entries"`
+	Expected     int               `json:"expected_files,omitempty"`
+	ExpectedSize int64             `json:"expected_bytes,omitempty"`
+	Migrated     int               `json:"migrated"`
+	Bytes        int64             `json:"bytes"`
+	Errors       int               `json:"errors"`
+	VerifyFailed int               `json:"verify_failed,omitempty"`
+	ErrorCodes   map[errorCode]int `json:"error_codes,omitempty"`
+	Queues       map[string]int    `json:"queues"`
+	ElapsedSec   float64           `json:"elapsed_sec"`
+	ETA          string            `json:"eta,omitempty"`
+	Final        bool              `json:"final,omitempty"`
+
+	eta    string // with its label, ETA holds just the estimate
+	done   int    // source entries the pass got through, as counted for the ETA
+	queues queueDepths
+	client *clientSample // nil without --client-stats
+}
+
+// progressSink receives the progress of every pass. due is asked on every
+// scan line and must be cheap; a snapshot is only taken when a sink wants
+// one. finish is called with the last snapshot of each pass.
+type progressSink interface {
+	due(now time.Time, lines int) bool
+	report(s *progressSnapshot)
+	finish(s *progressSnapshot)
+}
+
+// PROGRESS_SINKS are the sinks selectable with --progress NAME[:ARG]. A new
+// sink only needs to implement progressSink and be listed here.
+var PROGRESS_SINKS = map[string]func(arg string, opts *options) (progressSink, error){
+	"terminal": func(arg string, opts *options) (progressSink, error) {
+		return &terminalSink{deadline: opts.deadline, every: progressTimer{interval: terminalProgressInterval}}, nil
+	},
+	"jsonl":   newJSONLSink,
+	"fd":      newFDSink,
+	"status":  newStatusFileSink,
+	"http":    newHTTPSink,
+	"metrics": newMetricsSink,
+}
+
+// parseProgressSinks opens the sinks named by --progress. Without any, the
+// progress line is shown on the terminal; agents also report to their
+// coordinator, and systemd units to systemd.
+func parseProgressSinks(specs []string, opts *options) ([]progressSink, error) {
+	if len(specs) == 0 {
+		specs = []string{"terminal"}
+	}
+	var sinks []progressSink
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		open, ok := PROGRESS_SINKS[name]
+		if !ok {
+			names := make([]string, 0, len(PROGRESS_SINKS))
+			for n := range PROGRESS_SINKS {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown progress sink %q (available: %s)", name, strings.Join(names, ", "))
+		}
+		sink, err := open(arg, opts)
+		if err != nil {
+			return nil, fmt.Errorf("progress sink %s: %w", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if opts.agent {
+		sinks = append(sinks, &agentSink{every: progressTimer{interval: agentReportInterval}})
+	}
+	if underSystemd() {
+		sinks = append(sinks, &systemdSink{every: progressTimer{interval: systemdStatusInterval}})
+	}
+	return sinks, nil
+}
+
+// progressTimer makes a sink due every interval.
+type progressTimer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *progressTimer) due(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last.IsZero() {
+		t.last = now
+	}
+	if now.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = now
+	return true
+}
+
+// progressReporter feeds the sinks of one pass.
+type progressReporter struct {
+	m     *migrator
+	sinks []progressSink
+	start time.Time
+	host  string
+}
+
+func newProgressReporter(m *migrator, sinks []progressSink) *progressReporter {
+	host, _ := os.Hostname()
+	return &progressReporter{m: m, sinks: sinks, start: time.Now(), host: host}
+}
+
+// tick is called for every scan line and reports to the sinks that are due.
+func (r *progressReporter) tick(lines int) {
+	now := time.Now()
+	var snap *progressSnapshot
+	for _, sink := range r.sinks {
+		if !sink.due(now, lines) {
+			continue
+		}
+		if snap == nil {
+			snap = r.snapshot()
+		}
+		sink.report(snap)
+	}
+}
+
+// observeCopy hands the duration of a file copy to the sinks that want it.
+func (r *progressReporter) observeCopy(d time.Duration, size int64) {
+	for _, sink := range r.sinks {
+		if o, ok := sink.(copyObserver); ok {
+			o.observeCopy(d, size)
+		}
+	}
+}
+
+// finish hands the final state of the pass to every sink.
+func (r *progressReporter) finish() {
+	snap := r.snapshot()
+	snap.Final = true
+	for _, sink := range r.sinks {
+		sink.finish(snap)
+	}
+}
+
+func (r *progressReporter) snapshot() *progressSnapshot {
+	m := r.m
+	elapsed := time.Since(r.start)
+	s := &progressSnapshot{
+		Time:     time.Now(),
+		Host:     r.host,
+		Root:     m.cephRoot,
+		Expected: m.opts.expectedFiles,
+		queues:   m.queueDepths(),
+		eta:      m.eta(elapsed),
+	}
+	s.ETA = strings.TrimPrefix(s.eta, "ETA ")
+	s.ExpectedSize = m.opts.expectedBytes
+	m.mu.Lock()
+	stats := m.stats
+	s.Lines, s.SrcEntries = stats.lineCount, stats.srcEntries
+	s.Migrated, s.Bytes = stats.migrated, stats.bytesTotal
+	s.Errors, s.VerifyFailed = stats.errors, stats.verifyFailed
+	s.done = stats.srcEntries
+	if m.opts.redrain {
+		s.done = stats.total
+	}
+	s.ErrorCodes = maps.Clone(stats.errorCodes)
+	m.mu.Unlock()
+	s.ElapsedSec = elapsed.Seconds()
+	q := s.queues
+	s.Queues = map[string]int{
+		"lookup":      q.lookup,
+		"copy_wait":   q.copyWait,
+		"copying":     q.copying,
+		"verify_wait": q.verifyWait,
+		"verifying":   q.verifying,
+	}
+	if m.client != nil {
+		s.client = m.client.sample()
+	}
+	return s
+}
+
+// terminalSink is the progress line: redrawn in place every few seconds, or
+// printed every verboseProgressLines scan lines at --log-level debug. Once the
+// analyze phase has counted the files, it is a bar of the share done, in
+// bytes when the last dry run of the scan sized it and in files otherwise,
+// with the throughput and an ETA from its moving average. Unlike the ETA of
+// the other sinks, which spreads the whole pass over what is left, it
+// follows the current pace.
+type terminalSink struct {
+	deadline time.Time
+	every    progressTimer
+
+	mu         sync.Mutex
+	last       *progressSnapshot
+	byteRate   float64 // moving averages, per second
+	fileRate   float64
+	lineLength int // of the last line redrawn in place
+}
+
+func (t *terminalSink) due(now time.Time, lines int) bool {
+	if logShown(LOG_DEBUG) {
+		return lines%verboseProgressLines == 0
+	}
+	return t.every.due(now)
+}
+
+func (t *terminalSink) report(s *progressSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sample(s)
+	var line string
+	if s.Expected > 0 {
+		line = t.bar(s)
+	} else {
+		line = fmt.Sprintf("Processed %d lines... [%s]", s.Lines, s.queues)
+		if t.last != nil {
+			line += fmt.Sprintf(" [%.1f MB/s]", t.byteRate/(1024*1024))
+		}
+	}
+	if s.client != nil {
+		line += fmt.Sprintf(" [%s]", s.client)
+	}
+	if logShown(LOG_DEBUG) {
+		logf(LOG_INFO, "%s\n", line)
+		return
+	}
+	// Blank out what is left of a longer previous line.
+	pad := max(t.lineLength-len(line), 0)
+	t.lineLength = len(line)
+	logf(LOG_INFO, "%s%s\r", line, strings.Repeat(" ", pad))
+}
+
+// sample folds the throughput since the previous report into the moving
+// averages, weighted by how long ago that was.
+func (t *terminalSink) sample(s *progressSnapshot) {
+	prev := t.last
+	t.last = s
+	if prev == nil {
+		if s.ElapsedSec > 0 {
+			t.byteRate, t.fileRate = float64(s.Bytes)/s.ElapsedSec, float64(s.done)/s.ElapsedSec
+		}
+		return
+	}
+	dt := s.Time.Sub(prev.Time)
+	if dt <= 0 {
+		return
+	}
+	weight := 1 - math.Exp(-dt.Seconds()/progressRateWindow.Seconds())
+	t.byteRate += weight * (float64(s.Bytes-prev.Bytes)/dt.Seconds() - t.byteRate)
+	t.fileRate += weight * (float64(s.done-prev.done)/dt.Seconds() - t.fileRate)
+}
+
+// bar formats the progress against the totals of the analyze phase and the
+// last dry run.
+func (t *terminalSink) bar(s *progressSnapshot) string {
+	filesDone := min(float64(s.done)/float64(s.Expected), 1)
+	done := filesDone
+	var left time.Duration
+	if s.ExpectedSize > 0 {
+		done = min(float64(s.Bytes)/float64(s.ExpectedSize), 1)
+		if t.byteRate > 0 {
+			left = time.Duration(float64(max(s.ExpectedSize-s.Bytes, 0)) / t.byteRate * float64(time.Second))
+		}
+	} else if t.fileRate > 0 {
+		left = time.Duration(float64(max(s.Expected-s.done, 0)) / t.fileRate * float64(time.Second))
+	}
+
+	cells := int(done * progressBarWidth)
+	line := fmt.Sprintf("[%s%s] %5.1f%% of %d files", strings.Repeat("#", cells), strings.Repeat("-", progressBarWidth-cells),
+		filesDone*100, s.Expected)
+	if s.ExpectedSize > 0 {
+		line += fmt.Sprintf(", %5.1f%% of %.2f MB", done*100, mb(s.ExpectedSize))
+	}
+	line += fmt.Sprintf(", %.1f MB/s", t.byteRate/(1024*1024))
+	if left > 0 {
+		line += ", ETA " + formatETA(left)
+		if !t.deadline.IsZero() && s.Time.Add(left).After(t.deadline) {
+			line += " (past the deadline)"
+		}
+	}
+	return line + fmt.Sprintf(" [%s]", s.queues)
+}
+
+// finish leaves the last progress line for the summary, which starts on a
+// line of its own.
+func (t *terminalSink) finish(s *progressSnapshot) {}
+
+// agentSink reports to the coordinator of "migxattrs remote" on stdout. The
+// final result is sent by main once the exit status is known.
+type agentSink struct {
+	every progressTimer
+}
+
+func (a *agentSink) due(now time.Time, lines int) bool { return a.every.due(now) }
+
+func (a *agentSink) report(s *progressSnapshot) {
+	emitAgentLine(AGENT_PROGRESS_PREFIX, &agentReport{
+		Host:         s.Host,
+		Lines:        s.Lines,
+		Migrated:     s.Migrated,
+		Bytes:        s.Bytes,
+		Errors:       s.Errors,
+		VerifyFailed: s.VerifyFailed,
+		ErrorCodes:   s.ErrorCodes,
+		ElapsedSec:   s.ElapsedSec,
+	})
+}
+
+func (a *agentSink) finish(s *progressSnapshot) {}
+
+// parseSinkInterval splits PATH[,INTERVAL] as given to the file sinks.
+func parseSinkInterval(arg string) (string, time.Duration, error) {
+	path, every, found := strings.Cut(arg, ",")
+	if path == "" {
+		return "", 0, fmt.Errorf("missing path")
+	}
+	interval := 10 * time.Second
+	if found {
+		d, err := time.ParseDuration(every)
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("invalid interval %q", every)
+		}
+		interval = d
+	}
+	return path, interval, nil
+}
+
+// jsonlSink appends a JSON snapshot per line to a file (jsonl:PATH[,INTERVAL])
+// or to an inherited file descriptor (fd:N[,INTERVAL]), the last one of
+// each pass marked final. Each line also carries the throughput since the
+// line before it.
+type jsonlSink struct {
+	every progressTimer
+
+	mu   sync.Mutex
+	file *os.File
+	last *progressSnapshot
+}
+
+// progressRecord is a line of a jsonlSink.
+type progressRecord struct {
+	*progressSnapshot
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	FilesPerSec float64 `json:"files_per_sec"`
+}
+
+func newJSONLSink(arg string, opts *options) (progressSink, error) {
+	path, interval, err := parseSinkInterval(arg)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{every: progressTimer{interval: interval}, file: f}, nil
+}
+
+// newFDSink writes to a descriptor the wrapper running migxattrs opened for
+// it, e.g. 3 with "migxattrs --progress fd:3 ... 3>&1 >/dev/null".
+func newFDSink(arg string, opts *options) (progressSink, error) {
+	n, interval, err := parseSinkInterval(arg)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := strconv.Atoi(n)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %q", n)
+	}
+	f := os.NewFile(uintptr(fd), "fd "+n)
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+	}
+	return &jsonlSink{every: progressTimer{interval: interval}, file: f}, nil
+}
+
+func (j *jsonlSink) due(now time.Time, lines int) bool { return j.every.due(now) }
+
+func (j *jsonlSink) report(s *progressSnapshot) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := progressRecord{progressSnapshot: s}
+	// A new pass starts from zero again.
+	if last := j.last; last != nil && last.Root == s.Root && !last.Final && s.Bytes >= last.Bytes {
+		if d := s.Time.Sub(last.Time).Seconds(); d > 0 {
+			r.BytesPerSec = float64(s.Bytes-last.Bytes) / d
+			r.FilesPerSec = float64(s.Migrated-last.Migrated) / d
+		}
+	} else if s.ElapsedSec > 0 {
+		r.BytesPerSec = float64(s.Bytes) / s.ElapsedSec
+		r.FilesPerSec = float64(s.Migrated) / s.ElapsedSec
+	}
+	j.last = s
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError writing progress to %s: %v\n", j.file.Name(), err)
+	}
+}
+
+func (j *jsonlSink) finish(s *progressSnapshot) { j.report(s) }
+
+// statusFileSink keeps the latest snapshot in a file (status:PATH[,INTERVAL]),
+// replaced atomically so readers never see it half written.
+type statusFileSink struct {
+	every progressTimer
+	path  string
+	mu    sync.Mutex
+}
+
+func newStatusFileSink(arg string, opts *options) (progressSink, error) {
+	path, interval, err := parseSinkInterval(arg)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".tmp", nil, 0644); err != nil {
+		return nil, err
+	}
+	os.Remove(path + ".tmp")
+	return &statusFileSink{every: progressTimer{interval: interval}, path: path}, nil
+}
+
+func (f *statusFileSink) due(now time.Time, lines int) bool { return f.every.due(now) }
+
+func (f *statusFileSink) report(s *progressSnapshot) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tmpPath := f.path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err == nil {
+		err = os.Rename(tmpPath, f.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(os.Stderr, "\nError writing progress to %s: %v\n", f.path, err)
+	}
+}
+
+func (f *statusFileSink) finish(s *progressSnapshot) { f.report(s) }
+
+// httpSink serves the latest snapshot (http:ADDR): a page refreshing itself
+// at / and the JSON at /progress.json. It keeps serving between the passes
+// of --loop.
+type httpSink struct {
+	every progressTimer
+
+	mu   sync.Mutex
+	last map[string]*progressSnapshot // per root, for --mounts
+}
+
+// httpSinkInterval is how often the served snapshot is refreshed.
+const httpSinkInterval = 2 * time.Second
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta http-equiv="refresh" content="5"><title>migxattrs</title></head>
+<body><h1>migxattrs on {{.Host}}</h1>
+{{range .Passes}}<h2>{{.Root}}{{if .Final}} (pass finished){{end}}</h2>
+<table>
+<tr><td>Lines processed</td><td>{{.Lines}}</td></tr>
+<tr><td>Files migrated</td><td>{{.Migrated}}{{if .Expected}} of {{.Expected}}{{end}}</td></tr>
+<tr><td>Bytes migrated</td><td>{{.Bytes}}</td></tr>
+<tr><td>Errors</td><td>{{.Errors}}</td></tr>
+<tr><td>Queues</td><td>{{.QueueText}}</td></tr>
+<tr><td>ETA</td><td>{{.ETA}}</td></tr>
+<tr><td>Updated</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td></tr>
+</table>{{else}}<p>No pass has started yet.</p>{{end}}
+</body></html>
+`))
+
+func newHTTPSink(arg string, opts *options) (progressSink, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("missing listen address, e.g. http::8080")
+	}
+	ln, err := net.Listen("tcp", arg)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpSink{every: progressTimer{interval: httpSinkInterval}, last: make(map[string]*progressSnapshot)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/progress.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.passes())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		host, _ := os.Hostname()
+		type pass struct {
+			*progressSnapshot
+			QueueText string
+		}
+		var passes []pass
+		for _, s := range h.passes() {
+			passes = append(passes, pass{s, s.queues.String()})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dashboardPage.Execute(w, struct {
+			Host   string
+			Passes []pass
+		}{host, passes})
+	})
+	go http.Serve(ln, mux)
+	return h, nil
+}
+
+func (h *httpSink) due(now time.Time, lines int) bool { return h.every.due(now) }
+
+func (h *httpSink) report(s *progressSnapshot) {
+	h.mu.Lock()
+	h.last[s.Root] = s
+	h.mu.Unlock()
+}
+
+func (h *httpSink) finish(s *progressSnapshot) { h.report(s) }
+
+// passes returns the latest snapshot of every root, sorted by root.
+func (h *httpSink) passes() []*progressSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	passes := make([]*progressSnapshot, 0, len(h.last))
+	for _, s := range h.last {
+		passes = append(passes, s)
+	}
+	sort.Slice(passes, func(i, j int) bool { return passes[i].Root < passes[j].Root })
+	return passes
+}
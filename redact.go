@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// redactor is set by --redact-paths. Paths shown on stdout/stderr, in
+// per-directory statistics and in alert payloads are replaced by salted
+// hashes; the failed-file and audit log keep full paths.
+var redactor *pathRedactor
+
+type pathRedactor struct {
+	salt []byte
+}
+
+// newPathRedactor uses salt, or a random per-run salt when salt is empty.
+func newPathRedactor(salt string) *pathRedactor {
+	if salt == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return &pathRedactor{salt: b}
+	}
+	return &pathRedactor{salt: []byte(salt)}
+}
+
+func (r *pathRedactor) hash(path string) string {
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(path))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// displayPath returns path as it may be shown outside the protected
+// manifests.
+func displayPath(path string) string {
+	if redactor == nil {
+		return path
+	}
+	return redactor.hash(path)
+}
+
+// displayErr formats err with every occurrence of path redacted. Paths of
+// temporary files derived from path are covered as well.
+func displayErr(path string, err error) string {
+	if redactor == nil || path == "" {
+		return err.Error()
+	}
+	return strings.ReplaceAll(err.Error(), path, displayPath(path))
+}
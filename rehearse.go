@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// rehearseFile walks absPath through every metadata step of a migration
+// without copying data or renaming: the temp file is created with the
+// destination layout, given the ownership, permissions, ACLs and times of
+// the original, and removed again. It finds permission problems across a
+// tree at the speed of the metadata path.
+func (m *migrator) rehearseFile(absPath string, info os.FileInfo) error {
+	if m.dirTimes != nil {
+		m.mu.Lock()
+		m.dirTimes.remember(absPath)
+		m.mu.Unlock()
+	}
+	tmpPath := attemptTempPath(tempPath(m.opts.tempName, absPath, info))
+	return withFileTimeout(m.ctx, m.opts.fileTimeout, tmpPath, func(ctx context.Context) error {
+		if err := createTemp(absPath, tmpPath, info, m.opts.dstPool); err != nil {
+			return err
+		}
+		// The copy would read the original.
+		mdsOps(2) // the open and the removal of the temp file
+		src, err := os.Open(absPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return codeErrorf(E_OPEN, "failed to open source file: %w", err)
+		}
+		src.Close()
+		if err := finishTemp(ctx, absPath, tmpPath, info); err != nil {
+			return err
+		}
+		if err := os.Remove(tmpPath); err != nil {
+			return codeErrorf(E_CREATE, "failed to remove temp file: %w", err)
+		}
+		if dir := filepath.Dir(tmpPath); dir != filepath.Dir(absPath) {
+			os.Remove(dir)
+		}
+		return nil
+	})
+}
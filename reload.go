@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadSettings apply a setting of the --config file to opts when SIGHUP
+// re-reads it, keyed by flag name. The other settings of the file, and the
+// verbose, quiet and log-level settings handled by configLogLevel, only take
+// effect at the next start.
+var reloadSettings = map[string]func(opts *options, value string) error{
+	"file-timeout": func(opts *options, value string) error {
+		return parseDurationInto(&opts.fileTimeout, value)
+	},
+	"quiesce-window": func(opts *options, value string) error {
+		return parseDurationInto(&opts.quiesceWindow, value)
+	},
+	"max-duration": func(opts *options, value string) error {
+		var d time.Duration
+		if err := parseDurationInto(&d, value); err != nil {
+			return err
+		}
+		opts.deadline = time.Time{}
+		if d > 0 {
+			opts.deadline = opts.started.Add(d)
+		}
+		return nil
+	},
+	"workers": func(opts *options, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("must be at least 1")
+		}
+		if n > 1 && opts.dirBatch > 0 {
+			return fmt.Errorf("cannot exceed 1 with --dir-batch")
+		}
+		opts.workers = n
+		return nil
+	},
+	"sample": func(opts *options, value string) error {
+		rate, err := parseSampleRate(value)
+		if err == nil {
+			opts.sampleRate = rate
+		}
+		return err
+	},
+	"client-max-dirty": func(opts *options, value string) error {
+		limit, err := parseSize(value)
+		if err == nil {
+			opts.clientMaxDirty = limit
+		}
+		return err
+	},
+	"bwlimit": func(opts *options, value string) error {
+		rate, err := parseSize(value)
+		if err == nil {
+			opts.bwlimit = rate
+		}
+		return err
+	},
+	"files-per-sec": func(opts *options, value string) error {
+		return parseFloatInto(&opts.filesPerSec, value)
+	},
+	"mds-ops-per-sec": func(opts *options, value string) error {
+		return parseFloatInto(&opts.mdsOpsPerSec, value)
+	},
+	"client-max-latency": func(opts *options, value string) error {
+		return parseDurationInto(&opts.clientMaxLatency, value)
+	},
+	"alert-error-rate": func(opts *options, value string) error {
+		return parseFloatInto(&opts.alerts.errorRate, value)
+	},
+	"alert-min-throughput": func(opts *options, value string) error {
+		return parseFloatInto(&opts.alerts.minThroughput, value)
+	},
+	"alert-min-free": func(opts *options, value string) error {
+		limit, err := parseSize(value)
+		if err == nil {
+			opts.alerts.minFree = limit
+		}
+		return err
+	},
+}
+
+func parseDurationInto(d *time.Duration, value string) error {
+	v, err := time.ParseDuration(value)
+	if err == nil {
+		*d = v
+	}
+	return err
+}
+
+func parseFloatInto(f *float64, value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		*f = v
+	}
+	return err
+}
+
+// applyReloadConfig re-reads the --config file and applies its runtime
+// settings to opts. Settings given on the command line keep their value, as
+// at startup. Nothing is applied unless every setting is valid.
+func applyReloadConfig(opts *options) error {
+	settings, err := readConfigFile(opts.configPath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	updated := *opts
+	for _, name := range names {
+		apply, ok := reloadSettings[name]
+		values := settings[name]
+		if !ok || opts.commandLine[name] || len(values) == 0 {
+			continue
+		}
+		if err := apply(&updated, values[len(values)-1]); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if !opts.commandLine["verbose"] && !opts.commandLine["quiet"] && !opts.commandLine["log-level"] {
+		if updated.logLevel, err = configLogLevel(settings); err != nil {
+			return err
+		}
+	}
+
+	*opts = updated
+	return nil
+}
+
+// configLogLevel is the --log-level the verbose, quiet and log-level settings
+// of a config file ask for, info when it has none of them.
+func configLogLevel(settings map[string][]string) (string, error) {
+	level := LOG_INFO
+	var given []string
+	if values := settings["log-level"]; len(values) > 0 {
+		level = values[len(values)-1]
+		if !slices.Contains(LOG_LEVELS, level) {
+			return "", fmt.Errorf("invalid log-level: must be one of %s", strings.Join(LOG_LEVELS, ", "))
+		}
+		given = append(given, "log-level")
+	}
+	for _, setting := range []struct{ name, level string }{{"quiet", LOG_ERROR}, {"verbose", LOG_DEBUG}} {
+		values := settings[setting.name]
+		if len(values) == 0 {
+			continue
+		}
+		on, err := strconv.ParseBool(values[len(values)-1])
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+		if on {
+			level = setting.level
+			given = append(given, setting.name)
+		}
+	}
+	if len(given) > 1 {
+		return "", fmt.Errorf("%s cannot be combined", strings.Join(given, " and "))
+	}
+	return level, nil
+}
+
+// reloadGeneration counts SIGHUPs. Each scan loop compares it with the last
+// generation it applied and reloads between files, so no setting changes in
+// the middle of a file.
+var reloadGeneration atomic.Int64
+
+func watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reloadGeneration.Add(1)
+		}
+	}()
+}
+
+// reload re-reads the --config file if SIGHUP arrived since the last call.
+// A broken file is reported and leaves the current settings in place.
+func (m *migrator) reload() {
+	gen := reloadGeneration.Load()
+	if m.opts.configPath == "" || gen == m.reloadGen {
+		return
+	}
+	m.reloadGen = gen
+	// Workers read the settings, so let the files in flight finish first.
+	m.drain()
+	if err := applyReloadConfig(m.opts); err != nil {
+		fmt.Fprintf(os.Stderr, "\nIgnoring %s: %v\n", m.opts.configPath, err)
+		return
+	}
+	if m.adaptive != nil {
+		m.adaptive.reset(m.opts.workers)
+	} else {
+		m.pool.resize(m.opts.workers)
+	}
+	setLogLevel(m.opts.logLevel)
+	setBandwidth(m.opts.bwlimit)
+	m.setFileRate(m.opts.filesPerSec)
+	setMDSBudget(m.opts.mdsOpsPerSec)
+	if m.client != nil {
+		m.client.maxDirty, m.client.maxLatency = m.opts.clientMaxDirty, m.opts.clientMaxLatency
+	}
+	logf(LOG_INFO, "\nReloaded settings from %s\n", m.opts.configPath)
+}
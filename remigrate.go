@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// manifestFields are the fields --where can test. "under" matches every
+// record whose path lies in the given subtree.
+var manifestFields = []string{"path", "status", "error_code", "size", "under"}
+
+// loadManifestRecords reads any per-file output of a run: a failed-file, a
+// state database, an audit log or a residual report. Each record holds the
+// fields of manifestFields the format provides.
+func loadManifestRecords(path string) ([]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []map[string]string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			var rec auditRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			records = append(records, map[string]string{"path": rec.Path, "status": STATE_MIGRATED, "size": strconv.FormatInt(rec.Size, 10)})
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case len(fields) >= 3 && strings.HasPrefix(fields[1], "E_"): // failed-file
+			records = append(records, map[string]string{"path": fields[0], "status": STATE_FAILED, "error_code": fields[1]})
+		case len(fields) >= 4: // state database
+			records = append(records, map[string]string{"path": strings.Join(fields[3:], "\t"), "status": fields[0], "size": fields[2]})
+		case len(fields) == 2: // residual report
+			records = append(records, map[string]string{"path": fields[1], "status": fields[0]})
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized record", lineNo)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// manifestFilter is one --where condition: FIELD=VALUE or FIELD!=VALUE.
+type manifestFilter struct {
+	field  string
+	value  string
+	negate bool
+}
+
+func parseManifestFilter(expr string) (manifestFilter, error) {
+	field, value, ok := strings.Cut(expr, "=")
+	if !ok {
+		return manifestFilter{}, fmt.Errorf("%q: expected FIELD=VALUE or FIELD!=VALUE", expr)
+	}
+	f := manifestFilter{field: strings.TrimSpace(field), value: strings.TrimSpace(value)}
+	if strings.HasSuffix(f.field, "!") {
+		f.field, f.negate = strings.TrimSpace(strings.TrimSuffix(f.field, "!")), true
+	}
+	for _, known := range manifestFields {
+		if f.field == known {
+			return f, nil
+		}
+	}
+	return manifestFilter{}, fmt.Errorf("%q: unknown field %s (available: %s)", expr, f.field, strings.Join(manifestFields, ", "))
+}
+
+func (f manifestFilter) match(rec map[string]string) bool {
+	var hit bool
+	if f.field == "under" {
+		dir := filepath.Clean(f.value)
+		hit = rec["path"] == dir || strings.HasPrefix(rec["path"], dir+string(filepath.Separator))
+	} else {
+		hit = rec[f.field] == f.value
+	}
+	return hit != f.negate
+}
+
+// runRemigrateCommand implements "migxattrs remigrate": it selects files of
+// a previous run from one of its manifests, writes them to a scan file and
+// runs a re-drain migration over it, so only those still in the source pool
+// are rewritten. Flags after "--" are passed to the migration.
+func runRemigrateCommand(args []string) int {
+	fs := pflag.NewFlagSet("remigrate", pflag.ExitOnError)
+	manifest := fs.String("from-manifest", "", "Failed-file, --state-db, --audit-log or --residual-report output of a previous run")
+	where := fs.StringArray("where", nil, "Select records by FIELD=VALUE or FIELD!=VALUE on "+strings.Join(manifestFields, ", ")+", repeatable (all must match)")
+	fs.Parse(args)
+
+	positional := fs.Args()
+	var migrateArgs []string
+	if dash := fs.ArgsLenAtDash(); dash >= 0 {
+		positional, migrateArgs = fs.Args()[:dash], fs.Args()[dash:]
+	}
+	if *manifest == "" || len(positional) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs remigrate --from-manifest FILE [--where FIELD=VALUE]... CEPH_ROOT_DIR [-- MIGRATE FLAGS]\n")
+		return 1
+	}
+	filters := make([]manifestFilter, 0, len(*where))
+	for _, expr := range *where {
+		f, err := parseManifestFilter(expr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --where value: %v\n", err)
+			return 1
+		}
+		filters = append(filters, f)
+	}
+
+	records, err := loadManifestRecords(*manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading manifest: %v\n", err)
+		return 1
+	}
+	// The scan entries name the source pool the migration will match.
+	xf := pflag.NewFlagSet("remigrate", pflag.ContinueOnError)
+	xf.ParseErrorsWhitelist.UnknownFlags = true
+	xattr := addXattrFlags(xf, true)
+	xf.Parse(migrateArgs)
+
+	cephRoot, err := filepath.Abs(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// The scan file sits next to the manifest so a --resume of the
+	// migration finds it again.
+	scanPath := *manifest + ".selected"
+	out, err := os.Create(scanPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating scan file: %v\n", err)
+		return 1
+	}
+	w := bufio.NewWriter(out)
+	seen := make(map[string]bool)
+	outside := 0
+next:
+	for _, rec := range records {
+		for _, f := range filters {
+			if !f.match(rec) {
+				continue next
+			}
+		}
+		rel, err := filepath.Rel(cephRoot, rec["path"])
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			outside++
+			continue
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			// Re-drain mode checks the live pool of every entry.
+			fmt.Fprintf(w, "%s\t%s\n", *xattr.match, rel)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		fmt.Fprintf(os.Stderr, "Error writing scan file: %v\n", err)
+		return 1
+	}
+	out.Close()
+
+	fmt.Printf("Selected %d of %d records from %s into %s\n", len(seen), len(records), *manifest, scanPath)
+	if outside > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d selected records are outside %s and were left out\n", outside, displayPath(cephRoot))
+	}
+	if len(seen) == 0 {
+		return EXIT_OK
+	}
+	return runMigrateCommand(append([]string{"--redrain", "--scan-file", scanPath, cephRoot}, migrateArgs...))
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// REMOTE_DIR holds the per-host scan file parts of a remote run. It lives
+// under CEPH_ROOT_DIR so every agent sees the same files.
+const REMOTE_DIR = ".migxattrs-remote"
+
+// remoteAgent is one host taking part in a remote run.
+type remoteAgent struct {
+	host     string
+	partFile string
+
+	mu       sync.Mutex
+	progress *agentReport
+	result   *agentReport
+	err      error
+}
+
+func (a *remoteAgent) update(report *agentReport, final bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if final {
+		a.result = report
+	}
+	a.progress = report
+}
+
+// runRemoteCommand implements "migxattrs remote": it splits the scan file
+// between the given hosts, starts an agent on each over ssh and merges their
+// progress and results.
+func runRemoteCommand(args []string) int {
+	fs := pflag.NewFlagSet("remote", pflag.ExitOnError)
+	hosts := fs.StringSlice("hosts", nil, "Comma-separated hosts to run agents on")
+	binary := fs.String("binary", "migxattrs", "Path of the migxattrs binary on the remote hosts")
+	copyBinary := fs.Bool("copy-binary", false, "Copy this binary to --binary on every host with scp before starting")
+	sshOpts := fs.StringArray("ssh-opt", nil, "Extra option passed to ssh and scp (e.g. \"-oBatchMode=yes\"), repeatable")
+	remoteRoot := fs.String("remote-root", "", "Mount point of CEPH_ROOT_DIR on the remote hosts (default: same path)")
+	dryRun := fs.Bool("dry-run", false, "Start the agents in dry-run mode")
+	yes := fs.Bool("yes", false, "Start without asking for confirmation (required when stdin is not a terminal)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs remote --hosts H1,H2 [--binary PATH] [--copy-binary] CEPH_ROOT_DIR [-- AGENT_FLAGS...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	positional, agentArgs := fs.Args(), []string(nil)
+	if dash := fs.ArgsLenAtDash(); dash >= 0 {
+		positional, agentArgs = fs.Args()[:dash], fs.Args()[dash:]
+	}
+	if len(positional) != 1 || len(*hosts) == 0 {
+		fs.Usage()
+		return EXIT_FATAL
+	}
+	cephRoot := positional[0]
+	if *remoteRoot == "" {
+		*remoteRoot = cephRoot
+	}
+	if *dryRun {
+		agentArgs = append(agentArgs, "--dry-run")
+	}
+
+	scanPath := filepath.Join(cephRoot, SCAN_FILE)
+	fmt.Printf("Analyzing pool scan results from %s...\n", scanPath)
+	poolStats, err := analyzePoolScan(scanPath, shardSpec{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error analyzing pool scan: %v\n", err)
+		return EXIT_FATAL
+	}
+	fmt.Printf("Files in %s (source): %d\n", SRC_POOL, poolStats[SRC_POOL])
+	fmt.Printf("\nProceeding with migration of %d files on %d hosts\n", poolStats[SRC_POOL], len(*hosts))
+
+	if !*dryRun {
+		if proceed, status := confirmMigration(*yes); !proceed {
+			return status
+		}
+	}
+
+	runID := time.Now().Format("20060102-150405")
+	partDir := filepath.Join(cephRoot, REMOTE_DIR, runID)
+	parts, err := splitScanFile(scanPath, partDir, len(*hosts))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error splitting scan file: %v\n", err)
+		return EXIT_FATAL
+	}
+
+	agents := make([]*remoteAgent, len(*hosts))
+	for i, host := range *hosts {
+		agents[i] = &remoteAgent{host: host, partFile: parts[i]}
+	}
+
+	if *copyBinary {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error locating own binary: %v\n", err)
+			return EXIT_FATAL
+		}
+		for _, a := range agents {
+			scpArgs := append(append([]string{}, *sshOpts...), self, a.host+":"+*binary)
+			if out, err := exec.Command("scp", scpArgs...).CombinedOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error copying binary to %s: %v: %s\n", a.host, err, strings.TrimSpace(string(out)))
+				return EXIT_FATAL
+			}
+		}
+	}
+
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.err = runAgent(a, *sshOpts, *binary, agentArgs, remotePath(a.partFile, cephRoot, *remoteRoot), shardSpec{index: i, count: len(agents)}, *remoteRoot)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(agentReportInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			printRemoteProgress(agents, time.Since(startTime))
+		}
+	}
+
+	status := printRemoteReport(agents, time.Since(startTime))
+	if status == EXIT_OK {
+		os.RemoveAll(partDir)
+	}
+	return status
+}
+
+// splitScanFile distributes the lines of scanPath over n part files in dir,
+// part i holding the entries of shard i/n, and returns their paths. Each
+// agent runs as that shard, so the agents lock the root apart.
+func splitScanFile(scanPath, dir string, n int) ([]string, error) {
+	in, err := os.Open(scanPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths := make([]string, n)
+	writers := make([]*bufio.Writer, n)
+	for i := range n {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("part-%d.tab", i))
+		f, err := os.Create(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		fmt.Fprintln(writers[shardOf(fields[1], n)], scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// remotePath maps a path under the local CEPH_ROOT_DIR to the same file under
+// the remote mount point.
+func remotePath(path, localRoot, remoteRoot string) string {
+	rel, err := filepath.Rel(localRoot, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(remoteRoot, rel)
+}
+
+// runAgent starts one agent over ssh and follows its output until it exits.
+func runAgent(a *remoteAgent, sshOpts []string, binary string, agentArgs []string, partFile string, shard shardSpec, root string) error {
+	remote := []string{binary, "--agent", "--scan-file", partFile}
+	if shard.enabled() {
+		remote = append(remote, "--shard", shard.String())
+	}
+	remote = append(remote, agentArgs...)
+	remote = append(remote, root)
+	quoted := make([]string, len(remote))
+	for i, arg := range remote {
+		quoted[i] = shellQuote(arg)
+	}
+
+	sshArgs := append(append([]string{}, sshOpts...), a.host, strings.Join(quoted, " "))
+	cmd := exec.Command("ssh", sshArgs...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ssh: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		prefixLines(os.Stderr, stderr, a.host)
+	}()
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		prefix, final := AGENT_PROGRESS_PREFIX, false
+		if strings.HasPrefix(line, AGENT_RESULT_PREFIX) {
+			prefix, final = AGENT_RESULT_PREFIX, true
+		} else if !strings.HasPrefix(line, AGENT_PROGRESS_PREFIX) {
+			continue
+		}
+		var report agentReport
+		if err := json.Unmarshal([]byte(line[len(prefix):]), &report); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] bad agent report: %v\n", a.host, err)
+			continue
+		}
+		a.update(&report, final)
+	}
+	wg.Wait()
+
+	err = cmd.Wait()
+	if a.result == nil {
+		if err == nil {
+			err = fmt.Errorf("agent exited without a result")
+		}
+		return err
+	}
+	// A non-zero exit with a result only reflects file errors, which the
+	// result already carries.
+	return nil
+}
+
+func prefixLines(w io.Writer, r io.Reader, host string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Fprintf(w, "[%s] %s\n", host, scanner.Text())
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func printRemoteProgress(agents []*remoteAgent, elapsed time.Duration) {
+	var lines, migrated, errors int
+	var bytes int64
+	for _, a := range agents {
+		a.mu.Lock()
+		if a.progress != nil {
+			lines += a.progress.Lines
+			migrated += a.progress.Migrated
+			errors += a.progress.Errors
+			bytes += a.progress.Bytes
+		}
+		a.mu.Unlock()
+	}
+	fmt.Printf("\rProgress: %d lines, %d migrated, %d errors, %.2f MB/s across %d hosts",
+		lines, migrated, errors, perSecond(mb(bytes), elapsed), len(agents))
+}
+
+// slowHostRatio flags hosts whose throughput is below this fraction of the
+// median host, which usually points at a bad NIC or mount options.
+const slowHostRatio = 0.5
+
+func printRemoteReport(agents []*remoteAgent, elapsed time.Duration) int {
+	status := EXIT_OK
+	fmt.Println("\n\nRemote Report:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tMIGRATED\tMB\tMB/S\tFILES/S\tERRORS\tERROR CODES\tELAPSED\tSTATUS")
+	var files, errors int
+	var bytes int64
+	var rates []float64
+	for _, a := range agents {
+		if a.err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\t-\tfailed: %v\n", a.host, a.err)
+			status = max(status, EXIT_FATAL)
+			continue
+		}
+		r := a.result
+		hostElapsed := time.Duration(r.ElapsedSec * float64(time.Second))
+		fmt.Fprintf(tw, "%s\t%d\t%.2f\t%.2f\t%.1f\t%d\t%s\t%v\t%d\n", a.host, r.Migrated, mb(r.Bytes),
+			perSecond(mb(r.Bytes), hostElapsed), perSecond(float64(r.Migrated), hostElapsed), r.Errors,
+			formatCodes(r.ErrorCodes), hostElapsed.Round(time.Second), r.ExitStatus)
+		files += r.Migrated
+		errors += r.Errors
+		bytes += r.Bytes
+		rates = append(rates, perSecond(mb(r.Bytes), hostElapsed))
+		status = max(status, r.ExitStatus)
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%.2f\t%.2f\t%.1f\t%d\t\t%v\t\n", files, mb(bytes),
+		perSecond(mb(bytes), elapsed), perSecond(float64(files), elapsed), errors, elapsed.Round(time.Second))
+	tw.Flush()
+
+	if len(rates) > 1 {
+		slices.Sort(rates)
+		median := rates[len(rates)/2]
+		for _, a := range agents {
+			if a.err != nil {
+				continue
+			}
+			r := a.result
+			rate := perSecond(mb(r.Bytes), time.Duration(r.ElapsedSec*float64(time.Second)))
+			if rate < median*slowHostRatio {
+				fmt.Printf("Slow host: %s at %.2f MB/s (median %.2f MB/s)\n", a.host, rate, median)
+			}
+			if errors > 0 && r.Errors*len(rates) > 2*errors {
+				fmt.Printf("Error-prone host: %s has %d of %d errors\n", a.host, r.Errors, errors)
+			}
+		}
+	}
+	return status
+}
+
+// formatCodes renders error code counts as "E_IO=3,E_ACL=1", most frequent
+// first.
+func formatCodes(counts map[errorCode]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(counts))
+	for _, code := range sortedCodes(counts) {
+		parts = append(parts, fmt.Sprintf("%s=%d", code, counts[code]))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitScanFile(t *testing.T) {
+	dir := t.TempDir()
+	scanPath := filepath.Join(dir, SCAN_FILE)
+	var scan strings.Builder
+	for _, p := range []string{"a", "b/c", "d/e/f", "g", "h", "i/j", "k", "l"} {
+		scan.WriteString("src\t" + p + "\n")
+	}
+	if err := os.WriteFile(scanPath, []byte(scan.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 3
+	parts, err := splitScanFile(scanPath, filepath.Join(dir, "parts"), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := 0
+	for i, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			seen++
+			// The agent given this part runs as shard i/n and must own
+			// every entry in it.
+			if rel := strings.Fields(scanner.Text())[1]; !(shardSpec{index: i, count: n}).owns(rel) {
+				t.Errorf("%s in part %d, but shard %d/%d does not own it", rel, i, i, n)
+			}
+		}
+		f.Close()
+	}
+	if seen != 8 {
+		t.Errorf("parts hold %d entries, want 8", seen)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Residual categories, in the order of the checklist.
+const (
+	RESIDUAL_FAILED     = "failed"     // failed during the run
+	RESIDUAL_HARDLINKED = "hardlinked" // other links still share the old inode
+	RESIDUAL_SWAPPED    = "swapped"    // --swap original awaiting swap-cleanup
+	RESIDUAL_SKIPPED    = "skipped"    // in the scan but not migrated (sampled, active, canary...)
+	RESIDUAL_NEW        = "new"        // created after the scan file was taken
+	RESIDUAL_SNAPSHOT   = "snapshot"   // snapshot that pins objects in the old pool
+	RESIDUAL_DIRECTORY  = "directory"  // directory whose new files still go to the old pool
+)
+
+// residualExamples is how many paths of each category the sweep keeps for
+// the decommission report.
+const residualExamples = 50
+
+var residualChecklist = []struct {
+	category string
+	label    string
+	action   string
+}{
+	{RESIDUAL_FAILED, "Failed files:", "fix the errors in the failed-file and rerun with --redrain"},
+	{RESIDUAL_HARDLINKED, "Hardlinked files:", "migrate the remaining links or break them"},
+	{RESIDUAL_SWAPPED, "Swapped originals:", "run \"migxattrs swap-cleanup\" once rollback is no longer needed"},
+	{RESIDUAL_SKIPPED, "Skipped files:", "rerun with --redrain"},
+	{RESIDUAL_NEW, "New files:", "take a fresh scan and rerun"},
+	{RESIDUAL_SNAPSHOT, "Snapshots:", "remove the snapshots, their data stays in the old pool"},
+	{RESIDUAL_DIRECTORY, "Directory layouts:", "run \"migxattrs fix-dirs\" or rerun with --fix-dirs"},
+}
+
+// residualReport is the outcome of the end-of-run sweep.
+type residualReport struct {
+	counts     map[string]int
+	examples   map[string][]string // the first residualExamples paths
+	bytes      int64
+	unreadable int
+}
+
+// sweepResidual walks cephRoot and finds every file whose xattr still
+// reports the source pool, every directory whose default layout names it and
+// every snapshot, explaining why each remains. The findings are written to
+// reportPath, if set, as CATEGORY<TAB>PATH lines.
+func sweepResidual(cephRoot, scanPath, reportPath string, opts *options, stats *runStats) (*residualReport, error) {
+	scanned, err := loadScanPaths(scanPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan file: %w", err)
+	}
+	swapped := make(map[string]bool)
+	if entries, err := loadSwapJournal(filepath.Join(cephRoot, SWAP_JOURNAL)); err == nil {
+		for _, e := range entries {
+			swapped[e.oldPath] = true
+		}
+	}
+
+	out := io.Discard
+	if reportPath != "" {
+		f, err := os.Create(reportPath)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	r := &residualReport{counts: make(map[string]int), examples: make(map[string][]string)}
+	add := func(category, path string) {
+		r.counts[category]++
+		if len(r.examples[category]) < residualExamples {
+			r.examples[category] = append(r.examples[category], path)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", category, path)
+	}
+
+	err = filepath.WalkDir(cephRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			r.unreadable++
+			return nil
+		}
+		if d.IsDir() {
+			if value, err := getXattrValue(path, dirLayoutKey); err == nil && string(value) == opts.srcPool {
+				add(RESIDUAL_DIRECTORY, path)
+			}
+			// CephFS does not list .snap in readdir; snapshots inherited
+			// from a parent show up as _NAME_INO and are counted there.
+			if snaps, err := os.ReadDir(filepath.Join(path, ".snap")); err == nil {
+				for _, snap := range snaps {
+					if !strings.HasPrefix(snap.Name(), "_") {
+						add(RESIDUAL_SNAPSHOT, filepath.Join(path, ".snap", snap.Name()))
+					}
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(cephRoot, path)
+		if !opts.shard.owns(rel) {
+			return nil
+		}
+
+		value, err := getXattr(path)
+		if err != nil {
+			if !xattrMissing(err) {
+				r.unreadable++
+			}
+			return nil
+		}
+		if string(value) != opts.srcPool {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			r.unreadable++
+			return nil
+		}
+		r.bytes += info.Size()
+
+		dev, ino, _ := fileID(info)
+		switch {
+		case stats.failed[path]:
+			add(RESIDUAL_FAILED, path)
+		case swapped[path]:
+			add(RESIDUAL_SWAPPED, path)
+		case fileLinks(info) > 1 || stats.linked[[2]uint64{dev, ino}]:
+			add(RESIDUAL_HARDLINKED, path)
+		case scanned[rel]:
+			add(RESIDUAL_SKIPPED, path)
+		default:
+			add(RESIDUAL_NEW, path)
+		}
+		return nil
+	})
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if f, ok := out.(*os.File); ok {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return r, err
+}
+
+// loadScanPaths returns the set of paths listed in the scan file.
+func loadScanPaths(scanPath string) (map[string]bool, error) {
+	file, err := os.Open(scanPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	paths := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 {
+			paths[filepath.Clean(fields[1])] = true
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// reportResidual runs the sweep after a completed, non-dry run and prints
+// the checklist that must be cleared before the source pool can be removed,
+// followed by the --decommission-report.
+func reportResidual(cephRoot, scanPath, reportPath string, opts *options, stats *runStats) {
+	if reportPath == "" && opts.decommission == "" || opts.dryRun || stats.deadlineHit {
+		return
+	}
+	logf(LOG_INFO, "\nSweeping %s for data left in %s...\n", displayPath(cephRoot), opts.srcPool)
+	r, err := sweepResidual(cephRoot, scanPath, reportPath, opts, stats)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error during residual analysis: %v\n", err)
+		return
+	}
+
+	logf(LOG_INFO, "\nResidual Analysis:\n")
+	remaining := 0
+	for _, item := range residualChecklist {
+		n := r.counts[item.category]
+		remaining += n
+		if n == 0 {
+			logf(LOG_INFO, "  [x] %-19s 0\n", item.label)
+		} else {
+			logf(LOG_INFO, "  [ ] %-19s %d - %s\n", item.label, n, item.action)
+		}
+	}
+	if r.unreadable > 0 {
+		logf(LOG_INFO, "  Unreadable entries: %d (not classified)\n", r.unreadable)
+	}
+	switch {
+	case remaining == 0 && r.unreadable == 0:
+		logf(LOG_INFO, "Source pool %s holds no files below %s.\n", opts.srcPool, displayPath(cephRoot))
+	case reportPath != "":
+		logf(LOG_INFO, "%.2f MB still in %s; details in %s\n", mb(r.bytes), opts.srcPool, reportPath)
+	default:
+		logf(LOG_INFO, "%.2f MB still in %s\n", mb(r.bytes), opts.srcPool)
+	}
+
+	if opts.decommission != "" {
+		if err := reportDecommission(opts.decommission, cephRoot, opts, stats, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing decommission report: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runLock keeps a second run off the paths of a running one: both would
+// copy into the same .mig temp files and rename over each other's work. The
+// lock is an flock, which CephFS enforces across clients and the kernel
+// drops when the process dies, so a crashed run never leaves it stale. The
+// file stays behind and says who took it last.
+type runLock struct {
+	file   *os.File
+	path   string
+	shared bool
+	shard  *runLock // the lock of the shard, under a shared root lock
+}
+
+// runLockPath names the lock of a run over cephRoot, or of one shard of it.
+func runLockPath(cephRoot string, shard shardSpec) string {
+	return filepath.Join(cephRoot, LOCK_FILE) + shard.suffix()
+}
+
+// lockRun takes the locks of a run over cephRoot, whatever scan file it
+// reads. A run over the whole root holds the root lock alone. Runs that
+// divide the root between them hold it shared, which keeps out a run over
+// the whole root but not each other: the shards of a scan file, which also
+// hold the lock of their shard, and the workers of a coordinator, which
+// hands every batch to one of them.
+func lockRun(cephRoot string, shard shardSpec, worker bool) (*runLock, error) {
+	lock, err := acquireRunLock(runLockPath(cephRoot, shardSpec{}), worker || shard.enabled())
+	if err != nil {
+		return nil, err
+	}
+	if shard.enabled() {
+		if lock.shard, err = acquireRunLock(runLockPath(cephRoot, shard), false); err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+	return lock, nil
+}
+
+// acquireRunLock takes the lock at path, exclusive or shared, failing with
+// the holder if another run has it.
+func acquireRunLock(path string, shared bool) (*runLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLockFile(f, shared)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !locked {
+		holder, _ := io.ReadAll(io.LimitReader(f, 1024))
+		f.Close()
+		if h := strings.TrimSpace(string(holder)); h != "" {
+			return nil, fmt.Errorf("another run holds %s (%s)", path, h)
+		}
+		return nil, fmt.Errorf("another run holds %s", path)
+	}
+	if !shared {
+		// Holders of a shared lock leave the file to the exclusive one.
+		host, _ := os.Hostname()
+		f.Truncate(0)
+		f.WriteAt([]byte(fmt.Sprintf("pid %d on %s since %s\n", os.Getpid(), host, time.Now().Format(time.RFC3339))), 0)
+	}
+	return &runLock{file: f, path: path, shared: shared}, nil
+}
+
+// release drops the lock. Exiting does as well.
+func (l *runLock) release() {
+	if l == nil {
+		return
+	}
+	l.shard.release()
+	if !l.shared {
+		l.file.Truncate(0)
+	}
+	l.file.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestLockRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("locks of one process do not exclude each other on Windows")
+	}
+	root := t.TempDir()
+	whole := shardSpec{}
+	shard0, shard1 := shardSpec{index: 0, count: 2}, shardSpec{index: 1, count: 2}
+
+	tests := []struct {
+		name          string
+		first, second shardSpec
+		firstWorker   bool
+		secondWorker  bool
+		conflict      bool
+	}{
+		{name: "two runs over the root", first: whole, second: whole, conflict: true},
+		{name: "run over the root, then a shard", first: whole, second: shard0, conflict: true},
+		{name: "shard, then a run over the root", first: shard0, second: whole, conflict: true},
+		{name: "the same shard twice", first: shard0, second: shard0, conflict: true},
+		{name: "two shards", first: shard0, second: shard1},
+		{name: "worker, then a run over the root", first: whole, firstWorker: true, second: whole, conflict: true},
+		{name: "run over the root, then a worker", first: whole, second: whole, secondWorker: true, conflict: true},
+		{name: "two workers", first: whole, firstWorker: true, second: whole, secondWorker: true},
+	}
+	for _, tt := range tests {
+		first, err := lockRun(root, tt.first, tt.firstWorker)
+		if err != nil {
+			t.Fatalf("%s: first lock: %v", tt.name, err)
+		}
+		second, err := lockRun(root, tt.second, tt.secondWorker)
+		if tt.conflict && err == nil {
+			t.Errorf("%s: both runs got the lock", tt.name)
+		} else if !tt.conflict && err != nil {
+			t.Errorf("%s: second lock: %v", tt.name, err)
+		}
+		second.release()
+		first.release()
+	}
+
+	// A failed shard lock gives the shared root lock back.
+	held, err := lockRun(root, shard0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockRun(root, shard0, false); err == nil {
+		t.Fatal("the same shard locked twice")
+	}
+	held.release()
+	lock, err := lockRun(root, whole, false)
+	if err != nil {
+		t.Fatalf("root still locked after the shards released it: %v", err)
+	}
+	lock.release()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// buildScanFile walks cephRoot and writes a scan file listing the pool of
+// every regular file, in the POOL<TAB>PATH format of an external scan. Files
+// without a layout xattr are left out. The file is written next to scanPath
+// and renamed into place so an interrupted walk never leaves a partial scan.
+func buildScanFile(cephRoot, scanPath string) (int, error) {
+	tmpPath := scanPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(out)
+
+	files, unreadable := 0, 0
+	startTime := time.Now()
+	logf(LOG_INFO, "Scanning %s...\n", displayPath(cephRoot))
+	err = filepath.WalkDir(cephRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			unreadable++
+			return nil
+		}
+		if !d.Type().IsRegular() || path == scanPath || path == tmpPath {
+			return nil
+		}
+		pool, err := getXattr(path)
+		if err != nil {
+			if !xattrMissing(err) {
+				unreadable++
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(cephRoot, path)
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", pool, rel); err != nil {
+			return err
+		}
+		files++
+		if files%100000 == 0 {
+			logf(LOG_INFO, "Scanned %d files...\r", files)
+		}
+		return nil
+	})
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, scanPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return files, err
+	}
+
+	logf(LOG_INFO, "Scanned %d files in %v\n", files, time.Since(startTime))
+	if unreadable > 0 {
+		logf(LOG_WARN, "Warning: %d entries could not be read and are missing from the scan\n", unreadable)
+	}
+	return files, nil
+}
+
+// needsScan reports whether --scan must build scanPath. A resumed run keeps
+// the scan its checkpoint refers to.
+func needsScan(scanPath string, opts *options) bool {
+	if !opts.scan {
+		return false
+	}
+	if opts.resume != nil {
+		if _, err := os.Stat(scanPath); err == nil {
+			return false
+		}
+	}
+	return true
+}
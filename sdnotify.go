@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// systemdStatusInterval is how often the STATUS line of "systemctl status"
+// is updated.
+const systemdStatusInterval = 5 * time.Second
+
+// underSystemd reports whether the service manager listens for notifications
+// (Type=notify), as it says with NOTIFY_SOCKET.
+func underSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// sdNotify sends state, e.g. "READY=1", to the service manager. It does
+// nothing outside a Type=notify unit.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifySystemdReady tells systemd that the run has started, as soon as it
+// holds its lock: the scan and analysis can take hours. It returns the
+// function announcing the stop.
+func notifySystemdReady() (stopping func()) {
+	if !underSystemd() {
+		return func() {}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logf(LOG_WARN, "Warning: could not notify systemd: %v\n", err)
+	}
+	startSystemdWatchdog()
+	return func() { sdNotify("STOPPING=1") }
+}
+
+// sdWatchdog feeds the watchdog of a unit with WatchdogSec= for as long as
+// the pipeline moves. With --stall-timeout a stall stops the keepalives, so
+// systemd restarts a migration hung on the filesystem once WatchdogSec more
+// has passed; without it the keepalives only tell that the process is alive.
+type sdWatchdog struct {
+	stalled atomic.Bool
+}
+
+// systemdWatchdog is nil unless systemd asked for keepalives.
+var systemdWatchdog *sdWatchdog
+
+// startSystemdWatchdog sends keepalives at half the interval systemd gives
+// in WATCHDOG_USEC, if the variable is meant for this process.
+func startSystemdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 || !underSystemd() {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	w := &sdWatchdog{}
+	systemdWatchdog = w
+	go func() {
+		ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if w.stalled.Load() {
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				fmt.Fprintf(os.Stderr, "\nError sending watchdog keepalive: %v\n", err)
+			}
+		}
+	}()
+}
+
+// setStalled is called by the stall watchdog as the pipeline stops and moves
+// again.
+func (w *sdWatchdog) setStalled(stalled bool) {
+	if w == nil {
+		return
+	}
+	w.stalled.Store(stalled)
+}
+
+// systemdSink shows the progress of the pass as the STATUS of the unit.
+type systemdSink struct {
+	every progressTimer
+}
+
+func (s *systemdSink) due(now time.Time, lines int) bool { return s.every.due(now) }
+
+func (s *systemdSink) report(snap *progressSnapshot) {
+	status := fmt.Sprintf("Migrating %s: %d", snap.Root, snap.Migrated)
+	if snap.Expected > 0 {
+		status += fmt.Sprintf(" of %d", snap.Expected)
+	}
+	status += fmt.Sprintf(" files, %.2f MB, %d errors", mb(snap.Bytes), snap.Errors)
+	if snap.ETA != "" {
+		status += ", ETA " + snap.ETA
+	}
+	sdNotify("STATUS=" + status)
+}
+
+func (s *systemdSink) finish(snap *progressSnapshot) {
+	sdNotify(fmt.Sprintf("STATUS=Pass over %s finished: %d files, %.2f MB, %d errors", snap.Root, snap.Migrated, mb(snap.Bytes), snap.Errors))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// shardSpec selects the scan entries of one of several hosts working through
+// the same scan file at once (--shard INDEX/COUNT). An entry belongs to the
+// shard its path, relative to the root as listed in the scan file, hashes to
+// modulo COUNT, so every host decides alike without talking to the others,
+// wherever it mounts the filesystem. The zero value owns every entry.
+type shardSpec struct {
+	index, count int
+}
+
+// parseShard parses INDEX/COUNT with 0 <= INDEX < COUNT.
+func parseShard(s string) (shardSpec, error) {
+	i, n, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count {
+		return shardSpec{}, fmt.Errorf("invalid shard %q (want INDEX/COUNT, INDEX from 0 to COUNT-1)", s)
+	}
+	return shardSpec{index: index, count: count}, nil
+}
+
+func (s shardSpec) enabled() bool { return s.count > 1 }
+
+// owns reports whether the scan entry rel belongs to the shard.
+func (s shardSpec) owns(rel string) bool {
+	return !s.enabled() || shardOf(rel, s.count) == s.index
+}
+
+// shardOf returns the index of the shard, out of count, that owns the scan
+// entry rel.
+func shardOf(rel string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(filepath.Clean(rel)))
+	return int(h.Sum64() % uint64(count))
+}
+
+// suffix keeps the files of a run that other shards would clobber, such as
+// the checkpoint, apart per shard.
+func (s shardSpec) suffix() string {
+	if !s.enabled() {
+		return ""
+	}
+	return fmt.Sprintf(".shard-%d-of-%d", s.index, s.count)
+}
+
+func (s shardSpec) String() string {
+	return fmt.Sprintf("%d/%d", s.index, s.count)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// sparseCopies makes copies keep the holes of sparse files (--sparse).
+var sparseCopies bool
+
+// sparseStats counts the sparse files copied and the bytes of holes left
+// unwritten, so the summary can tell logical from physical bytes.
+var sparseStats struct {
+	files     atomic.Int64
+	holeBytes atomic.Int64
+}
+
+// extent is a range [off, end) of a file that holds data.
+type extent struct {
+	off, end int64
+}
+
+// zeros stands in for the holes fed to checksums.
+var zeros [64 << 10]byte
+
+// copyFileData copies src, which was size bytes when stat'ed, into dst with
+// the copy engine after preallocating it. With --sparse a file that has
+// holes is copied extent by extent instead, leaving the same holes in dst
+// rather than writing them out as zeros in the new pool; preallocating would
+// fill them. A --copy-cmd command gets the whole file as it is.
+func copyFileData(ctx context.Context, dst, src *os.File, size int64, h hash.Hash) error {
+	if _, ok := engine.(commandEngine); ok {
+		return engine.copyData(ctx, dst, src, h)
+	}
+	if !sparseCopies || size == 0 {
+		return copyWhole(ctx, dst, src, size, h)
+	}
+	extents, err := dataExtents(src, size)
+	if err != nil || len(extents) == 1 && extents[0] == (extent{0, size}) {
+		// Finding the extents moved the offset the engines copy from.
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return copyWhole(ctx, dst, src, size, h)
+	}
+
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	var pos, holes int64
+	for _, e := range extents {
+		holes += e.off - pos
+		hashZeros(h, e.off-pos)
+		if err := copyRange(ctx, dst, src, e.off, e.end, h); err != nil {
+			return err
+		}
+		pos = e.end
+	}
+	holes += size - pos
+	hashZeros(h, size-pos)
+	// Pick up anything appended since the file was stat'ed.
+	if err := copyRange(ctx, dst, src, size, -1, h); err != nil {
+		return err
+	}
+	sparseStats.files.Add(1)
+	sparseStats.holeBytes.Add(holes)
+	return nil
+}
+
+// copyWhole copies all of src with the engine into the preallocated dst.
+func copyWhole(ctx context.Context, dst, src *os.File, size int64, h hash.Hash) error {
+	if err := preallocate(dst, size); err != nil {
+		return err
+	}
+	return engine.copyData(ctx, dst, src, h)
+}
+
+// hashZeros feeds n zero bytes, a hole, to h if it is not nil.
+func hashZeros(h hash.Hash, n int64) {
+	for h != nil && n > 0 {
+		chunk := min(n, int64(len(zeros)))
+		h.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
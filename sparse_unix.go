@@ -0,0 +1,32 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents lists the ranges of the first size bytes of f that hold data,
+// found with SEEK_DATA and SEEK_HOLE. A filesystem without hole support
+// reports the whole file as one extent.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) || err == nil && data >= size {
+			break // only holes up to the end
+		} else if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, extent{data, min(hole, size)})
+		off = hole
+	}
+	return extents, nil
+}
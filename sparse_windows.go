@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dataExtents is not implemented on Windows; files are copied whole.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows has no numeric owners or inode numbers in a FileInfo.
+
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func fileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+func fileLinks(info os.FileInfo) uint64 {
+	return 1
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if attrs, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attrs.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
+
+// fileCtime falls back to the modification time, as Windows keeps no inode
+// change time.
+func fileCtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func freeSpace(path string) (int64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &avail, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(avail), nil
+}
+
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	if attrs, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attrs.CreationTime.Nanoseconds()), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// State entry statuses.
+const (
+	STATE_MIGRATED = "migrated"
+	STATE_FAILED   = "failed"
+)
+
+type stateEntry struct {
+	status string
+	ino    uint64
+	size   int64
+}
+
+// stateDB remembers the outcome of every file across runs. It is an
+// append-only log of STATUS<TAB>INO<TAB>SIZE<TAB>PATH lines where the last
+// line for a path wins, so a crash loses at most the line being written.
+// Re-runs skip files recorded as migrated after an lstat, without a getxattr.
+// Opening it compacts the log to the last line of each path, so it grows with
+// the files of the tree rather than with the runs and retries. It stays a
+// text file because remigrate, verify --manifest and --diff-against read it.
+type stateDB struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]stateEntry
+}
+
+func openStateDB(path string) (*stateDB, error) {
+	db := &stateDB{entries: make(map[string]stateEntry)}
+	order, lines, err := db.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if lines > len(order) {
+		if err := db.compact(path, order); err != nil {
+			return nil, fmt.Errorf("failed to compact %s: %w", path, err)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.file = file
+	return db, nil
+}
+
+// load reads the log at path into db.entries. It returns the paths in the
+// order of their last line and the number of lines read, torn ones included.
+func (db *stateDB) load(path string) (order []string, lines int, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	last := make(map[string]int) // line number of the last line of each path
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		lines++
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) != 4 {
+			continue // torn final line
+		}
+		ino, _ := strconv.ParseUint(fields[1], 10, 64)
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		db.entries[fields[3]] = stateEntry{status: fields[0], ino: ino, size: size}
+		last[fields[3]] = lines
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	order = make([]string, 0, len(last))
+	for p := range last {
+		order = append(order, p)
+	}
+	sort.Slice(order, func(i, j int) bool { return last[order[i]] < last[order[j]] })
+	return order, lines, nil
+}
+
+// compact replaces the log at path with one line per path of order,
+// atomically, dropping the lines later ones superseded and torn lines.
+func (db *stateDB) compact(path string, order []string) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, p := range order {
+		e := db.entries[p]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", e.status, e.ino, e.size, p)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// migrated reports whether absPath was migrated by an earlier run and is
+// still the file that run left behind: a file replaced or rewritten since has
+// another inode or size and is looked at again.
+func (db *stateDB) migrated(absPath string) bool {
+	db.mu.Lock()
+	e := db.entries[absPath]
+	db.mu.Unlock()
+	if e.status != STATE_MIGRATED {
+		return false
+	}
+	mdsOps(1)
+	info, err := os.Lstat(absPath)
+	if err != nil || info.Size() != e.size {
+		return false
+	}
+	_, ino, ok := fileID(info)
+	return !ok || ino == e.ino
+}
+
+// record stores the outcome for absPath. info may be nil for failures; for
+// migrated files it must describe the file now at absPath, not the source.
+func (db *stateDB) record(absPath, status string, info os.FileInfo) error {
+	e := stateEntry{status: status}
+	if info != nil {
+		_, e.ino, _ = fileID(info)
+		e.size = info.Size()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[absPath] = e
+	_, err := fmt.Fprintf(db.file, "%s\t%d\t%d\t%s\n", e.status, e.ino, e.size, absPath)
+	return err
+}
+
+func (db *stateDB) close() error {
+	return db.file.Close()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestStateDBLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	log := "migrated\t11\t100\t/root/a\n" +
+		"failed\t0\t0\t/root/b\n" +
+		"failed\t0\t0\t/root/a\n" + // the last line for a path wins
+		"migrated\t12\t5\t/root/b\n" +
+		"migrated\t13\t7\t/root/with\ttab\n" +
+		"migrated\t14\t9" // torn final line
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db := &stateDB{entries: make(map[string]stateEntry)}
+	order, lines, err := db.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines != 6 {
+		t.Errorf("read %d lines, want 6", lines)
+	}
+	if want := []string{"/root/a", "/root/b", "/root/with\ttab"}; !slices.Equal(order, want) {
+		t.Errorf("order %q, want %q", order, want)
+	}
+	want := map[string]stateEntry{
+		"/root/a":         {status: STATE_FAILED},
+		"/root/b":         {status: STATE_MIGRATED, ino: 12, size: 5},
+		"/root/with\ttab": {status: STATE_MIGRATED, ino: 13, size: 7},
+	}
+	if len(db.entries) != len(want) {
+		t.Errorf("loaded %d entries, want %d: %v", len(db.entries), len(want), db.entries)
+	}
+	for p, e := range want {
+		if db.entries[p] != e {
+			t.Errorf("entry for %q = %+v, want %+v", p, db.entries[p], e)
+		}
+	}
+
+	if _, _, err := db.load(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("load of a missing file: %v", err)
+	}
+}
+
+func TestStateDBMigrated(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "state.db")
+	file := filepath.Join(dir, "file")
+	info := writeFile(t, file, "migrated copy")
+	if _, _, ok := fileID(info); !ok {
+		t.Skip("no inode numbers on this platform")
+	}
+
+	db, err := openStateDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.migrated(file) {
+		t.Error("migrated before anything was recorded")
+	}
+	if err := db.record(file, STATE_MIGRATED, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.record(filepath.Join(dir, "failed"), STATE_FAILED, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later run sees the same file as migrated.
+	db, err = openStateDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if !db.migrated(file) {
+		t.Error("recorded file not reported as migrated")
+	}
+	if db.migrated(filepath.Join(dir, "failed")) {
+		t.Error("failed file reported as migrated")
+	}
+
+	// Rewritten in place: same inode, other size.
+	writeFile(t, file, "migrated copy, appended to since")
+	if db.migrated(file) {
+		t.Error("file of another size reported as migrated")
+	}
+
+	// Replaced by a new file of the same size: another inode. The old one
+	// is kept so the new file cannot reuse its inode number.
+	if err := os.Rename(file, file+".old"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, file, "migrated copy")
+	if db.migrated(file) {
+		t.Error("replaced file reported as migrated")
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if db.migrated(file) {
+		t.Error("deleted file reported as migrated")
+	}
+}
+
+func TestStateDBCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	log := "failed\t0\t0\t/root/a\n" +
+		"migrated\t12\t5\t/root/b\n" +
+		"migrated\t11\t100\t/root/a\n" +
+		"migrated\t14\t9" // torn final line
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openStateDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.record("/root/c", STATE_FAILED, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "migrated\t12\t5\t/root/b\n" +
+		"migrated\t11\t100\t/root/a\n" +
+		"failed\t0\t0\t/root/c\n"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("compacted log:\n%s\nwant:\n%s", data, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
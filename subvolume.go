@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// cephMount is a CephFS mount on this host and the filesystem path it exposes.
+type cephMount struct {
+	mountPoint string
+	fsName     string // empty when the mount does not say
+	fsPath     string // path inside the filesystem mounted at mountPoint
+}
+
+// resolveSubvolume turns "group/name" (or just "name" for the default group)
+// into a local path by asking the cluster for the subvolume path and mapping
+// it onto a CephFS mount that covers it. If mountHint is set, only that mount
+// point is considered.
+func resolveSubvolume(spec, fsName, mountHint string) (string, error) {
+	group, name, ok := strings.Cut(spec, "/")
+	if !ok {
+		group, name = "", spec
+	}
+	if name == "" {
+		return "", fmt.Errorf("invalid subvolume %q (want group/name or name)", spec)
+	}
+
+	args := []string{"fs", "subvolume", "getpath", fsName, name}
+	if group != "" {
+		args = append(args, "--group_name", group)
+	}
+	out, err := exec.Command("ceph", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("ceph %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("ceph %s: %w", strings.Join(args, " "), err)
+	}
+	subPath := filepath.Clean(strings.TrimSpace(string(out)))
+
+	mounts, err := cephMounts()
+	if err != nil {
+		return "", err
+	}
+	if mountHint != "" {
+		mountHint = filepath.Clean(mountHint)
+	}
+
+	for _, mnt := range mounts {
+		if mountHint != "" && mnt.mountPoint != mountHint {
+			continue
+		}
+		if mnt.fsName != "" && mnt.fsName != fsName {
+			continue
+		}
+		rel, err := filepath.Rel(mnt.fsPath, subPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+
+		local := filepath.Join(mnt.mountPoint, rel)
+		if _, err := os.Stat(local); err != nil {
+			return "", fmt.Errorf("subvolume path %s maps to %s on mount %s but is not accessible: %w", subPath, local, mnt.mountPoint, err)
+		}
+		return local, nil
+	}
+
+	if mountHint != "" {
+		return "", fmt.Errorf("subvolume path %s is not covered by a CephFS mount at %s", subPath, mountHint)
+	}
+	return "", fmt.Errorf("subvolume path %s is not covered by any CephFS mount on this host", subPath)
+}
+
+// cephMounts lists kernel and FUSE CephFS mounts from /proc/self/mounts.
+func cephMounts() ([]cephMount, error) {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []cephMount
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		source, mountPoint, fsType, mountOpts := fields[0], unescapeMountPath(fields[1]), fields[2], fields[3]
+
+		switch fsType {
+		case "ceph":
+			mnt := cephMount{mountPoint: mountPoint, fsPath: "/"}
+			if dev, path, ok := strings.Cut(source, "="); ok {
+				// New-style device string: name@fsid.fsname=/path
+				mnt.fsPath = path
+				if i := strings.LastIndexByte(dev, '.'); i >= 0 {
+					mnt.fsName = dev[i+1:]
+				}
+			} else if i := strings.Index(source, ":/"); i >= 0 {
+				// Old-style device string: mon1:6789,mon2:6789:/path
+				mnt.fsPath = source[i+1:]
+			}
+			for _, opt := range strings.Split(mountOpts, ",") {
+				if v, ok := strings.CutPrefix(opt, "mds_namespace="); ok {
+					mnt.fsName = v
+				} else if v, ok := strings.CutPrefix(opt, "fs="); ok {
+					mnt.fsName = v
+				}
+			}
+			mounts = append(mounts, mnt)
+		case "fuse.ceph-fuse":
+			// ceph-fuse does not expose client_mountpoint here; assume the
+			// filesystem root is mounted.
+			mounts = append(mounts, cephMount{mountPoint: mountPoint, fsPath: "/"})
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath undoes the octal escaping of spaces and tabs used in
+// /proc/self/mounts.
+func unescapeMountPath(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTP_PASSWORD_ENV holds the password of --smtp-user, kept off the command
+// line where every user of the host could read it.
+const SMTP_PASSWORD_ENV = "MIGXATTRS_SMTP_PASSWORD"
+
+// summaryMailConfig is where the summary of a run is mailed (--summary-email)
+// over SMTP, for bastion hosts with no other way to reach the operators
+// than a mail relay. Unlike --alert-email it needs no local sendmail.
+type summaryMailConfig struct {
+	server   string // HOST:PORT
+	from     string
+	user     string
+	password string
+	to       []string
+}
+
+func (c *summaryMailConfig) enabled() bool {
+	return len(c.to) > 0
+}
+
+// parseMailAddress checks that s is one mail address, such as
+// ops@example.com or "Ops <ops@example.com>", and returns the bare address
+// that SMTP and the To and From headers get.
+func parseMailAddress(s string) (string, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a mail address: %w", s, err)
+	}
+	return addr.Address, nil
+}
+
+// parseMailAddresses replaces every address in addrs by what
+// parseMailAddress makes of it.
+func parseMailAddresses(addrs []string) error {
+	for i, s := range addrs {
+		addr, err := parseMailAddress(s)
+		if err != nil {
+			return err
+		}
+		addrs[i] = addr
+	}
+	return nil
+}
+
+// headerValue makes s safe to put in a mail header: a line break in it would
+// end the header and let the rest of s add headers, or recipients, of its
+// own.
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// sendSummaryMail mails the outcome of a run with its failed files attached.
+// The connection is upgraded with STARTTLS when the server offers it, which
+// net/smtp requires before it sends a password to anything but localhost.
+func sendSummaryMail(cfg *summaryMailConfig, cephRoot, name string, t *runTotals, failed []string) error {
+	host, _ := os.Hostname()
+	msg, err := summaryMessage(cfg, host, cephRoot, name, t, failed)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if cfg.user != "" {
+		server, _, _ := net.SplitHostPort(cfg.server)
+		auth = smtp.PlainAuth("", cfg.user, cfg.password, server)
+	}
+	return smtp.SendMail(cfg.server, auth, cfg.from, cfg.to, msg)
+}
+
+// summaryMessage is the summary mail sent from host, headers first.
+func summaryMessage(cfg *summaryMailConfig, host, cephRoot, name string, t *runTotals, failed []string) ([]byte, error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "migxattrs on %s: %s\n\n", host, name)
+	fmt.Fprintf(&body, "Root:             %s\n", displayPath(cephRoot))
+	fmt.Fprintf(&body, "Passes:           %d\n", t.Passes)
+	fmt.Fprintf(&body, "Files migrated:   %d\n", t.Migrated)
+	fmt.Fprintf(&body, "Bytes migrated:   %.2f MB\n", mb(t.Bytes))
+	fmt.Fprintf(&body, "Errors:           %d\n", t.Errors)
+	if t.VerifyFailed > 0 {
+		fmt.Fprintf(&body, "Verify failed:    %d\n", t.VerifyFailed)
+	}
+	fmt.Fprintf(&body, "Time elapsed:     %v\n", (time.Duration(t.ElapsedSec) * time.Second).Round(time.Second))
+	fmt.Fprintf(&body, "Exit status:      %d\n", t.ExitStatus)
+	if len(t.ErrorCodes) > 0 {
+		codes := make([]string, 0, len(t.ErrorCodes))
+		for code := range t.ErrorCodes {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(&body, "\nErrors by code:\n")
+		for _, code := range codes {
+			fmt.Fprintf(&body, "  %-16s%d\n", code, t.ErrorCodes[errorCode(code)])
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&body, "\nThe %d failed files are listed in the attachment.\n", len(failed))
+	}
+
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: [migxattrs] %s on %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		headerValue(cfg.from), headerValue(strings.Join(cfg.to, ", ")), headerValue(name), headerValue(host), time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(strings.ReplaceAll(body.String(), "\n", "\r\n")))
+	if len(failed) > 0 {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="failed-files.txt"`},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(strings.Join(failed, "\n") + "\n"))
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
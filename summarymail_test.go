@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMailAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "ops@example.com", want: "ops@example.com"},
+		{in: "Storage Ops <ops@example.com>", want: "ops@example.com"},
+		{in: "<ops@example.com>", want: "ops@example.com"},
+		{in: "", wantErr: true},
+		{in: "ops", wantErr: true},
+		{in: "ops@example.com, other@example.com", wantErr: true},
+		{in: "ops@example.com\r\nBcc: evil@example.com", wantErr: true},
+		{in: "ops@example.com\nBcc: evil@example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMailAddress(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMailAddress(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseMailAddress(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	addrs := []string{"A <a@example.com>", "b@example.com"}
+	if err := parseMailAddresses(addrs); err != nil || addrs[0] != "a@example.com" || addrs[1] != "b@example.com" {
+		t.Errorf("parseMailAddresses = %q, %v", addrs, err)
+	}
+	if err := parseMailAddresses([]string{"a@example.com", "bad"}); err == nil {
+		t.Error("parseMailAddresses accepted a bad address")
+	}
+}
+
+// checkHeaders parses msg and fails unless its headers are exactly want,
+// whatever their values.
+func checkHeaders(t *testing.T, msg string, want ...string) *mail.Message {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range m.Header {
+		found := false
+		for _, w := range want {
+			found = found || name == w
+		}
+		if !found {
+			t.Errorf("unexpected header %s: %q", name, m.Header.Get(name))
+		}
+	}
+	return m
+}
+
+const injection = "x\r\nBcc: evil@example.com\nX-Injected: yes"
+
+func TestAlertMessageHeaders(t *testing.T) {
+	a := &alert{Name: "error_rate" + injection, Message: "body", Time: time.Now(), Host: "host" + injection, Root: "/mnt"}
+	m := checkHeaders(t, emailSink{to: "ops@example.com"}.message(a), "To", "Subject")
+	if to := m.Header.Get("To"); to != "ops@example.com" {
+		t.Errorf("To = %q", to)
+	}
+	if subject := m.Header.Get("Subject"); !strings.Contains(subject, "Bcc: evil@example.com") {
+		t.Errorf("Subject = %q, want the injection kept on its line", subject)
+	}
+}
+
+func TestSummaryMessageHeaders(t *testing.T) {
+	cfg := &summaryMailConfig{from: "migxattrs@example.com", to: []string{"a@example.com", "b@example.com"}}
+	msg, err := summaryMessage(cfg, "host"+injection, "/mnt", "finished"+injection, &runTotals{Migrated: 3}, []string{"/mnt/failed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := checkHeaders(t, string(msg), "From", "To", "Subject", "Date", "Mime-Version", "Content-Type")
+	if to := m.Header.Get("To"); to != "a@example.com, b@example.com" {
+		t.Errorf("To = %q", to)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// SWAP_JOURNAL lists, under CEPH_ROOT_DIR, the files swapped in with --swap
+// whose original inode still sits next to them under its swappedPath.
+const SWAP_JOURNAL = "migxattrs.swapped"
+
+// placeMode selects how the finished temp file replaces the original.
+type placeMode int
+
+const (
+	// PLACE_RENAME overwrites the original with rename(2).
+	PLACE_RENAME placeMode = iota
+	// PLACE_EXCHANGE swaps temp and original with RENAME_EXCHANGE, leaving
+	// the original inode under its swappedPath for rollback.
+	PLACE_EXCHANGE
+	// PLACE_NOREPLACE exchanges the temp file in and checks that it took
+	// the place of the original, refusing to clobber a path recreated
+	// meanwhile.
+	PLACE_NOREPLACE
+)
+
+var errPlaceConflict = errors.New("path was replaced after the copy")
+
+// errPlaceStranded is a conflict that could not be undone: the temp name
+// holds a file that is not ours.
+var errPlaceStranded = errors.New("path was replaced after the copy and could not be restored")
+
+// placeFile moves tmpPath into place at path according to mode. info is the
+// original file as copied.
+func placeFile(tmpPath, path string, info os.FileInfo, mode placeMode) error {
+	switch mode {
+	case PLACE_EXCHANGE:
+		mdsOps(2)
+		return placeExchange(tmpPath, path, info)
+	case PLACE_NOREPLACE:
+		mdsOps(3) // exchange, lstat and remove
+		return placeNoReplace(tmpPath, path, info)
+	}
+	mdsOps(1)
+	return os.Rename(tmpPath, path)
+}
+
+// swappedPath is where --swap keeps the original inode of path, copied as
+// info from tmpPath. It is not a temp name, which a later pass or remigrate
+// may need again while the original is kept.
+func swappedPath(tmpPath string, info os.FileInfo) string {
+	_, ino, _ := fileID(info)
+	return fmt.Sprintf("%s.orig-%d", tmpPath, ino)
+}
+
+// placeExchange moves the temp file to the swappedPath of the original and
+// exchanges it with path there, so the original ends up under that name. On
+// failure the temp file is back under tmpPath.
+func placeExchange(tmpPath, path string, info os.FileInfo) error {
+	aside := swappedPath(tmpPath, info)
+	if err := renameNoReplace(tmpPath, aside); err != nil {
+		return err
+	}
+	if err := renameExchange(aside, path); err != nil {
+		os.Rename(aside, tmpPath)
+		return err
+	}
+	return nil
+}
+
+// placeNoReplace never overwrites a file other than the one copied, and never
+// leaves path missing: the temp file is exchanged with whatever is at path,
+// which must then be the inode that was copied. Anything else is exchanged
+// back and the placement refused. A path removed since the copy is taken
+// with RENAME_NOREPLACE, which refuses one recreated meanwhile.
+func placeNoReplace(tmpPath, path string, info os.FileInfo) error {
+	err := renameExchange(tmpPath, path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return placeAside(tmpPath, path, info)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, statErr := os.Lstat(tmpPath); statErr != nil {
+			return err
+		}
+		if err := renameNoReplace(tmpPath, path); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return fmt.Errorf("%w: path was recreated during placement", errPlaceConflict)
+			}
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// tmpPath now holds what was at path.
+	prevInfo, err := os.Lstat(tmpPath)
+	if err != nil || !os.SameFile(prevInfo, info) {
+		if err := renameExchange(tmpPath, path); err != nil {
+			return fmt.Errorf("%w; the current version of the file is at %s and the copy at its path: %v", errPlaceStranded, tmpPath, err)
+		}
+		return errPlaceConflict
+	}
+	return os.Remove(tmpPath)
+}
+
+// placeAside is placeNoReplace where there is no RENAME_EXCHANGE: the
+// original is renamed aside, checked to be the inode that was copied, and
+// only then is the temp file renamed into the free path, which is missing in
+// between. A conflict at either step leaves every file that is not ours
+// untouched.
+func placeAside(tmpPath, path string, info os.FileInfo) error {
+	aside := tmpPath + ".orig"
+	if err := renameNoReplace(path, aside); err != nil {
+		return err
+	}
+
+	asideInfo, err := os.Lstat(aside)
+	if err != nil || !os.SameFile(asideInfo, info) {
+		if err := renameNoReplace(aside, path); err != nil {
+			return fmt.Errorf("%w; its current version was left at %s: %v", errPlaceConflict, aside, err)
+		}
+		return errPlaceConflict
+	}
+
+	if err := renameNoReplace(tmpPath, path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%w; path was recreated during placement, original left at %s", errPlaceConflict, aside)
+		}
+		renameNoReplace(aside, path)
+		return err
+	}
+	return os.Remove(aside)
+}
+
+type swapEntry struct {
+	swapped time.Time
+	path    string
+	oldPath string // original inode, under the temp name
+
+	// The migrated copy as placed at path, which a rollback must find
+	// there unchanged. ino is 0 where it is unknown.
+	ino   uint64
+	size  int64
+	mtime time.Time
+}
+
+// placedAt records info, the migrated copy at path, in the entry.
+func (e *swapEntry) placedAt(info os.FileInfo) {
+	_, e.ino, _ = fileID(info)
+	e.size, e.mtime = info.Size(), info.ModTime()
+}
+
+// unchanged reports whether info is still the migrated copy of the entry,
+// neither replaced nor written to since the swap.
+func (e *swapEntry) unchanged(info os.FileInfo) bool {
+	_, ino, ok := fileID(info)
+	return ok && e.ino != 0 && ino == e.ino && info.Size() == e.size && info.ModTime().Equal(e.mtime)
+}
+
+func (e *swapEntry) String() string {
+	return fmt.Sprintf("%d\t%s\t%s\t%d\t%d\t%d", e.swapped.Unix(), e.path, e.oldPath, e.ino, e.size, e.mtime.UnixNano())
+}
+
+// swapJournal appends an entry for every swapped file.
+type swapJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openSwapJournal(path string) (*swapJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &swapJournal{file: file}, nil
+}
+
+// add records that path, now the migrated copy placed, was swapped with its
+// original, kept at oldPath.
+func (j *swapJournal) add(path, oldPath string, placed os.FileInfo) error {
+	e := swapEntry{swapped: time.Now(), path: path, oldPath: oldPath}
+	e.placedAt(placed)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := fmt.Fprintln(j.file, e.String())
+	return err
+}
+
+func (j *swapJournal) close() error {
+	return j.file.Close()
+}
+
+func loadSwapJournal(path string) ([]swapEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []swapEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 && len(fields) != 6 {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		e := swapEntry{swapped: time.Unix(secs, 0), path: fields[1], oldPath: fields[2]}
+		if len(fields) == 6 {
+			// Journals of older versions do not record the copy.
+			ino, err1 := strconv.ParseUint(fields[3], 10, 64)
+			size, err2 := strconv.ParseInt(fields[4], 10, 64)
+			nsec, err3 := strconv.ParseInt(fields[5], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+			e.ino, e.size, e.mtime = ino, size, time.Unix(0, nsec)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// saveSwapJournal replaces the journal with entries, atomically.
+func saveSwapJournal(path string, entries []swapEntry) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, e := range entries {
+		fmt.Fprintln(w, e.String())
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// cleanupSwapped removes the original inodes of files swapped more than
+// grace ago and drops them from the journal. It returns the number removed.
+func cleanupSwapped(journalPath string, grace time.Duration) (int, error) {
+	entries, err := loadSwapJournal(journalPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var keep []swapEntry
+	for _, e := range entries {
+		if time.Since(e.swapped) < grace {
+			keep = append(keep, e)
+			continue
+		}
+		if err := os.Remove(e.oldPath); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Failed to remove %s: %v\n", displayPath(e.oldPath), displayErr(e.oldPath, err))
+			keep = append(keep, e)
+			continue
+		}
+		removed++
+	}
+	return removed, saveSwapJournal(journalPath, keep)
+}
+
+// rollbackSwapped swaps the original inode of each path back in and removes
+// the migrated copy. A path no longer holding the copy as it was placed,
+// replaced or written to since, is not rolled back: that would throw the
+// writes away. Should it change during the exchange, both files are kept.
+// It returns the number of files rolled back.
+func rollbackSwapped(journalPath string, paths map[string]bool) (int, error) {
+	entries, err := loadSwapJournal(journalPath)
+	if err != nil {
+		return 0, err
+	}
+
+	rolledBack := 0
+	var keep []swapEntry
+	for _, e := range entries {
+		abs, _ := filepath.Abs(e.path)
+		if paths != nil && !paths[abs] {
+			keep = append(keep, e)
+			continue
+		}
+		mdsOps(2)
+		if current, err := os.Lstat(e.path); err != nil || !e.unchanged(current) {
+			fmt.Fprintf(os.Stderr, "Not rolling back %s: it changed since the migration; the original is kept at %s\n", displayPath(e.path), displayPath(e.oldPath))
+			keep = append(keep, e)
+			continue
+		}
+		if err := renameExchange(e.oldPath, e.path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to roll back %s: %v\n", displayPath(e.path), displayErr(e.path, err))
+			keep = append(keep, e)
+			continue
+		}
+		rolledBack++
+		mdsOps(1)
+		if copied, err := os.Lstat(e.oldPath); err != nil || !e.unchanged(copied) {
+			fmt.Fprintf(os.Stderr, "Rolled back %s, which changed meanwhile; its migrated version is kept at %s\n", displayPath(e.path), displayPath(e.oldPath))
+			continue
+		}
+		mdsOps(1)
+		os.Remove(e.oldPath)
+	}
+	return rolledBack, saveSwapJournal(journalPath, keep)
+}
+
+// runSwapCommand implements "migxattrs swap-cleanup" and "migxattrs
+// rollback" for files migrated with --swap.
+func runSwapCommand(name string, args []string) int {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	grace := fs.Duration("grace", 0, "Only remove originals swapped out longer ago than this")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || (name == "swap-cleanup" && fs.NArg() != 1) {
+		if name == "rollback" {
+			fmt.Fprintf(os.Stderr, "Usage: migxattrs rollback CEPH_ROOT_DIR [PATH...]\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: migxattrs swap-cleanup [--grace D] CEPH_ROOT_DIR\n")
+		}
+		return 1
+	}
+	// A migration of the root appends to the journal these rewrite.
+	lock, err := lockRun(fs.Arg(0), shardSpec{}, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locking %s: %v\n", displayPath(fs.Arg(0)), err)
+		return 1
+	}
+	defer lock.release()
+	journalPath := filepath.Join(fs.Arg(0), SWAP_JOURNAL)
+
+	if name == "swap-cleanup" {
+		removed, err := cleanupSwapped(journalPath, *grace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error cleaning up swapped files: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed %d original files\n", removed)
+		return 0
+	}
+
+	var paths map[string]bool
+	if fs.NArg() > 1 {
+		paths = make(map[string]bool)
+		for _, p := range fs.Args()[1:] {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+			paths[abs] = true
+		}
+	}
+	rolledBack, err := rollbackSwapped(journalPath, paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rolling back: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Rolled back %d files\n", rolledBack)
+	return 0
+}
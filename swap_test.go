@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// writeFile creates path with data and returns its FileInfo.
+func writeFile(t *testing.T, path, data string) os.FileInfo {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// checkContent fails the test unless path holds data.
+func checkContent(t *testing.T, path, data string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != data {
+		t.Errorf("%s = %q, %v, want %q", filepath.Base(path), got, err, data)
+	}
+}
+
+// skipWithoutExchange skips tests of RENAME_EXCHANGE where the platform or
+// filesystem lacks it.
+func skipWithoutExchange(t *testing.T, dir string) {
+	t.Helper()
+	a, b := filepath.Join(dir, ".probe-a"), filepath.Join(dir, ".probe-b")
+	writeFile(t, a, "a")
+	writeFile(t, b, "b")
+	defer os.Remove(a)
+	defer os.Remove(b)
+	if err := renameExchange(a, b); err != nil {
+		t.Skipf("no RENAME_EXCHANGE in %s: %v", dir, err)
+	}
+}
+
+func TestPlaceExchange(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+
+	if err := placeFile(tmpPath, path, info, PLACE_EXCHANGE); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, path, "copy")
+	aside := swappedPath(tmpPath, info)
+	checkContent(t, aside, "original")
+	if asideInfo, err := os.Lstat(aside); err != nil || !os.SameFile(asideInfo, info) {
+		t.Errorf("%s is not the original inode: %v", aside, err)
+	}
+	// The temp name is free for the next pass.
+	if _, err := os.Lstat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temp name still taken: %v", err)
+	}
+
+	// Rolling back swaps the original in again.
+	journal := filepath.Join(dir, SWAP_JOURNAL)
+	j, err := openSwapJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.add(path, aside, placed); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	if n, err := rollbackSwapped(journal, nil); err != nil || n != 1 {
+		t.Fatalf("rollbackSwapped = %d, %v, want 1", n, err)
+	}
+	checkContent(t, path, "original")
+	if _, err := os.Lstat(aside); !os.IsNotExist(err) {
+		t.Errorf("migrated copy left at %s: %v", aside, err)
+	}
+}
+
+func TestRollbackKeepsLaterWrites(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+	if err := placeFile(tmpPath, path, info, PLACE_EXCHANGE); err != nil {
+		t.Fatal(err)
+	}
+	placed, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(dir, SWAP_JOURNAL)
+	j, err := openSwapJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.add(path, swappedPath(tmpPath, info), placed); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+
+	// Written to after the migration.
+	if err := os.WriteFile(path, []byte("copy, then edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rollbackSwapped(journal, nil); err != nil || n != 0 {
+		t.Fatalf("rollbackSwapped = %d, %v, want nothing rolled back", n, err)
+	}
+	checkContent(t, path, "copy, then edited")
+	checkContent(t, swappedPath(tmpPath, info), "original")
+	if entries, err := loadSwapJournal(journal); err != nil || len(entries) != 1 {
+		t.Errorf("journal = %v, %v, want the entry kept", entries, err)
+	}
+}
+
+func TestPlaceExchangeMissingPath(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+	os.Remove(path)
+
+	if err := placeFile(tmpPath, path, info, PLACE_EXCHANGE); err == nil {
+		t.Fatal("exchange with a missing path succeeded")
+	}
+	// The caller removes the temp file it still finds under its name.
+	checkContent(t, tmpPath, "copy")
+	if _, err := os.Lstat(swappedPath(tmpPath, info)); !os.IsNotExist(err) {
+		t.Errorf("temp file left under the swapped name: %v", err)
+	}
+}
+
+func TestPlaceNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+
+	if err := placeFile(tmpPath, path, info, PLACE_NOREPLACE); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, path, "copy")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files left next to the placed copy: %v", entries)
+	}
+}
+
+func TestPlaceNoReplaceConflict(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+	// The original is replaced after the copy. It stays around so that its
+	// inode number is not reused for the new file.
+	if err := os.Rename(path, filepath.Join(dir, "file.old")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "rewritten")
+
+	err := placeFile(tmpPath, path, info, PLACE_NOREPLACE)
+	if !errors.Is(err, errPlaceConflict) || errors.Is(err, errPlaceStranded) {
+		t.Fatalf("placeFile = %v, want %v", err, errPlaceConflict)
+	}
+	checkContent(t, path, "rewritten")
+	checkContent(t, tmpPath, "copy")
+}
+
+func TestPlaceNoReplaceRemoved(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	info := writeFile(t, path, "original")
+	writeFile(t, tmpPath, "copy")
+	os.Remove(path)
+
+	if err := placeFile(tmpPath, path, info, PLACE_NOREPLACE); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, path, "copy")
+	if _, err := os.Lstat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+
+	// Without a temp file there is nothing to place.
+	if err := placeFile(tmpPath, path, info, PLACE_NOREPLACE); err == nil {
+		t.Error("placeFile without a temp file succeeded")
+	}
+	checkContent(t, path, "copy")
+}
+
+// TestPlaceNoReplaceNeverMissing checks that readers never find the path
+// gone while copies are placed over it.
+func TestPlaceNoReplaceNeverMissing(t *testing.T) {
+	dir := t.TempDir()
+	skipWithoutExchange(t, dir)
+	path, tmpPath := filepath.Join(dir, "file"), filepath.Join(dir, "file.mig")
+	writeFile(t, path, "original")
+
+	stop := make(chan struct{})
+	var missing atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				missing.Add(1)
+			}
+		}
+	}()
+	for i := range 200 {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, tmpPath, strconv.Itoa(i))
+		if err := placeFile(tmpPath, path, info, PLACE_NOREPLACE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if n := missing.Load(); n > 0 {
+		t.Errorf("path was missing %d times during placement", n)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// runSynthCommand implements "migxattrs synth": it builds a fake tree with a
+// matching scan file for load and correctness testing.
+func runSynthCommand(args []string) int {
+	fs := pflag.NewFlagSet("synth", pflag.ExitOnError)
+	files := fs.Int("files", 1000, "Number of files to create")
+	minSize := fs.String("min-size", "0", "Smallest file size")
+	maxSize := fs.String("max-size", "1M", "Largest file size")
+	sizeDist := fs.String("size-dist", "log", "File size distribution between min and max: uniform or log")
+	depth := fs.Int("depth", 3, "Directory depth")
+	fanout := fs.Int("fanout", 8, "Subdirectories per directory")
+	hardlinkRatio := fs.Float64("hardlink-ratio", 0, "Fraction of entries that are hardlinks to earlier files")
+	sparseRatio := fs.Float64("sparse-ratio", 0, "Fraction of files created sparse (data at both ends, hole in the middle)")
+	dstRatio := fs.Float64("dst-ratio", 0, "Fraction of entries listed in the scan file as already in the destination pool")
+	setLayout := fs.Bool("set-layout", true, "Set the pool layout xattr on each new file (requires CephFS)")
+	emulate := fs.Bool("emulate", false, "Set the layout as "+emulatedKey(XATTR_KEY)+", for rehearsals with \"migxattrs --emulate\" on any filesystem")
+	seed := fs.Uint64("seed", 0, "Random seed (0 = time-based)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: migxattrs synth [flags] ROOT_DIR\n")
+		return 1
+	}
+	if *sizeDist != "uniform" && *sizeDist != "log" {
+		fmt.Fprintf(os.Stderr, "Invalid --size-dist value: %s (want uniform or log)\n", *sizeDist)
+		return 1
+	}
+
+	lo, err := parseSize(*minSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --min-size value: %v\n", err)
+		return 1
+	}
+	hi, err := parseSize(*maxSize)
+	if err != nil || hi < lo {
+		fmt.Fprintf(os.Stderr, "Invalid --max-size value: %s\n", *maxSize)
+		return 1
+	}
+
+	if *emulate {
+		xattrKey = emulatedKey(XATTR_KEY)
+	}
+
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+
+	root := fs.Arg(0)
+	dirs := synthDirs(root, *depth, *fanout)
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", dir, err)
+			return 1
+		}
+	}
+
+	scanFile, err := os.Create(filepath.Join(root, SCAN_FILE))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating scan file: %v\n", err)
+		return 1
+	}
+	defer scanFile.Close()
+	scan := bufio.NewWriter(scanFile)
+
+	fmt.Printf("Generating %d entries in %d directories under %s (seed %d)\n", *files, len(dirs), root, *seed)
+
+	var created []string
+	var totalBytes int64
+	links, sparse, layoutWarned := 0, 0, false
+	startTime := time.Now()
+
+	for i := range *files {
+		dir := dirs[rng.IntN(len(dirs))]
+		path := filepath.Join(dir, fmt.Sprintf("file%07d", i))
+
+		if len(created) > 0 && rng.Float64() < *hardlinkRatio {
+			if err := os.Link(created[rng.IntN(len(created))], path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating hardlink %s: %v\n", path, err)
+				return 1
+			}
+			links++
+		} else {
+			size := synthSize(rng, lo, hi, *sizeDist)
+			isSparse := rng.Float64() < *sparseRatio
+			if err := writeSynthFile(path, size, isSparse, *setLayout, &layoutWarned); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", path, err)
+				return 1
+			}
+			if isSparse {
+				sparse++
+			}
+			created = append(created, path)
+			totalBytes += size
+		}
+
+		pool := SRC_POOL
+		if rng.Float64() < *dstRatio {
+			pool = DST_POOL
+		}
+		rel, _ := filepath.Rel(root, path)
+		fmt.Fprintf(scan, "%s\t%s\n", pool, rel)
+
+		if (i+1)%10000 == 0 {
+			fmt.Printf("Created %d entries...\r", i+1)
+		}
+	}
+
+	if err := scan.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing scan file: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Created %d files (%d sparse), %d hardlinks, %.2f MB logical in %v\n",
+		len(created), sparse, links, mb(totalBytes), time.Since(startTime).Round(time.Millisecond))
+	fmt.Printf("Scan file: %s\n", scanFile.Name())
+	return 0
+}
+
+// synthDirs lists every directory of a tree with the given depth and fanout.
+func synthDirs(root string, depth, fanout int) []string {
+	dirs := []string{root}
+	level := []string{root}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, parent := range level {
+			for f := 0; f < fanout; f++ {
+				next = append(next, filepath.Join(parent, fmt.Sprintf("d%d_%d", d, f)))
+			}
+		}
+		dirs = append(dirs, next...)
+		level = next
+	}
+	return dirs
+}
+
+func synthSize(rng *rand.Rand, lo, hi int64, dist string) int64 {
+	if hi == lo {
+		return lo
+	}
+	if dist == "uniform" {
+		return lo + rng.Int64N(hi-lo+1)
+	}
+	// Log-uniform: as many files between 1K and 10K as between 1M and 10M.
+	lmin, lmax := math.Log(float64(max(lo, 1))), math.Log(float64(hi))
+	return max(lo, int64(math.Exp(lmin+rng.Float64()*(lmax-lmin))))
+}
+
+// writeSynthFile creates a file of the given size. The layout xattr has to be
+// set while the file is still empty. Sparse files get one block of data at
+// each end with a hole in between.
+func writeSynthFile(path string, size int64, sparse, setLayout bool, layoutWarned *bool) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if setLayout {
+		if err := sysFsetxattr(file, xattrKey, []byte(SRC_POOL)); err != nil && !*layoutWarned {
+			fmt.Fprintf(os.Stderr, "Warning: could not set %s (%v); continuing without layouts\n", xattrKey, err)
+			*layoutWarned = true
+		}
+	}
+
+	const block = 64 * 1024
+	buf := make([]byte, block)
+	for i := range buf {
+		buf[i] = byte(i*7 + len(path))
+	}
+
+	if sparse && size > 2*block {
+		if _, err := file.WriteAt(buf, 0); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(buf, size-block); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for written := int64(0); written < size; {
+		n := min(int64(block), size-written)
+		if _, err := file.Write(buf[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
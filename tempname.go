@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_TEMP_NAME = "{dir}/{name}.mig"
+
+// TEMP_MARKER_XATTR holds, on a temp file being written, the inode number of
+// the file it is a copy of. It proves to cleanup that the temp is ours and
+// belongs to the file next to it, and is removed before the rename.
+const TEMP_MARKER_XATTR = "user.migxattrs.temp"
+
+// TEMP_NAME_PRESETS are the named --temp-name schemes. Anything else is used
+// as a template.
+var TEMP_NAME_PRESETS = map[string]string{
+	"visible": DEFAULT_TEMP_NAME,
+	"hidden":  "{dir}/.{name}.mig",
+	"staging": "{dir}/.migxattrs-staging/{name}",
+}
+
+// parseTempName resolves a --temp-name preset or validates a template. A
+// template may use {dir} (directory of the file), {name} (its base name) and
+// {ino} (its inode number); it must place the temp file on the same CephFS so
+// the final rename stays atomic, e.g. "/mnt/cephfs/.staging/{ino}". Every
+// file must get a temp name of its own: an absolute template also needs {ino}
+// or {dir}, since {name} alone gives a/x and b/x the same one.
+func parseTempName(spec string) (string, error) {
+	if preset, ok := TEMP_NAME_PRESETS[spec]; ok {
+		return preset, nil
+	}
+	if !strings.Contains(spec, "{name}") && !strings.Contains(spec, "{ino}") {
+		return "", fmt.Errorf("template %q must contain {name} or {ino}", spec)
+	}
+	if !strings.HasPrefix(spec, "{dir}") && !filepath.IsAbs(spec) {
+		return "", fmt.Errorf("template %q must start with {dir} or be an absolute path", spec)
+	}
+	if filepath.IsAbs(spec) && !strings.Contains(spec, "{ino}") && !strings.Contains(spec, "{dir}") {
+		return "", fmt.Errorf("absolute template %q must contain {ino} or {dir} to give every file its own temp name", spec)
+	}
+	return spec, nil
+}
+
+// tempPath expands template for the file at path.
+func tempPath(template, path string, info os.FileInfo) string {
+	if template == "" {
+		template = DEFAULT_TEMP_NAME
+	}
+	_, ino, _ := fileID(info)
+	r := strings.NewReplacer("{dir}", filepath.Dir(path), "{name}", filepath.Base(path), "{ino}", strconv.FormatUint(ino, 10))
+	return filepath.Clean(r.Replace(template))
+}
+
+// tempMarker is the TEMP_MARKER_XATTR value of a temp file copying the file
+// described by info.
+func tempMarker(info os.FileInfo) []byte {
+	_, ino, _ := fileID(info)
+	return []byte(strconv.FormatUint(ino, 10))
+}
+
+// ownedTemp reports whether tmpPath is a temp file a run created for the
+// file described by info and left behind. A file merely carrying the temp
+// name, or a temp copying another file, is not.
+func ownedTemp(tmpPath string, info os.FileInfo) bool {
+	if _, _, ok := fileID(info); !ok {
+		return false
+	}
+	tmpInfo, err := os.Lstat(tmpPath)
+	if err != nil || !tmpInfo.Mode().IsRegular() || os.SameFile(info, tmpInfo) {
+		return false
+	}
+	value, err := getXattrValue(tmpPath, TEMP_MARKER_XATTR)
+	return err == nil && string(value) == string(tempMarker(info))
+}
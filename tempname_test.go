@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseTempName(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "visible", want: "{dir}/{name}.mig"},
+		{spec: "hidden", want: "{dir}/.{name}.mig"},
+		{spec: "staging", want: "{dir}/.migxattrs-staging/{name}"},
+		{spec: "{dir}/.tmp-{name}", want: "{dir}/.tmp-{name}"},
+		{spec: "{dir}/{ino}.part", want: "{dir}/{ino}.part"},
+		{spec: "/mnt/cephfs/.staging/{ino}", want: "/mnt/cephfs/.staging/{ino}"},
+		{spec: "/mnt/cephfs/.staging/{ino}-{name}", want: "/mnt/cephfs/.staging/{ino}-{name}"},
+		{spec: "/mnt/cephfs/.staging{dir}/{name}", want: "/mnt/cephfs/.staging{dir}/{name}"},
+		// Every a/x and b/x would share one temp file.
+		{spec: "/mnt/cephfs/.staging/{name}", wantErr: true},
+		{spec: "/mnt/cephfs/.staging/{name}.mig", wantErr: true},
+		{spec: "{dir}/fixed.tmp", wantErr: true},
+		{spec: "/mnt/cephfs/.staging/fixed", wantErr: true},
+		{spec: "relative/{name}", wantErr: true},
+		{spec: "{name}.mig", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTempName(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTempName(%q) = %q, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTempName(%q) = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestTempPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "file.dat")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ino, ok := fileID(info)
+	if !ok {
+		t.Skip("no inode numbers on this platform")
+	}
+	inoStr := strconv.FormatUint(ino, 10)
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "", want: path + ".mig"},
+		{template: DEFAULT_TEMP_NAME, want: path + ".mig"},
+		{template: TEMP_NAME_PRESETS["hidden"], want: filepath.Join(dir, "sub", ".file.dat.mig")},
+		{template: TEMP_NAME_PRESETS["staging"], want: filepath.Join(dir, "sub", ".migxattrs-staging", "file.dat")},
+		{template: "/staging/{ino}", want: "/staging/" + inoStr},
+		{template: "/staging{dir}/{name}", want: filepath.Join("/staging", dir, "sub", "file.dat")},
+		{template: "{dir}//./{name}.{ino}", want: filepath.Join(dir, "sub", "file.dat."+inoStr)},
+	}
+	for _, tt := range tests {
+		if got := tempPath(tt.template, path, info); got != tt.want {
+			t.Errorf("tempPath(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+
+	// Files of the same name in different directories never share a temp.
+	other := filepath.Join(dir, "other", "file.dat")
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	otherInfo, err := os.Lstat(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"visible", "hidden", "staging", "/staging/{ino}", "/staging{dir}/{name}"} {
+		template, err := parseTempName(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, b := tempPath(template, path, info), tempPath(template, other, otherInfo); a == b {
+			t.Errorf("template %q gives %s and %s the same temp name %s", spec, path, other, a)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errFileTimeout = withCode(E_TIMEOUT, errors.New("file migration timed out"))
+
+// migrateFileWithTimeout runs migrateFile under a deadline. A syscall stuck on
+// an unresponsive OSD cannot be interrupted, so on timeout the migration
+// goroutine is abandoned: its context is cancelled, which stops the copy at
+// the next read and prevents the final rename, and it removes its temp file
+// when it returns. The retry writes a temp file of its own meanwhile, see
+// attemptTempPath.
+func migrateFileWithTimeout(ctx context.Context, path, tmpPath string, info os.FileInfo, dstPool string, mode placeMode, timeout time.Duration, h hash.Hash) error {
+	return withFileTimeout(ctx, timeout, tmpPath, func(ctx context.Context) error {
+		return migrateFile(ctx, path, tmpPath, info, dstPool, mode, h)
+	})
+}
+
+// abandoned holds, by temp path, the attempts given up on by the timeout
+// that are still running. The temp file is theirs until they return.
+var abandoned sync.Map // string -> chan struct{}
+
+// attemptSeq numbers the temp files of retries.
+var attemptSeq atomic.Uint64
+
+// attemptTempPath returns tmpPath, or a name for this attempt alone while an
+// abandoned attempt may still write, or rename, tmpPath.
+func attemptTempPath(tmpPath string) string {
+	if _, ok := abandoned.Load(tmpPath); !ok {
+		return tmpPath
+	}
+	return fmt.Sprintf("%s.%d", tmpPath, attemptSeq.Add(1))
+}
+
+// withFileTimeout runs fn, which writes tmpPath, under the per-file timeout
+// as described for migrateFileWithTimeout. Cancelling ctx, the context of
+// the run, stops fn the same way. fn must remove tmpPath when it fails, and
+// must not rename it once its context is done.
+func withFileTimeout(ctx context.Context, timeout time.Duration, tmpPath string, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done, finished := make(chan error, 1), make(chan struct{})
+	go func() {
+		done <- fn(ctx)
+		close(finished)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The migration may have finished just as the deadline fired.
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		abandoned.Store(tmpPath, finished)
+		go func() {
+			<-finished
+			abandoned.CompareAndDelete(tmpPath, finished)
+		}()
+		return stoppedErr(ctx)
+	}
+}
+
+// stoppedErr is the error of an attempt stopped by ctx: errFileTimeout when
+// the per-file timeout ran out, or the cause the run was cancelled with.
+func stoppedErr(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return cause
+	}
+	return errFileTimeout
+}
+
+// ctxReader aborts reads once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
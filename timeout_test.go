@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithFileTimeoutFinishes(t *testing.T) {
+	errCopy := errors.New("copy failed")
+	for _, want := range []error{nil, errCopy} {
+		err := withFileTimeout(context.Background(), time.Second, t.TempDir()+"/a.mig", func(ctx context.Context) error {
+			return want
+		})
+		if err != want {
+			t.Errorf("withFileTimeout = %v, want %v", err, want)
+		}
+	}
+
+	// Without a timeout fn runs with a context that never ends.
+	err := withFileTimeout(context.Background(), 0, t.TempDir()+"/b.mig", func(ctx context.Context) error {
+		if ctx.Done() != nil {
+			return errors.New("context can end")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithFileTimeoutAbandons(t *testing.T) {
+	tmpPath := t.TempDir() + "/c.mig"
+	release, returned := make(chan struct{}), make(chan error, 1)
+	start := time.Now()
+	err := withFileTimeout(context.Background(), 20*time.Millisecond, tmpPath, func(ctx context.Context) error {
+		<-release // stuck in a syscall
+		// What migrateFile checks before its rename.
+		returned <- ctx.Err()
+		return ctx.Err()
+	})
+	if !errors.Is(err, errFileTimeout) {
+		t.Fatalf("withFileTimeout = %v, want %v", err, errFileTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timeout took %v", d)
+	}
+
+	// The retries must not share the temp file the abandoned attempt may
+	// still write, nor one another's.
+	retry, retry2 := attemptTempPath(tmpPath), attemptTempPath(tmpPath)
+	if retry == tmpPath || retry2 == tmpPath || retry == retry2 {
+		t.Errorf("retries got %q and %q while %q is in use", retry, retry2, tmpPath)
+	}
+	if !strings.HasPrefix(retry, tmpPath) {
+		t.Errorf("retry temp %q is not next to %q", retry, tmpPath)
+	}
+
+	close(release)
+	if err := <-returned; err == nil {
+		t.Error("the abandoned attempt saw a live context")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for attemptTempPath(tmpPath) != tmpPath {
+		if time.Now().After(deadline) {
+			t.Fatal("temp name still held after the abandoned attempt returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWithFileTimeoutCancelled(t *testing.T) {
+	errStop := errors.New("run stopped")
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		started := make(chan struct{})
+		go func() {
+			<-started
+			cancel(errStop)
+		}()
+		err := withFileTimeout(ctx, timeout, t.TempDir()+"/d.mig", func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return stoppedErr(ctx)
+		})
+		if !errors.Is(err, errStop) {
+			t.Errorf("timeout %v: withFileTimeout = %v, want %v", timeout, err, errStop)
+		}
+	}
+}
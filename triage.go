@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// triageExamples is how many example paths are kept per directory and
+// printed per group.
+const triageExamples = 3
+
+// triageDir counts the failures of one cause in a single directory.
+type triageDir struct {
+	count    int
+	examples []string
+}
+
+// triage groups failures by cause and directory for the --triage-report,
+// keeping counts and a few example paths rather than every failed path.
+type triage struct {
+	causes map[string]map[string]*triageDir // cause -> parent directory -> failures
+	total  map[string]int
+}
+
+func newTriage() *triage {
+	return &triage{causes: make(map[string]map[string]*triageDir), total: make(map[string]int)}
+}
+
+func (t *triage) add(cause, path string) {
+	dirs := t.causes[cause]
+	if dirs == nil {
+		dirs = make(map[string]*triageDir)
+		t.causes[cause] = dirs
+	}
+	dir := filepath.Dir(path)
+	d := dirs[dir]
+	if d == nil {
+		d = &triageDir{}
+		dirs[dir] = d
+	}
+	d.count++
+	if len(d.examples) < triageExamples {
+		d.examples = append(d.examples, path)
+	}
+	t.total[cause]++
+}
+
+// triageGroup is a subtree holding failures of one cause.
+type triageGroup struct {
+	dir      string
+	count    int
+	examples []string
+}
+
+// groups collapses the directories of cause into subtrees: the failures are
+// split by the first path component below their common ancestor, and each
+// part is reported under its own deepest common ancestor. A cause confined to
+// one subtree therefore shows up as a single line naming that subtree.
+func (t *triage) groups(cause string) []triageGroup {
+	dirs := t.causes[cause]
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	slices.Sort(names)
+	root := commonAncestor(names)
+
+	parts := make(map[string][]string)
+	for _, dir := range names {
+		key := dir
+		if rel, err := filepath.Rel(root, dir); err == nil && rel != "." {
+			key = filepath.Join(root, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+		}
+		parts[key] = append(parts[key], dir)
+	}
+
+	groups := make([]triageGroup, 0, len(parts))
+	for _, part := range parts {
+		g := triageGroup{dir: commonAncestor(part)}
+		for _, dir := range part {
+			d := dirs[dir]
+			g.count += d.count
+			for _, ex := range d.examples {
+				if len(g.examples) < triageExamples {
+					g.examples = append(g.examples, ex)
+				}
+			}
+		}
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b triageGroup) int {
+		if a.count != b.count {
+			return b.count - a.count
+		}
+		return strings.Compare(a.dir, b.dir)
+	})
+	return groups
+}
+
+// commonAncestor returns the deepest directory containing every one of dirs.
+func commonAncestor(dirs []string) string {
+	if len(dirs) == 0 {
+		return ""
+	}
+	ancestor := dirs[0]
+	for _, dir := range dirs[1:] {
+		for ancestor != dir && !strings.HasPrefix(dir, ancestor+string(filepath.Separator)) {
+			parent := filepath.Dir(ancestor)
+			if parent == ancestor {
+				break
+			}
+			ancestor = parent
+		}
+	}
+	return ancestor
+}
+
+// write saves the report to path, causes ordered by descending count.
+func (t *triage) write(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+
+	causes := make([]string, 0, len(t.total))
+	for cause := range t.total {
+		causes = append(causes, cause)
+	}
+	slices.SortFunc(causes, func(a, b string) int {
+		if t.total[a] != t.total[b] {
+			return t.total[b] - t.total[a]
+		}
+		return strings.Compare(a, b)
+	})
+
+	if len(causes) == 0 {
+		fmt.Fprintln(w, "No failures.")
+	}
+	for _, cause := range causes {
+		fmt.Fprintf(w, "%s (%d)\n", cause, t.total[cause])
+		for _, g := range t.groups(cause) {
+			fmt.Fprintf(w, "  %7d  under %s\n", g.count, displayPath(g.dir))
+			for _, ex := range g.examples {
+				fmt.Fprintf(w, "           e.g. %s\n", displayPath(ex))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+type verifyJob struct {
+	path string
+	sum  []byte
+}
+
+// verifier re-reads migrated files in its own worker pool so checksum
+// verification does not serialize with copying. The bounded queue lets it
+// lag behind the copy stage without holding an unbounded backlog.
+type verifier struct {
+	jobs    chan verifyJob
+	dstPool string
+	wg      sync.WaitGroup
+	report  func(path string, err error)
+
+	mu        sync.Mutex
+	passed    int
+	failed    int
+	active    int
+	completed atomic.Int64 // verifications finished, for the stall watchdog
+}
+
+// newVerifier starts the worker pool; report is called for every failed
+// verification and must be safe for concurrent use.
+func newVerifier(dstPool string, workers, queue int, report func(path string, err error)) *verifier {
+	v := &verifier{jobs: make(chan verifyJob, queue), dstPool: dstPool, report: report}
+	for range workers {
+		v.wg.Add(1)
+		go v.worker()
+	}
+	return v
+}
+
+// submit queues a migrated file for verification, blocking while the queue
+// is full.
+func (v *verifier) submit(job verifyJob) {
+	v.jobs <- job
+}
+
+// wait closes the queue, waits for outstanding verifications and returns the
+// pass and fail counts.
+func (v *verifier) wait() (int, int) {
+	close(v.jobs)
+	v.wg.Wait()
+	return v.passed, v.failed
+}
+
+// depth returns the number of verifications running and queued.
+func (v *verifier) depth() (active, queued int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.active, len(v.jobs)
+}
+
+func (v *verifier) worker() {
+	defer v.wg.Done()
+	for job := range v.jobs {
+		v.mu.Lock()
+		v.active++
+		v.mu.Unlock()
+		unlock := pathLocks.lock(job.path)
+		err := verifyMigratedFile(job.path, v.dstPool, job.sum)
+		unlock()
+		v.completed.Add(1)
+
+		v.mu.Lock()
+		v.active--
+		if err != nil {
+			v.failed++
+		} else {
+			v.passed++
+		}
+		v.mu.Unlock()
+
+		if err != nil {
+			v.report(job.path, err)
+		} else {
+			logf(LOG_DEBUG, "Verified: %s\n", displayPath(job.path))
+		}
+	}
+}
+
+// verifyMigratedFile confirms that path now reports the destination pool and
+// that its content matches the checksum taken from the source.
+func verifyMigratedFile(path, dstPool string, wantSum []byte) error {
+	mdsOps(2) // getxattr and open
+	newPool, err := getXattr(path)
+	if err != nil {
+		return codeErrorf(E_VERIFY, "failed to read xattr after migration: %w", err)
+	}
+	if string(newPool) != dstPool {
+		return codeErrorf(E_VERIFY, "xattr not updated: expected %s, got %s", dstPool, string(newPool))
+	}
+
+	gotSum, err := fileChecksum(path)
+	if err != nil {
+		return codeErrorf(E_VERIFY, "failed to checksum migrated file: %w", err)
+	}
+	if !bytes.Equal(wantSum, gotSum) {
+		return codeErrorf(E_VERIFY, "checksum mismatch: source %x, migrated %x", wantSum, gotSum)
+	}
+	return nil
+}
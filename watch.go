@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// watchFeedPoll is how often a --watch-feed that is a regular file is
+// checked for lines appended to it.
+const watchFeedPoll = time.Second
+
+type watchConfig struct {
+	interval time.Duration
+	feed     string // file or FIFO of paths, "" to rescan the tree
+}
+
+// runWatch keeps migrating what lands in the source pool after the first
+// pass, for drain windows where applications still create files through
+// directories whose layout names it: every interval it rescans the tree,
+// or with a feed migrates the paths written to it since the last pass. It
+// runs until the run deadline or a SIGINT or SIGTERM, which let the current
+// pass finish; a second one kills the process. It returns the process exit
+// code.
+func runWatch(cephRoot, scanPath, checkpointPath string, opts *options, exclude map[string]bool, cfg watchConfig) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var feed *pathFeed
+	feedScanPath := scanPath + ".watch"
+	if cfg.feed != "" {
+		var err error
+		if feed, err = followPathFeed(cephRoot, cfg.feed); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening watch feed: %v\n", err)
+			return EXIT_FATAL
+		}
+	}
+
+	watchStart := time.Now()
+	exitCode, migrated := EXIT_OK, 0
+	passPath := scanPath
+	pass := 0
+	for {
+		pass++
+		logf(LOG_INFO, "\n=== Watch pass %d (started %s) ===\n", pass, time.Now().Format(time.RFC3339))
+		startTime := time.Now()
+		stats, err := runMigration(context.Background(), cephRoot, passPath, opts, exclude)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening scan file: %v\n", err)
+			exitCode = EXIT_FATAL
+			break
+		}
+		printSummary(stats, opts, time.Since(startTime))
+		cpErr := finishCheckpoint(checkpointPath, passPath, stats, opts)
+		recordRun(cephRoot, passPath, opts, stats, startTime, runOutcome(stats, opts))
+		opts.resume = nil
+		if cpErr != nil {
+			fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", cpErr)
+			exitCode = EXIT_FATAL
+			break
+		}
+		migrated += stats.migrated
+		exitCode = max(exitCode, exitStatus(stats))
+
+		if stats.deadlineHit {
+			exitCode = EXIT_INCOMPLETE
+			break
+		}
+		if opts.dryRun {
+			logf(LOG_INFO, "\nDry run: stopping after a single pass.\n")
+			break
+		}
+		if !opts.deadline.IsZero() && time.Now().Add(cfg.interval).After(opts.deadline) {
+			logf(LOG_INFO, "\nNext watch pass would start after the run deadline.\n")
+			break
+		}
+
+		// Wait for the next pass, or for one with something to do when
+		// nothing new turns up.
+		logf(LOG_INFO, "\nWatching %s for files in %s; next pass in %v\n", displayPath(cephRoot), opts.srcPool, cfg.interval)
+		stopped := false
+		for next := 0; next == 0 && !stopped; {
+			select {
+			case sig := <-stop:
+				logf(LOG_INFO, "\nReceived %v, stopping the watch\n", sig)
+				stopped = true
+				continue
+			case <-time.After(cfg.interval):
+			}
+			if feed == nil {
+				if _, err := buildScanFile(cephRoot, scanPath); err != nil {
+					fmt.Fprintf(os.Stderr, "Error scanning %s: %v\n", displayPath(cephRoot), err)
+					return EXIT_FATAL
+				}
+			} else {
+				passPath = feedScanPath
+				if n, err := feed.writeScanFile(passPath); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", passPath, err)
+					return EXIT_FATAL
+				} else if n == 0 {
+					continue
+				}
+			}
+			poolStats, err := analyzePoolScan(passPath, opts.shard)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error analyzing scan file: %v\n", err)
+				return EXIT_FATAL
+			}
+			next = poolStats[opts.srcPool]
+			if opts.redrain {
+				next = 0
+				for _, count := range poolStats {
+					next += count
+				}
+			}
+			if next == 0 && feed == nil {
+				logf(LOG_INFO, "No new files in %s; next pass in %v\n", opts.srcPool, cfg.interval)
+			}
+			opts.expectedFiles, opts.expectedBytes = next, 0
+		}
+		if stopped {
+			// A second signal ends the process the default way.
+			signal.Stop(stop)
+			break
+		}
+	}
+
+	logf(LOG_INFO, "Watch finished after %d passes in %v (%d files migrated)\n", pass, time.Since(watchStart).Round(time.Second), migrated)
+	return exitCode
+}
+
+// pathFeed collects the paths written to a --watch-feed, relative to the
+// root, until the next pass takes them.
+type pathFeed struct {
+	cephRoot string
+	mu       sync.Mutex
+	paths    map[string]bool
+}
+
+// followPathFeed reads the paths written to path from now on. A FIFO is
+// reopened whenever its writer goes away; a regular file is followed like
+// tail -f from its current end.
+func followPathFeed(cephRoot, path string) (*pathFeed, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &pathFeed{cephRoot: cephRoot, paths: make(map[string]bool)}
+	fifo := info.Mode()&os.ModeNamedPipe != 0
+	var file *os.File
+	if !fifo {
+		// Opening a FIFO blocks until it has a writer, so only regular
+		// files are opened up front.
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	go f.follow(path, file, fifo)
+	return f, nil
+}
+
+func (f *pathFeed) follow(path string, file *os.File, fifo bool) {
+	for {
+		if file == nil {
+			var err error
+			if file, err = os.Open(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening watch feed: %v\n", err)
+				time.Sleep(watchFeedPoll)
+				continue
+			}
+		}
+		r := bufio.NewReader(file)
+		partial := ""
+		for {
+			chunk, err := r.ReadString('\n')
+			partial += chunk
+			if err == nil {
+				f.add(partial)
+				partial = ""
+				continue
+			}
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error reading watch feed: %v\n", err)
+				break
+			}
+			if fifo {
+				f.add(partial)
+				break
+			}
+			time.Sleep(watchFeedPoll)
+		}
+		file.Close()
+		file = nil
+	}
+}
+
+// add records a line of the feed, a path absolute or relative to the root.
+func (f *pathFeed) add(line string) {
+	path := strings.TrimSpace(line)
+	if path == "" {
+		return
+	}
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(f.cephRoot, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+		path = rel
+	}
+	f.mu.Lock()
+	f.paths[filepath.Clean(path)] = true
+	f.mu.Unlock()
+}
+
+// writeScanFile writes the paths collected since the last call as a scan
+// file, with the pool each is in now, and returns how many it took. Paths
+// that are gone by then or are not regular files are dropped.
+func (f *pathFeed) writeScanFile(scanPath string) (int, error) {
+	f.mu.Lock()
+	paths := make([]string, 0, len(f.paths))
+	for path := range f.paths {
+		paths = append(paths, path)
+	}
+	f.paths = make(map[string]bool)
+	f.mu.Unlock()
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	sort.Strings(paths)
+
+	out, err := os.Create(scanPath)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(out)
+	for _, rel := range paths {
+		path := filepath.Join(f.cephRoot, rel)
+		if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		pool, err := getXattr(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", pool, rel)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	logf(LOG_INFO, "Read %d paths from the watch feed\n", len(paths))
+	return len(paths), out.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "sync"
+
+// workerPool runs up to limit jobs at a time, each in its own goroutine. The
+// limit can be changed while jobs are running; it takes effect as running
+// jobs finish.
+type workerPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	active  int
+	waiting int // submit calls blocked on a free worker
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(limit int) *workerPool {
+	p := &workerPool{limit: max(1, limit)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// submit starts fn once a worker is free, blocking until then.
+func (p *workerPool) submit(fn func()) {
+	p.mu.Lock()
+	p.waiting++
+	for p.active >= p.limit {
+		p.cond.Wait()
+	}
+	p.waiting--
+	p.active++
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+		p.mu.Lock()
+		p.active--
+		p.cond.Signal()
+		p.mu.Unlock()
+	}()
+}
+
+// wait blocks until every submitted job has finished.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// depth returns the number of running jobs and of submit calls waiting for
+// a worker.
+func (p *workerPool) depth() (active, waiting int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active, p.waiting
+}
+
+func (p *workerPool) resize(limit int) {
+	p.mu.Lock()
+	p.limit = max(1, limit)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
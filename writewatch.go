@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// watchSources aborts the copy of a file that is written to before it is
+// renamed into place (--watch-writes).
+var watchSources bool
+
+// errSourceModified fails a migration whose source was written to during
+// its copy. Like a timeout, it is requeued once.
+var errSourceModified = withCode(E_MODIFIED, errors.New("source was written to during the copy"))
+
+// watchedCopy runs fn, which copies path into tmpPath, while watching path
+// for writes. The first write cancels the context of fn; a write seen at
+// any point before fn returns removes tmpPath and fails with
+// errSourceModified, which a stat taken before and after the copy could miss.
+func watchedCopy(ctx context.Context, path, tmpPath string, fn func(ctx context.Context) error) error {
+	if !watchSources {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop, err := watchWrites(path, cancel)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return withCode(E_VANISHED, err)
+		}
+		return codeErrorf(E_OPEN, "failed to watch source file: %w", err)
+	}
+	err = fn(ctx)
+	if stop() {
+		os.Remove(tmpPath)
+		return errSourceModified
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The xattr calls of Linux and macOS only differ in the errno reported for a
+// missing attribute, see errnoNoXattr.
+
+func sysGetxattr(path, name string, buf []byte) (int, error) {
+	return unix.Getxattr(path, name, buf)
+}
+
+func sysSetxattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
+
+func sysFsetxattr(f *os.File, name string, value []byte) error {
+	return unix.Fsetxattr(int(f.Fd()), name, value, 0)
+}
+
+func sysRemovexattr(path, name string) error {
+	return unix.Removexattr(path, name)
+}
+
+// xattrTooSmall reports whether a read failed because buf was too small.
+func xattrTooSmall(err error) bool {
+	return errors.Is(err, unix.ERANGE)
+}
+
+// xattrMissing reports whether the file does not carry the attribute or the
+// filesystem has no xattrs at all.
+func xattrMissing(err error) bool {
+	return errors.Is(err, errnoNoXattr) || errors.Is(err, unix.ENOTSUP)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows has no POSIX xattrs. NTFS extended attributes (what SMB exposes as
+// EAs) are only reachable through NtQueryEaFile/NtSetEaFile, which this
+// backend does not implement yet, so every call reports errXattrUnsupported.
+var errXattrUnsupported = errors.New("extended attributes are not supported on Windows")
+
+func sysGetxattr(path, name string, buf []byte) (int, error) {
+	return 0, errXattrUnsupported
+}
+
+func sysSetxattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func sysFsetxattr(f *os.File, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func sysRemovexattr(path, name string) error {
+	return errXattrUnsupported
+}
+
+func xattrTooSmall(err error) bool {
+	return false
+}
+
+func xattrMissing(err error) bool {
+	return errors.Is(err, errXattrUnsupported)
+}